@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"strings"
+	"time"
+)
+
+// aboutSection is the "About this book" page -about adds after the cover:
+// how long the book is, how long it takes to read, and where and when its
+// chapters were published.
+func aboutSection(book ScrapedBook) string {
+	words, missing := 0, 0
+	var first, last time.Time
+	for _, entry := range book.toc {
+		if chapter, ok := book.chapters.get(entry.URL); ok {
+			words += countWords(chapter.Content)
+		} else {
+			missing++
+		}
+		if entry.Date.IsZero() {
+			continue
+		}
+		if first.IsZero() || entry.Date.Before(first) {
+			first = entry.Date
+		}
+		if entry.Date.After(last) {
+			last = entry.Date
+		}
+	}
+	minutes := (words + readingSpeed - 1) / readingSpeed
+
+	var b strings.Builder
+	b.WriteString("<h2>About this book</h2>\n<dl class=\"about\">\n")
+	item := func(term, definition string) {
+		fmt.Fprintf(&b, "<dt>%s</dt>\n<dd>%s</dd>\n", term, definition)
+	}
+	item("Title", html.EscapeString(book.meta.Title))
+	if book.meta.Author != "" {
+		item("Author", html.EscapeString(book.meta.Author))
+	}
+	chapters := fmt.Sprint(len(book.toc))
+	if missing > 0 {
+		chapters += fmt.Sprintf(", %d of them missing", missing)
+	}
+	item("Chapters", chapters)
+	item("Words", formatCount(words))
+	item("Reading time", fmt.Sprintf("About %s, at %d words a minute", spellMinutes(minutes), readingSpeed))
+	if !first.IsZero() {
+		item("Published", fmt.Sprintf("%s to %s", first.Format("January 2, 2006"), last.Format("January 2, 2006")))
+	}
+	source := html.EscapeString(book.meta.SourceURL)
+	item("Source", fmt.Sprintf(`<a href="%s">%s</a>`, source, source))
+	b.WriteString("</dl>")
+	return b.String()
+}
+
+// spellMinutes writes a reading time for readers, as 5 hours 20 minutes.
+func spellMinutes(minutes int) string {
+	plural := func(n int, unit string) string {
+		if n == 1 {
+			return "1 " + unit
+		}
+		return fmt.Sprintf("%d %ss", n, unit)
+	}
+	hours, minutes := minutes/60, minutes%60
+	switch {
+	case hours == 0:
+		return plural(minutes, "minute")
+	case minutes == 0:
+		return plural(hours, "hour")
+	}
+	return plural(hours, "hour") + " " + plural(minutes, "minute")
+}
+
+// formatCount writes n with its thousands separated by commas.
+func formatCount(n int) string {
+	digits := fmt.Sprint(n)
+	var b strings.Builder
+	for i, digit := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(digit)
+	}
+	return b.String()
+}
+
+// chapterSection is the name of the section of the chapter at index in the
+// table of contents, as go-epub would name it, given here so that other
+// sections can link to chapters.
+func chapterSection(index int) string {
+	return fmt.Sprintf("section%04d.xhtml", index+1)
+}
+
+// whatsNewSection is the "What's new" page -whats-new adds to an updated
+// epub, linking the chapters added and those replaced by a newer version.
+func whatsNewSection(book ScrapedBook, added []string, changed []string) string {
+	index := make(map[string]int)
+	for i, entry := range book.toc {
+		index[chapterKey(entry.URL)] = i
+	}
+	var b strings.Builder
+	b.WriteString("<h2>What's new</h2>\n")
+	list := func(heading string, urls []string) {
+		if len(urls) == 0 {
+			return
+		}
+		fmt.Fprintf(&b, "<h3>%s</h3>\n<ul class=\"whats-new\">\n", heading)
+		for _, url := range urls {
+			i, ok := index[chapterKey(url)]
+			if !ok {
+				continue
+			}
+			entry := book.toc[i]
+			fmt.Fprintf(&b, `<li><a href="%s">%s</a>`, chapterSection(i), html.EscapeString(entry.Title))
+			if !entry.Date.IsZero() {
+				fmt.Fprintf(&b, ", %s", entry.Date.Format("January 2, 2006"))
+			}
+			b.WriteString("</li>\n")
+		}
+		b.WriteString("</ul>\n")
+	}
+	heading := func(n int, kind string) string {
+		if n == 1 {
+			return "1 " + kind + " chapter"
+		}
+		return fmt.Sprintf("%d %s chapters", n, kind)
+	}
+	list(heading(len(added), "new"), added)
+	list(heading(len(changed), "revised"), changed)
+	return strings.TrimSuffix(b.String(), "\n")
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// archiver submits chapter URLs to the Wayback Machine's Save Page Now, so
+// that a story survives its author or site deleting it. Submissions are
+// queued and sent one at a time in the background, slowly enough for the
+// service's rate limits, which are far lower for anonymous use than with
+// the keys of an archive.org account in $WAYBACK_ACCESS_KEY and
+// $WAYBACK_SECRET_KEY.
+type archiver struct {
+	client         *http.Client
+	access, secret string
+	interval       time.Duration
+	queue          chan string
+	wg             sync.WaitGroup
+	mu             sync.Mutex
+	seen           map[string]bool
+	saved, failed  int
+}
+
+// archiveRecent is how recent a capture must be for a page not to be saved
+// again.
+const archiveRecent = 30 * 24 * time.Hour
+
+func newArchiver() *archiver {
+	a := &archiver{
+		client:   &http.Client{Timeout: 2 * time.Minute},
+		access:   os.Getenv("WAYBACK_ACCESS_KEY"),
+		secret:   os.Getenv("WAYBACK_SECRET_KEY"),
+		interval: 10 * time.Second,
+		queue:    make(chan string, 100000),
+		seen:     make(map[string]bool),
+	}
+	if a.access != "" && a.secret != "" {
+		a.interval = 3 * time.Second
+	}
+	a.wg.Add(1)
+	go a.run()
+	return a
+}
+
+// add queues pageURL to be saved, unless it already has been this run.
+func (a *archiver) add(pageURL string) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.seen[chapterKey(pageURL)] {
+		return
+	}
+	a.seen[chapterKey(pageURL)] = true
+	a.queue <- pageURL
+}
+
+// wait saves whatever is still queued, and stops the archiver.
+func (a *archiver) wait() {
+	if a == nil {
+		return
+	}
+	close(a.queue)
+	if n := len(a.queue); n > 0 {
+		logger.Infow("Wait for pages to be archived", "pending", n, "eta", time.Duration(n)*a.interval)
+	}
+	a.wg.Wait()
+	logger.Infow("Archived pages to the Wayback Machine", "saved", a.saved, "failed", a.failed)
+}
+
+func (a *archiver) run() {
+	defer a.wg.Done()
+	var last time.Time
+	for pageURL := range a.queue {
+		time.Sleep(a.interval - time.Since(last))
+		last = time.Now()
+		if err := a.save(pageURL); err != nil {
+			logger.Warnw("Failed to archive page", "url", pageURL, "error", err)
+			a.failed++
+		} else {
+			a.saved++
+		}
+	}
+}
+
+func (a *archiver) save(pageURL string) error {
+	if a.access != "" && a.secret != "" {
+		return a.saveWithKeys(pageURL)
+	}
+	// Anonymous saves are scarce, so pages captured lately are left be.
+	if recent, err := a.recentlyArchived(pageURL); err == nil && recent {
+		logger.Debugw("Page is already archived", "url", pageURL)
+		return nil
+	}
+	request, err := http.NewRequest(http.MethodGet, "https://web.archive.org/save/"+pageURL, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("User-Agent", versionUserAgent())
+	return checkArchiveResponse(a.client.Do(request))
+}
+
+// saveWithKeys uses the authenticated Save Page Now API, which skips pages
+// captured recently by itself.
+func (a *archiver) saveWithKeys(pageURL string) error {
+	form := url.Values{
+		"url":                    {pageURL},
+		"if_not_archived_within": {fmt.Sprintf("%ds", int(archiveRecent.Seconds()))},
+		"skip_first_archive":     {"1"},
+		"delay_wb_availability":  {"1"},
+	}
+	request, err := http.NewRequest(http.MethodPost, "https://web.archive.org/save", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	request.Header.Set("Authorization", "LOW "+a.access+":"+a.secret)
+	request.Header.Set("User-Agent", versionUserAgent())
+	return checkArchiveResponse(a.client.Do(request))
+}
+
+func (a *archiver) recentlyArchived(pageURL string) (bool, error) {
+	request, err := http.NewRequest(http.MethodGet, "https://archive.org/wayback/available?url="+url.QueryEscape(pageURL), nil)
+	if err != nil {
+		return false, err
+	}
+	request.Header.Set("User-Agent", versionUserAgent())
+	response, err := a.client.Do(request)
+	if err != nil {
+		return false, err
+	}
+	defer response.Body.Close()
+	var result struct {
+		ArchivedSnapshots struct {
+			Closest struct {
+				Available bool   `json:"available"`
+				Timestamp string `json:"timestamp"`
+			} `json:"closest"`
+		} `json:"archived_snapshots"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return false, err
+	}
+	closest := result.ArchivedSnapshots.Closest
+	if !closest.Available {
+		return false, nil
+	}
+	captured, err := time.Parse("20060102150405", closest.Timestamp)
+	if err != nil {
+		return false, err
+	}
+	return time.Since(captured) < archiveRecent, nil
+}
+
+func checkArchiveResponse(response *http.Response, err error) error {
+	if err == nil && response.StatusCode == http.StatusTooManyRequests {
+		response.Body.Close()
+		return errors.New("rate limited by the Wayback Machine")
+	}
+	return checkUploadResponse(response, err)
+}
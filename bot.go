@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// In bot mode users send story URLs to a Telegram or Discord bot and get the
+// epub back. Telegram is polled for messages with $TELEGRAM_BOT_TOKEN;
+// Discord posts the interactions of a /scrape command with a url option to
+// an endpoint served on -discord-addr, checked against $DISCORD_PUBLIC_KEY.
+// The command itself is registered with Discord beforehand, outside of this
+// program. Books are written as for any other run, so a story asked for
+// again is only written anew with -force or -unique.
+
+// botRequest is a story a bot user asked for, along with how to get the
+// result back to them.
+type botRequest struct {
+	URL   string
+	reply func(filename string, err error)
+}
+
+// botQueue scrapes the stories asked for one at a time, so that any number
+// of users share the same limits on the sites.
+type botQueue chan botRequest
+
+// add queues a story, or returns why it can't be scraped at all.
+func (q botQueue) add(rawURL string, reply func(filename string, err error)) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("%q is not a story URL", rawURL)
+	}
+	if _, ok := handlers[u.Host]; !ok {
+		return fmt.Errorf("%s is not a supported site", u.Host)
+	}
+	select {
+	case q <- botRequest{URL: rawURL, reply: reply}:
+		return nil
+	default:
+		return errors.New("too many stories are queued already, try again later")
+	}
+}
+
+// botMaxUpload is the largest epub sent as a file; bigger ones are linked
+// to with -download-url, or refused.
+var botMaxUpload int64 = 50 << 20
+
+// runBotCommand implements `bot [-discord-addr ADDR] [-download-url PREFIX]`,
+// answering until the program is stopped.
+func (s *session) runBotCommand(defaults bookJob, args []string) error {
+	flags := flag.NewFlagSet("bot", flag.ContinueOnError)
+	discordAddr := flags.String("discord-addr", ":8081", "serve Discord interactions on `address`")
+	downloadURL := flags.String("download-url", "", "reply with a link to the epub under `prefix`, where the output directory is served, instead of the file")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	telegramToken := os.Getenv("TELEGRAM_BOT_TOKEN")
+	discordKey := os.Getenv("DISCORD_PUBLIC_KEY")
+	if telegramToken == "" && discordKey == "" {
+		return errors.New("bot needs $TELEGRAM_BOT_TOKEN, $DISCORD_PUBLIC_KEY or both")
+	}
+
+	queue := make(botQueue, 32)
+	go func() {
+		for request := range queue {
+			job := defaults
+			job.URL = request.URL
+			var written string
+			job.OnWritten = func(filename string) { written = filename }
+			err := s.scrapeBook(job)
+			if err == nil && written == "" {
+				err = errors.New("no epub was written")
+			}
+			request.reply(written, err)
+		}
+	}()
+	link := func(filename string) string {
+		return strings.TrimSuffix(*downloadURL, "/") + "/" + url.PathEscape(filepath.Base(filename))
+	}
+
+	errs := make(chan error, 2)
+	client := &http.Client{Timeout: 2 * time.Minute}
+	if telegramToken != "" {
+		bot := &telegramBot{Token: telegramToken, Client: client, Queue: queue}
+		if *downloadURL != "" {
+			bot.Link = link
+		}
+		go func() { errs <- bot.run() }()
+	}
+	if discordKey != "" {
+		key, err := hex.DecodeString(discordKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return errors.New("$DISCORD_PUBLIC_KEY is not a hex encoded ed25519 public key")
+		}
+		bot := &discordBot{PublicKey: key, Client: client, Queue: queue}
+		if *downloadURL != "" {
+			bot.Link = link
+		}
+		server := &http.Server{Addr: *discordAddr, Handler: bot, ReadHeaderTimeout: 10 * time.Second}
+		logger.Infow("Serve Discord interactions", "addr", *discordAddr)
+		go func() { errs <- server.ListenAndServe() }()
+	}
+	return <-errs
+}
+
+// storyURLs picks the URLs out of a message.
+func storyURLs(text string) []string {
+	var urls []string
+	for _, field := range strings.Fields(text) {
+		if strings.HasPrefix(field, "http://") || strings.HasPrefix(field, "https://") {
+			urls = append(urls, field)
+		}
+	}
+	return urls
+}
+
+// telegramBot answers messages sent to a Telegram bot, which it long polls
+// for with getUpdates.
+type telegramBot struct {
+	Token  string
+	Client *http.Client
+	Queue  botQueue
+	// Link, if set, returns where a written epub can be downloaded.
+	Link func(filename string) string
+}
+
+func (b *telegramBot) api(method string) string {
+	return "https://api.telegram.org/bot" + b.Token + "/" + method
+}
+
+func (b *telegramBot) run() error {
+	logger.Infow("Poll Telegram for messages")
+	offset := 0
+	for {
+		var updates []struct {
+			UpdateID int `json:"update_id"`
+			Message  *struct {
+				Chat struct {
+					ID int64 `json:"id"`
+				} `json:"chat"`
+				Text string `json:"text"`
+			} `json:"message"`
+		}
+		query := url.Values{"timeout": {"50"}, "offset": {strconv.Itoa(offset)}, "allowed_updates": {`["message"]`}}
+		if err := b.call("getUpdates", query, &updates); err != nil {
+			logger.Warnw("Failed to poll Telegram", "error", err)
+			time.Sleep(10 * time.Second)
+			continue
+		}
+		for _, update := range updates {
+			offset = update.UpdateID + 1
+			if update.Message == nil {
+				continue
+			}
+			chat := update.Message.Chat.ID
+			urls := storyURLs(update.Message.Text)
+			if len(urls) == 0 {
+				b.send(chat, "Send me the URL of a story and I'll send you back its epub.")
+				continue
+			}
+			for _, storyURL := range urls {
+				storyURL := storyURL
+				err := b.Queue.add(storyURL, func(filename string, err error) {
+					b.reply(chat, storyURL, filename, err)
+				})
+				if err != nil {
+					b.send(chat, err.Error())
+				} else {
+					b.send(chat, "Queued "+storyURL)
+				}
+			}
+		}
+	}
+}
+
+// call makes a Bot API request, decoding its result into result.
+func (b *telegramBot) call(method string, query url.Values, result any) error {
+	response, err := b.Client.PostForm(b.api(method), query)
+	if err != nil {
+		// The token is part of the URL, which the error quotes.
+		return errors.New(strings.ReplaceAll(err.Error(), b.Token, "<token>"))
+	}
+	return decodeTelegramResponse(response, result)
+}
+
+func decodeTelegramResponse(response *http.Response, result any) error {
+	defer response.Body.Close()
+	var envelope struct {
+		OK          bool            `json:"ok"`
+		Description string          `json:"description"`
+		Result      json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&envelope); err != nil {
+		return fmt.Errorf("telegram returned %s: %w", response.Status, err)
+	}
+	if !envelope.OK {
+		return fmt.Errorf("telegram: %s", envelope.Description)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(envelope.Result, result)
+}
+
+func (b *telegramBot) send(chat int64, text string) {
+	query := url.Values{"chat_id": {strconv.FormatInt(chat, 10)}, "text": {text}}
+	if err := b.call("sendMessage", query, nil); err != nil {
+		logger.Warnw("Failed to send Telegram message", "chat", chat, "error", err)
+	}
+}
+
+func (b *telegramBot) reply(chat int64, storyURL string, filename string, err error) {
+	if err != nil {
+		b.send(chat, fmt.Sprintf("Failed to scrape %s: %v", storyURL, err))
+		return
+	}
+	if b.Link != nil {
+		b.send(chat, b.Link(filename))
+		return
+	}
+	if err := b.sendDocument(chat, filename); err != nil {
+		logger.Warnw("Failed to send epub to Telegram", "chat", chat, "filename", filename, "error", err)
+		b.send(chat, fmt.Sprintf("Failed to send %s: %v", filepath.Base(filename), err))
+	}
+}
+
+func (b *telegramBot) sendDocument(chat int64, filename string) error {
+	body, contentType, err := multipartFile(map[string]string{"chat_id": strconv.FormatInt(chat, 10)}, "document", filename)
+	if err != nil {
+		return err
+	}
+	response, err := b.Client.Post(b.api("sendDocument"), contentType, body)
+	if err != nil {
+		return errors.New(strings.ReplaceAll(err.Error(), b.Token, "<token>"))
+	}
+	return decodeTelegramResponse(response, nil)
+}
+
+// multipartFile builds a form of fields and the file at filename, for the
+// bot APIs that take uploads that way.
+func multipartFile(fields map[string]string, fileField string, filename string) (io.Reader, string, error) {
+	stat, err := os.Stat(filename)
+	if err != nil {
+		return nil, "", err
+	}
+	if stat.Size() > botMaxUpload {
+		return nil, "", fmt.Errorf("the epub is %s, too large to send", formatBytes(stat.Size()))
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, "", err
+	}
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for name, value := range fields {
+		if err := writer.WriteField(name, value); err != nil {
+			return nil, "", err
+		}
+	}
+	part, err := writer.CreateFormFile(fileField, filepath.Base(filename))
+	if err != nil {
+		return nil, "", err
+	}
+	part.Write(data)
+	if err := writer.Close(); err != nil {
+		return nil, "", err
+	}
+	return body, writer.FormDataContentType(), nil
+}
+
+// discordBot answers the interactions Discord posts for the /scrape command.
+// Scraping takes longer than Discord waits for an answer, so the answer is
+// deferred and the epub sent later as a follow-up message.
+type discordBot struct {
+	PublicKey ed25519.PublicKey
+	Client    *http.Client
+	Queue     botQueue
+	Link      func(filename string) string
+}
+
+type discordInteraction struct {
+	Type          int    `json:"type"`
+	Token         string `json:"token"`
+	ApplicationID string `json:"application_id"`
+	Data          struct {
+		Name    string `json:"name"`
+		Options []struct {
+			Name  string `json:"name"`
+			Value any    `json:"value"`
+		} `json:"options"`
+	} `json:"data"`
+}
+
+const (
+	discordPing                  = 1
+	discordApplicationCommand    = 2
+	discordPong                  = 1
+	discordMessage               = 4
+	discordDeferredMessage       = 5
+	discordFollowUpURLFormat     = "https://discord.com/api/v10/webhooks/%s/%s"
+	discordMaxInteractionRequest = 1 << 20
+)
+
+func (b *discordBot) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, discordMaxInteractionRequest))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Discord checks that requests it didn't sign are refused.
+	signature, err := hex.DecodeString(r.Header.Get("X-Signature-Ed25519"))
+	timestamp := r.Header.Get("X-Signature-Timestamp")
+	if err != nil || !ed25519.Verify(b.PublicKey, append([]byte(timestamp), body...), signature) {
+		http.Error(w, "invalid request signature", http.StatusUnauthorized)
+		return
+	}
+	var interaction discordInteraction
+	if err := json.Unmarshal(body, &interaction); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	switch interaction.Type {
+	case discordPing:
+		json.NewEncoder(w).Encode(map[string]int{"type": discordPong})
+		return
+	case discordApplicationCommand:
+	default:
+		http.Error(w, "unsupported interaction", http.StatusBadRequest)
+		return
+	}
+	var storyURL string
+	for _, option := range interaction.Data.Options {
+		if value, ok := option.Value.(string); ok && option.Name == "url" {
+			storyURL = strings.TrimSpace(value)
+		}
+	}
+	err = b.Queue.add(storyURL, func(filename string, err error) {
+		b.followUp(interaction, storyURL, filename, err)
+	})
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]any{"type": discordMessage, "data": map[string]string{"content": err.Error()}})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]int{"type": discordDeferredMessage})
+}
+
+func (b *discordBot) followUp(interaction discordInteraction, storyURL string, filename string, err error) {
+	followUpURL := fmt.Sprintf(discordFollowUpURLFormat, interaction.ApplicationID, interaction.Token)
+	var body io.Reader
+	var contentType, content string
+	switch {
+	case err != nil:
+		content = fmt.Sprintf("Failed to scrape %s: %v", storyURL, err)
+	case b.Link != nil:
+		content = b.Link(filename)
+	default:
+		body, contentType, err = multipartFile(map[string]string{"payload_json": `{"content":""}`}, "files[0]", filename)
+		if err != nil {
+			content = fmt.Sprintf("Failed to send %s: %v", filepath.Base(filename), err)
+		}
+	}
+	if content != "" {
+		data, _ := json.Marshal(map[string]string{"content": content})
+		body, contentType = bytes.NewReader(data), "application/json"
+	}
+	response, err := b.Client.Post(followUpURL, contentType, body)
+	if err == nil {
+		err = checkUploadResponse(response, nil)
+	}
+	if err != nil {
+		logger.Warnw("Failed to answer Discord interaction", "url", storyURL, "error", err)
+	}
+}
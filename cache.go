@@ -0,0 +1,571 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gocolly/colly"
+	"github.com/klauspost/compress/zstd"
+)
+
+// defaultCacheDir is $XDG_CACHE_HOME/ebook-scraper or the platform's
+// equivalent, so that runs from any working directory share one cache.
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ".cache"
+	}
+	return filepath.Join(dir, "ebook-scraper")
+}
+
+// CachingTransport stores successful GET responses on disk along with their
+// validators (ETag and Last-Modified). Cached responses that carry validators
+// are revalidated with a conditional request, so a re-run costs one 304 per
+// page but still picks up chapters that were edited since the last scrape.
+// Responses without validators can't be revalidated, so they are fetched
+// again. POST requests marked as listing pages, such as Scribblehub's for its
+// chapter list, are cached too, by their body as well as their URL; other
+// requests pass straight through.
+//
+// TTL, when non-zero, is a freshness window: entries younger than it are
+// served without contacting the site, validators or not. Refresh bypasses
+// cached entries entirely, while RefreshTOC revalidates only requests marked
+// as listing pages (see markTOCRequest) and serves everything else from the
+// cache.
+//
+// In Offline mode the wrapped transport is never used; requests that are not
+// in the cache fail with errNotCached and are remembered so the caller can
+// report them once the scrape is over.
+//
+// Entries are stored zstd-compressed. When MaxSize is non-zero and the
+// cache grows past it, the least recently used entries are evicted; every
+// load touches an entry's modification time to keep track of use.
+type CachingTransport struct {
+	Transport  http.RoundTripper
+	Dir        string
+	TTL        time.Duration
+	Refresh    bool
+	RefreshTOC bool
+	Offline    bool
+	MaxSize    int64
+
+	mu sync.Mutex
+	// misses and tocPages are kept by book, as named by cacheBookHeader.
+	misses   map[string][]string
+	tocPages map[string][]string
+	// size is the total size of the cache entries, or 0 until it has been
+	// measured.
+	size int64
+}
+
+var errNotCached = errors.New("response not in cache")
+
+// isStateDir reports whether a directory in the cache holds state kept next
+// to the responses, such as -resume records or -translate translations,
+// rather than responses.
+func isStateDir(name string) bool {
+	return name == "resume" || name == "toc" || name == "stories" || name == "translations" || name == "search"
+}
+
+// cacheRoleHeader marks requests for listing pages. It is consumed by
+// CachingTransport and never sent to the site.
+const cacheRoleHeader = "X-Ebook-Scraper-Cache-Role"
+
+// markTOCRequest marks r as a request for a listing page, in its headers for
+// the cache and in its context for the scraper, where the headers may have
+// been replaced by those of the request that went out.
+func markTOCRequest(r *colly.Request) {
+	r.Headers.Set(cacheRoleHeader, "toc")
+	r.Ctx.Put("toc", "true")
+}
+
+// cacheBookHeader names the book a request is made for, so that books scraped
+// at the same time can each be told about their own misses and listing
+// pages. Like cacheRoleHeader it is never sent to the site.
+const cacheBookHeader = "X-Ebook-Scraper-Book"
+
+// BookTransport tags every request passing through it as made for Book.
+type BookTransport struct {
+	Transport http.RoundTripper
+	Book      string
+}
+
+func (t BookTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	request = request.Clone(request.Context())
+	request.Header.Set(cacheBookHeader, t.Book)
+	return t.Transport.RoundTrip(request)
+}
+
+type cacheEntry struct {
+	URL        string
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	StoredAt   time.Time
+	// Method, ContentType and RequestBody are those of the request, for
+	// requests other than GET, to be told apart and revalidated by.
+	Method      string
+	ContentType string
+	RequestBody []byte
+}
+
+// requestKey is what a response is cached and recorded by: its URL, and for
+// a request with a body, its method and the hash of its body too.
+func requestKey(method string, url string, body []byte) string {
+	if method == "" || method == http.MethodGet || method == http.MethodHead {
+		return url
+	}
+	sum := sha1.Sum(body)
+	return method + " " + url + " " + hex.EncodeToString(sum[:])
+}
+
+// requestBody reads the body of request, leaving it to be read again.
+func requestBody(request *http.Request) ([]byte, error) {
+	if request.Body == nil || request.Body == http.NoBody {
+		return nil, nil
+	}
+	if request.GetBody != nil {
+		body, err := request.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		defer body.Close()
+		return io.ReadAll(body)
+	}
+	data, err := io.ReadAll(request.Body)
+	request.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	request.Body = io.NopCloser(bytes.NewReader(data))
+	request.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(data)), nil }
+	return data, nil
+}
+
+func (e *cacheEntry) key() string {
+	return requestKey(e.Method, e.URL, e.RequestBody)
+}
+
+// request is a new request like the one entry is the response to.
+func (e *cacheEntry) request() (*http.Request, error) {
+	method := e.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	request, err := http.NewRequest(method, e.URL, bytes.NewReader(e.RequestBody))
+	if err != nil {
+		return nil, err
+	}
+	if e.ContentType != "" {
+		request.Header.Set("Content-Type", e.ContentType)
+	}
+	return request, nil
+}
+
+func (e *cacheEntry) hasValidators() bool {
+	return e.Header.Get("ETag") != "" || e.Header.Get("Last-Modified") != ""
+}
+
+// validator is what identifies this version of the response to the site.
+func (e *cacheEntry) validator() string {
+	if etag := e.Header.Get("ETag"); etag != "" {
+		return etag
+	}
+	return e.Header.Get("Last-Modified")
+}
+
+// conditional returns request made conditional on the site still having
+// this version of the response.
+func (e *cacheEntry) conditional(request *http.Request) *http.Request {
+	conditional := request.Clone(request.Context())
+	if etag := e.Header.Get("ETag"); etag != "" {
+		conditional.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := e.Header.Get("Last-Modified"); lastModified != "" {
+		conditional.Header.Set("If-Modified-Since", lastModified)
+	}
+	return conditional
+}
+
+func (e *cacheEntry) response(request *http.Request) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.StatusCode, http.StatusText(e.StatusCode)),
+		StatusCode:    e.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        e.Header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(e.Body)),
+		ContentLength: int64(len(e.Body)),
+		Request:       request,
+	}
+}
+
+func (t *CachingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	isTOC := request.Header.Get(cacheRoleHeader) == "toc"
+	book := request.Header.Get(cacheBookHeader)
+	if request.Header.Get(cacheRoleHeader) != "" || book != "" {
+		request = request.Clone(request.Context())
+		request.Header.Del(cacheRoleHeader)
+		request.Header.Del(cacheBookHeader)
+	}
+	var body []byte
+	cachedPost := request.Method == http.MethodPost && isTOC
+	if cachedPost {
+		var err error
+		if body, err = requestBody(request); err != nil {
+			return nil, err
+		}
+	}
+	url := requestKey(request.Method, request.URL.String(), body)
+	if isTOC {
+		t.mu.Lock()
+		if t.tocPages == nil {
+			t.tocPages = make(map[string][]string)
+		}
+		t.tocPages[book] = append(t.tocPages[book], url)
+		t.mu.Unlock()
+	}
+	if t.Offline {
+		return t.offlineRoundTrip(request, url, book)
+	}
+	if request.Method != http.MethodGet && !cachedPost {
+		return t.Transport.RoundTrip(request)
+	}
+	// The cached copy of a page fetched again with the alternate transport
+	// is what was wrong with it.
+	if t.Refresh || request.Header.Get(alternateTransportHeader) != "" {
+		logger.Debugw("Cache bypassed", "url", url)
+		return t.fetch(request, body)
+	}
+	entry, ok := t.load(url)
+	if !ok {
+		logger.Debugw("Cache miss", "url", url)
+		return t.fetch(request, body)
+	}
+	if t.fresh(entry, isTOC) {
+		logger.Debugw("Cache hit", "url", url)
+		return entry.response(request), nil
+	}
+	if !entry.hasValidators() {
+		logger.Debugw("Cache entry expired", "url", url)
+		return t.fetch(request, body)
+	}
+
+	response, err := t.Transport.RoundTrip(entry.conditional(request))
+	if err != nil {
+		logger.Warnw("Revalidation failed, serving stale response", "url", url, "error", err)
+		return entry.response(request), nil
+	}
+	if response.StatusCode != http.StatusNotModified {
+		logger.Debugw("Cache entry replaced", "url", url, "status", response.StatusCode)
+		return t.store(response, body)
+	}
+	t.revalidated(entry, response)
+	return entry.response(request), nil
+}
+
+// revalidated refreshes entry after the site answered a conditional request
+// for it with notModified.
+func (t *CachingTransport) revalidated(entry *cacheEntry, notModified *http.Response) {
+	notModified.Body.Close()
+	logger.Debugw("Cache entry revalidated", "url", entry.key())
+	for key, values := range notModified.Header {
+		if key == "Etag" || key == "Last-Modified" || key == "Cache-Control" || key == "Expires" {
+			entry.Header[key] = values
+		}
+	}
+	entry.StoredAt = time.Now()
+	if err := t.save(entry); err != nil {
+		logger.Warnw("Failed to update cache entry", "url", entry.key(), "error", err)
+	}
+}
+
+// Unchanged reports whether the site confirms, with a conditional request,
+// that the page at url, a requestKey, is still the version cached with
+// validator. A page that has changed is cached anew.
+func (t *CachingTransport) Unchanged(url string, validator string) bool {
+	if t.Offline || t.Refresh || t.RefreshTOC {
+		return false
+	}
+	entry, ok := t.load(url)
+	if !ok || validator == "" || entry.validator() != validator {
+		return false
+	}
+	request, err := entry.request()
+	if err != nil {
+		return false
+	}
+	request.Header.Set("User-Agent", versionUserAgent())
+	if userAgent != "" {
+		request.Header.Set("User-Agent", userAgent)
+	}
+	response, err := t.Transport.RoundTrip(entry.conditional(request))
+	if err != nil {
+		logger.Warnw("Revalidation failed", "url", url, "error", err)
+		return false
+	}
+	if response.StatusCode != http.StatusNotModified {
+		logger.Debugw("Cache entry replaced", "url", url, "status", response.StatusCode)
+		if response, err := t.store(response, entry.RequestBody); err == nil {
+			response.Body.Close()
+		}
+		return false
+	}
+	t.revalidated(entry, response)
+	return true
+}
+
+// Validator returns the validator of the cached response for url, a
+// requestKey, or "" if there is none.
+func (t *CachingTransport) Validator(url string) string {
+	entry, ok := t.load(url)
+	if !ok {
+		return ""
+	}
+	return entry.validator()
+}
+
+// offlineRoundTrip answers requests from the cache alone, by url, their
+// requestKey. Only GET, HEAD and cached POST requests can be answered.
+func (t *CachingTransport) offlineRoundTrip(request *http.Request, url string, book string) (*http.Response, error) {
+	var entry *cacheEntry
+	ok := false
+	if request.Method == http.MethodGet || request.Method == http.MethodHead || request.Method == http.MethodPost {
+		entry, ok = t.load(url)
+	}
+	if !ok {
+		t.mu.Lock()
+		if t.misses == nil {
+			t.misses = make(map[string][]string)
+		}
+		t.misses[book] = append(t.misses[book], url)
+		t.mu.Unlock()
+		return nil, fmt.Errorf("offline: %s %s: %w", request.Method, request.URL, errNotCached)
+	}
+	logger.Debugw("Cache hit", "url", url)
+	response := entry.response(request)
+	if request.Method == http.MethodHead {
+		response.Body = http.NoBody
+	}
+	return response, nil
+}
+
+// Misses returns the URLs requested for book that could not be served in
+// offline mode.
+func (t *CachingTransport) Misses(book string) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]string(nil), t.misses[book]...)
+}
+
+// TOCPages returns the URLs of the listing pages requested so far for book.
+func (t *CachingTransport) TOCPages(book string) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]string(nil), t.tocPages[book]...)
+}
+
+// fresh reports whether entry can be served without contacting the site.
+func (t *CachingTransport) fresh(entry *cacheEntry, isTOC bool) bool {
+	if t.RefreshTOC {
+		return !isTOC
+	}
+	return t.TTL > 0 && time.Since(entry.StoredAt) < t.TTL
+}
+
+// fetch makes request, whose body is body, and caches its response.
+func (t *CachingTransport) fetch(request *http.Request, body []byte) (*http.Response, error) {
+	response, err := t.Transport.RoundTrip(request)
+	if err != nil {
+		return nil, err
+	}
+	return t.store(response, body)
+}
+
+// store saves a successful response to the cache, along with the body of its
+// request, and returns an equivalent response whose body can still be read by
+// the caller.
+func (t *CachingTransport) store(response *http.Response, requestBody []byte) (*http.Response, error) {
+	if response.StatusCode != http.StatusOK {
+		return response, nil
+	}
+	body, err := io.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	response.Body = io.NopCloser(bytes.NewReader(body))
+	entry := &cacheEntry{
+		URL:        response.Request.URL.String(),
+		StatusCode: response.StatusCode,
+		Header:     response.Header,
+		Body:       body,
+		StoredAt:   time.Now(),
+	}
+	if method := response.Request.Method; method != "" && method != http.MethodGet {
+		entry.Method = method
+		entry.ContentType = response.Request.Header.Get("Content-Type")
+		entry.RequestBody = requestBody
+	}
+	if err := t.save(entry); err != nil {
+		logger.Warnw("Failed to write cache entry", "url", entry.key(), "error", err)
+	}
+	return response, nil
+}
+
+func (t *CachingTransport) path(url string) string {
+	sum := sha1.Sum([]byte(url))
+	key := hex.EncodeToString(sum[:])
+	return filepath.Join(t.Dir, key[:2], key)
+}
+
+func (t *CachingTransport) load(url string) (*cacheEntry, bool) {
+	filename := t.path(url)
+	entry, err := readCacheEntry(filename)
+	// Entries written by colly's own cache fail to decode and are treated
+	// as misses, to be overwritten by the next fetch.
+	if err != nil || entry.key() != url {
+		return nil, false
+	}
+	now := time.Now()
+	os.Chtimes(filename, now, now)
+	return entry, true
+}
+
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// readCacheEntry decodes a cache file, which older versions wrote without
+// compression.
+func readCacheEntry(filename string) (*cacheEntry, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(data, zstdMagic) {
+		decoder, err := zstd.NewReader(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer decoder.Close()
+		data, err = decoder.DecodeAll(data, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var entry cacheEntry
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+func (t *CachingTransport) save(entry *cacheEntry) error {
+	filename := t.path(entry.key())
+	if err := os.MkdirAll(filepath.Dir(filename), 0750); err != nil {
+		return err
+	}
+	var encoded bytes.Buffer
+	if err := gob.NewEncoder(&encoded).Encode(entry); err != nil {
+		return err
+	}
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		return err
+	}
+	compressed := encoder.EncodeAll(encoded.Bytes(), nil)
+	encoder.Close()
+	if err := os.WriteFile(filename+"~", compressed, 0640); err != nil {
+		return err
+	}
+	var previousSize int64
+	if info, err := os.Stat(filename); err == nil {
+		previousSize = info.Size()
+	}
+	if err := os.Rename(filename+"~", filename); err != nil {
+		return err
+	}
+	t.grew(int64(len(compressed)) - previousSize)
+	return nil
+}
+
+// grew accounts for the cache having grown by delta bytes, evicting the
+// least recently used entries once it is over MaxSize.
+func (t *CachingTransport) grew(delta int64) {
+	if t.MaxSize == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.size <= 0 {
+		t.size = 0
+		filepath.WalkDir(t.Dir, func(_ string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if d.IsDir() && isStateDir(d.Name()) {
+				return filepath.SkipDir
+			}
+			if info, err := d.Info(); err == nil && !d.IsDir() {
+				t.size += info.Size()
+			}
+			return nil
+		})
+	} else {
+		t.size += delta
+	}
+	if t.size > t.MaxSize {
+		t.evict()
+	}
+}
+
+// evict removes the least recently used entries until the cache is back
+// under 90% of MaxSize, so that it isn't evicting again with every save.
+func (t *CachingTransport) evict() {
+	type file struct {
+		name    string
+		size    int64
+		modTime time.Time
+	}
+	var files []file
+	filepath.WalkDir(t.Dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if isStateDir(d.Name()) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			files = append(files, file{name, info.Size(), info.ModTime()})
+		}
+		return nil
+	})
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	target := t.MaxSize / 10 * 9
+	evicted := 0
+	for _, f := range files {
+		if t.size <= target {
+			break
+		}
+		if os.Remove(f.name) == nil {
+			t.size -= f.size
+			evicted++
+		}
+	}
+	logger.Debugw("Evict cache entries", "evicted", evicted, "size", t.size)
+}
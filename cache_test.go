@@ -0,0 +1,43 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Pages a site gives no validators for can't be revalidated, so with no TTL
+// they are fetched again rather than served from the cache forever.
+func TestCacheRefetchesPagesWithoutValidators(t *testing.T) {
+	hits := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		io.WriteString(w, "chapter")
+	}))
+	defer server.Close()
+
+	for _, test := range []struct {
+		ttl      time.Duration
+		wantHits int
+	}{
+		{0, 2},
+		{time.Hour, 1},
+	} {
+		hits = 0
+		client := &http.Client{Transport: &CachingTransport{Transport: http.DefaultTransport, Dir: filepath.Join(t.TempDir(), "cache"), TTL: test.ttl}}
+		for i := 0; i < 2; i++ {
+			response, err := client.Get(server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.Copy(io.Discard, response.Body)
+			response.Body.Close()
+		}
+		if hits != test.wantHits {
+			t.Errorf("with TTL %v the site was asked %d times, want %d", test.ttl, hits, test.wantHits)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// runCacheCommand implements `cache stats`, `cache clear [host]` and
+// `cache prune -older-than AGE` over the cache in dir.
+func runCacheCommand(dir string, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: cache stats | cache clear [host] | cache prune -older-than AGE")
+	}
+	switch args[0] {
+	case "stats":
+		return cacheStats(dir)
+	case "clear":
+		if len(args) > 2 {
+			return errors.New("usage: cache clear [host]")
+		}
+		host := ""
+		if len(args) == 2 {
+			host = args[1]
+		}
+		return cacheClear(dir, host)
+	case "prune":
+		flags := flag.NewFlagSet("cache prune", flag.ContinueOnError)
+		olderThan := flags.String("older-than", "", "remove entries stored more than `age` ago, such as 12h or 30d")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		if *olderThan == "" || flags.NArg() > 0 {
+			return errors.New("usage: cache prune -older-than AGE")
+		}
+		age, err := parseAge(*olderThan)
+		if err != nil {
+			return err
+		}
+		return cachePrune(dir, age)
+	}
+	return fmt.Errorf("unknown cache command %q", args[0])
+}
+
+// parseAge is time.ParseDuration with an added "d" unit for days.
+func parseAge(value string) (time.Duration, error) {
+	if days, found := strings.CutSuffix(value, "d"); found {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid age %q", value)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// walkCache calls fn for every response stored in dir. Files that don't
+// decode as cache entries are passed with a nil entry.
+func walkCache(dir string, fn func(filename string, entry *cacheEntry, size int64) error) error {
+	return filepath.WalkDir(dir, func(filename string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) && filename == dir {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			if isStateDir(d.Name()) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		entry, err := readCacheEntry(filename)
+		if err != nil {
+			return fn(filename, nil, info.Size())
+		}
+		return fn(filename, entry, info.Size())
+	})
+}
+
+func entryHost(entry *cacheEntry) string {
+	parsed, err := url.Parse(entry.URL)
+	if err != nil {
+		return ""
+	}
+	return parsed.Host
+}
+
+func cacheStats(dir string) error {
+	type hostStats struct {
+		entries int
+		bytes   int64
+		oldest  time.Time
+		newest  time.Time
+	}
+	hosts := make(map[string]*hostStats)
+	var total hostStats
+	unreadable := 0
+	err := walkCache(dir, func(filename string, entry *cacheEntry, size int64) error {
+		if entry == nil {
+			unreadable++
+			return nil
+		}
+		host := hosts[entryHost(entry)]
+		if host == nil {
+			host = &hostStats{}
+			hosts[entryHost(entry)] = host
+		}
+		for _, stats := range []*hostStats{&total, host} {
+			stats.entries++
+			stats.bytes += size
+			if stats.oldest.IsZero() || entry.StoredAt.Before(stats.oldest) {
+				stats.oldest = entry.StoredAt
+			}
+			if entry.StoredAt.After(stats.newest) {
+				stats.newest = entry.StoredAt
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for host := range hosts {
+		names = append(names, host)
+	}
+	sort.Strings(names)
+	fmt.Printf("Cache directory: %s\n", dir)
+	if unreadable > 0 {
+		fmt.Printf("Unreadable files: %d\n", unreadable)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tENTRIES\tSIZE\tOLDEST\tNEWEST")
+	const dateFormat = "2006-01-02 15:04"
+	for _, host := range append(names, "") {
+		stats, label := hosts[host], host
+		if host == "" {
+			stats, label = &total, "total"
+		}
+		if stats.entries == 0 {
+			fmt.Fprintf(w, "%s\t0\t-\t-\t-\n", label)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n", label, stats.entries, formatBytes(stats.bytes),
+			stats.oldest.Local().Format(dateFormat), stats.newest.Local().Format(dateFormat))
+	}
+	return w.Flush()
+}
+
+// cacheClear removes every entry for host, or the whole cache if host is
+// empty.
+func cacheClear(dir string, host string) error {
+	if host == "" {
+		logger.Infow("Clear cache", "dir", dir)
+		return os.RemoveAll(dir)
+	}
+	removed := 0
+	err := walkCache(dir, func(filename string, entry *cacheEntry, size int64) error {
+		if entry == nil || entryHost(entry) != host {
+			return nil
+		}
+		removed++
+		return os.Remove(filename)
+	})
+	logger.Infow("Clear cache", "dir", dir, "host", host, "removed", removed)
+	return err
+}
+
+// cachePrune removes entries stored more than age ago, along with files that
+// aren't readable cache entries at all.
+func cachePrune(dir string, age time.Duration) error {
+	cutoff := time.Now().Add(-age)
+	removed := 0
+	var freed int64
+	err := walkCache(dir, func(filename string, entry *cacheEntry, size int64) error {
+		if entry != nil && entry.StoredAt.After(cutoff) {
+			return nil
+		}
+		removed++
+		freed += size
+		return os.Remove(filename)
+	})
+	logger.Infow("Prune cache", "dir", dir, "removed", removed, "freed", formatBytes(freed))
+	return err
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// calibreOPF is the metadata.opf Calibre keeps next to each book in its
+// library, and reads back when a book is added along with one.
+type calibreOPF struct {
+	XMLName          xml.Name `xml:"http://www.idpf.org/2007/opf package"`
+	Version          string   `xml:"version,attr"`
+	UniqueIdentifier string   `xml:"unique-identifier,attr"`
+	Metadata         struct {
+		DC          string              `xml:"xmlns:dc,attr"`
+		OPF         string              `xml:"xmlns:opf,attr"`
+		Identifiers []calibreIdentifier `xml:"dc:identifier"`
+		Title       string              `xml:"dc:title"`
+		Creator     *calibreCreator     `xml:"dc:creator,omitempty"`
+		Date        string              `xml:"dc:date"`
+		Description string              `xml:"dc:description,omitempty"`
+		Publisher   string              `xml:"dc:publisher,omitempty"`
+		Language    string              `xml:"dc:language"`
+		Source      string              `xml:"dc:source"`
+		Meta        []calibreMeta       `xml:"meta"`
+	} `xml:"metadata"`
+}
+
+type calibreIdentifier struct {
+	ID     string `xml:"id,attr,omitempty"`
+	Scheme string `xml:"opf:scheme,attr"`
+	Value  string `xml:",chardata"`
+}
+
+type calibreCreator struct {
+	Role  string `xml:"opf:role,attr"`
+	Value string `xml:",chardata"`
+}
+
+type calibreMeta struct {
+	Name    string `xml:"name,attr"`
+	Content string `xml:"content,attr"`
+}
+
+// calibreOPFFilename is where the metadata of the epub at filename goes:
+// metadata.opf, as Calibre names it, when the book has a directory to itself
+// in a library, and otherwise the epub's name with an .opf extension, so
+// that books written to the same directory don't overwrite each other's.
+func calibreOPFFilename(filename string, library bool) string {
+	if library {
+		return filepath.Join(filepath.Dir(filename), "metadata.opf")
+	}
+	return strings.TrimSuffix(filename, filepath.Ext(filename)) + ".opf"
+}
+
+// writeCalibreOPF writes the metadata of book, written at timestamp, to
+// filename in the form of Calibre's metadata.opf. The identifiers are the
+// ones the epub itself carries, so Calibre matches the two up.
+func writeCalibreOPF(filename string, book ScrapedBook, timestamp time.Time) error {
+	opf := calibreOPF{Version: "2.0", UniqueIdentifier: "uuid_id"}
+	opf.Metadata.DC = "http://purl.org/dc/elements/1.1/"
+	opf.Metadata.OPF = "http://www.idpf.org/2007/opf"
+	meta := book.meta
+	opf.Metadata.Identifiers = []calibreIdentifier{
+		{ID: "uuid_id", Scheme: "uuid", Value: strings.TrimPrefix(bookIdentifier(meta.SourceURL), "urn:uuid:")},
+		{Scheme: "url", Value: meta.SourceURL},
+	}
+	if meta.ISBN != "" {
+		opf.Metadata.Identifiers = append(opf.Metadata.Identifiers, calibreIdentifier{Scheme: "isbn", Value: meta.ISBN})
+	}
+	if meta.OpenLibrary != "" {
+		opf.Metadata.Identifiers = append(opf.Metadata.Identifiers, calibreIdentifier{Scheme: "openlibrary", Value: meta.OpenLibrary})
+	}
+	opf.Metadata.Title = meta.Title
+	if meta.Author != "" {
+		opf.Metadata.Creator = &calibreCreator{Role: "aut", Value: meta.Author}
+	}
+	// Calibre takes dc:date for the date the book was published.
+	written := timestamp.UTC().Format(time.RFC3339)
+	opf.Metadata.Date = written
+	if meta.Published != "" {
+		opf.Metadata.Date = meta.Published
+	}
+	opf.Metadata.Description = meta.Description
+	if u, err := url.Parse(meta.SourceURL); err == nil {
+		opf.Metadata.Publisher = u.Host
+	}
+	opf.Metadata.Language = "en"
+	opf.Metadata.Source = meta.SourceURL
+	opf.Metadata.Meta = []calibreMeta{
+		{Name: "calibre:timestamp", Content: written},
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	encoder := xml.NewEncoder(&buf)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(opf); err != nil {
+		return err
+	}
+	buf.WriteByte('\n')
+	return os.WriteFile(filename, buf.Bytes(), 0644)
+}
+
+// calibreAdd adds the epub at filename to a Calibre library with calibredb,
+// merging it into the library's copy of the book if it has one. library is
+// either the library's directory or the URL of a Calibre content server,
+// which may carry the user name and password to log in with.
+func calibreAdd(library string, filename string, book ScrapedBook) error {
+	args := []string{"add", "--automerge", "overwrite", "--identifier", "url:" + book.meta.SourceURL}
+	if u, err := url.Parse(library); err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.User != nil {
+		args = append(args, "--username", u.User.Username())
+		if password, ok := u.User.Password(); ok {
+			args = append(args, "--password", password)
+		}
+		u.User = nil
+		library = u.String()
+	}
+	args = append(args, "--with-library", library, filename)
+	output, err := exec.Command("calibredb", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("calibredb: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+	logger.Debugw("Added book to Calibre", "library", library, "output", strings.TrimSpace(string(output)))
+	return nil
+}
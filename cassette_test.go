@@ -0,0 +1,203 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	mapset "github.com/deckarep/golang-set/v2"
+	"github.com/gocolly/colly"
+)
+
+// Cassettes are scrapes recorded with `-record FILE -sanitize` and replayed
+// here end to end, from the first request to the written epub, without the
+// network. To add one, record a scrape of a short story into
+// testdata/cassettes and list it below.
+var cassettes = []struct {
+	filename string
+	url      string
+	title    string
+	chapters int
+}{
+	{"scribblehub.har", "https://www.scribblehub.com/series/123456/another-example/", "Another Example", 3},
+}
+
+// cassetteSession is a session whose every request is answered from the
+// cassette at filename, writing books under dir.
+func cassetteSession(t *testing.T, filename string, dir string) *session {
+	t.Helper()
+	replayer, err := LoadHARReplayer(filepath.Join("testdata", "cassettes", filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	collector := colly.NewCollector(colly.UserAgent("ebook-scraper-test"))
+	collector.WithTransport(replayer)
+	return &session{
+		client:       replayer,
+		cache:        &CachingTransport{Transport: replayer, Dir: filepath.Join(dir, "cache")},
+		collector:    collector,
+		limitedHosts: mapset.NewSet[string](),
+		force:        true,
+		concurrency:  2,
+		imageWorkers: 2,
+		timestamp:    time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+}
+
+// TestCassettes scrapes each cassette into an epub twice, checking the book
+// and that both epubs are the same to the byte.
+func TestCassettes(t *testing.T) {
+	for _, cassette := range cassettes {
+		cassette := cassette
+		t.Run(cassette.filename, func(t *testing.T) {
+			var epubs [][]byte
+			for i := 0; i < 2; i++ {
+				dir := t.TempDir()
+				output := filepath.Join(dir, "book.epub")
+				s := cassetteSession(t, cassette.filename, dir)
+				if err := s.scrapeBook(bookJob{URL: cassette.url, Output: output}); err != nil {
+					t.Fatal(err)
+				}
+				manifest, err := readManifest(output)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if manifest.Source != cassette.url {
+					t.Errorf("manifest source is %s, want %s", manifest.Source, cassette.url)
+				}
+				if len(manifest.Chapters) != cassette.chapters {
+					t.Errorf("epub has %d chapters, want %d", len(manifest.Chapters), cassette.chapters)
+				}
+				for _, chapter := range manifest.Chapters {
+					if chapter.Missing {
+						t.Errorf("chapter %s is missing", chapter.URL)
+					}
+				}
+				data, err := os.ReadFile(output)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if title := epubTitle(t, data); title != cassette.title {
+					t.Errorf("epub title is %q, want %q", title, cassette.title)
+				}
+				epubs = append(epubs, data)
+			}
+			if !bytes.Equal(epubs[0], epubs[1]) {
+				t.Error("scraping the same cassette twice wrote different epubs")
+			}
+		})
+	}
+}
+
+func epubTitle(t *testing.T, data []byte) string {
+	t.Helper()
+	reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range reader.File {
+		if f.Name != epubPackageFile {
+			continue
+		}
+		opf, err := readZipFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := bytes.Index(opf, []byte("<dc:title>"))
+		end := bytes.Index(opf, []byte("</dc:title>"))
+		if start < 0 || end < start {
+			t.Fatal("package document has no title")
+		}
+		return string(opf[start+len("<dc:title>") : end])
+	}
+	t.Fatal("epub has no package document")
+	return ""
+}
+
+// h2Site answers every request over what it claims is HTTP/2.
+type h2Site struct{}
+
+func (h2Site) RoundTrip(request *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/2.0",
+		ProtoMajor: 2,
+		Header:     http.Header{"Content-Type": {"text/html"}},
+		Body:       io.NopCloser(strings.NewReader("<p>chapter</p>")),
+		Request:    request,
+	}, nil
+}
+
+// Recordings hold requests as they went on the wire.
+func TestHARRecorderRecordsWireRequests(t *testing.T) {
+	recorder := &HARRecorder{Transport: h2Site{}}
+	request, _ := http.NewRequest(http.MethodGet, "https://example.com/chapter", nil)
+	request.Header.Set("User-Agent", "test")
+	request.Header.Set(cacheRoleHeader, "toc")
+	request.Header.Set(cacheBookHeader, "book")
+	request.Header.Set(alternateTransportHeader, "1")
+	response, err := recorder.RoundTrip(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	recorded := recorder.entries[0].Request
+	if recorded.HTTPVersion != "HTTP/2.0" {
+		t.Errorf("recorded the request as %s, want HTTP/2.0", recorded.HTTPVersion)
+	}
+	for _, header := range recorded.Headers {
+		if strings.HasPrefix(header.Name, "X-Ebook-Scraper-") {
+			t.Errorf("recorded the internal header %s", header.Name)
+		}
+	}
+	if len(recorded.Headers) != 1 {
+		t.Errorf("recorded headers %v, want only the User-Agent", recorded.Headers)
+	}
+}
+
+// POSTs to the same URL are recorded with their bodies and replayed by them,
+// as Scribblehub's pages of its chapter list are.
+func TestHARReplaysPostsByBody(t *testing.T) {
+	post := func(transport http.RoundTripper, page string) string {
+		t.Helper()
+		form := url.Values{"action": {"wi_getreleases_pagination"}, "pagenum": {page}, "mypostid": {"1"}}
+		request, _ := http.NewRequest(http.MethodPost, scribblehubTOCURL, strings.NewReader(form.Encode()))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		response, err := transport.RoundTrip(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		body, err := io.ReadAll(response.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(body)
+	}
+	recorder := &HARRecorder{Transport: mockTransport{}, Sanitize: true}
+	pages := []string{post(recorder, "1"), post(recorder, "2")}
+	if pages[0] == pages[1] {
+		t.Fatal("the mock site answered both pages the same")
+	}
+	filename := filepath.Join(t.TempDir(), "scribblehub.har")
+	if err := recorder.Save(filename); err != nil {
+		t.Fatal(err)
+	}
+	replayer, err := LoadHARReplayer(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := post(replayer, "2"); got != pages[1] {
+		t.Errorf("replayed page 2 as %q, want %q", got, pages[1])
+	}
+	if got := post(replayer, "1"); got != pages[0] {
+		t.Errorf("replayed page 1 as %q, want %q", got, pages[0])
+	}
+}
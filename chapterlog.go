@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// chapterLog is an append-only file of chapter records, each compressed as a
+// zstd frame of its own. The frames together read as one zstd stream of JSON
+// records, so the whole log is read back in a single pass, and a record cut
+// short by an interruption only loses itself.
+type chapterLog struct {
+	mu      sync.Mutex
+	file    *os.File
+	encoder *zstd.Encoder
+}
+
+type chapterRecord struct {
+	URL     string `json:"url,omitempty"`
+	Hash    string `json:"hash,omitempty"`
+	Title   string `json:"title,omitempty"`
+	Content string `json:"content"`
+}
+
+// createChapterLog starts an empty log at filename, replacing any there.
+func createChapterLog(filename string) (*chapterLog, error) {
+	return openChapterLog(filename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY)
+}
+
+// appendChapterLog opens the log at filename to add records after those in
+// it, creating it if needed.
+func appendChapterLog(filename string) (*chapterLog, error) {
+	return openChapterLog(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY)
+}
+
+func openChapterLog(filename string, flag int) (*chapterLog, error) {
+	file, err := os.OpenFile(filename, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &chapterLog{file: file, encoder: encoder}, nil
+}
+
+// add appends a record to the log. It is safe for concurrent use.
+func (l *chapterLog) add(record chapterRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.file.Write(l.encoder.EncodeAll(append(data, '\n'), nil))
+	return err
+}
+
+func (l *chapterLog) Close() error {
+	l.encoder.Close()
+	return l.file.Close()
+}
+
+// readChapterLog calls fn with every record in the log at filename, in the
+// order they were added. A damaged record ends the log: the records before it
+// are still read and errDamagedLog is returned.
+func readChapterLog(filename string, fn func(chapterRecord) error) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	decoder, err := zstd.NewReader(bufio.NewReader(file))
+	if err != nil {
+		return err
+	}
+	defer decoder.Close()
+	lines := bufio.NewReader(decoder)
+	for {
+		line, err := lines.ReadBytes('\n')
+		if errors.Is(err, io.EOF) && len(line) == 0 {
+			return nil
+		}
+		if err != nil {
+			return errDamagedLog
+		}
+		var record chapterRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return errDamagedLog
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+}
+
+var errDamagedLog = errors.New("log ends with a damaged record")
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gocolly/colly"
+	"golang.org/x/net/html/charset"
+)
+
+// decodeBody transcodes the body of an html page that doesn't name its
+// charset in its Content-Type to UTF-8. colly already converts pages that do,
+// but parses the rest as UTF-8 whatever their <meta> says, which turns old
+// pages in ISO-8859-1 or Shift-JIS, like early Phrack issues, into mojibake.
+// A body that is valid UTF-8 is taken to be UTF-8; otherwise the charset
+// comes from its <meta>, or is Windows-1252 like browsers assume.
+func decodeBody(r *colly.Response) {
+	contentType := r.Headers.Get("Content-Type")
+	if strings.Contains(strings.ToLower(contentType), "charset") {
+		return
+	}
+	if contentType != "" && !strings.Contains(contentType, "html") {
+		return
+	}
+	if utf8.Valid(r.Body) {
+		return
+	}
+	encoding, name, _ := charset.DetermineEncoding(r.Body, contentType)
+	body, err := encoding.NewDecoder().Bytes(r.Body)
+	if err != nil {
+		logger.Warnw("Failed to decode page", "url", r.Request.URL, "charset", name, "error", err)
+		return
+	}
+	logger.Debugw("Decode page", "url", r.Request.URL, "charset", name)
+	r.Body = body
+	r.Headers.Set("Content-Type", "text/html; charset=utf-8")
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	mapset "github.com/deckarep/golang-set/v2"
+)
+
+// checkBook looks for signs of a scraper bug in a book about to be
+// assembled: chapters in the table of contents that were neither fetched nor
+// reported as failed, chapters fetched without any content, and chapters
+// listed twice. It returns what it found. Chapters fetched but left out of
+// the table of contents would only be dropped from the epub, so they are
+// just logged.
+func checkBook(book ScrapedBook) []string {
+	var problems []string
+	listed := mapset.NewSet[string]()
+	for _, entry := range book.toc {
+		if !listed.Add(chapterKey(entry.URL)) {
+			problems = append(problems, fmt.Sprintf("chapter %q (%s) is listed more than once", entry.Title, entry.URL))
+			continue
+		}
+		chapter, ok := book.chapters.get(entry.URL)
+		if !ok {
+			if book.failure(entry.URL) == nil {
+				problems = append(problems, fmt.Sprintf("chapter %q (%s) was neither fetched nor reported as failed", entry.Title, entry.URL))
+			}
+			continue
+		}
+		if strings.TrimSpace(chapter.Content) == "" {
+			problems = append(problems, fmt.Sprintf("chapter %q (%s) is empty", entry.Title, entry.URL))
+		}
+	}
+	for _, key := range book.chapters.keys() {
+		if !listed.Contains(key) {
+			logger.Warnw("Chapter was fetched but is not in the table of contents", "title", book.meta.Title, "url", key)
+		}
+	}
+	return problems
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/gocolly/colly"
+)
+
+// The comments -comments takes from chapter pages: the top-level comments
+// of readers, or only those the story's author wrote, replies included.
+const (
+	commentsTop    = "top"
+	commentsAuthor = "author"
+)
+
+// commentSites are the sites whose scrapers can take the comments of
+// chapters.
+var commentSites = map[string]bool{
+	"www.royalroad.com": true,
+}
+
+// readerComment is a comment left on a chapter, its content as html.
+type readerComment struct {
+	Author   string
+	Date     time.Time
+	Content  string
+	ByAuthor bool
+}
+
+// chapterComments collects the comments of the chapters of a book as they
+// are scraped, possibly from several goroutines at once.
+type chapterComments struct {
+	mu       sync.Mutex
+	comments map[string][]readerComment
+}
+
+func newChapterComments() *chapterComments {
+	return &chapterComments{comments: make(map[string][]readerComment)}
+}
+
+func (c *chapterComments) add(url string, comments []readerComment) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.comments[chapterKey(url)] = comments
+}
+
+func (c *chapterComments) get(url string) []readerComment {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.comments[chapterKey(url)]
+}
+
+// royalRoadComments reads the comments of a Royal Road chapter page that
+// mode asks for, author being the story's author.
+func royalRoadComments(e *colly.HTMLElement, mode string, author string) []readerComment {
+	sel := &royalRoadSelectors
+	var comments []readerComment
+	sel.comment.find(e).Each(func(_ int, s *goquery.Selection) {
+		reply := s.ParentsFiltered(".subcomments").Length() > 0
+		name := strings.TrimSpace(s.FindMatcher(sel.commentAuthor).First().Text())
+		byAuthor := author != "" && strings.EqualFold(name, author)
+		if mode == commentsAuthor && !byAuthor || mode == commentsTop && reply {
+			return
+		}
+		// Only the comment's own body, not those of its replies, and none of
+		// its images, which the book doesn't embed.
+		body := s.FindMatcher(sel.commentBody).First().Clone()
+		body.Find(".comment, img, script").Remove()
+		content, _ := body.Html()
+		if strings.TrimSpace(body.Text()) == "" {
+			return
+		}
+		comment := readerComment{Author: name, Content: strings.TrimSpace(content), ByAuthor: byAuthor}
+		if unixtime, err := strconv.ParseInt(s.FindMatcher(sel.commentDate).First().AttrOr("unixtime", ""), 10, 64); err == nil {
+			comment.Date = time.Unix(unixtime, 0)
+		}
+		comments = append(comments, comment)
+	})
+	return comments
+}
+
+// commentsSection is the appendix of the comments of each chapter, under a
+// link back to the chapter.
+func commentsSection(book ScrapedBook, comments *chapterComments) string {
+	var b strings.Builder
+	b.WriteString("<h2>Comments</h2>\n")
+	for index, entry := range book.toc {
+		chapterComments := comments.get(entry.URL)
+		if len(chapterComments) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "<h3><a href=\"%s\">%s</a></h3>\n", chapterSection(index), html.EscapeString(entry.Title))
+		for _, comment := range chapterComments {
+			byline := html.EscapeString(comment.Author)
+			if comment.ByAuthor {
+				byline += " (author)"
+			}
+			if !comment.Date.IsZero() {
+				byline += ", " + comment.Date.Format("January 2, 2006")
+			}
+			fmt.Fprintf(&b, "<div class=\"comment\">\n<p><strong>%s</strong></p>\n%s\n</div>\n", byline, repairHTML(comment.Content))
+		}
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// hasComments reports whether any chapter of book has comments to append.
+func (c *chapterComments) hasComments(book ScrapedBook) bool {
+	for _, entry := range book.toc {
+		if len(c.get(entry.URL)) > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/PuerkitoBio/goquery"
+	mapset "github.com/deckarep/golang-set/v2"
+)
+
+// conformanceFixture is a story a scraper is checked against, with the
+// transport that serves its pages.
+type conformanceFixture struct {
+	name      string
+	url       string
+	transport http.RoundTripper
+}
+
+// runConformance checks that scraper holds to what every scraper must, on
+// each of fixtures: a title and a table of contents of absolute, distinct
+// chapter URLs with titles, every chapter listed fetched with content and
+// none that isn't listed, images that point at absolute URLs, each chapter
+// passed to OnChapter under its listed URL, and MaxChapters respected. A new
+// scraper gets these checks by adding its stored pages to scraperFixtures
+// and its story to the mock site.
+func runConformance(t *testing.T, scraper Scraper, fixtures []conformanceFixture) {
+	t.Helper()
+	for _, fixture := range fixtures {
+		fixture := fixture
+		t.Run(fixture.name, func(t *testing.T) {
+			var mu sync.Mutex
+			seen := mapset.NewThreadUnsafeSet[string]()
+			opts := ScrapeOptions{
+				OnChapter: func(url string, _ Chapter) {
+					mu.Lock()
+					seen.Add(chapterKey(url))
+					mu.Unlock()
+				},
+			}
+			book, err := scraper(fixtureCollector(fixture.transport), fixture.url, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer book.chapters.Close()
+
+			if strings.TrimSpace(book.meta.Title) == "" {
+				t.Error("book has no title")
+			}
+			if book.meta.CoverURL != "" && !isAbsoluteURL(book.meta.CoverURL) {
+				t.Errorf("cover url %q is not absolute", book.meta.CoverURL)
+			}
+			if len(book.toc) == 0 {
+				t.Fatal("table of contents is empty")
+			}
+			listed := mapset.NewThreadUnsafeSet[string]()
+			for _, entry := range book.toc {
+				if !isAbsoluteURL(entry.URL) {
+					t.Errorf("chapter url %q is not absolute", entry.URL)
+				}
+				if !listed.Add(chapterKey(entry.URL)) {
+					t.Errorf("chapter %s is listed more than once", entry.URL)
+				}
+				if strings.TrimSpace(entry.Title) == "" {
+					t.Errorf("chapter %s has no title", entry.URL)
+				}
+				chapter, ok := book.chapters.get(entry.URL)
+				if !ok {
+					t.Errorf("chapter %s was not fetched", entry.URL)
+					continue
+				}
+				if strings.TrimSpace(chapter.Content) == "" {
+					t.Errorf("chapter %s is empty", entry.URL)
+				}
+				for _, src := range imageSources(t, chapter.Content) {
+					if !isAbsoluteURL(src) {
+						t.Errorf("chapter %s has image %q, which is not absolute", entry.URL, src)
+					}
+				}
+			}
+			for _, key := range book.chapters.keys() {
+				if !listed.Contains(key) {
+					t.Errorf("chapter %s was fetched but is not listed", key)
+				}
+			}
+			if !seen.Equal(listed) {
+				t.Errorf("OnChapter was called for %v, want %v", seen.ToSlice(), listed.ToSlice())
+			}
+
+			limited, err := scraper(fixtureCollector(fixture.transport), fixture.url, ScrapeOptions{MaxChapters: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer limited.chapters.Close()
+			if n := limited.chapters.count(); n != 1 {
+				t.Errorf("fetched %d chapters with MaxChapters 1", n)
+			}
+		})
+	}
+}
+
+func isAbsoluteURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+func imageSources(t *testing.T, content string) []string {
+	t.Helper()
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sources []string
+	doc.Find("img[src]").Each(func(_ int, s *goquery.Selection) {
+		sources = append(sources, s.AttrOr("src", ""))
+	})
+	return sources
+}
+
+// TestConformance runs every scraper through runConformance, over its
+// stored pages and the mock site's story.
+func TestConformance(t *testing.T) {
+	fixtures := make(map[string][]conformanceFixture)
+	for _, fixture := range scraperFixtures {
+		host := mustHost(t, fixture.baseURL)
+		fixtures[host] = append(fixtures[host], conformanceFixture{name: fixture.name, url: fixture.baseURL, transport: fixture.transport})
+	}
+	for _, story := range mockStories {
+		host := mustHost(t, story)
+		fixtures[host] = append(fixtures[host], conformanceFixture{name: "mock", url: story, transport: mockTransport{}})
+	}
+	for host, scraper := range handlers {
+		host, scraper := host, scraper
+		t.Run(host, func(t *testing.T) {
+			if len(fixtures[host]) == 0 {
+				t.Fatal("scraper has no fixtures to check it against")
+			}
+			runConformance(t, scraper, fixtures[host])
+		})
+	}
+}
+
+func mustHost(t *testing.T, raw string) string {
+	t.Helper()
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Host
+}
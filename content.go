@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"html"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/gocolly/colly"
+	xhtml "golang.org/x/net/html"
+)
+
+// The selectors scrapers look for inside their OnHTML callbacks are compiled
+// once, when the program starts, rather than parsed again on every page as
+// colly's ChildText and friends do. These helpers are their equivalents for
+// compiled selectors.
+
+func childText(e *colly.HTMLElement, selector *siteSelector) string {
+	return strings.TrimSpace(selector.find(e).Text())
+}
+
+func childAttr(e *colly.HTMLElement, selector *siteSelector, attr string) string {
+	if value, ok := selector.find(e).Attr(attr); ok {
+		return strings.TrimSpace(value)
+	}
+	return ""
+}
+
+func forEachChild(e *colly.HTMLElement, selector *siteSelector, callback func(int, *colly.HTMLElement)) {
+	i := 0
+	selector.find(e).Each(func(_ int, s *goquery.Selection) {
+		for _, node := range s.Nodes {
+			callback(i, colly.NewHTMLElementFromSelectionNode(e.Response, s, node, i))
+			i++
+		}
+	})
+}
+
+// contentBuffers are reused between chapters, which for a large book saves
+// growing a fresh buffer for every one of them.
+var contentBuffers = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+// renderContent renders the content of a chapter page in a single pass: an
+// <h2> heading unless heading is empty, followed by the inner html of the
+// first element matched by selector, wrapped in a wrap element unless wrap is
+// empty. Lazy-loaded images get their real sources.
+func renderContent(e *colly.HTMLElement, heading string, selector *siteSelector, wrap string) string {
+	buf := contentBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer contentBuffers.Put(buf)
+
+	if heading != "" {
+		buf.WriteString("<h2>")
+		buf.WriteString(html.EscapeString(heading))
+		buf.WriteString("</h2>")
+	}
+	if wrap != "" {
+		buf.WriteString("<" + wrap + ">")
+	}
+	if selection := selector.find(e); selection.Length() > 0 {
+		resolveLazyImages(selection.Nodes[0])
+		for child := selection.Nodes[0].FirstChild; child != nil; child = child.NextSibling {
+			if err := xhtml.Render(buf, child); err != nil {
+				logger.Warnw("Failed to render content", "url", e.Request.URL, "error", err)
+				return ""
+			}
+		}
+	}
+	if wrap != "" {
+		buf.WriteString("</" + wrap + ">")
+	}
+	return buf.String()
+}
+
+// minChapterText is how many characters of text chapter content needs not to
+// be taken as cut short.
+const minChapterText = 100
+
+// interstitialMarkers are found in the bot check pages Cloudflare serves in
+// place of the page asked for.
+var interstitialMarkers = [][]byte{
+	[]byte("/cdn-cgi/challenge-platform/"),
+	[]byte("<title>Just a moment...</title>"),
+	[]byte(`id="challenge-form"`),
+}
+
+var (
+	errInterstitial = errors.New("page is a bot check instead of the chapter")
+	errNoContent    = errors.New("page has no chapter content")
+	errShortContent = errors.New("chapter content is suspiciously short")
+)
+
+// suspectContent reports what is wrong with a chapter page whose content is
+// the element matched by selector, if anything: the page is an interstitial,
+// or the content is missing or short enough that it was likely cut off.
+func suspectContent(e *colly.HTMLElement, selector *siteSelector) error {
+	for _, marker := range interstitialMarkers {
+		if bytes.Contains(e.Response.Body, marker) {
+			return errInterstitial
+		}
+	}
+	selection := selector.find(e)
+	if selection.Length() == 0 {
+		return errNoContent
+	}
+	text := strings.TrimSpace(selection.First().Text())
+	if text == "" && selection.First().Find("img").Length() == 0 {
+		return errNoContent
+	}
+	if text != "" && utf8.RuneCountInString(text) < minChapterText {
+		return errShortContent
+	}
+	return nil
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+	_ "modernc.org/sqlite"
+)
+
+// readBrowserCookies returns the cookies a browser has stored for host and its
+// parent domains, so that an existing logged-in or Cloudflare-cleared session
+// can be reused.
+func readBrowserCookies(browser string, host string) ([]*http.Cookie, error) {
+	switch browser {
+	case "firefox":
+		return readFirefoxCookies(host)
+	case "chrome", "chromium":
+		return readChromeCookies(browser, host)
+	}
+	return nil, fmt.Errorf("unsupported browser %q", browser)
+}
+
+// cookieHostPatterns lists the values of a cookie's host column that apply to
+// host: the host itself and every parent domain with a leading dot.
+func cookieHostPatterns(host string) []any {
+	patterns := []any{host, "." + host}
+	for parts := strings.Split(host, "."); len(parts) > 2; parts = parts[1:] {
+		patterns = append(patterns, "."+strings.Join(parts[1:], "."))
+	}
+	return patterns
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
+
+// openCookieDB opens a copy of a browser's cookie database, since the browser
+// keeps the original locked while it is running.
+func openCookieDB(filename string) (*sql.DB, func(), error) {
+	dir, err := os.MkdirTemp("", "ebook-scraper-cookies")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+	for _, suffix := range []string{"", "-wal"} {
+		if err := copyFile(filename+suffix, filepath.Join(dir, "cookies.db"+suffix)); err != nil && suffix == "" {
+			cleanup()
+			return nil, nil, err
+		}
+	}
+	db, err := sql.Open("sqlite", filepath.Join(dir, "cookies.db"))
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return db, func() { db.Close(); cleanup() }, nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func firefoxProfileDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	root := filepath.Join(home, ".mozilla", "firefox")
+	switch runtime.GOOS {
+	case "darwin":
+		root = filepath.Join(home, "Library", "Application Support", "Firefox")
+	case "windows":
+		root = filepath.Join(os.Getenv("APPDATA"), "Mozilla", "Firefox")
+	}
+	ini, err := os.ReadFile(filepath.Join(root, "profiles.ini"))
+	if err != nil {
+		return "", err
+	}
+	// Prefer the profile an install section points at, then one marked as
+	// the default, then whichever profile comes first.
+	var installDefault, markedDefault, first, path string
+	section := ""
+	for _, line := range strings.Split(string(ini), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") {
+			section = line
+			path = ""
+			continue
+		}
+		key, value, _ := strings.Cut(line, "=")
+		switch {
+		case strings.HasPrefix(section, "[Install") && key == "Default":
+			installDefault = value
+		case strings.HasPrefix(section, "[Profile") && key == "Path":
+			path = value
+			if first == "" {
+				first = value
+			}
+		case strings.HasPrefix(section, "[Profile") && key == "Default" && value == "1":
+			markedDefault = path
+		}
+	}
+	for _, profile := range []string{installDefault, markedDefault, first} {
+		if profile == "" {
+			continue
+		}
+		if filepath.IsAbs(profile) {
+			return profile, nil
+		}
+		return filepath.Join(root, profile), nil
+	}
+	return "", errors.New("no firefox profile found")
+}
+
+func readFirefoxCookies(host string) ([]*http.Cookie, error) {
+	profile, err := firefoxProfileDir()
+	if err != nil {
+		return nil, err
+	}
+	db, closeDB, err := openCookieDB(filepath.Join(profile, "cookies.sqlite"))
+	if err != nil {
+		return nil, err
+	}
+	defer closeDB()
+	patterns := cookieHostPatterns(host)
+	rows, err := db.Query(
+		"SELECT host, name, value, path, expiry, isSecure, isHttpOnly FROM moz_cookies WHERE host IN ("+placeholders(len(patterns))+")",
+		patterns...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var cookies []*http.Cookie
+	for rows.Next() {
+		var cookie http.Cookie
+		var expiry int64
+		if err := rows.Scan(&cookie.Domain, &cookie.Name, &cookie.Value, &cookie.Path, &expiry, &cookie.Secure, &cookie.HttpOnly); err != nil {
+			return nil, err
+		}
+		// Newer versions of Firefox store the expiry in milliseconds.
+		if expiry > 1e11 {
+			expiry /= 1000
+		}
+		if expiry > 0 {
+			cookie.Expires = time.Unix(expiry, 0)
+		}
+		cookies = append(cookies, &cookie)
+	}
+	return cookies, rows.Err()
+}
+
+func chromeCookieFile(browser string) (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	dir := map[string]string{"chrome": "google-chrome", "chromium": "chromium"}[browser]
+	root := filepath.Join(home, ".config", dir)
+	if runtime.GOOS == "darwin" {
+		dir = map[string]string{"chrome": "Google/Chrome", "chromium": "Chromium"}[browser]
+		root = filepath.Join(home, "Library", "Application Support", dir)
+	}
+	for _, candidate := range []string{"Default/Network/Cookies", "Default/Cookies"} {
+		filename := filepath.Join(root, candidate)
+		if _, err := os.Stat(filename); err == nil {
+			return filename, nil
+		}
+	}
+	return "", fmt.Errorf("no %s cookie database found in %s", browser, root)
+}
+
+// chromeKey derives the key Chrome encrypts cookie values with. On Linux the
+// password comes from the desktop keyring when Chrome uses one ("v11"
+// values), and is the hardcoded "peanuts" otherwise ("v10"); on macOS it is
+// always in the keychain.
+func chromeKey(browser string, version string) ([]byte, error) {
+	password := []byte("peanuts")
+	iterations := 1
+	switch {
+	case runtime.GOOS == "darwin":
+		service := map[string]string{"chrome": "Chrome Safe Storage", "chromium": "Chromium Safe Storage"}[browser]
+		out, err := exec.Command("security", "find-generic-password", "-w", "-s", service).Output()
+		if err != nil {
+			return nil, fmt.Errorf("%w: reading %q from the keychain: %v", errNoChromeKey, service, err)
+		}
+		password = bytes.TrimSpace(out)
+		iterations = 1003
+	case version == "v11":
+		out, err := exec.Command("secret-tool", "lookup", "application", browser).Output()
+		if err != nil {
+			return nil, fmt.Errorf("%w: reading %s's Safe Storage password from the keyring: %v", errNoChromeKey, browser, err)
+		}
+		password = bytes.TrimSpace(out)
+	}
+	return pbkdf2.Key(password, []byte("saltysalt"), iterations, 16, sha1.New), nil
+}
+
+// errNoChromeKey is returned when the key Chrome encrypts cookies with can't
+// be had, which leaves none of them readable.
+var errNoChromeKey = errors.New("no key to decrypt Chrome cookies with")
+
+func decryptChromeValue(encrypted []byte, key func(version string) ([]byte, error), dbVersion int) (string, error) {
+	if len(encrypted) < 3 {
+		return "", nil
+	}
+	version := string(encrypted[:3])
+	if version != "v10" && version != "v11" {
+		return "", fmt.Errorf("unsupported cookie encryption %q", version)
+	}
+	ciphertext := encrypted[3:]
+	if len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return "", errors.New("malformed encrypted cookie")
+	}
+	k, err := key(version)
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return "", err
+	}
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, bytes.Repeat([]byte(" "), aes.BlockSize)).CryptBlocks(plaintext, ciphertext)
+	padding := int(plaintext[len(plaintext)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return "", errors.New("bad padding in decrypted cookie, wrong key?")
+	}
+	plaintext = plaintext[:len(plaintext)-padding]
+	// Since database version 24 the value is prefixed with a hash of the
+	// cookie's domain.
+	if dbVersion >= 24 && len(plaintext) >= sha256.Size {
+		plaintext = plaintext[sha256.Size:]
+	}
+	return string(plaintext), nil
+}
+
+func readChromeCookies(browser string, host string) ([]*http.Cookie, error) {
+	if runtime.GOOS == "windows" {
+		return nil, errors.New("reading chrome cookies is not supported on windows")
+	}
+	filename, err := chromeCookieFile(browser)
+	if err != nil {
+		return nil, err
+	}
+	db, closeDB, err := openCookieDB(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer closeDB()
+	var dbVersion int
+	if err := db.QueryRow("SELECT value FROM meta WHERE key = 'version'").Scan(&dbVersion); err != nil {
+		return nil, err
+	}
+	patterns := cookieHostPatterns(host)
+	rows, err := db.Query(
+		"SELECT host_key, name, value, encrypted_value, path, expires_utc, is_secure, is_httponly FROM cookies WHERE host_key IN ("+placeholders(len(patterns))+")",
+		patterns...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := make(map[string][]byte)
+	key := func(version string) ([]byte, error) {
+		if _, ok := keys[version]; !ok {
+			k, err := chromeKey(browser, version)
+			if err != nil {
+				return nil, err
+			}
+			keys[version] = k
+		}
+		return keys[version], nil
+	}
+	var cookies []*http.Cookie
+	for rows.Next() {
+		var cookie http.Cookie
+		var encrypted []byte
+		var expires int64
+		if err := rows.Scan(&cookie.Domain, &cookie.Name, &cookie.Value, &encrypted, &cookie.Path, &expires, &cookie.Secure, &cookie.HttpOnly); err != nil {
+			return nil, err
+		}
+		if cookie.Value == "" && len(encrypted) > 0 {
+			cookie.Value, err = decryptChromeValue(encrypted, key, dbVersion)
+			if errors.Is(err, errNoChromeKey) {
+				return nil, err
+			}
+			if err != nil {
+				logger.Warnw("Failed to decrypt cookie", "name", cookie.Name, "domain", cookie.Domain, "error", err)
+				continue
+			}
+		}
+		// Chrome counts microseconds since 1601-01-01.
+		if expires > 0 {
+			cookie.Expires = time.UnixMicro(expires - 11644473600000000)
+		}
+		cookies = append(cookies, &cookie)
+	}
+	return cookies, rows.Err()
+}
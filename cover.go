@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+	_ "golang.org/x/image/webp"
+)
+
+// minCoverSize is the smallest width and height a cover may have. Anything
+// smaller is a placeholder or a tracking pixel rather than a cover.
+const minCoverSize = 100
+
+// addCover embeds the cover of book. A cover that fails to download, or
+// turns out not to be an image, such as an error page served with a success
+// status, is fetched again with the alternate transport and then replaced by
+// a generated one, rather than failing the book.
+func (b *epubBuilder) addCover(meta Metadata) (string, error) {
+	filename, hash, err := b.fetcher.wait(meta.CoverURL)
+	if err == nil {
+		err = validateCover(filename)
+	}
+	if err != nil && b.alternate {
+		logger.Infow("Fetch cover again with the alternate transport", "url", meta.CoverURL, "error", err)
+		filename, hash, err = b.fetcher.waitAlternate(meta.CoverURL)
+		if err == nil {
+			err = validateCover(filename)
+		}
+	}
+	if err != nil {
+		logger.Warnw("Use a generated cover", "url", meta.CoverURL, "error", err)
+		filename = filepath.Join(b.fetcher.dir, "generated-cover.png")
+		if err := generateCover(filename, meta); err != nil {
+			return "", err
+		}
+		if hash, err = hashFile(filename); err != nil {
+			return "", err
+		}
+	}
+	return b.images.addDownloaded(filename, hash, "cover")
+}
+
+// validateCover checks that the file at filename is an image large enough to
+// be a cover. Images in formats that can't be decoded here are taken on
+// trust.
+func validateCover(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	if contentType := http.DetectContentType(head[:n]); !strings.HasPrefix(contentType, "image/") {
+		return fmt.Errorf("cover is %s, not an image", contentType)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return nil
+	}
+	if config.Width < minCoverSize || config.Height < minCoverSize {
+		return fmt.Errorf("cover is only %dx%d pixels", config.Width, config.Height)
+	}
+	return nil
+}
+
+// generateCover writes a plain cover with the book's title and author to
+// filename as a PNG. The text is drawn with a small bitmap font and scaled
+// up, so characters outside Latin-1 come out as replacement characters. The
+// background colour is picked by the title, so that generated covers tell
+// books apart at a glance.
+func generateCover(filename string, meta Metadata) error {
+	const width, height, scale = 600, 900, 4
+	sum := sha1.Sum([]byte(meta.Title))
+	background := color.RGBA{R: 40 + sum[0]%120, G: 40 + sum[1]%120, B: 40 + sum[2]%120, A: 255}
+
+	small := image.NewRGBA(image.Rect(0, 0, width/scale, height/scale))
+	draw.Draw(small, small.Bounds(), image.NewUniform(background), image.Point{}, draw.Src)
+	face := basicfont.Face7x13
+	drawer := &font.Drawer{Dst: small, Src: image.White, Face: face}
+	columns := (width/scale - 8) / 7
+	y := height / scale / 4
+	for _, line := range wrapText(meta.Title, columns) {
+		drawCentered(drawer, line, y)
+		y += face.Height
+	}
+	y = height/scale*3/4 - face.Height
+	for _, line := range wrapText(meta.Author, columns) {
+		drawCentered(drawer, line, y)
+		y += face.Height
+	}
+
+	cover := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.NearestNeighbor.Scale(cover, cover.Bounds(), small, small.Bounds(), draw.Src, nil)
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(f, cover); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func drawCentered(drawer *font.Drawer, text string, y int) {
+	width := drawer.Dst.Bounds().Dx()
+	advance := drawer.MeasureString(text).Ceil()
+	drawer.Dot = fixed.P((width-advance)/2, y)
+	drawer.DrawString(text)
+}
+
+// wrapText breaks text into lines of at most columns characters, breaking
+// words only where a single word is longer than that.
+func wrapText(text string, columns int) []string {
+	var lines []string
+	var line string
+	for _, word := range strings.Fields(text) {
+		for len([]rune(word)) > columns {
+			if line != "" {
+				lines = append(lines, line)
+				line = ""
+			}
+			runes := []rune(word)
+			lines = append(lines, string(runes[:columns]))
+			word = string(runes[columns:])
+		}
+		if line == "" {
+			line = word
+		} else if len([]rune(line))+1+len([]rune(word)) <= columns {
+			line += " " + word
+		} else {
+			lines = append(lines, line)
+			line = word
+		}
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return lines
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+)
+
+// debugDump keeps everything a run saw and made under a directory, for
+// working out afterwards why a chapter came out wrong: the body of every
+// response under responses/, listed in responses/index.tsv, and for each
+// book the html extracted of its chapters and the book itself as json under
+// books/.
+type debugDump struct {
+	dir string
+
+	mu        sync.Mutex
+	responses int
+	index     *os.File
+}
+
+func newDebugDump(dir string) (*debugDump, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "responses"), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "books"), 0755); err != nil {
+		return nil, err
+	}
+	index, err := os.OpenFile(filepath.Join(dir, "responses", "index.tsv"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintln(index, "file\tbook\tmethod\tstatus\turl")
+	return &debugDump{dir: dir, index: index}, nil
+}
+
+func (d *debugDump) Close() error {
+	return d.index.Close()
+}
+
+// DumpTransport saves the body of every response passing through it.
+type DumpTransport struct {
+	Transport http.RoundTripper
+	Dump      *debugDump
+}
+
+func (t DumpTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	response, err := t.Transport.RoundTrip(request)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	response.Body = io.NopCloser(bytes.NewReader(body))
+	if err := t.Dump.saveResponse(request, response.StatusCode, body); err != nil {
+		logger.Warnw("Failed to dump response", "url", request.URL.String(), "error", err)
+	}
+	return response, nil
+}
+
+func (d *debugDump) saveResponse(request *http.Request, status int, body []byte) error {
+	d.mu.Lock()
+	d.responses++
+	n := d.responses
+	d.mu.Unlock()
+	name := fmt.Sprintf("%05d-%s", n, sanitizePathComponent(request.URL.Host))
+	if base := path.Base(request.URL.Path); base != "/" && base != "." {
+		name += "-" + sanitizePathComponent(base)
+	}
+	if len(name) > 100 {
+		name = name[:100]
+	}
+	if err := os.WriteFile(filepath.Join(d.dir, "responses", name), body, 0644); err != nil {
+		return err
+	}
+	book := request.Header.Get(cacheBookHeader)
+	if book == "" {
+		book = "-"
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, err := fmt.Fprintf(d.index, "%s\t%s\t%s\t%d\t%s\n", name, book, request.Method, status, request.URL)
+	return err
+}
+
+// dumpedBook is a ScrapedBook as it is saved, with the chapters that were
+// fetched in table of contents order and why the others weren't.
+type dumpedBook struct {
+	Meta     Metadata
+	TOC      []TOCEntry
+	Chapters []Chapter
+	Failed   map[string]string `json:",omitempty"`
+}
+
+// saveBook saves the chapters of the book numbered book as extracted, with
+// their images still pointing where imageSources says they came from, and
+// the book as json.
+func (d *debugDump) saveBook(book string, scraped ScrapedBook, imageSources map[string]string) error {
+	dir := filepath.Join(d.dir, "books", book+"-"+sanitizePathComponent(scraped.meta.Title))
+	if err := writeChapterHTML(filepath.Join(dir, "chapters"), scraped, imageSources); err != nil {
+		return err
+	}
+	dumped := dumpedBook{Meta: scraped.meta, TOC: scraped.toc}
+	for _, entry := range scraped.toc {
+		if chapter, ok := scraped.chapters.get(entry.URL); ok {
+			dumped.Chapters = append(dumped.Chapters, chapter)
+		}
+	}
+	if len(scraped.failed) > 0 {
+		dumped.Failed = make(map[string]string)
+		for url, err := range scraped.failed {
+			dumped.Failed[url] = err.Error()
+		}
+	}
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(dumped); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "book.json"), buf.Bytes(), 0644)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/andybalholm/cascadia"
+)
+
+// devReplHelp lists what the selector repl takes.
+const devReplHelp = `Enter a CSS selector to list the elements it matches on the page, or:
+  :text SELECTOR       print the text of each match
+  :html SELECTOR       print the inner html of each match
+  :attr NAME SELECTOR  print attribute NAME of each match
+  :get URL             fetch another page
+  :help                show this again
+  :quit                leave (or end the input)`
+
+// devReplWidth is how much of each match is shown when listing them.
+const devReplWidth = 160
+
+// runDevCommand implements `dev repl URL`, fetching the page at URL through
+// client and evaluating selectors against it as they are typed, to try them
+// out while writing a scraper.
+func runDevCommand(client http.RoundTripper, args []string, in io.Reader, out io.Writer) error {
+	if len(args) != 2 || args[0] != "repl" {
+		return errors.New("usage: dev repl URL")
+	}
+	repl := &selectorRepl{client: &http.Client{Transport: client}, out: out}
+	if err := repl.load(args[1]); err != nil {
+		return err
+	}
+	fmt.Fprintln(out, devReplHelp)
+	scanner := bufio.NewScanner(in)
+	for {
+		fmt.Fprint(out, "> ")
+		if !scanner.Scan() {
+			fmt.Fprintln(out)
+			return scanner.Err()
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == ":quit" {
+			return nil
+		}
+		if err := repl.eval(line); err != nil {
+			fmt.Fprintln(out, "error:", err)
+		}
+	}
+}
+
+type selectorRepl struct {
+	client *http.Client
+	out    io.Writer
+	doc    *goquery.Document
+}
+
+// load fetches the page at url to evaluate selectors against.
+func (r *selectorRepl) load(url string) error {
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	agent := userAgent
+	if agent == "" {
+		agent = versionUserAgent()
+	}
+	request.Header.Set("User-Agent", agent)
+	response, err := r.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, response.Status)
+	}
+	doc, err := goquery.NewDocumentFromReader(response.Body)
+	if err != nil {
+		return err
+	}
+	r.doc = doc
+	fmt.Fprintf(r.out, "Loaded %s (%s)\n", url, strings.TrimSpace(doc.Find("title").First().Text()))
+	return nil
+}
+
+func (r *selectorRepl) eval(line string) error {
+	command, rest := "", line
+	if strings.HasPrefix(line, ":") {
+		command, rest, _ = strings.Cut(line, " ")
+		rest = strings.TrimSpace(rest)
+	}
+	switch command {
+	case "":
+		if line == "" {
+			return nil
+		}
+		return r.each(rest, func(s *goquery.Selection) string {
+			html, _ := goquery.OuterHtml(s)
+			return devReplShorten(html)
+		})
+	case ":text":
+		return r.each(rest, func(s *goquery.Selection) string { return strings.TrimSpace(s.Text()) })
+	case ":html":
+		return r.each(rest, func(s *goquery.Selection) string {
+			html, _ := s.Html()
+			return strings.TrimSpace(html)
+		})
+	case ":attr":
+		name, selector, found := strings.Cut(rest, " ")
+		if !found {
+			return errors.New("usage: :attr NAME SELECTOR")
+		}
+		return r.each(strings.TrimSpace(selector), func(s *goquery.Selection) string {
+			value, ok := s.Attr(name)
+			if !ok {
+				return "(none)"
+			}
+			return value
+		})
+	case ":get":
+		if rest == "" {
+			return errors.New("usage: :get URL")
+		}
+		return r.load(rest)
+	case ":help":
+		fmt.Fprintln(r.out, devReplHelp)
+		return nil
+	}
+	return fmt.Errorf("unknown command %s; try :help", command)
+}
+
+// each prints show of every element selector matches, numbered, after how
+// many there are.
+func (r *selectorRepl) each(selector string, show func(*goquery.Selection) string) error {
+	if selector == "" {
+		return errors.New("no selector")
+	}
+	// goquery would take an invalid selector for one that matches nothing.
+	compiled, err := cascadia.Compile(selector)
+	if err != nil {
+		return err
+	}
+	matches := r.doc.FindMatcher(compiled)
+	fmt.Fprintf(r.out, "%d matches\n", matches.Length())
+	matches.Each(func(i int, s *goquery.Selection) {
+		fmt.Fprintf(r.out, "[%d] %s\n", i+1, show(s))
+	})
+	return nil
+}
+
+// devReplShorten fits html on one line of about devReplWidth characters.
+func devReplShorten(html string) string {
+	html = strings.Join(strings.Fields(html), " ")
+	if utf8.RuneCountInString(html) <= devReplWidth {
+		return html
+	}
+	return string([]rune(html)[:devReplWidth]) + "…"
+}
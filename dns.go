@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DoHResolver resolves host names over DNS-over-HTTPS (RFC 8484), for
+// networks where the site's DNS records are blocked or poisoned. The DoH
+// server itself is reached through the system resolver, so pointing URL at an
+// address such as https://1.1.1.1/dns-query avoids local DNS entirely.
+type DoHResolver struct {
+	URL    string
+	Client *http.Client
+
+	mu    sync.Mutex
+	cache map[string]dohCacheEntry
+}
+
+type dohCacheEntry struct {
+	addrs   []net.IP
+	expires time.Time
+}
+
+func NewDoHResolver(url string) *DoHResolver {
+	return &DoHResolver{
+		URL:    url,
+		Client: &http.Client{Timeout: 10 * time.Second},
+		cache:  make(map[string]dohCacheEntry),
+	}
+}
+
+// DialContext has the signature of net.Dialer.DialContext and can be used in
+// place of it in an http.Transport.
+func (r *DoHResolver) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return dialer.DialContext(ctx, network, address)
+	}
+	addrs, err := r.LookupIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var dialErr error
+	for _, addr := range addrs {
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(addr.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		dialErr = err
+	}
+	return nil, dialErr
+}
+
+func (r *DoHResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	r.mu.Lock()
+	entry, ok := r.cache[host]
+	r.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.addrs, nil
+	}
+
+	var addrs []net.IP
+	ttl := uint32(300)
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		answers, minTTL, err := r.query(ctx, host, qtype)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, answers...)
+		if len(answers) > 0 && minTTL < ttl {
+			ttl = minTTL
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: "no addresses found", Name: host, Server: r.URL, IsNotFound: true}
+	}
+	logger.Debugw("Resolved over DoH", "host", host, "addrs", addrs, "ttl", ttl)
+	r.mu.Lock()
+	r.cache[host] = dohCacheEntry{addrs: addrs, expires: time.Now().Add(time.Duration(ttl) * time.Second)}
+	r.mu.Unlock()
+	return addrs, nil
+}
+
+func (r *DoHResolver) query(ctx context.Context, host string, qtype dnsmessage.Type) ([]net.IP, uint32, error) {
+	name, err := dnsmessage.NewName(host + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+	// The ID is zero as recommended by RFC 8484 section 4.1, for cacheability.
+	message := dnsmessage.Message{
+		Header:    dnsmessage.Header{RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := message.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, r.URL, bytes.NewReader(packed))
+	if err != nil {
+		return nil, 0, err
+	}
+	request.Header.Set("Content-Type", "application/dns-message")
+	request.Header.Set("Accept", "application/dns-message")
+	response, err := r.Client.Do(request)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("doh server %s returned %s", r.URL, response.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(response.Body, 65535))
+	if err != nil {
+		return nil, 0, err
+	}
+	var reply dnsmessage.Message
+	if err := reply.Unpack(body); err != nil {
+		return nil, 0, err
+	}
+	if reply.RCode != dnsmessage.RCodeSuccess && reply.RCode != dnsmessage.RCodeNameError {
+		return nil, 0, errors.New("doh lookup of " + host + " failed: " + reply.RCode.String())
+	}
+
+	var addrs []net.IP
+	minTTL := ^uint32(0)
+	for _, answer := range reply.Answers {
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			addrs = append(addrs, net.IP(body.A[:]))
+		case *dnsmessage.AAAAResource:
+			addrs = append(addrs, net.IP(body.AAAA[:]))
+		default:
+			continue
+		}
+		if answer.Header.TTL < minTTL {
+			minTTL = answer.Header.TTL
+		}
+	}
+	return addrs, minTTL, nil
+}
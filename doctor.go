@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"unicode/utf8"
+)
+
+// doctorCase is a story the doctor command scrapes to tell whether a site's
+// scraper still works, and what it expects to find.
+type doctorCase struct {
+	// site is the name the site's selectors are registered under.
+	site string
+	url  string
+	// title, if set, is the title the story must have; any title will do
+	// otherwise. author is whether it must have an author.
+	title  string
+	author bool
+	// chapters is the fewest chapters its table of contents may list.
+	chapters int
+}
+
+// doctorCases are long finished stories, one for each supported site, that
+// aren't going anywhere.
+var doctorCases = []doctorCase{
+	{site: "royalroad", url: "https://www.royalroad.com/fiction/21220/mother-of-learning", title: "Mother of Learning", author: true, chapters: 100},
+	{site: "scribblehub", url: "https://www.scribblehub.com/series/10442/the-humble-life-of-a-skeleton/", author: true, chapters: 10},
+	{site: "phrack", url: "http://phrack.org/issues/49/14.html", title: "Phrack Magazine", chapters: 10},
+}
+
+// mockDoctorCases check the scrapers against the mock site's stories
+// instead, with -target mock.
+func mockDoctorCases() []doctorCase {
+	sites := map[string]string{"www.royalroad.com": "royalroad", "www.scribblehub.com": "scribblehub", "phrack.org": "phrack"}
+	var cases []doctorCase
+	for _, story := range mockStories {
+		parsed, _ := url.Parse(story)
+		cases = append(cases, doctorCase{site: sites[parsed.Host], url: story, chapters: mockChapters})
+	}
+	return cases
+}
+
+// runDoctor scrapes the metadata, table of contents and first chapter of
+// each of cases whose site is in sites, or of all of them if sites is empty,
+// and reports which scrapers are broken. Pages are fetched again rather than
+// taken from the cache, which could hide a change to the site.
+func (s *session) runDoctor(cases []doctorCase, sites []string) error {
+	wanted := make(map[string]bool)
+	for _, site := range sites {
+		wanted[site] = true
+	}
+	var selected []doctorCase
+	for _, c := range cases {
+		if len(wanted) == 0 || wanted[c.site] {
+			selected = append(selected, c)
+		}
+	}
+	if len(selected) == 0 {
+		return fmt.Errorf("no known story for sites %v", sites)
+	}
+	s.cache.Refresh = true
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SITE\tSTATUS\tDETAILS")
+	var broken int
+	for _, c := range selected {
+		problems := s.diagnose(c)
+		if len(problems) == 0 {
+			fmt.Fprintf(tw, "%s\tok\t%s\n", c.site, c.url)
+			continue
+		}
+		broken++
+		logger.Debugw("Scraper is broken", "site", c.site, "url", c.url, "problems", problems)
+		fmt.Fprintf(tw, "%s\tbroken\t%s\n", c.site, strings.Join(problems, "; "))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if broken > 0 {
+		return fmt.Errorf("%d of %d scrapers are broken", broken, len(selected))
+	}
+	return nil
+}
+
+// diagnose scrapes the story of c and returns what is wrong with it.
+func (s *session) diagnose(c doctorCase) []string {
+	parsed, err := url.Parse(c.url)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	if err := s.setupHost(parsed); err != nil {
+		return []string{err.Error()}
+	}
+	var mu sync.Mutex
+	failed := make(map[string]error)
+	opts := ScrapeOptions{
+		MaxChapters: 1,
+		Alternate:   s.alternate,
+		OnError: func(url string, err error) {
+			mu.Lock()
+			failed[chapterKey(url)] = err
+			mu.Unlock()
+		},
+	}
+	logger.Infow("Check scraper", "site", c.site, "url", c.url)
+	book, err := handlers[parsed.Host](s.collector.Clone(), c.url, opts)
+	if err != nil {
+		return []string{fmt.Sprintf("scrape failed: %v", err)}
+	}
+	defer book.chapters.Close()
+	book.failed = failed
+
+	var problems []string
+	if book.meta.Title == "" {
+		problems = append(problems, "no title")
+	} else if c.title != "" && book.meta.Title != c.title {
+		problems = append(problems, fmt.Sprintf("title is %q, want %q", book.meta.Title, c.title))
+	}
+	if c.author && book.meta.Author == "" {
+		problems = append(problems, "no author")
+	}
+	if len(book.toc) < c.chapters {
+		problems = append(problems, fmt.Sprintf("%d chapters listed, want at least %d", len(book.toc), c.chapters))
+	}
+	if len(book.toc) > 0 {
+		first := book.toc[0]
+		if chapter, ok := book.chapters.get(first.URL); !ok {
+			reason := book.failure(first.URL)
+			if reason == nil {
+				reason = errors.New("not fetched")
+			}
+			problems = append(problems, fmt.Sprintf("first chapter: %v", reason))
+		} else if n := utf8.RuneCountInString(strings.TrimSpace(htmlText(chapter.Content))); n < minChapterText {
+			problems = append(problems, fmt.Sprintf("first chapter has only %d characters of text", n))
+		}
+	}
+	for _, name := range brokenSelectors(c.site) {
+		problems = append(problems, fmt.Sprintf("selector %s matched nothing", name))
+	}
+	return problems
+}
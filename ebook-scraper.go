@@ -1,23 +1,36 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"html"
+	"io"
+	"net/http"
 	"net/url"
 	"os"
-	"runtime/pprof"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
 
 	mapset "github.com/deckarep/golang-set/v2"
 	"github.com/gocolly/colly"
 	"github.com/gocolly/colly/extensions"
 	"github.com/mdepp/go-epub"
-	"github.com/schollz/progressbar/v3"
 	"go.uber.org/zap"
 )
 
 type TOCEntry struct {
-	URL string
+	URL   string
+	Title string
+	Date  time.Time
 }
 
 type Chapter struct {
@@ -26,267 +39,1477 @@ type Chapter struct {
 }
 
 type Metadata struct {
+	SourceURL   string
 	Title       string
 	Author      string
 	CoverURL    string
 	Description string
+	// Published, the year of first publication, and the identifiers below
+	// are only known of published works looked up in Open Library.
+	Published   string
+	ISBN        string
+	OpenLibrary string
 }
 
 type ScrapedBook struct {
 	meta     Metadata
 	toc      []TOCEntry
-	chapters map[string]Chapter
+	chapters *chapterStore
+	// failed maps the chapterKey of each chapter in the table of contents
+	// that couldn't be fetched to why.
+	failed map[string]error
 }
 
-type Scraper = func(*colly.Collector, string) (ScrapedBook, error)
+// failure returns why the chapter at url couldn't be fetched, or nil.
+func (b ScrapedBook) failure(url string) error {
+	return b.failed[chapterKey(url)]
+}
+
+// dropUnfetched removes the chapters that weren't fetched from the table of
+// contents, such as those past -max-chapters. Chapters that failed stay, to
+// be marked as missing.
+func (b *ScrapedBook) dropUnfetched() {
+	var toc []TOCEntry
+	for _, entry := range b.toc {
+		if b.chapters.has(entry.URL) || b.failure(entry.URL) != nil {
+			toc = append(toc, entry)
+		}
+	}
+	if dropped := len(b.toc) - len(toc); dropped > 0 {
+		logger.Infow("Leave out chapters past the limit", "chapters", dropped)
+	}
+	b.toc = toc
+}
+
+// ScrapeOptions narrow down which chapters of a story a Scraper fetches.
+type ScrapeOptions struct {
+	// FromURL, if set, is the first chapter to fetch; earlier ones are skipped.
+	FromURL string
+	// TOCOnly stops scrapers from fetching chapter bodies where the table of
+	// contents can be built without them.
+	TOCOnly bool
+	// Known lists, in order, the chapters the caller already has. Scrapers
+	// keep them in the table of contents but need not fetch them again.
+	Known []string
+	// Have, if set, reports whether the caller already has the version of a
+	// chapter listed in the table of contents. Scrapers need not fetch those
+	// either.
+	Have func(entry TOCEntry) bool
+	// ExcludeTitles leaves out chapters whose titles match any of them.
+	ExcludeTitles []*regexp.Regexp
+	// MaxChapters, if positive, caps how many chapters are fetched.
+	MaxChapters int
+	// OnChapter, if set, is called with every chapter as soon as it has been
+	// fetched, possibly from several goroutines at once.
+	OnChapter func(url string, chapter Chapter)
+	// Prepare, if set, is called after OnChapter and returns the chapter
+	// the scraper keeps.
+	Prepare func(url string, chapter Chapter) Chapter
+	// OnRequest, if set, is called with every request the scraper makes.
+	OnRequest func(r *colly.Request)
+	// OnQueue, if set, is told how many chapters are about to be fetched by
+	// scrapers that know it in advance.
+	OnQueue func(n int)
+	// OnError, if set, is called with every page that failed for good, after
+	// any retries.
+	OnError func(url string, err error)
+	// Filter, if set, cleans up the content of every chapter fetched before
+	// it is passed on.
+	Filter func(url string, content string) string
+	// SkipPolls leaves the polls of chapters out instead of listing their
+	// options.
+	SkipPolls bool
+	// Comments, if set, is which comments of each chapter are passed to
+	// OnComments, by scrapers of the sites in commentSites: commentsTop or
+	// commentsAuthor.
+	Comments   string
+	OnComments func(url string, comments []readerComment)
+	// Alternate allows chapter pages that look wrong to be fetched again
+	// with the alternate transport.
+	Alternate bool
+	// KeepUserAgent sends the same user agent with every request instead of
+	// a random one, for cookies imported from a browser to keep working.
+	KeepUserAgent bool
+}
+
+func (o ScrapeOptions) fetched(url string, chapter Chapter) Chapter {
+	if o.Filter != nil {
+		chapter.Content = o.Filter(url, chapter.Content)
+	}
+	if o.OnChapter != nil {
+		o.OnChapter(url, chapter)
+	}
+	if o.Prepare != nil {
+		chapter = o.Prepare(url, chapter)
+	}
+	return chapter
+}
+
+// fetchError is why a page failed for good, after every attempt at it.
+type fetchError struct {
+	Attempts int
+	Err      error
+}
+
+func (e *fetchError) Error() string {
+	return fmt.Sprintf("%v (after %d attempts)", e.Err, e.Attempts)
+}
+
+func (e *fetchError) Unwrap() error {
+	return e.Err
+}
+
+// failed reports the page of r as failed for good.
+func (o ScrapeOptions) failed(r *colly.Request, err error) {
+	if o.OnError == nil {
+		return
+	}
+	retries, _ := r.Ctx.GetAny("retries").(int)
+	o.OnError(requestedURL(r), &fetchError{Attempts: retries + 1, Err: err})
+}
+
+// retry fetches the page of r again unless that would exceed its budget of
+// fetchRetries, reporting whether it did. A page that failed to fetch is
+// first tried again as it was, after a pause, and then with the alternate
+// transport. A page that came back wrong is only tried with the alternate
+// transport, since the same one would likely get the same page again. The
+// count is kept in the context, which unlike the headers survives transports
+// that hand back a copy of the request.
+func (o ScrapeOptions) retry(r *colly.Request, reason error, failed bool) bool {
+	retries, _ := r.Ctx.GetAny("retries").(int)
+	if retries >= fetchRetries {
+		return false
+	}
+	alternate := o.Alternate && (!failed || retries > 0)
+	if !failed && !alternate {
+		return false
+	}
+	retries++
+	r.Ctx.Put("retries", retries)
+	logger.Infow("Retry request", "url", requestedURL(r), "attempt", retries+1, "alternate", alternate, "reason", reason)
+	if alternate {
+		r.Headers.Set(alternateTransportHeader, "1")
+	}
+	if failed {
+		time.Sleep(time.Duration(retries) * time.Second)
+	}
+	return r.Retry() == nil
+}
+
+// checkChapter reports whether the chapter page e, whose content is the
+// element matched by selector, should be kept. A page that looks wrong is
+// dropped in favour of a retry where there is one. Failing that, content that
+// is merely short is kept, while a page without content fails its chapter.
+func (o ScrapeOptions) checkChapter(e *colly.HTMLElement, selector *siteSelector) bool {
+	suspect := suspectContent(e, selector)
+	if suspect == nil {
+		return true
+	}
+	if o.retry(e.Request, suspect, false) {
+		return false
+	}
+	url := requestedURL(e.Request)
+	if errors.Is(suspect, errShortContent) {
+		logger.Warnw("Chapter content looks cut short", "url", url)
+		return true
+	}
+	logger.Warnw("Chapter page has no content", "url", url, "reason", suspect)
+	o.failed(e.Request, suspect)
+	return false
+}
+
+// knownKeys returns the chapterKey of each of the Known chapters.
+func (o ScrapeOptions) knownKeys() mapset.Set[string] {
+	known := mapset.NewSet[string]()
+	for _, url := range o.Known {
+		known.Add(chapterKey(url))
+	}
+	return known
+}
+
+func (o ScrapeOptions) has(entry TOCEntry) bool {
+	return o.Have != nil && o.Have(entry)
+}
+
+func (o ScrapeOptions) excluded(title string) bool {
+	for _, pattern := range o.ExcludeTitles {
+		if pattern.MatchString(title) {
+			return true
+		}
+	}
+	return false
+}
+
+// capped reports whether fetched chapters are as many as may be fetched.
+func (o ScrapeOptions) capped(fetched int) bool {
+	return o.MaxChapters > 0 && fetched >= o.MaxChapters
+}
+
+// selectChapters narrows down a story's full list of chapters to its table
+// of contents, and the chapters in it that are to be fetched.
+func (o ScrapeOptions) selectChapters(listed []TOCEntry) ([]TOCEntry, []string, error) {
+	var toc []TOCEntry
+	var pending []string
+	skipping := o.FromURL != ""
+	known := o.knownKeys()
+	listedKeys := mapset.NewSet[string]()
+	for _, entry := range listed {
+		key := chapterKey(entry.URL)
+		if skipping && key != chapterKey(o.FromURL) {
+			continue
+		}
+		skipping = false
+		if o.excluded(entry.Title) || !listedKeys.Add(key) {
+			continue
+		}
+		toc = append(toc, entry)
+		if !o.TOCOnly && !known.Contains(key) && !o.has(entry) {
+			pending = append(pending, entry.URL)
+		}
+	}
+	if skipping {
+		return nil, nil, fmt.Errorf("chapter %s not found in table of contents", o.FromURL)
+	}
+	if o.capped(len(pending)) {
+		pending = pending[:o.MaxChapters]
+	}
+	return toc, pending, nil
+}
+
+func (o ScrapeOptions) queued(n int) {
+	if o.OnQueue != nil {
+		o.OnQueue(n)
+	}
+}
+
+type Scraper = func(*colly.Collector, string, ScrapeOptions) (ScrapedBook, error)
 
 var logger *zap.SugaredLogger
 
-func assembleEpub(book ScrapedBook) (*epub.Epub, error) {
-	doc := epub.NewEpub(book.meta.Title)
+// userAgent replaces the randomized user agent when set.
+var userAgent string
+
+// fetchRetries is how many times a chapter is fetched again, whatever the
+// transport, after it failed or came back wrong before it is given up on.
+var fetchRetries = 2
+
+var handlers = map[string]Scraper{
+	"www.royalroad.com":   scrapeRoyalRoad,
+	"phrack.org":          scrapePhrack,
+	"www.scribblehub.com": scrapeScribblehub,
+}
+
+// Covers and illustrations are often served from CDNs or image proxies
+// rather than the story's own host.
+var assetDomains = map[string][]string{
+	"www.royalroad.com":   {"royalroadcdn.com"},
+	"www.scribblehub.com": {"scribblehub.com"},
+}
+
+// cdnHosts are the hosts a site's images are served from, whose connections
+// -prewarm opens along with the site's own.
+var cdnHosts = map[string][]string{
+	"www.royalroad.com":   {"www.royalroadcdn.com"},
+	"www.scribblehub.com": {"cdn.scribblehub.com"},
+}
+
+// epubBuilder builds the epub for one book. The images of each chapter start
+// downloading on their own workers as soon as the chapter has been fetched,
+// so that this overlaps with downloading the rest; sections are added in
+// table of contents order once the scrape is over.
+type epubBuilder struct {
+	doc     *epub.Epub
+	fetcher *imageFetcher
+	images  *imageEmbedder
+	// alternate allows a cover that fails to be fetched again with the
+	// alternate transport.
+	alternate bool
+	// about adds an "About this book" page after the cover.
+	about bool
+	// added and changed, if any, are the URLs of the chapters an update
+	// brought, listed on a "What's new" page after the cover.
+	added, changed []string
+	// glossary, if any, is appended to the book, its terms linked from the
+	// chapters where they first appear.
+	glossary []glossaryEntry
+	// comments, if set, are appended to the book after its chapters.
+	comments *chapterComments
+	// cleanTitle, if set, cleans up the title of each chapter.
+	cleanTitle func(string) string
+	// translator, if set, translates each chapter but those in carried.
+	translator *chapterTranslator
+	// carried maps the chapters an update keeps, retitled and translated
+	// already, to the hashes of their originals as fetched.
+	carried map[string]string
+}
+
+// newEpubBuilder starts an epub whose images are fetched with client from
+// assetHosts, by up to imageWorkers at once. carried are images from a
+// previous epub, by their name in it, and are added first so they keep their
+// names.
+func newEpubBuilder(client *http.Client, assetHosts hostAllowList, imageWorkers int, carried map[string]string) (*epubBuilder, error) {
+	doc := epub.NewEpub("")
+	doc.Client = client
+	fetcher, err := newImageFetcher(client, imageWorkers)
+	if err != nil {
+		return nil, err
+	}
+	images := newImageEmbedder(doc, assetHosts, fetcher)
+	// Sorted, so that later images are given the same generated names on
+	// every run.
+	names := make([]string, 0, len(carried))
+	for name := range carried {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		filename := carried[name]
+		path, err := doc.AddImage(filename, name)
+		if err != nil {
+			fetcher.Close()
+			return nil, err
+		}
+		// New chapters may repeat images the previous ones had.
+		if hash, err := hashFile(filename); err == nil {
+			images.byHash[hash] = path
+		}
+	}
+	return &epubBuilder{doc: doc, fetcher: fetcher, images: images}, nil
+}
+
+// prepare starts downloading the images of a freshly fetched chapter. It is
+// safe to call from several goroutines.
+func (b *epubBuilder) prepare(url string, chapter Chapter) Chapter {
+	for _, imageURL := range b.images.imageURLs(chapter.Content, url) {
+		b.fetcher.fetch(imageURL)
+	}
+	return chapter
+}
+
+// Close removes downloaded images once the epub has been written.
+func (b *epubBuilder) Close() error {
+	return b.fetcher.Close()
+}
+
+// assemble adds the book's sections to the epub, dating its colophon
+// timestamp.
+func (b *epubBuilder) assemble(book ScrapedBook, timestamp time.Time, prog *progress) (*epub.Epub, *bookManifest, error) {
+	doc := b.doc
+	doc.SetIdentifier(bookIdentifier(book.meta.SourceURL))
+	doc.SetTitle(book.meta.Title)
 	doc.SetAuthor(book.meta.Author)
+	if b.translator != nil {
+		doc.SetLang(strings.ToLower(b.translator.lang))
+	}
+	manifest := &bookManifest{Source: book.meta.SourceURL}
 
 	if book.meta.CoverURL != "" {
-		coverImage, err := doc.AddImage(book.meta.CoverURL, "cover")
+		coverImage, err := b.addCover(book.meta)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		coverCSS, err := doc.AddCSS("assets/cover.css", "")
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		doc.SetCover(coverImage, coverCSS)
 		doc.SetDescription(book.meta.Description)
 	}
 
-	bar := progressbar.Default(int64(len(book.toc)))
-	defer bar.Finish()
-	for _, tocEntry := range book.toc {
-		bar.Add(1)
-		chapter := book.chapters[tocEntry.URL]
-		_, err := doc.AddSection(chapter.Content, chapter.Title, "", "")
+	if b.about {
+		if _, err := doc.AddSection(aboutSection(book), "About this book", "about.xhtml", ""); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if len(b.added) > 0 || len(b.changed) > 0 {
+		if _, err := doc.AddSection(whatsNewSection(book, b.added, b.changed), "What's new", "whats-new.xhtml", ""); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// The stylesheet of stat blocks and polls is added with the first
+	// chapter that has one.
+	var blocksCSS string
+	prog.start(phaseAssemble, len(book.toc))
+	for index, tocEntry := range book.toc {
+		prog.step(phaseAssemble)
+		chapter, ok := book.chapters.get(tocEntry.URL)
+		if !ok {
+			chapter = missingChapter(tocEntry, book.failure(tocEntry.URL))
+		}
+		var hash string
+		if ok {
+			hash = chapterHash(chapter.Content)
+		}
+		if b.cleanTitle != nil {
+			title := b.cleanTitle(chapter.Title)
+			chapter.Content = retitleContent(chapter.Content, chapter.Title, title)
+			chapter.Title = title
+		}
+		if previousHash, carried := b.carried[chapterKey(tocEntry.URL)]; carried {
+			if previousHash != "" {
+				hash = previousHash
+			}
+		} else if ok && b.translator != nil {
+			prog.detail("Translate " + chapter.Title)
+			translated, err := b.translator.chapter(chapter)
+			if err != nil {
+				return nil, nil, err
+			}
+			chapter = translated
+		}
+		content, err := b.images.embed(linkGlossaryTerms(repairHTML(chapter.Content), b.glossary, glossarySectionFile), tocEntry.URL)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
+		}
+		var css string
+		if strings.Contains(content, `class="`+statBlockClass+`"`) || strings.Contains(content, `class="`+pollClass+`"`) {
+			if blocksCSS == "" {
+				if blocksCSS, err = doc.AddCSS("assets/blocks.css", ""); err != nil {
+					return nil, nil, err
+				}
+			}
+			css = blocksCSS
+		}
+		section, err := doc.AddSection(content, chapter.Title, chapterSection(index), css)
+		if err != nil {
+			return nil, nil, err
+		}
+		entry := manifestChapter{
+			URL:     tocEntry.URL,
+			Title:   chapter.Title,
+			Date:    tocEntry.Date,
+			File:    section,
+			Missing: !ok,
+		}
+		entry.Hash = hash
+		manifest.Chapters = append(manifest.Chapters, entry)
+	}
+
+	if b.comments != nil && b.comments.hasComments(book) {
+		if _, err := doc.AddSection(commentsSection(book, b.comments), "Comments", "comments.xhtml", ""); err != nil {
+			return nil, nil, err
 		}
 	}
 
-	return doc, nil
+	if len(b.glossary) > 0 {
+		if _, err := doc.AddSection(glossarySection(b.glossary), "Glossary", glossarySectionFile, ""); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	colophon := fmt.Sprintf("<h2>Colophon</h2>\n<p>Scraped from <a href=\"%s\">%s</a> on %s with %s.</p>",
+		html.EscapeString(book.meta.SourceURL), html.EscapeString(book.meta.SourceURL), timestamp.Format("2006-01-02"), html.EscapeString(versionString()))
+	if _, err := doc.AddSection(colophon, "Colophon", "colophon.xhtml", ""); err != nil {
+		return nil, nil, err
+	}
+
+	prog.start(phaseWrite, -1)
+	return doc, manifest, nil
 }
 
-func main() {
-	rawLogger, _ := zap.NewDevelopment()
-	defer rawLogger.Sync()
-	logger = rawLogger.Sugar()
+// imageSources maps the path of every image embedded from the web back to
+// its URL.
+func (b *epubBuilder) imageSources() map[string]string {
+	sources := make(map[string]string)
+	for url, path := range b.images.embedded {
+		sources[path] = url
+	}
+	return sources
+}
 
+func main() {
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s <URL>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s [-input-file FILE] <URL>...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s update <EPUB>...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s [-watch-interval DURATION] [-once] watch <EPUB>...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s cache stats | cache clear [HOST] | cache prune -older-than AGE\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s -library DIR serve [-addr ADDR]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s search [-limit N] [-query] TEXT...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s stats [-json] <EPUB>...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s doctor [SITE]...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s dev repl <URL>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s bot [-discord-addr ADDR] [-download-url PREFIX]\n", os.Args[0])
 		flag.PrintDefaults()
 	}
-	cpuprofile := flag.String("cpuprofile", "", "write cpu profile to `filename`")
+	inputFile := flag.String("input-file", "", "read story URLs, one per line with optional per-story flags, from `file` (- for stdin)")
+	showVersion := flag.Bool("version", false, "print version information and exit")
+	var prof profiling
+	flag.StringVar(&prof.CPUProfile, "cpuprofile", "", "write cpu profile to `filename`")
+	flag.StringVar(&prof.MemProfile, "memprofile", "", "write a heap profile to `filename` when done")
+	flag.StringVar(&prof.Trace, "trace", "", "write an execution trace to `filename`")
+	flag.StringVar(&prof.PprofAddr, "pprof-addr", "", "serve live pprof profiles on `address`, such as localhost:6060")
+	var output string
+	flag.StringVar(&output, "output", defaultOutputTemplate, "write the epub to `path`, a template over .Title, .Author, .ChapterCount and .Host")
+	flag.StringVar(&output, "o", defaultOutputTemplate, "shorthand for -output")
+	library := flag.String("library", "", "file books as `dir`/Author/Title/Title.epub and keep an index of them")
+	calibreOPF := flag.Bool("calibre-opf", false, "write a Calibre metadata.opf next to each epub")
+	calibreLibrary := flag.String("calibredb", "", "add each epub to the Calibre `library`, a directory or a content server url, with calibredb")
+	watchInterval := flag.Duration("watch-interval", time.Hour, "with watch, poll each book's feed every `duration`")
+	watchOnce := flag.Bool("once", false, "with watch, poll each feed once and exit instead of polling forever")
+	openLibrary := flag.Bool("openlibrary", false, "look each book up in Open Library by title, taking its canonical author, publication year and ISBN")
+	kepub := flag.Bool("kepub", false, "also write each book as a kepub for Kobo readers, and upload and serve that instead of the epub")
+	koboServe := flag.String("kobo-serve", "", "serve finished books on `address`, such as :8000, for a Kobo's browser to download")
+	koboServeFor := flag.Duration("kobo-serve-for", 10*time.Minute, "with -kobo-serve, keep serving books not yet downloaded for at most `duration`")
+	var uploadURLs stringsFlag
+	flag.Var(&uploadURLs, "upload", "upload each epub to `target`: webdav[s]://host/dir/, calibreweb[s]://user@host/, dropbox:/dir, gdrive:[folder id] or s3://bucket/prefix (repeatable)")
+	var emailTo stringsFlag
+	flag.Var(&emailTo, "email", "email each epub to `address`, through the SMTP server in $SMTP_URL (repeatable)")
+	emailLink := flag.String("email-link", "", "email a link to the epub under `prefix`, where the output directory is served, instead of attaching it")
+	archive := flag.Bool("archive", false, "submit every chapter fetched to the Wayback Machine, with an archive.org account's keys in $WAYBACK_ACCESS_KEY and $WAYBACK_SECRET_KEY if set")
+	indexSearch := flag.Bool("search-index", true, "index the text of each book written, for the search command")
+	about := flag.Bool("about", false, "add an \"About this book\" page after the cover with the book's length, reading time and publication dates")
+	whatsNew := flag.Bool("whats-new", false, "with update, add a \"What's new\" page after the cover listing the chapters the update added, linked")
+	glossary := flag.Bool("glossary", false, "append the glossary or character list the site keeps for a story, such as ScribbleHub's, linking terms from the chapters")
+	glossaryURL := flag.String("glossary-url", "", "append the glossary at `url`, such as a fan wiki's list of terms, linking terms from the chapters")
+	noFilters := flag.Bool("no-filters", false, "keep the junk the built-in filters take out of chapters, such as Patreon plugs, donation footers and notices to read the story elsewhere")
+	cleanTitles := flag.String("clean-titles", "", "clean up chapter titles by the comma separated `transforms`: tags to drop notes like [TL], story to drop the story's title, numbering to drop leading chapter numbers, or all")
+	comments := flag.String("comments", "", "append the comments of each chapter fetched, where the site has them: `which`, top for readers' top-level comments or author for the author's")
+	translateTo := flag.String("translate", "", "machine translate chapters into `language`, such as en, keeping original titles in the table of contents")
+	translateBackend := flag.String("translate-backend", "deepl", "translate with `service`: deepl, google or libretranslate, with its API key in $TRANSLATE_API_KEY")
+	translateURL := flag.String("translate-url", "", "with -translate-backend libretranslate, use the server at `url` (default "+defaultLibreTranslateURL+")")
+	skipPolls := flag.Bool("skip-polls", false, "leave the polls in chapters out instead of listing their options")
+	rulesFile := flag.String("rules", "", "rewrite chapters by the regular expression replacements in `file`, one a line as KIND PATTERN REPLACEMENT [HOST]..., KIND being text or html")
+	termsFile := flag.String("terms", "", "replace terms in chapters and their titles by the dictionary in `file`, one a line as TERM REPLACEMENT, matching whole words and keeping their case")
+	keepHTML := flag.Bool("keep-html", false, "also save each chapter's extracted html in a directory next to the epub")
+	strict := flag.Bool("strict", false, "fail a book instead of writing it when its chapters don't match its table of contents")
+	force := flag.Bool("force", false, "overwrite an existing epub")
+	unique := flag.Bool("unique", false, "write to a new name instead of overwriting an existing epub")
+	listChapters := flag.Bool("list-chapters", false, "print the table of contents without downloading chapters")
+	dryRun := flag.Bool("dry-run", false, "fetch only metadata and the table of contents, report what would be written and exit")
+	fromURL := flag.String("from-url", "", "start at the chapter at `url` instead of the first one")
+	excludeTitles := regexpsFlag{}
+	flag.Var(&excludeTitles, "exclude-title", "leave out chapters whose titles match `regexp` (repeatable)")
+	concurrency := flag.Int("concurrency", 5, "fetch up to `n` pages from a site at once")
+	parallelBooks := flag.Int("jobs", 3, "scrape up to `n` books at once")
+	maxRequests := flag.Int("max-requests", 16, "keep up to `n` requests in flight across all books and hosts (0 for no limit)")
+	flag.Int64Var(&chapterMemoryLimit, "chapter-memory", chapterMemoryLimit, "keep up to `bytes` of chapter content in memory, spilling the rest to temporary files")
+	flag.IntVar(&fetchRetries, "retries", fetchRetries, "fetch a chapter up to `n` more times, switching to the alternate transport, when it fails or looks wrong")
+	flag.IntVar(&chapterBacklog, "chapter-backlog", chapterBacklog, "pause fetching while `n` fetched chapters wait to be stored")
+	imageConcurrency := flag.Int("image-concurrency", 4, "download up to `n` images at once")
+	var timestamp timestampFlag
+	flag.Var(&timestamp, "timestamp", "date the epub `time`, RFC 3339 or Unix seconds, instead of its newest chapter, for reproducible output")
+	maxChapters := flag.Int("max-chapters", 0, "fetch at most `n` chapters (0 for no limit)")
+	target := flag.String("target", "live", "scrape `sites`: live, or mock for the built-in mock site, which needs no network, and its stories if no URLs are given")
 	transport := flag.String("transport", "default", "request transport `backend` [default|curl]")
+	httpVersion := flag.String("http-version", "auto", "protocol `version` used by the default transport [auto|1.1|2|3]")
+	prewarmConns := flag.Bool("prewarm", false, "open connections to the site and its image CDN before the first request")
+	dohURL := flag.String("doh", "", "resolve host names with the DNS-over-HTTPS server at `url` (default transport only)")
+	refresh := flag.Bool("refresh", false, "ignore cached responses and fetch everything again")
+	refreshTOC := flag.Bool("refresh-toc", false, "revalidate only listing pages, serving chapters from the cache")
+	recheck := flag.Bool("recheck", false, "with update, fetch every chapter again and replace those whose text changed upstream")
+	resume := flag.Bool("resume", false, "continue an interrupted scrape without fetching its chapters again")
+	cacheDir := flag.String("cache-dir", defaultCacheDir(), "keep cached responses and resume state in `dir`")
+	cacheMaxSize := sizeFlag(1 << 30)
+	flag.Var(&cacheMaxSize, "cache-max-size", "evict the least recently used responses once the cache is larger than `size`, such as 500MB (0 for no limit)")
+	cacheTTL := flag.Duration("cache-ttl", 0, "serve cached responses younger than `duration` without revalidating (0 always revalidates, fetching again pages the site gave no ETag or Last-Modified for)")
+	headers := headerFlag{}
+	flag.Var(headers, "header", "add `'Key: Value'` to every request (repeatable)")
+	flag.StringVar(&userAgent, "user-agent", "", "send `string` as the user agent instead of a random one")
+	extraAssetDomains := stringsFlag{}
+	flag.Var(&extraAssetDomains, "asset-domain", "also fetch images and css from `domain` and its subdomains (repeatable)")
+	ignoreRobots := flag.Bool("ignore-robots", false, "do not obey the site's robots.txt rules and Crawl-delay")
+	cookiesFromBrowser := flag.String("cookies-from-browser", "", "send the cookies `browser` [firefox|chrome|chromium] has stored for the site")
+	offline := flag.Bool("offline", false, "build the epub from cached responses only, without touching the network")
+	record := flag.String("record", "", "record all http traffic of the scrape to HAR `file`")
+	sanitize := flag.Bool("sanitize", false, "with -record, leave cookies, credentials and timings out of the recording, for committing it as a test cassette")
+	debugDumpDir := flag.String("debug-dump", "", "save every response body, the html extracted of each chapter and each book as json under `dir`")
+	replay := flag.String("replay", "", "answer all requests from a HAR `file` recorded with -record")
+	var logOpts logOptions
+	flag.BoolVar(&logOpts.Verbose, "v", false, "log debugging details such as every request")
+	flag.BoolVar(&logOpts.Quiet, "q", false, "log only warnings and errors")
+	flag.StringVar(&logOpts.Format, "log-format", "console", "structured log `format` [console|json]")
+	flag.StringVar(&logOpts.File, "log-file", "", "append structured logs to `file`")
+	flag.BoolVar(&logOpts.Debug, "debug", false, "write structured logs to stderr instead of status lines")
+	report := flag.Bool("report", false, "print every selector used with how many elements it matched, and the bytes and text extracted of every chapter, when done")
+	missingReportFile := flag.String("missing-report", "", "write the chapters that couldn't be fetched to `file` as json")
+	notifyDesktop := flag.Bool("notify", false, "show a desktop notification when each book is written or fails")
+	notifyURL := flag.String("notify-url", "", "also push notifications, including each book starting, to `url`: an ntfy topic, a Gotify server as gotify[s]://TOKEN@host/, or a webhook taking text")
+	webhookURL := flag.String("webhook", "", "POST a json report of each finished or failed book to `url`")
 	flag.Parse()
-	if flag.NArg() < 1 {
+	if *showVersion {
+		fmt.Println(versionString())
+		return
+	}
+
+	rawLogger, err := newLogger(logOpts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	defer rawLogger.Sync()
+	logger = rawLogger.Sugar()
+
+	if flag.Arg(0) == "cache" {
+		if err := runCacheCommand(*cacheDir, flag.Args()[1:]); err != nil {
+			logger.Fatal(err)
+		}
+		return
+	}
+	if flag.Arg(0) == "search" {
+		if err := runSearchCommand(*cacheDir, flag.Args()[1:]); err != nil {
+			logger.Fatal(err)
+		}
+		return
+	}
+	if flag.Arg(0) == "stats" {
+		if err := runStatsCommand(flag.Args()[1:]); err != nil {
+			logger.Fatal(err)
+		}
+		return
+	}
+	if flag.Arg(0) == "serve" {
+		if err := runServeCommand(*library, flag.Args()[1:]); err != nil {
+			logger.Fatal(err)
+		}
+		return
+	}
+
+	defaults := bookJob{
+		Output:      output,
+		GlossaryURL: *glossaryURL,
+		Options:     ScrapeOptions{FromURL: *fromURL, TOCOnly: *listChapters || *dryRun, ExcludeTitles: excludeTitles, MaxChapters: *maxChapters, SkipPolls: *skipPolls},
+	}
+	var jobs []bookJob
+	if flag.Arg(0) == "update" || flag.Arg(0) == "watch" {
+		for _, filename := range flag.Args()[1:] {
+			manifest, err := readManifest(filename)
+			if err != nil {
+				logger.Fatal(err)
+			}
+			job := defaults
+			job.URL = manifest.Source
+			job.Update = filename
+			jobs = append(jobs, job)
+		}
+	} else if flag.Arg(0) != "bot" && flag.Arg(0) != "doctor" && flag.Arg(0) != "dev" {
+		for _, baseURL := range flag.Args() {
+			job := defaults
+			job.URL = baseURL
+			jobs = append(jobs, job)
+		}
+	}
+	if *inputFile != "" {
+		fileJobs, err := readInputFile(*inputFile, defaults)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		jobs = append(jobs, fileJobs...)
+	}
+	if *target != "live" && *target != "mock" {
+		logger.Fatal("Target must be one of live or mock")
+	}
+	if *target == "mock" {
+		// Mock pages are kept apart from those of the real sites, whose
+		// URLs they share.
+		*cacheDir = filepath.Join(os.TempDir(), "ebook-scraper-mock")
+	}
+	if *target == "mock" && len(jobs) == 0 && flag.NArg() == 0 {
+		for _, story := range mockStories {
+			job := defaults
+			job.URL = story
+			jobs = append(jobs, job)
+		}
+	}
+	if len(jobs) < 1 && flag.Arg(0) != "bot" && flag.Arg(0) != "doctor" && flag.Arg(0) != "dev" {
 		flag.Usage()
 		os.Exit(1)
 	}
-	baseURL := flag.Arg(0)
 
-	if *cpuprofile != "" {
-		logger.Infow("Begin CPU profile", "filename", cpuprofile)
-		f, err := os.Create(*cpuprofile)
+	if *comments != "" && *comments != commentsTop && *comments != commentsAuthor {
+		logger.Fatal("Comments must be one of top or author")
+	}
+	titleCleaners, err := parseTitleCleaners(*cleanTitles)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	var rules []rewriteRule
+	if *rulesFile != "" {
+		var err error
+		rules, err = readRules(*rulesFile)
+		if err != nil {
+			logger.Fatal(err)
+		}
+	}
+	var terms *termDictionary
+	if *termsFile != "" {
+		var err error
+		terms, err = readTerms(*termsFile)
 		if err != nil {
 			logger.Fatal(err)
 		}
-		pprof.StartCPUProfile(f)
-		defer pprof.StopCPUProfile()
+	}
+
+	if err := prof.start(); err != nil {
+		logger.Fatal(err)
 	}
 	if *transport != "default" && *transport != "curl" {
 		logger.Fatal("Transport must be one of default or curl")
 	}
-
-	handlers := map[string]Scraper{
-		"www.royalroad.com":   scrapeRoyalRoad,
-		"phrack.org":          scrapePhrack,
-		"www.scribblehub.com": scrapeScribblehub,
+	if *transport == "curl" && (*httpVersion != "auto" || *dohURL != "") {
+		logger.Fatal("HTTP version and DoH resolver can only be used with the default transport")
 	}
-	parsedURL, err := url.Parse(baseURL)
-	if err != nil {
-		logger.Fatal(err)
+	if *library != "" && output != defaultOutputTemplate {
+		logger.Fatal("-library and -output cannot be used together")
+	}
+	if *cookiesFromBrowser != "" && userAgent == "" {
+		logger.Warn("Cookies from the browser, such as Cloudflare's cf_clearance, are only accepted along with its user agent; pass that with -user-agent")
+	}
+	if *concurrency < 1 || *imageConcurrency < 1 || *parallelBooks < 1 || chapterBacklog < 1 {
+		logger.Fatal("-concurrency, -image-concurrency, -jobs and -chapter-backlog must be at least 1")
+	}
+	var uploads []uploadTarget
+	for _, raw := range uploadURLs {
+		target, err := parseUploadTarget(raw)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		uploads = append(uploads, target)
+	}
+	var emailer *mailer
+	if len(emailTo) > 0 {
+		var err error
+		if emailer, err = newMailer(emailTo, *emailLink); err != nil {
+			logger.Fatal(err)
+		}
+	}
+	var translation *chapterTranslator
+	if *translateTo != "" {
+		var err error
+		if translation, err = newChapterTranslator(*translateBackend, *translateURL, *translateTo, filepath.Join(*cacheDir, "translations")); err != nil {
+			logger.Fatal(err)
+		}
+	}
+	if fetchRetries < 0 {
+		logger.Fatal("-retries cannot be negative")
+	}
+	if *force && *unique {
+		logger.Fatal("-force and -unique cannot be used together")
 	}
-	handler, ok := handlers[parsedURL.Host]
-	if !ok {
-		logger.Fatalw("No handler for host", "host", parsedURL.Host)
+	if *offline && (*refresh || *refreshTOC) {
+		logger.Fatal("Offline mode cannot be combined with refresh flags")
+	}
+	if *record != "" && *replay != "" {
+		logger.Fatal("Record and replay cannot be combined")
+	}
+	if *fromURL != "" && len(jobs) > 1 {
+		logger.Fatal("A starting chapter can only be given for a single URL")
+	}
+
+	var hosts []string
+	for _, job := range jobs {
+		parsedURL, err := url.Parse(job.URL)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		if _, ok := handlers[parsedURL.Host]; !ok {
+			logger.Fatalw("No handler for host", "host", parsedURL.Host)
+		}
+		hosts = append(hosts, parsedURL.Host)
+	}
+	// A bot takes stories from any of the sites, as its users ask, and the
+	// doctor checks them all.
+	if flag.Arg(0) == "bot" || flag.Arg(0) == "doctor" {
+		for host := range handlers {
+			hosts = append(hosts, host)
+		}
 	}
 
+	curlPath, curlErr := findCurl()
+	if *transport == "curl" && curlErr != nil {
+		logger.Warnw("Use the default transport instead of curl", "error", curlErr)
+		*transport = "default"
+	}
+	logger.Debugw("Set transport backend", "transport", *transport)
+	var roundTripper http.RoundTripper = CurlTransport{Path: curlPath}
+	if *transport == "default" {
+		var resolver *DoHResolver
+		if *dohURL != "" {
+			resolver = NewDoHResolver(*dohURL)
+		}
+		var err error
+		roundTripper, err = newDefaultTransport(*httpVersion, resolver)
+		if err != nil {
+			logger.Fatal(err)
+		}
+	}
+	// Chapter pages that come back wrong are fetched again with the other
+	// backend, as long as a usable curl is there to be one of them.
+	alternate := curlErr == nil && *replay == "" && !*offline && *target == "live"
+	if alternate {
+		var alternateTransport http.RoundTripper = CurlTransport{Path: curlPath}
+		if *transport == "curl" {
+			alternateTransport, err = newDefaultTransport("auto", nil)
+			if err != nil {
+				logger.Fatal(err)
+			}
+		}
+		roundTripper = AlternateTransport{Transport: roundTripper, Alternate: alternateTransport}
+	}
+	if *target == "mock" {
+		logger.Infow("Scrape the mock site")
+		roundTripper = mockTransport{}
+	}
+	if *maxRequests > 0 {
+		roundTripper = NewLimitTransport(roundTripper, *maxRequests)
+	}
+	if userAgent != "" {
+		http.Header(headers).Set("User-Agent", userAgent)
+	}
+	cache := &CachingTransport{
+		Transport:  HeaderTransport{Transport: roundTripper, Header: http.Header(headers)},
+		Dir:        *cacheDir,
+		TTL:        *cacheTTL,
+		Refresh:    *refresh,
+		RefreshTOC: *refreshTOC,
+		Offline:    *offline,
+		MaxSize:    int64(cacheMaxSize),
+	}
+	var client http.RoundTripper = cache
+	var recorder *HARRecorder
+	if *record != "" {
+		recorder = &HARRecorder{Transport: cache, Sanitize: *sanitize}
+		client = recorder
+	}
+	if *replay != "" {
+		logger.Infow("Replay recorded session", "filename", *replay)
+		var err error
+		client, err = LoadHARReplayer(*replay)
+		if err != nil {
+			logger.Fatal(err)
+		}
+	}
+	var dump *debugDump
+	if *debugDumpDir != "" {
+		var err error
+		dump, err = newDebugDump(*debugDumpDir)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		defer dump.Close()
+		client = DumpTransport{Transport: client, Dump: dump}
+	}
+	// All books share one collector backend, and with it the rate limits.
 	baseCollector := colly.NewCollector(
-		colly.CacheDir(".cache"),
-		colly.AllowedDomains(parsedURL.Host),
+		colly.AllowedDomains(hosts...),
+		colly.UserAgent(versionUserAgent()),
 		func(col *colly.Collector) {
-			col.Limit(&colly.LimitRule{DomainGlob: "*", Parallelism: 5})
-			logger.Debugw("Set transport backend", "transport", transport)
-			if *transport == "curl" {
-				col.WithTransport(CurlTransport{})
-			}
+			col.WithTransport(client)
 		},
 	)
+	if !*ignoreRobots && !*offline && *replay == "" && *target == "live" {
+		baseCollector.IgnoreRobotsTxt = false
+	}
+	s := &session{
+		client:         client,
+		cache:          cache,
+		collector:      baseCollector,
+		limitedHosts:   mapset.NewSet[string](),
+		obeyRobots:     !baseCollector.IgnoreRobotsTxt,
+		cookieBrowser:  *cookiesFromBrowser,
+		assetDomains:   extraAssetDomains,
+		listChapters:   *listChapters,
+		dryRun:         *dryRun,
+		resume:         *resume,
+		showProgress:   !logOpts.Quiet && logOpts.statusLines() && (*parallelBooks == 1 || len(jobs) == 1),
+		force:          *force,
+		unique:         *unique,
+		library:        *library,
+		calibreOPF:     *calibreOPF,
+		calibreLibrary: *calibreLibrary,
+		uploads:        uploads,
+		openLibrary:    *openLibrary && *replay == "" && !*offline,
+		kepub:          *kepub,
+		about:          *about,
+		glossary:       *glossary,
+		filters:        !*noFilters,
+		rules:          rules,
+		cleanTitles:    titleCleaners,
+		terms:          terms,
+		comments:       *comments,
+		translator:     translation,
+		whatsNew:       *whatsNew,
+		mailer:         emailer,
+		keepHTML:       *keepHTML,
+		strict:         *strict,
+		report:         *report,
+		concurrency:    *concurrency,
+		imageWorkers:   *imageConcurrency,
+		reuseTOC:       *replay == "" && !*offline,
+		recheck:        *recheck,
+		prewarm:        *prewarmConns && *replay == "" && !*offline,
+		alternate:      alternate,
+		timestamp:      time.Time(timestamp),
+		dump:           dump,
+	}
+	if *notifyDesktop || *notifyURL != "" || *webhookURL != "" {
+		s.notifier = &notifier{Desktop: *notifyDesktop, URL: *notifyURL, Webhook: *webhookURL}
+	}
 
-	logger.Infow("Scrape html", "baseURL", baseURL)
-	scrapedBook, err := handler(baseCollector, baseURL)
-	if err != nil {
-		logger.Fatal(err)
+	if *indexSearch && !*dryRun && !*listChapters {
+		index, err := openSearchIndex(searchIndexFilename(*cacheDir))
+		if err != nil {
+			logger.Warnw("Books won't be indexed for search", "error", err)
+		} else {
+			defer index.Close()
+			s.search = index
+		}
 	}
-	logger.Infow("Assemble epub", "title", scrapedBook.meta.Title, "chapters", len(scrapedBook.toc))
-	doc, err := assembleEpub(scrapedBook)
-	if err != nil {
-		logger.Fatal(err)
+	if *archive && *replay == "" && !*offline {
+		s.archiver = newArchiver()
+	}
+	if *koboServe != "" {
+		kobo, err := startKoboServer(*koboServe)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		s.kobo = kobo
+	}
+
+	if flag.Arg(0) == "watch" {
+		s.watchBooks(jobs, *watchInterval, *watchOnce)
+		s.archiver.wait()
+		if s.kobo != nil {
+			s.kobo.wait(*koboServeFor)
+		}
+		return
+	}
+	if flag.Arg(0) == "dev" {
+		if err := runDevCommand(s.client, flag.Args()[1:], os.Stdin, os.Stdout); err != nil {
+			logger.Fatal(err)
+		}
+		return
+	}
+	if flag.Arg(0) == "doctor" {
+		cases := doctorCases
+		if *target == "mock" {
+			cases = mockDoctorCases()
+		}
+		if err := s.runDoctor(cases, flag.Args()[1:]); err != nil {
+			logger.Fatal(err)
+		}
+		return
+	}
+	if flag.Arg(0) == "bot" {
+		if err := s.runBotCommand(defaults, flag.Args()[1:]); err != nil {
+			logger.Fatal(err)
+		}
+		return
+	}
+
+	// Books share the collector's per-host limits and the -max-requests
+	// budget, however many are scraped at once.
+	var failed atomic.Int32
+	queue := make(chan bookJob)
+	var wg sync.WaitGroup
+	for i := 0; i < *parallelBooks && i < len(jobs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				if err := s.scrapeBook(job); err != nil {
+					logger.Errorw("Failed to scrape book", "baseURL", job.URL, "error", err)
+					s.notifier.forJob(job).bookFailed(job.URL, err)
+					failed.Add(1)
+				}
+			}
+		}()
+	}
+	for _, job := range jobs {
+		queue <- job
+	}
+	close(queue)
+	wg.Wait()
+	prof.stop()
+	if recorder != nil {
+		logger.Infow("Save recorded session", "filename", *record)
+		if err := recorder.Save(*record); err != nil {
+			logger.Fatal(err)
+		}
+	}
+	reportSelectorHealth()
+	if *report {
+		printReport(os.Stdout, s.extractions)
+	}
+	s.archiver.wait()
+	if s.kobo != nil {
+		s.kobo.wait(*koboServeFor)
+	}
+	if len(s.missing) > 0 {
+		printMissingReport(os.Stderr, s.missing)
+	}
+	if *missingReportFile != "" {
+		if err := writeMissingReport(*missingReportFile, s.missing); err != nil {
+			logger.Fatal(err)
+		}
+	}
+	if failed.Load() > 0 {
+		logger.Fatalw("Some books failed", "failed", failed.Load(), "total", len(jobs))
 	}
-	filename := strings.ToLower(strings.ReplaceAll(doc.Title(), " ", "-")) + ".epub"
-	logger.Infow("Write to file", "filename", filename)
-	doc.Write(filename)
 	logger.Infow("All done")
 }
 
-func scrapeRoyalRoad(baseCollector *colly.Collector, baseURL string) (ScrapedBook, error) {
+func printTOC(w io.Writer, toc []TOCEntry) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for index, entry := range toc {
+		date := "-"
+		if !entry.Date.IsZero() {
+			date = entry.Date.Format("2006-01-02")
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", index+1, entry.Title, date, entry.URL)
+	}
+	tw.Flush()
+}
+
+var royalRoadSelectors = struct {
+	cover, title, author, description    *siteSelector
+	chapterRow, chapterLink, chapterDate *siteSelector
+	chapterTitle, chapterContent         *siteSelector
+	comment, commentAuthor, commentDate  *siteSelector
+	commentBody                          *siteSelector
+}{
+	cover:          newSelector("royalroad", "cover", `.fic-header img[data-type="cover"]`),
+	title:          keySelector("royalroad", "title", ".fic-title h1"),
+	author:         newSelector("royalroad", "author", ".fic-title h4 a"),
+	description:    newSelector("royalroad", "description", ".description .hidden-content"),
+	chapterRow:     newSelector("royalroad", "chapterRow", "tbody tr"),
+	chapterLink:    newSelector("royalroad", "chapterLink", "td:nth-child(1) a"),
+	chapterDate:    newSelector("royalroad", "chapterDate", "time"),
+	chapterTitle:   newSelector("royalroad", "chapterTitle", ".fic-header h1"),
+	chapterContent: keySelector("royalroad", "chapterContent", ".chapter-content"),
+	comment:        newSelector("royalroad", "comment", ".comment"),
+	commentAuthor:  newSelector("royalroad", "commentAuthor", ".media-heading .name"),
+	commentDate:    newSelector("royalroad", "commentDate", ".media-heading time"),
+	commentBody:    newSelector("royalroad", "commentBody", ".media-content"),
+}
+
+func scrapeRoyalRoad(baseCollector *colly.Collector, baseURL string, opts ScrapeOptions) (ScrapedBook, error) {
 	var meta Metadata
-	var toc []TOCEntry
-	var chapters = make(map[string]Chapter)
+	chapters := newChapterStore()
 
 	mainCollector := baseCollector.Clone()
+	// Chapters are fetched concurrently, as many at once as the host's limit
+	// rule allows. Their order comes from the table of contents, not from
+	// when they arrive.
 	chapterCollector := mainCollector.Clone()
+	chapterCollector.Async = true
 
-	setupCommonHandlers(mainCollector)
-	setupCommonHandlers(chapterCollector)
+	setupCommonHandlers(mainCollector, opts)
+	setupCommonHandlers(chapterCollector, opts)
+	mainCollector.OnRequest(markTOCRequest)
 
 	mainCollector.OnHTML("html", func(e *colly.HTMLElement) {
-		coverURL := e.Request.AbsoluteURL(e.ChildAttr(".fic-header img[data-type=\"cover\"]", "src"))
+		sel := &royalRoadSelectors
+		coverURL := e.Request.AbsoluteURL(childAttr(e, sel.cover, "src"))
 		if strings.Contains(coverURL, "/nocover") {
 			coverURL = ""
 		}
 		meta = Metadata{
-			Title:       e.ChildText(".fic-title h1"),
-			Author:      e.ChildText(".fic-title h4 a"),
+			Title:       childText(e, sel.title),
+			Author:      childText(e, sel.author),
 			CoverURL:    strings.ReplaceAll(coverURL, "covers-full", "covers-large"),
-			Description: childHTML(e, ".description .hidden-content"),
+			Description: childHTML(e, sel.description),
 		}
 	})
 
+	// The chapter table only shows part of the list on fictions whose table
+	// paginates, so the full list the page embeds for its own scripts is
+	// preferred.
+	var tableEntries, scriptEntries []TOCEntry
 	mainCollector.OnHTML("#chapters", func(e *colly.HTMLElement) {
-		e.ForEach("tr td:nth-child(1) a", func(index int, anchor *colly.HTMLElement) {
-			chapterURL := e.Request.AbsoluteURL(anchor.Attr("href"))
-			toc = append(toc, TOCEntry{URL: chapterURL})
-			chapterCollector.Visit(chapterURL)
+		sel := &royalRoadSelectors
+		forEachChild(e, sel.chapterRow, func(index int, row *colly.HTMLElement) {
+			tableEntries = append(tableEntries, TOCEntry{
+				URL:   e.Request.AbsoluteURL(childAttr(row, sel.chapterLink, "href")),
+				Title: childText(row, sel.chapterLink),
+				Date:  parseTimeElement(row, sel.chapterDate),
+			})
 		})
 	})
-
-	chapterCollector.OnHTML("html", func(e *colly.HTMLElement) {
-		chapterURL := e.Request.URL.String()
-		chapterTitle := e.ChildText(".fic-header h1")
-		chapterContent := "<h2>" + chapterTitle + "</h2>" + childHTML(e, ".chapter-content")
-		chapters[chapterURL] = Chapter{
-			Title:   chapterTitle,
-			Content: chapterContent,
+	mainCollector.OnHTML("script", func(e *colly.HTMLElement) {
+		if scriptEntries != nil {
+			return
 		}
+		entries, err := royalRoadScriptChapters(e)
+		if err != nil {
+			logger.Warnw("Failed to read chapter list from page script", "url", e.Request.URL, "error", err)
+		}
+		scriptEntries = entries
 	})
 
 	err := mainCollector.Visit(baseURL)
 	if err != nil {
 		return ScrapedBook{}, err
 	}
-	return ScrapedBook{meta, toc, chapters}, nil
+	listed := scriptEntries
+	if listed == nil {
+		logger.Debugw("Read chapter list from the table", "url", baseURL)
+		listed = tableEntries
+	}
+	toc, pending, err := opts.selectChapters(listed)
+	if err != nil {
+		return ScrapedBook{}, err
+	}
+
+	queue := newChapterQueue(opts, chapters)
+	chapterCollector.OnHTML("html", func(e *colly.HTMLElement) {
+		sel := &royalRoadSelectors
+		if !opts.checkChapter(e, sel.chapterContent) {
+			return
+		}
+		chapterTitle := childText(e, sel.chapterTitle)
+		if opts.Comments != "" && opts.OnComments != nil {
+			opts.OnComments(requestedURL(e.Request), royalRoadComments(e, opts.Comments, meta.Author))
+		}
+		queue.add(requestedURL(e.Request), Chapter{
+			Title:   chapterTitle,
+			Content: renderBlocks(renderContent(e, chapterTitle, sel.chapterContent, ""), opts.SkipPolls),
+		})
+	})
+	opts.queued(len(pending))
+	for _, chapterURL := range pending {
+		chapterCollector.Visit(chapterURL)
+	}
+	chapterCollector.Wait()
+	queue.Close()
+	return ScrapedBook{meta: meta, toc: toc, chapters: chapters}, nil
+}
+
+// royalRoadChapter is a chapter as listed in the window.chapters array of a
+// fiction page.
+type royalRoadChapter struct {
+	Title   string    `json:"title"`
+	URL     string    `json:"url"`
+	Date    time.Time `json:"date"`
+	Order   int       `json:"order"`
+	Visible int       `json:"visible"`
 }
 
-func scrapePhrack(baseCollector *colly.Collector, baseURL string) (ScrapedBook, error) {
+const royalRoadChaptersVar = "window.chapters ="
+
+// royalRoadScriptChapters reads the chapter list a fiction page assigns to
+// window.chapters in the script e, in order and without the chapters hidden
+// from readers. It returns nil if the script doesn't assign it.
+func royalRoadScriptChapters(e *colly.HTMLElement) ([]TOCEntry, error) {
+	script := e.Text
+	start := strings.Index(script, royalRoadChaptersVar)
+	if start < 0 {
+		return nil, nil
+	}
+	// The decoder stops at the end of the array, before the rest of the
+	// script.
+	var chapters []royalRoadChapter
+	decoder := json.NewDecoder(strings.NewReader(script[start+len(royalRoadChaptersVar):]))
+	if err := decoder.Decode(&chapters); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(chapters, func(i, j int) bool { return chapters[i].Order < chapters[j].Order })
+	entries := []TOCEntry{}
+	for _, chapter := range chapters {
+		if chapter.Visible == 0 {
+			continue
+		}
+		entries = append(entries, TOCEntry{
+			URL:   e.Request.AbsoluteURL(chapter.URL),
+			Title: strings.TrimSpace(chapter.Title),
+			Date:  chapter.Date,
+		})
+	}
+	return entries, nil
+}
+
+var phrackSelectors = struct {
+	title, content *siteSelector
+}{
+	title:   newSelector("phrack", "title", ".p-title"),
+	content: keySelector("phrack", "content", "pre"),
+}
+
+func scrapePhrack(baseCollector *colly.Collector, baseURL string, opts ScrapeOptions) (ScrapedBook, error) {
 	meta := Metadata{
 		Title: "Phrack Magazine", CoverURL: "http://phrack.org/images/phrack-logo.jpg",
 	}
 	var toc []TOCEntry
 	tocSet := mapset.NewSet[string]()
-	var chapters = make(map[string]Chapter)
+	chapters := newChapterStore()
 
-	setupCommonHandlers(baseCollector)
+	setupCommonHandlers(baseCollector, opts)
+	baseCollector.OnRequest(func(r *colly.Request) {
+		if r.URL.String() == baseURL {
+			markTOCRequest(r)
+		}
+	})
+	// Every article repeats the issue's table of contents, so articles before
+	// FromURL or excluded by title are remembered in order not to pick them
+	// up again later.
+	skipping := opts.FromURL != ""
+	skipped := mapset.NewSet[string]()
+	known := opts.knownKeys()
+	// Articles are visited while the page linking them is still being
+	// parsed, before any of them is stored, so the cap is kept on the
+	// articles asked for, the issue's first page among them.
+	requested := mapset.NewSet[string](chapterKey(baseURL))
+	visit := func(childURL string) {
+		if opts.capped(requested.Cardinality()) || !requested.Add(chapterKey(childURL)) {
+			return
+		}
+		baseCollector.Visit(childURL)
+	}
 	baseCollector.OnHTML(".tissue a", func(e *colly.HTMLElement) {
 		childURL := e.Request.AbsoluteURL(e.Attr("href"))
-		if !tocSet.Contains(childURL) {
-			toc = append(toc, TOCEntry{URL: childURL})
-			tocSet.Add(childURL)
+		key := chapterKey(childURL)
+		if skipping && key != chapterKey(opts.FromURL) {
+			skipped.Add(key)
+		}
+		if skipped.Contains(key) {
+			return
+		}
+		skipping = false
+		if opts.excluded(strings.TrimSpace(e.Text)) {
+			skipped.Add(key)
+			return
+		}
+		entry := TOCEntry{URL: childURL, Title: strings.TrimSpace(e.Text)}
+		if tocSet.Add(key) {
+			toc = append(toc, entry)
+		}
+		if !opts.TOCOnly && !known.Contains(key) && !opts.has(entry) {
+			visit(childURL)
 		}
-		baseCollector.Visit(childURL)
 	})
 	baseCollector.OnHTML(".details a", func(e *colly.HTMLElement) {
-		childURL := e.Request.AbsoluteURL(e.Attr("href"))
-		baseCollector.Visit(childURL)
+		if !opts.TOCOnly {
+			visit(e.Request.AbsoluteURL(e.Attr("href")))
+		}
 	})
 	baseCollector.OnHTML("body", func(e *colly.HTMLElement) {
-		chapterURL := e.Request.URL.String()
-		chapterTitle := e.ChildText(".p-title")
-		chapterContent := "<pre>" + childHTML(e, "pre") + "</pre>"
-		chapters[chapterURL] = Chapter{Title: chapterTitle, Content: chapterContent}
+		if !opts.checkChapter(e, phrackSelectors.content) {
+			return
+		}
+		chapterURL := requestedURL(e.Request)
+		chapterTitle := childText(e, phrackSelectors.title)
+		chapterContent := renderContent(e, "", phrackSelectors.content, "pre")
+		chapters.put(chapterURL, opts.fetched(chapterURL, Chapter{Title: chapterTitle, Content: chapterContent}))
 	})
 	err := baseCollector.Visit(baseURL)
 	if err != nil {
 		return ScrapedBook{}, err
 	}
-	return ScrapedBook{meta, toc, chapters}, nil
+	if skipping {
+		return ScrapedBook{}, fmt.Errorf("article %s not found in table of contents", opts.FromURL)
+	}
+	return ScrapedBook{meta: meta, toc: toc, chapters: chapters}, nil
+}
+
+var scribblehubSelectors = struct {
+	postID, title, author, cover, description *siteSelector
+	tocLink, tocDate                          *siteSelector
+	chapterTitle, chapterContent              *siteSelector
+}{
+	postID:         newSelector("scribblehub", "postID", "#mypostid"),
+	title:          keySelector("scribblehub", "title", ".fic_title"),
+	author:         newSelector("scribblehub", "author", ".auth_name_fic"),
+	cover:          newSelector("scribblehub", "cover", ".fic_image img"),
+	description:    newSelector("scribblehub", "description", ".wi_fic_desc"),
+	tocLink:        keySelector("scribblehub", "tocLink", "a.toc_a"),
+	tocDate:        newSelector("scribblehub", "tocDate", ".fic_date_pub"),
+	chapterTitle:   newSelector("scribblehub", "chapterTitle", ".chapter-title"),
+	chapterContent: keySelector("scribblehub", "chapterContent", ".chp_raw"),
 }
 
-func scrapeScribblehub(baseCollector *colly.Collector, baseURL string) (ScrapedBook, error) {
+// scribblehubTOCURL is the endpoint a series page loads the pages of its
+// chapter list from.
+const scribblehubTOCURL = "https://www.scribblehub.com/wp-admin/admin-ajax.php"
+
+var scribblehubSeriesID = regexp.MustCompile(`/series/(\d+)/`)
+
+func scrapeScribblehub(baseCollector *colly.Collector, baseURL string, opts ScrapeOptions) (ScrapedBook, error) {
 	var meta Metadata
-	var toc []TOCEntry
-	var chapters = make(map[string]Chapter)
+	var seriesID string
+	chapters := newChapterStore()
 
-	setupCommonHandlers(baseCollector)
-	baseCollector.OnHTML("body", func(e *colly.HTMLElement) {
-		firstChapterURL := e.ChildAttr(".read_buttons a:first-child", "href")
-		if firstChapterURL != "" {
-			meta = Metadata{
-				Title:       e.ChildText(".fic_title"),
-				Author:      e.ChildText(".auth_name_fic"),
-				CoverURL:    e.ChildAttr(".fic_image img", "src"),
-				Description: childHTML(e, ".wi_fic_desc"),
-			}
-			baseCollector.Visit(firstChapterURL)
-		}
-		chapterContent := childHTML(e, ".chp_raw")
-		if chapterContent != "" {
-			chapterURL := e.Request.URL.String()
-			toc = append(toc, TOCEntry{
-				URL: chapterURL,
-			})
-			chapters[chapterURL] = Chapter{
-				Title:   e.ChildText(".chapter-title"),
-				Content: chapterContent,
-			}
+	mainCollector := baseCollector.Clone()
+	// The chapter list is read page by page from the same endpoint the
+	// series page uses, rather than by walking the chapters' next links,
+	// which skips hidden chapters and ends the book at the first broken one.
+	tocCollector := mainCollector.Clone()
+	chapterCollector := mainCollector.Clone()
+	chapterCollector.Async = true
+
+	setupCommonHandlers(mainCollector, opts)
+	setupCommonHandlers(tocCollector, opts)
+	setupCommonHandlers(chapterCollector, opts)
+	mainCollector.OnRequest(markTOCRequest)
+	tocCollector.OnRequest(markTOCRequest)
+
+	mainCollector.OnHTML("body", func(e *colly.HTMLElement) {
+		sel := &scribblehubSelectors
+		meta = Metadata{
+			Title:       childText(e, sel.title),
+			Author:      childText(e, sel.author),
+			CoverURL:    childAttr(e, sel.cover, "src"),
+			Description: childHTML(e, sel.description),
 		}
-		nextChapterURL := e.ChildAttr(".btn-next", "href")
-		if nextChapterURL != "" {
-			baseCollector.Visit(nextChapterURL)
+		seriesID = childAttr(e, sel.postID, "value")
+	})
+
+	// Entries come newest first; their order attribute numbers them from
+	// the first chapter.
+	type listedChapter struct {
+		order int
+		entry TOCEntry
+	}
+	var listed []listedChapter
+	listedURLs := mapset.NewSet[string]()
+	tocCollector.OnHTML("li.toc_w", func(e *colly.HTMLElement) {
+		sel := &scribblehubSelectors
+		chapterURL := e.Request.AbsoluteURL(childAttr(e, sel.tocLink, "href"))
+		if chapterURL == "" || !listedURLs.Add(chapterKey(chapterURL)) {
+			return
 		}
+		order, _ := strconv.Atoi(e.Attr("order"))
+		listed = append(listed, listedChapter{order: order, entry: TOCEntry{
+			URL:   chapterURL,
+			Title: childText(e, sel.tocLink),
+			Date:  parseScribblehubDate(e, sel.tocDate),
+		}})
 	})
 
-	err := baseCollector.Visit(baseURL)
+	if err := mainCollector.Visit(baseURL); err != nil {
+		return ScrapedBook{}, err
+	}
+	if seriesID == "" {
+		match := scribblehubSeriesID.FindStringSubmatch(baseURL)
+		if match == nil {
+			return ScrapedBook{}, fmt.Errorf("no series id found for %s", baseURL)
+		}
+		seriesID = match[1]
+	}
+	// Past the last page the endpoint returns no entries, or repeats one.
+	for page := 1; ; page++ {
+		before := len(listed)
+		err := tocCollector.Post(scribblehubTOCURL, map[string]string{
+			"action":   "wi_getreleases_pagination",
+			"pagenum":  strconv.Itoa(page),
+			"mypostid": seriesID,
+		})
+		if err != nil {
+			return ScrapedBook{}, err
+		}
+		if len(listed) == before {
+			break
+		}
+	}
+	sort.SliceStable(listed, func(i, j int) bool { return listed[i].order < listed[j].order })
+	var entries []TOCEntry
+	for _, chapter := range listed {
+		entries = append(entries, chapter.entry)
+	}
+	toc, pending, err := opts.selectChapters(entries)
 	if err != nil {
 		return ScrapedBook{}, err
 	}
-	return ScrapedBook{meta, toc, chapters}, nil
+
+	queue := newChapterQueue(opts, chapters)
+	chapterCollector.OnHTML("body", func(e *colly.HTMLElement) {
+		sel := &scribblehubSelectors
+		if !opts.checkChapter(e, sel.chapterContent) {
+			return
+		}
+		queue.add(requestedURL(e.Request), Chapter{
+			Title:   childText(e, sel.chapterTitle),
+			Content: childHTML(e, sel.chapterContent),
+		})
+	})
+	opts.queued(len(pending))
+	for _, chapterURL := range pending {
+		chapterCollector.Visit(chapterURL)
+	}
+	chapterCollector.Wait()
+	queue.Close()
+	return ScrapedBook{meta: meta, toc: toc, chapters: chapters}, nil
 }
 
-func setupCommonHandlers(collector *colly.Collector) {
-	extensions.RandomUserAgent(collector)
+// parseScribblehubDate reads the date a chapter list entry was published,
+// which the site gives in full in the title of the element matched by
+// selector and often only relatively in its text.
+func parseScribblehubDate(e *colly.HTMLElement, selector *siteSelector) time.Time {
+	for _, value := range []string{childAttr(e, selector, "title"), childText(e, selector)} {
+		for _, layout := range []string{"Jan 2, 2006 03:04 PM", "Jan 2, 2006"} {
+			if t, err := time.Parse(layout, value); err == nil {
+				return t
+			}
+		}
+	}
+	return time.Time{}
+}
+
+func setupCommonHandlers(collector *colly.Collector, opts ScrapeOptions) {
+	switch {
+	case userAgent != "":
+		collector.UserAgent = userAgent
+	case !opts.KeepUserAgent:
+		extensions.RandomUserAgent(collector)
+	}
+	if opts.OnRequest != nil {
+		collector.OnRequest(opts.OnRequest)
+	}
 	collector.OnRequest(func(r *colly.Request) {
 		logger.Debugw("Visit", "method", r.Method, "url", r.URL, "headers", r.Headers)
+		if r.Ctx.Get("url") == "" {
+			r.Ctx.Put("url", r.URL.String())
+		}
 	})
 	collector.OnError(func(r *colly.Response, err error) {
 		logger.Warnw("Error", "status", r.StatusCode, "request", r.Request, "headers", r.Headers, "error", err)
+		// Listing pages aren't retried: their failure fails the scrape
+		// whatever a retry returns.
+		if retryable(r, err) && r.Ctx.Get("toc") == "" && opts.retry(r.Request, err, true) {
+			return
+		}
+		opts.failed(r.Request, err)
 	})
 	collector.OnResponse(func(r *colly.Response) {
 		logger.Debugw("Response", "url", r.Request.URL, "status", r.StatusCode)
+		decodeBody(r)
 	})
 }
 
-func childHTML(e *colly.HTMLElement, goquerySelector string) string {
-	text, err := e.DOM.Find(goquerySelector).Html()
-	if err != nil {
-		return ""
+// requestedURL is the URL r was first made for. Chapters are stored under
+// it, which is how the table of contents lists them, even when the site
+// redirects them elsewhere; the epub is assembled in the order of the table
+// of contents, however the chapters arrived.
+func requestedURL(r *colly.Request) string {
+	if url := r.Ctx.Get("url"); url != "" {
+		return url
+	}
+	return r.URL.String()
+}
+
+// retryable reports whether a failed request may succeed if made again: the
+// connection failed, or the server was overloaded or broken for a moment.
+func retryable(r *colly.Response, err error) bool {
+	if errors.Is(err, errNotCached) {
+		return false
 	}
-	return text
+	return r.StatusCode == 0 || r.StatusCode == http.StatusTooManyRequests || r.StatusCode >= 500
+}
+
+// parseTimeElement reads the first <time> element matched by selector, which
+// carries either a datetime or a unixtime attribute.
+func parseTimeElement(e *colly.HTMLElement, selector *siteSelector) time.Time {
+	if datetime := childAttr(e, selector, "datetime"); datetime != "" {
+		if t, err := time.Parse(time.RFC3339, datetime); err == nil {
+			return t
+		}
+	}
+	if unixtime, err := strconv.ParseInt(childAttr(e, selector, "unixtime"), 10, 64); err == nil {
+		return time.Unix(unixtime, 0)
+	}
+	return time.Time{}
+}
+
+func childHTML(e *colly.HTMLElement, selector *siteSelector) string {
+	return renderContent(e, "", selector, "")
 }
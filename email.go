@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// emailMaxAttachment is the largest book sent as an attachment. Most mail
+// servers refuse messages over 25MB, and base64 grows the book by a third.
+const emailMaxAttachment = 18 << 20
+
+// mailer emails finished books to readers that accept books by email, such
+// as PocketBook's Send-to-PocketBook or a Boox or reMarkable inbox. The SMTP
+// server is configured in the environment, like the credentials of upload
+// targets:
+//
+//	SMTP_URL       smtp://[user@]host[:587] (STARTTLS) or smtps://[user@]host[:465]
+//	SMTP_PASSWORD  the user's password
+//	SMTP_FROM      the sender, by default the user if it is an address
+type mailer struct {
+	server   url.URL
+	password string
+	from     string
+	to       []string
+	// link, if set, is the prefix under which the output directory is
+	// served; books are then linked to rather than attached.
+	link string
+}
+
+func newMailer(to []string, link string) (*mailer, error) {
+	raw := os.Getenv("SMTP_URL")
+	if raw == "" {
+		return nil, errors.New("email delivery needs the SMTP server in $SMTP_URL")
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("parsing $SMTP_URL: %w", err)
+	}
+	if u.Scheme != "smtp" && u.Scheme != "smtps" {
+		return nil, fmt.Errorf("$SMTP_URL must be an smtp:// or smtps:// url, not %s://", u.Scheme)
+	}
+	if u.Port() == "" {
+		port := "587"
+		if u.Scheme == "smtps" {
+			port = "465"
+		}
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+	m := &mailer{server: *u, password: os.Getenv("SMTP_PASSWORD"), from: os.Getenv("SMTP_FROM"), link: link}
+	if m.from == "" && strings.Contains(u.User.Username(), "@") {
+		m.from = u.User.Username()
+	}
+	from, err := mail.ParseAddress(m.from)
+	if err != nil {
+		return nil, fmt.Errorf("email delivery needs the sender in $SMTP_FROM: %w", err)
+	}
+	// Formatting the address encodes a name that isn't ASCII for the header.
+	m.from = from.String()
+	for _, address := range to {
+		if _, err := mail.ParseAddress(address); err != nil {
+			return nil, fmt.Errorf("email address %q: %w", address, err)
+		}
+	}
+	m.to = to
+	return m, nil
+}
+
+// send emails the epub at filename to every recipient, in one message. An
+// SMTP server that turns it away, often for its size once it is base64
+// encoded, is logged rather than failing the scrape.
+func (m *mailer) send(filename string, meta Metadata) {
+	if m == nil {
+		return
+	}
+	logger.Infow("Email book", "filename", filename, "to", m.to)
+	message, err := m.message(filename, meta)
+	if err == nil {
+		err = m.deliver(message)
+	}
+	if err != nil {
+		logger.Warnw("Failed to email book", "filename", filename, "server", m.server.Redacted(), "error", err)
+	}
+}
+
+func (m *mailer) message(filename string, meta Metadata) ([]byte, error) {
+	var buf bytes.Buffer
+	headers := textproto.MIMEHeader{}
+	headers.Set("From", m.from)
+	headers.Set("To", strings.Join(m.to, ", "))
+	headers.Set("Subject", mime.QEncoding.Encode("utf-8", meta.Title))
+	headers.Set("Date", time.Now().Format(time.RFC1123Z))
+	headers.Set("MIME-Version", "1.0")
+	headers.Set("User-Agent", versionUserAgent())
+
+	text := meta.Title
+	if meta.Author != "" {
+		text += " by " + meta.Author
+	}
+	text += "\r\n\r\nScraped from " + meta.SourceURL + "\r\n"
+	if m.link != "" {
+		text += "\r\nDownload: " + strings.TrimSuffix(m.link, "/") + "/" + url.PathEscape(filepath.Base(filename)) + "\r\n"
+		headers.Set("Content-Type", "text/plain; charset=utf-8")
+		writeMIMEHeader(&buf, headers)
+		buf.WriteString(text)
+		return buf.Bytes(), nil
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > emailMaxAttachment {
+		return nil, fmt.Errorf("book is %s, too large to attach; link to it with -email-link instead", formatBytes(int64(len(data))))
+	}
+	var parts bytes.Buffer
+	writer := multipart.NewWriter(&parts)
+	part, err := writer.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+	if err != nil {
+		return nil, err
+	}
+	part.Write([]byte(text))
+	disposition := mime.FormatMediaType("attachment", map[string]string{"filename": filepath.Base(filename)})
+	part, err = writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"application/epub+zip"},
+		"Content-Disposition":       {disposition},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		part.Write([]byte(encoded[:76] + "\r\n"))
+		encoded = encoded[76:]
+	}
+	part.Write([]byte(encoded + "\r\n"))
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	headers.Set("Content-Type", "multipart/mixed; boundary="+writer.Boundary())
+	writeMIMEHeader(&buf, headers)
+	buf.Write(parts.Bytes())
+	return buf.Bytes(), nil
+}
+
+func writeMIMEHeader(buf *bytes.Buffer, headers textproto.MIMEHeader) {
+	for _, key := range []string{"From", "To", "Subject", "Date", "MIME-Version", "User-Agent", "Content-Type"} {
+		if value := headers.Get(key); value != "" {
+			fmt.Fprintf(buf, "%s: %s\r\n", key, value)
+		}
+	}
+	buf.WriteString("\r\n")
+}
+
+// deliver sends message over SMTP, with implicit TLS for smtps and
+// STARTTLS, when the server offers it, for smtp.
+func (m *mailer) deliver(message []byte) error {
+	host := m.server.Hostname()
+	conn, err := net.DialTimeout("tcp", m.server.Host, 30*time.Second)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(uploadTimeout))
+	if m.server.Scheme == "smtps" {
+		conn = tls.Client(conn, &tls.Config{ServerName: host})
+	}
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	if m.server.Scheme == "smtp" {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+				return err
+			}
+		}
+	}
+	if user := m.server.User.Username(); user != "" {
+		// PlainAuth refuses to send the password unencrypted, other than
+		// to localhost.
+		if err := client.Auth(smtp.PlainAuth("", user, m.password, host)); err != nil {
+			return err
+		}
+	}
+	from, _ := mail.ParseAddress(m.from)
+	if err := client.Mail(from.Address); err != nil {
+		return err
+	}
+	for _, to := range m.to {
+		address, _ := mail.ParseAddress(to)
+		if err := client.Rcpt(address.Address); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(message); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	xhtml "golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// maxFilteredText is the most text, in characters, an element may hold to be
+// taken out by a content filter; anything longer is the story itself or
+// holds it.
+const maxFilteredText = 300
+
+// contentFilter is a kind of junk that sites, or those who translate or
+// repost stories on them, put between the paragraphs of chapters. An element
+// is taken out when its text, with the links in it, matches every one of
+// patterns.
+type contentFilter struct {
+	name string
+	// hosts are the sites the filter is for, or empty for every site.
+	hosts    []string
+	patterns []*regexp.Regexp
+}
+
+// contentFilters are the filters applied to chapters unless -no-filters is
+// given. They are kept narrow: missing some junk is better than taking out
+// a line of the story.
+var contentFilters = []contentFilter{
+	{
+		// Royal Road hides notices in chapters for readers of copies of
+		// them on other sites, often reworded.
+		name:  "stolen content notice",
+		hosts: []string{"www.royalroad.com"},
+		patterns: []*regexp.Regexp{
+			regexp.MustCompile(`(?i)\b(royal ?road|amazon)\b`),
+			regexp.MustCompile(`(?i)\b(stolen|misappropriated|appropriated|pilfered|lifted|unauthori[sz]ed|without (the )?(author's )?(permission|consent)|report)\b`),
+			regexp.MustCompile(`(?i)\b(story|stories|narrative|tale|content|novel|work|chapter)\b`),
+		},
+	},
+	{
+		name: "read it elsewhere",
+		patterns: []*regexp.Regexp{
+			regexp.MustCompile(`(?i)(\bread(ing)?\b.{0,40}\b(on|at)\b|\boriginally (published|posted)\b|\bif you('re| are) (not )?reading this\b)`),
+			regexp.MustCompile(`(?i)(\.(com|net|org|io|co)\b|\broyal ?road\b|\bscribble ?hub\b|\bwattpad\b|\bwebnovel\b|\bwuxiaworld\b|\bnovel ?updates\b|\bthe original site\b|\bany other site\b)`),
+		},
+	},
+	{
+		name: "donation request",
+		patterns: []*regexp.Regexp{
+			regexp.MustCompile(`(?i)(\bko-?fi\b|\bpaypal\b|buy me a coffee|\bdonat(e|ions?|ing)\b|\bsponsored chapter\b)`),
+			regexp.MustCompile(`(?i)(\bko-?fi\b|\bpaypal\b|\bcoffee\b|\bsupport\b|\bthank|\bchapter\b|\brelease)`),
+		},
+	},
+	{
+		name: "patreon",
+		patterns: []*regexp.Regexp{
+			regexp.MustCompile(`(?i)\bpatreon\b`),
+		},
+	},
+	{
+		name: "discord invitation",
+		patterns: []*regexp.Regexp{
+			regexp.MustCompile(`(?i)(\bjoin (my|our|the) discord\b|discord\.gg/)`),
+		},
+	},
+}
+
+// match reports whether text is junk this filter takes out of chapters
+// from host.
+func (f contentFilter) match(host string, text string) bool {
+	if len(f.hosts) > 0 && !containsString(f.hosts, host) {
+		return false
+	}
+	for _, pattern := range f.patterns {
+		if !pattern.MatchString(text) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// filterContent takes out of chapter content from host the paragraphs and
+// blocks that contentFilters find to be junk.
+func filterContent(host string, url string, content string) string {
+	context := &xhtml.Node{Type: xhtml.ElementNode, Data: "body", DataAtom: atom.Body}
+	nodes, err := xhtml.ParseFragment(strings.NewReader(content), context)
+	if err != nil {
+		logger.Warnw("Failed to parse chapter content", "url", url, "error", err)
+		return content
+	}
+	for _, node := range nodes {
+		context.AppendChild(node)
+	}
+	if !filterNode(context, host, url) {
+		return content
+	}
+	var buf bytes.Buffer
+	for node := context.FirstChild; node != nil; node = node.NextSibling {
+		if err := xhtml.Render(&buf, node); err != nil {
+			logger.Warnw("Failed to render chapter content", "url", url, "error", err)
+			return content
+		}
+	}
+	return buf.String()
+}
+
+// filterNode removes the blocks under node that a filter matches, reporting
+// whether there were any.
+func filterNode(node *xhtml.Node, host string, url string) bool {
+	filtered := false
+	for child := node.FirstChild; child != nil; {
+		next := child.NextSibling
+		if child.Type == xhtml.ElementNode && filteredBlock(child.DataAtom) {
+			// Blocks of blocks are filtered a block at a time, for the
+			// story around the junk to stay.
+			if hasBlocks(child) {
+				if filterNode(child, host, url) {
+					filtered = true
+				}
+			} else if name := matchFilter(child, host); name != "" {
+				logger.Debugw("Filter junk out of chapter", "url", url, "filter", name)
+				node.RemoveChild(child)
+				filtered = true
+			}
+		}
+		child = next
+	}
+	return filtered
+}
+
+func hasBlocks(node *xhtml.Node) bool {
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		if child.Type == xhtml.ElementNode && filteredBlock(child.DataAtom) {
+			return true
+		}
+	}
+	return false
+}
+
+// filteredBlock reports whether elements of kind a are ones filters may take
+// out whole.
+func filteredBlock(a atom.Atom) bool {
+	switch a {
+	case atom.P, atom.Div, atom.Center, atom.Blockquote, atom.Section, atom.Aside:
+		return true
+	}
+	return false
+}
+
+// matchFilter returns the name of the filter that matches the element, or
+// "" if none does.
+func matchFilter(element *xhtml.Node, host string) string {
+	var text strings.Builder
+	var walk func(*xhtml.Node)
+	walk = func(node *xhtml.Node) {
+		switch node.Type {
+		case xhtml.TextNode:
+			text.WriteString(node.Data)
+		case xhtml.ElementNode:
+			if node.DataAtom == atom.A {
+				for _, attr := range node.Attr {
+					if attr.Key == "href" {
+						text.WriteString(" " + attr.Val + " ")
+					}
+				}
+			}
+		}
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+	walk(element)
+	content := strings.Join(strings.Fields(text.String()), " ")
+	if content == "" || utf8.RuneCountInString(content) > maxFilteredText {
+		return ""
+	}
+	for _, filter := range contentFilters {
+		if filter.match(host, content) {
+			return filter.name
+		}
+	}
+	return ""
+}
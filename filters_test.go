@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestFilterContent(t *testing.T) {
+	for _, test := range []struct {
+		host    string
+		content string
+		want    string
+	}{
+		{
+			"www.royalroad.com",
+			`<p>She ran.</p><p class="cjJlZm">Unauthorized usage: this narrative is on Amazon without the author's consent. Report any sightings.</p><p>He followed.</p>`,
+			`<p>She ran.</p><p>He followed.</p>`,
+		},
+		// Only Royal Road hides notices about itself.
+		{
+			"www.scribblehub.com",
+			`<p>Report any sightings of this story on Amazon.</p>`,
+			`<p>Report any sightings of this story on Amazon.</p>`,
+		},
+		{
+			"www.scribblehub.com",
+			`<div><p>She ran.</p><p><a href="https://www.patreon.com/someone"><img src="banner.png"></a></p><p>Please read this chapter at example-translations.com!</p></div><p>Thanks for reading! Buy me a coffee on <a href="https://ko-fi.com/someone">Ko-fi</a> for a bonus chapter.</p>`,
+			`<div><p>She ran.</p></div>`,
+		},
+		// Story text is left alone, however much it sounds like junk.
+		{
+			"phrack.org",
+			`<p>"I'll read it at home," she said, and donated the rest to the library.</p>`,
+			`<p>"I'll read it at home," she said, and donated the rest to the library.</p>`,
+		},
+	} {
+		if got := filterContent(test.host, "https://"+test.host+"/chapter", test.content); got != test.want {
+			t.Errorf("filterContent(%s, %q)\n got %q\nwant %q", test.host, test.content, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// headerFlag collects repeated `-header 'Key: Value'` arguments.
+type headerFlag http.Header
+
+func (h headerFlag) String() string {
+	var lines []string
+	for key, values := range h {
+		for _, value := range values {
+			lines = append(lines, key+": "+value)
+		}
+	}
+	return strings.Join(lines, ", ")
+}
+
+func (h headerFlag) Set(value string) error {
+	key, val, found := strings.Cut(value, ":")
+	if !found || strings.TrimSpace(key) == "" {
+		return fmt.Errorf("header %q is not of the form 'Key: Value'", value)
+	}
+	http.Header(h).Add(strings.TrimSpace(key), strings.TrimSpace(val))
+	return nil
+}
+
+// stringsFlag collects the values of a repeatable string flag.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ", ")
+}
+
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// regexpsFlag collects the patterns of a repeatable regular expression flag.
+type regexpsFlag []*regexp.Regexp
+
+func (r *regexpsFlag) String() string {
+	var patterns []string
+	for _, pattern := range *r {
+		patterns = append(patterns, pattern.String())
+	}
+	return strings.Join(patterns, ", ")
+}
+
+func (r *regexpsFlag) Set(value string) error {
+	pattern, err := regexp.Compile(value)
+	if err != nil {
+		return err
+	}
+	*r = append(*r, pattern)
+	return nil
+}
+
+// sizeFlag is a number of bytes, given with an optional unit such as 500MB or
+// 2GiB.
+type sizeFlag int64
+
+func (s *sizeFlag) String() string {
+	return formatBytes(int64(*s))
+}
+
+func (s *sizeFlag) Set(value string) error {
+	units := []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30},
+		{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"B", 1},
+	}
+	number, multiplier := strings.TrimSpace(value), int64(1)
+	for _, unit := range units {
+		if trimmed, found := strings.CutSuffix(number, unit.suffix); found {
+			number, multiplier = strings.TrimSpace(trimmed), unit.multiplier
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q", value)
+	}
+	*s = sizeFlag(n * float64(multiplier))
+	return nil
+}
+
+// timestampFlag is a time given in RFC 3339 or as Unix seconds.
+type timestampFlag time.Time
+
+func (t *timestampFlag) String() string {
+	if time.Time(*t).IsZero() {
+		return ""
+	}
+	return time.Time(*t).Format(time.RFC3339)
+}
+
+func (t *timestampFlag) Set(value string) error {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		*t = timestampFlag(time.Unix(seconds, 0))
+		return nil
+	}
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp %q", value)
+	}
+	*t = timestampFlag(parsed)
+	return nil
+}
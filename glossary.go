@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	xhtml "golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// glossaryTermClass marks the links from chapter text to the glossary, so
+// that they can be told from the story's own links and redone when a book
+// is updated.
+const glossaryTermClass = "glossary-term"
+
+// maxGlossaryTerm is the longest a term may be, in bytes; longer "terms" are
+// rows of some other table.
+const maxGlossaryTerm = 60
+
+// glossarySectionFile is the section of the epub the glossary is put in.
+const glossarySectionFile = "glossary.xhtml"
+
+// glossaryEntry is a term of a story's glossary or character list, with its
+// definition as html.
+type glossaryEntry struct {
+	Term       string
+	Definition string
+}
+
+// siteGlossaryURL returns the glossary page a site keeps for the story at
+// source, such as the glossary tab of a ScribbleHub series, or "" if the
+// site has none.
+func siteGlossaryURL(source string) string {
+	u, err := url.Parse(source)
+	if err != nil {
+		return ""
+	}
+	switch u.Host {
+	case "www.scribblehub.com", "scribblehub.com":
+		if !scribblehubSeriesID.MatchString(source) {
+			return ""
+		}
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/glossary/"
+		u.RawQuery, u.Fragment = "", ""
+		return u.String()
+	}
+	return ""
+}
+
+// fetchGlossary reads the glossary at pageURL, a site's glossary tab or a
+// wiki page, taking its terms from definition lists and from tables whose
+// rows start with the term.
+func fetchGlossary(client *http.Client, pageURL string) ([]glossaryEntry, error) {
+	request, err := http.NewRequest(http.MethodGet, pageURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if userAgent != "" {
+		request.Header.Set("User-Agent", userAgent)
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("glossary returned %s", response.Status)
+	}
+	doc, err := goquery.NewDocumentFromReader(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	return parseGlossary(doc), nil
+}
+
+func parseGlossary(doc *goquery.Document) []glossaryEntry {
+	var entries []glossaryEntry
+	seen := make(map[string]bool)
+	add := func(term *goquery.Selection, definitions *goquery.Selection) {
+		name := strings.Join(strings.Fields(term.Text()), " ")
+		if name == "" || len(name) > maxGlossaryTerm || seen[name] {
+			return
+		}
+		var definition strings.Builder
+		definitions.Each(func(_ int, s *goquery.Selection) {
+			content, _ := s.Html()
+			if content = strings.TrimSpace(content); content != "" {
+				definition.WriteString("<p>" + content + "</p>")
+			}
+		})
+		seen[name] = true
+		entries = append(entries, glossaryEntry{Term: name, Definition: definition.String()})
+	}
+	doc.Find("dl > dt").Each(func(_ int, dt *goquery.Selection) {
+		add(dt, dt.NextUntil("dt").Filter("dd"))
+	})
+	doc.Find("table tr").Each(func(_ int, row *goquery.Selection) {
+		cells := row.ChildrenFiltered("td, th")
+		if cells.Length() < 2 || cells.First().Is("th") && row.Parent().Is("thead") {
+			return
+		}
+		add(cells.First(), cells.Slice(1, cells.Length()))
+	})
+	return entries
+}
+
+// glossarySection is the appendix of the glossary's entries, each with an
+// anchor for chapters to link to.
+func glossarySection(entries []glossaryEntry) string {
+	var b strings.Builder
+	b.WriteString("<h2>Glossary</h2>\n<dl class=\"glossary\">\n")
+	for i, entry := range entries {
+		fmt.Fprintf(&b, "<dt id=\"%s\">%s</dt>\n<dd>%s</dd>\n", glossaryAnchor(i), html.EscapeString(entry.Term), repairHTML(entry.Definition))
+	}
+	b.WriteString("</dl>")
+	return b.String()
+}
+
+func glossaryAnchor(index int) string {
+	return fmt.Sprintf("term-%d", index+1)
+}
+
+// linkGlossaryTerms links the first mention of each glossary term in a
+// chapter's text to its entry in the appendix at section, leaving alone
+// text that is already a link or a heading. Links from an earlier glossary,
+// in chapters carried over from the epub being updated, are undone first.
+func linkGlossaryTerms(content string, entries []glossaryEntry, section string) string {
+	if len(entries) == 0 && !strings.Contains(content, glossaryTermClass) {
+		return content
+	}
+	context := &xhtml.Node{Type: xhtml.ElementNode, Data: "body", DataAtom: atom.Body}
+	nodes, err := xhtml.ParseFragment(strings.NewReader(content), context)
+	if err != nil {
+		logger.Warnw("Failed to parse chapter content", "error", err)
+		return content
+	}
+	for _, node := range nodes {
+		context.AppendChild(node)
+	}
+	unlinkGlossaryTerms(context)
+	if len(entries) > 0 {
+		anchors := make(map[string]string)
+		terms := make([]string, 0, len(entries))
+		for i, entry := range entries {
+			anchors[entry.Term] = glossaryAnchor(i)
+			terms = append(terms, regexp.QuoteMeta(entry.Term))
+		}
+		// Longer terms are tried first, for "Zach Noveda" to win over "Zach".
+		sort.SliceStable(terms, func(i, j int) bool { return len(terms[i]) > len(terms[j]) })
+		linker := &glossaryLinker{
+			pattern: regexp.MustCompile(`\b(?:` + strings.Join(terms, "|") + `)\b`),
+			anchors: anchors,
+			section: section,
+			linked:  make(map[string]bool),
+		}
+		linker.link(context)
+	}
+	var buf bytes.Buffer
+	for node := context.FirstChild; node != nil; node = node.NextSibling {
+		if err := xhtml.Render(&buf, node); err != nil {
+			logger.Warnw("Failed to render chapter content", "error", err)
+			return content
+		}
+	}
+	return buf.String()
+}
+
+// unlinkGlossaryTerms replaces every glossary link under node with its text.
+func unlinkGlossaryTerms(node *xhtml.Node) {
+	for child := node.FirstChild; child != nil; {
+		next := child.NextSibling
+		if child.DataAtom == atom.A && hasClass(child, glossaryTermClass) {
+			for grandchild := child.FirstChild; grandchild != nil; {
+				after := grandchild.NextSibling
+				child.RemoveChild(grandchild)
+				node.InsertBefore(grandchild, child)
+				grandchild = after
+			}
+			node.RemoveChild(child)
+		} else {
+			unlinkGlossaryTerms(child)
+		}
+		child = next
+	}
+}
+
+func hasClass(node *xhtml.Node, class string) bool {
+	for _, attr := range node.Attr {
+		if attr.Key == "class" && strings.Contains(" "+attr.Val+" ", " "+class+" ") {
+			return true
+		}
+	}
+	return false
+}
+
+type glossaryLinker struct {
+	pattern *regexp.Regexp
+	anchors map[string]string
+	section string
+	// linked are the terms already linked in the chapter.
+	linked map[string]bool
+}
+
+func (l *glossaryLinker) link(node *xhtml.Node) {
+	for child := node.FirstChild; child != nil; {
+		next := child.NextSibling
+		switch child.Type {
+		case xhtml.TextNode:
+			l.linkText(child)
+		case xhtml.ElementNode:
+			switch child.DataAtom {
+			case atom.A, atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6, atom.Script, atom.Style:
+			default:
+				l.link(child)
+			}
+		}
+		child = next
+	}
+}
+
+// linkText splits text around the first mentions of terms not yet linked,
+// putting each of those in a link to the glossary.
+func (l *glossaryLinker) linkText(text *xhtml.Node) {
+	parent, data, last := text.Parent, text.Data, 0
+	for _, match := range l.pattern.FindAllStringIndex(data, -1) {
+		term := data[match[0]:match[1]]
+		if l.linked[term] {
+			continue
+		}
+		l.linked[term] = true
+		if match[0] > last {
+			parent.InsertBefore(&xhtml.Node{Type: xhtml.TextNode, Data: data[last:match[0]]}, text)
+		}
+		link := &xhtml.Node{Type: xhtml.ElementNode, Data: "a", DataAtom: atom.A, Attr: []xhtml.Attribute{
+			{Key: "class", Val: glossaryTermClass},
+			{Key: "href", Val: l.section + "#" + l.anchors[term]},
+		}}
+		link.AppendChild(&xhtml.Node{Type: xhtml.TextNode, Data: term})
+		parent.InsertBefore(link, text)
+		last = match[1]
+	}
+	text.Data = data[last:]
+}
+
+// addGlossary fetches the glossary of job's story for builder to append,
+// from the page given for it or else the site's own. A glossary that can't
+// be had is warned about rather than failing the book.
+func (s *session) addGlossary(builder *epubBuilder, job bookJob, client *http.Client) {
+	pageURL := job.GlossaryURL
+	if pageURL == "" {
+		pageURL = siteGlossaryURL(job.URL)
+	}
+	if pageURL == "" {
+		logger.Warnw("Site keeps no glossary for the story; give one with -glossary-url", "url", job.URL)
+		return
+	}
+	entries, err := fetchGlossary(client, pageURL)
+	if err != nil {
+		logger.Warnw("Failed to fetch glossary", "url", pageURL, "error", err)
+		return
+	}
+	if len(entries) == 0 {
+		logger.Warnw("Glossary lists no terms", "url", pageURL)
+		return
+	}
+	logger.Infow("Add glossary", "url", pageURL, "terms", len(entries))
+	builder.glossary = entries
+}
@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestLinkGlossaryTerms(t *testing.T) {
+	entries := []glossaryEntry{{Term: "Zach"}, {Term: "Zach Noveda"}, {Term: "Cyoria"}}
+	for _, test := range []struct {
+		content string
+		want    string
+	}{
+		{
+			`<p>Zach Noveda woke in Cyoria. Zach sighed; Cyoria again.</p>`,
+			`<p><a class="glossary-term" href="glossary.xhtml#term-2">Zach Noveda</a> woke in <a class="glossary-term" href="glossary.xhtml#term-3">Cyoria</a>. <a class="glossary-term" href="glossary.xhtml#term-1">Zach</a> sighed; Cyoria again.</p>`,
+		},
+		{
+			`<h2>Cyoria</h2><p><a href="https://example.com/">Cyoria</a>, Zachary and Cyoria.</p>`,
+			`<h2>Cyoria</h2><p><a href="https://example.com/">Cyoria</a>, Zachary and <a class="glossary-term" href="glossary.xhtml#term-3">Cyoria</a>.</p>`,
+		},
+		// Links made for an earlier glossary are redone.
+		{
+			`<p>In <a class="glossary-term" href="glossary.xhtml#term-9">Cyoria</a>.</p>`,
+			`<p>In <a class="glossary-term" href="glossary.xhtml#term-3">Cyoria</a>.</p>`,
+		},
+	} {
+		if got := linkGlossaryTerms(test.content, entries, "glossary.xhtml"); got != test.want {
+			t.Errorf("linkGlossaryTerms(%q)\n got %q\nwant %q", test.content, got, test.want)
+		}
+	}
+	if got := linkGlossaryTerms(`<p>In <a class="glossary-term" href="glossary.xhtml#term-3">Cyoria</a>.</p>`, nil, "glossary.xhtml"); got != `<p>In Cyoria.</p>` {
+		t.Errorf("links were left without a glossary: %q", got)
+	}
+}
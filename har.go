@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The subset of the HAR 1.2 format (http://www.softwareishard.com/blog/har-12-spec/)
+// needed to record and replay a scrape. Bodies are always stored base64
+// encoded so binary responses such as cover images survive the round trip.
+type harFile struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+}
+
+type harRequest struct {
+	Method      string       `json:"method"`
+	URL         string       `json:"url"`
+	HTTPVersion string       `json:"httpVersion"`
+	Headers     []harHeader  `json:"headers"`
+	QueryString []harHeader  `json:"queryString"`
+	Cookies     []harHeader  `json:"cookies"`
+	PostData    *harPostData `json:"postData,omitempty"`
+	HeadersSize int          `json:"headersSize"`
+	BodySize    int          `json:"bodySize"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harResponse struct {
+	Status      int         `json:"status"`
+	StatusText  string      `json:"statusText"`
+	HTTPVersion string      `json:"httpVersion"`
+	Headers     []harHeader `json:"headers"`
+	Cookies     []harHeader `json:"cookies"`
+	Content     harContent  `json:"content"`
+	RedirectURL string      `json:"redirectURL"`
+	HeadersSize int         `json:"headersSize"`
+	BodySize    int         `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"encoding"`
+}
+
+type harHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+func toHARHeaders(header http.Header) []harHeader {
+	headers := []harHeader{}
+	for key, values := range header {
+		for _, value := range values {
+			headers = append(headers, harHeader{Name: key, Value: value})
+		}
+	}
+	return headers
+}
+
+func fromHARHeaders(headers []harHeader) http.Header {
+	header := http.Header{}
+	for _, h := range headers {
+		header.Add(h.Name, h.Value)
+	}
+	return header
+}
+
+// HARRecorder passes requests through to Transport and keeps a copy of every
+// exchange, to be written out with Save.
+type HARRecorder struct {
+	Transport http.RoundTripper
+	// Sanitize makes Save write a recording fit to be committed as a test
+	// cassette: without credentials, and the same from one recording of
+	// the same pages to the next.
+	Sanitize bool
+
+	mu      sync.Mutex
+	entries []harEntry
+}
+
+func (t *HARRecorder) RoundTrip(request *http.Request) (*http.Response, error) {
+	start := time.Now()
+	requestBody, err := requestBody(request)
+	if err != nil {
+		return nil, err
+	}
+	response, err := t.Transport.RoundTrip(request)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	response.Body = io.NopCloser(bytes.NewReader(body))
+	elapsed := float64(time.Since(start).Milliseconds())
+
+	query := []harHeader{}
+	for key, values := range request.URL.Query() {
+		for _, value := range values {
+			query = append(query, harHeader{Name: key, Value: value})
+		}
+	}
+	entry := harEntry{
+		StartedDateTime: start,
+		Time:            elapsed,
+		Request: harRequest{
+			Method:      request.Method,
+			URL:         request.URL.String(),
+			HTTPVersion: requestVersion(request, response),
+			Headers:     toHARHeaders(wireHeader(request.Header)),
+			QueryString: query,
+			Cookies:     []harHeader{},
+			HeadersSize: -1,
+			BodySize:    len(requestBody),
+		},
+		Response: harResponse{
+			Status:      response.StatusCode,
+			StatusText:  http.StatusText(response.StatusCode),
+			HTTPVersion: response.Proto,
+			Headers:     toHARHeaders(response.Header),
+			Cookies:     []harHeader{},
+			Content: harContent{
+				Size:     len(body),
+				MimeType: response.Header.Get("Content-Type"),
+				Text:     base64.StdEncoding.EncodeToString(body),
+				Encoding: "base64",
+			},
+			RedirectURL: response.Header.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    len(body),
+		},
+		Timings: harTimings{Send: 0, Wait: elapsed, Receive: 0},
+	}
+	if requestBody != nil {
+		entry.Request.PostData = &harPostData{MimeType: request.Header.Get("Content-Type"), Text: string(requestBody)}
+	}
+	t.mu.Lock()
+	t.entries = append(t.entries, entry)
+	t.mu.Unlock()
+	return response, nil
+}
+
+// wireHeader is header as it went out, without the headers that only tell
+// the transports below the recorder what to do, which they strip.
+func wireHeader(header http.Header) http.Header {
+	header = header.Clone()
+	header.Del(cacheRoleHeader)
+	header.Del(cacheBookHeader)
+	header.Del(alternateTransportHeader)
+	return header
+}
+
+// requestVersion is the protocol request went out with, which is that of its
+// response; a client's request only says what it was made as.
+func requestVersion(request *http.Request, response *http.Response) string {
+	if response.Proto != "" {
+		return response.Proto
+	}
+	if request.Proto != "" {
+		return request.Proto
+	}
+	return "HTTP/1.1"
+}
+
+// Save writes every exchange recorded so far to filename.
+func (t *HARRecorder) Save(filename string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	entries := t.entries
+	if t.Sanitize {
+		entries = sanitizeHAR(entries)
+	}
+	data, err := json.MarshalIndent(harFile{Log: harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: "ebook-scraper", Version: "0"},
+		Entries: entries,
+	}}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, data, 0644)
+}
+
+// sanitizeHAR returns entries without cookies, credentials or the headers
+// the scraper marks requests with for its cache, and with their times,
+// headers and order, which chapters fetched concurrently make vary, made
+// stable. Requests for the same URL keep their order, which replay relies
+// on.
+func sanitizeHAR(entries []harEntry) []harEntry {
+	sanitized := make([]harEntry, len(entries))
+	for i, entry := range entries {
+		entry.StartedDateTime = time.Time{}
+		entry.Time = 0
+		entry.Timings = harTimings{}
+		entry.Request.Headers = sanitizeHARHeaders(entry.Request.Headers)
+		entry.Response.Headers = sanitizeHARHeaders(entry.Response.Headers)
+		sanitized[i] = entry
+	}
+	sort.SliceStable(sanitized, func(i, j int) bool {
+		a, b := sanitized[i].Request, sanitized[j].Request
+		return a.URL < b.URL || a.URL == b.URL && a.Method < b.Method
+	})
+	return sanitized
+}
+
+func sanitizeHARHeaders(headers []harHeader) []harHeader {
+	kept := []harHeader{}
+	for _, h := range headers {
+		switch name := http.CanonicalHeaderKey(h.Name); {
+		case name == "Cookie", name == "Set-Cookie", name == "Authorization", name == "Proxy-Authorization":
+		case name == "Date", name == "Age", name == "Expires", name == "User-Agent":
+		case strings.HasPrefix(name, "X-Ebook-Scraper-"):
+		default:
+			kept = append(kept, h)
+		}
+	}
+	sort.SliceStable(kept, func(i, j int) bool { return kept[i].Name < kept[j].Name })
+	return kept
+}
+
+// HARReplayer answers requests from a recorded HAR file without touching the
+// network. Repeated requests for the same URL, and body if they have one, are
+// answered with the recorded responses in order, the last one being reused
+// once they run out.
+type HARReplayer struct {
+	mu      sync.Mutex
+	entries map[string][]harEntry
+}
+
+func LoadHARReplayer(filename string) (*HARReplayer, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var har harFile
+	if err := json.Unmarshal(data, &har); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	t := &HARReplayer{entries: make(map[string][]harEntry)}
+	for _, entry := range har.Log.Entries {
+		var body []byte
+		if entry.Request.PostData != nil {
+			body = []byte(entry.Request.PostData.Text)
+		}
+		key := harKey(entry.Request.Method, entry.Request.URL, body)
+		t.entries[key] = append(t.entries[key], entry)
+	}
+	return t, nil
+}
+
+// harKey is what a request is replayed by: its method and URL, and the hash
+// of its body if it has one.
+func harKey(method string, url string, body []byte) string {
+	if len(body) == 0 {
+		return method + " " + url
+	}
+	return requestKey(method, url, body)
+}
+
+func (t *HARReplayer) RoundTrip(request *http.Request) (*http.Response, error) {
+	requestBody, err := requestBody(request)
+	if err != nil {
+		return nil, err
+	}
+	key := harKey(request.Method, request.URL.String(), requestBody)
+	t.mu.Lock()
+	queue := t.entries[key]
+	if len(queue) == 0 && len(requestBody) > 0 {
+		// Recordings made before bodies were recorded have requests by
+		// their method and URL alone.
+		key = harKey(request.Method, request.URL.String(), nil)
+		queue = t.entries[key]
+	}
+	if len(queue) == 0 {
+		t.mu.Unlock()
+		return nil, fmt.Errorf("replay: no recorded response for %s", key)
+	}
+	entry := queue[0]
+	if len(queue) > 1 {
+		t.entries[key] = queue[1:]
+	}
+	t.mu.Unlock()
+
+	body := []byte(entry.Response.Content.Text)
+	if entry.Response.Content.Encoding == "base64" {
+		decoded, err := base64.StdEncoding.DecodeString(entry.Response.Content.Text)
+		if err != nil {
+			return nil, fmt.Errorf("replay: %s: %w", key, err)
+		}
+		body = decoded
+	}
+	major, minor, ok := http.ParseHTTPVersion(entry.Response.HTTPVersion)
+	if !ok {
+		major, minor = 1, 1
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", entry.Response.Status, entry.Response.StatusText),
+		StatusCode:    entry.Response.Status,
+		Proto:         fmt.Sprintf("HTTP/%d.%d", major, minor),
+		ProtoMajor:    major,
+		ProtoMinor:    minor,
+		Header:        fromHARHeaders(entry.Response.Headers),
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       request,
+	}, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+
+	"golang.org/x/image/webp"
+)
+
+// avifConverters are the commands, tried in turn, that turn an AVIF image
+// into a PNG, there being no decoder for it in Go: libavif's. ImageMagick is
+// left out on purpose, as it sniffs what it is given and hands it to
+// whichever of its delegates claims it, which images from any site on the
+// web must not get to choose.
+var avifConverters = [][]string{
+	{"avifdec", "{in}", "{out}"},
+}
+
+var errNoAVIFConverter = errors.New("no avifdec to convert AVIF images with")
+
+// warnNoAVIFConverter warns about errNoAVIFConverter once rather than for
+// every image.
+var warnNoAVIFConverter sync.Once
+
+// imageFormat sniffs the format of an image from its first bytes, returning
+// webp, avif or "" for any other.
+func imageFormat(head []byte) string {
+	switch {
+	case len(head) >= 12 && string(head[:4]) == "RIFF" && string(head[8:12]) == "WEBP":
+		return "webp"
+	case len(head) >= 12 && string(head[4:8]) == "ftyp" && (string(head[8:12]) == "avif" || string(head[8:12]) == "avis"):
+		return "avif"
+	}
+	return ""
+}
+
+// convertImage converts the image at filename to JPEG, or to PNG where it is
+// transparent, if it is WebP or AVIF, which many e-readers can't show. It
+// returns the file to embed, which is filename for images that need no
+// converting, and name with the extension of that file.
+func convertImage(filename string, name string) (string, string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+	head := make([]byte, 12)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", "", err
+	}
+	var img image.Image
+	switch imageFormat(head[:n]) {
+	case "webp":
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return "", "", err
+		}
+		if img, err = webp.Decode(f); err != nil {
+			return "", "", fmt.Errorf("decoding webp: %w", err)
+		}
+	case "avif":
+		if img, err = decodeAVIF(filename); err != nil {
+			return "", "", err
+		}
+	default:
+		return filename, name, nil
+	}
+	var buf bytes.Buffer
+	ext := ".jpg"
+	if opaque, ok := img.(interface{ Opaque() bool }); ok && !opaque.Opaque() {
+		ext = ".png"
+		err = png.Encode(&buf, img)
+	} else {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90})
+	}
+	if err != nil {
+		return "", "", err
+	}
+	converted := strings.TrimSuffix(filename, path.Ext(filename)) + "-converted" + ext
+	if err := os.WriteFile(converted, buf.Bytes(), 0644); err != nil {
+		return "", "", err
+	}
+	if name != "" && path.Ext(name) != "" {
+		name = strings.TrimSuffix(name, path.Ext(name)) + ext
+	}
+	return converted, name, nil
+}
+
+// decodeAVIF decodes the AVIF image at filename by way of a PNG made by the
+// first of avifConverters that is installed.
+func decodeAVIF(filename string) (image.Image, error) {
+	out := filename + ".png"
+	defer os.Remove(out)
+	if found, err := convertWith(avifConverters, filename, out); err != nil {
+		return nil, err
+	} else if !found {
+		return nil, errNoAVIFConverter
+	}
+	f, err := os.Open(out)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return png.Decode(f)
+}
+
+// convertWith converts the file in into out with the first of converters
+// that is installed, each a command whose arguments may stand for the files
+// as {in} and {out}. It reports false if none is.
+func convertWith(converters [][]string, in string, out string) (bool, error) {
+	for _, converter := range converters {
+		command, err := exec.LookPath(converter[0])
+		if err != nil {
+			continue
+		}
+		var args []string
+		for _, arg := range converter[1:] {
+			args = append(args, strings.NewReplacer("{in}", in, "{out}", out).Replace(arg))
+		}
+		if output, err := exec.Command(command, args...).CombinedOutput(); err != nil {
+			return true, fmt.Errorf("%s: %w: %s", converter[0], err, strings.TrimSpace(string(output)))
+		}
+		return true, nil
+	}
+	return false, nil
+}
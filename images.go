@@ -0,0 +1,508 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/mdepp/go-epub"
+	xhtml "golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// hostAllowList matches a host against a list of domains, each of which also
+// allows all of its subdomains.
+type hostAllowList []string
+
+func (l hostAllowList) allows(host string) bool {
+	for _, domain := range l {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// imageFetcher downloads images into a temporary directory, at most Workers
+// at a time, so that images can be fetched while chapters are still being
+// scraped rather than one by one when the epub is written.
+type imageFetcher struct {
+	client *http.Client
+	dir    string
+	slots  chan struct{}
+
+	mu        sync.Mutex
+	downloads map[string]*imageDownload
+}
+
+type imageDownload struct {
+	done     chan struct{}
+	filename string
+	// hash is the SHA-256 of the image, by which identical images served
+	// from different URLs are recognized.
+	hash string
+	err  error
+}
+
+func newImageFetcher(client *http.Client, workers int) (*imageFetcher, error) {
+	dir, err := os.MkdirTemp("", "ebook-scraper-images")
+	if err != nil {
+		return nil, err
+	}
+	return &imageFetcher{
+		client:    client,
+		dir:       dir,
+		slots:     make(chan struct{}, workers),
+		downloads: make(map[string]*imageDownload),
+	}, nil
+}
+
+// fetch starts downloading imageURL unless it already has been.
+func (f *imageFetcher) fetch(imageURL string) *imageDownload {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if download, ok := f.downloads[imageURL]; ok {
+		return download
+	}
+	sum := sha1.Sum([]byte(imageURL))
+	download := &imageDownload{
+		done:     make(chan struct{}),
+		filename: filepath.Join(f.dir, hex.EncodeToString(sum[:])+imageExt(imageURL)),
+	}
+	f.downloads[imageURL] = download
+	go func() {
+		f.slots <- struct{}{}
+		defer func() { <-f.slots }()
+		download.hash, download.err = f.download(imageURL, download.filename, false)
+		close(download.done)
+	}()
+	return download
+}
+
+// download saves imageURL to filename, fetching it with the alternate
+// transport if alternate is set, and returns its hash.
+func (f *imageFetcher) download(imageURL string, filename string, alternate bool) (string, error) {
+	request, err := http.NewRequest(http.MethodGet, imageURL, nil)
+	if err != nil {
+		return "", err
+	}
+	if alternate {
+		request.Header.Set(alternateTransportHeader, "1")
+	}
+	response, err := f.client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("server returned %s", response.Status)
+	}
+	out, err := os.Create(filename)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(out, hash), response.Body); err != nil {
+		out.Close()
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), out.Close()
+}
+
+// wait returns the downloaded copy of imageURL and its hash, starting the
+// download if needed.
+func (f *imageFetcher) wait(imageURL string) (string, string, error) {
+	download := f.fetch(imageURL)
+	<-download.done
+	return download.filename, download.hash, download.err
+}
+
+// waitAlternate downloads imageURL again with the alternate transport, for
+// when the copy wait returned turned out to be something else.
+func (f *imageFetcher) waitAlternate(imageURL string) (string, string, error) {
+	sum := sha1.Sum([]byte(imageURL))
+	filename := filepath.Join(f.dir, hex.EncodeToString(sum[:])+"-alternate"+imageExt(imageURL))
+	hash, err := f.download(imageURL, filename, true)
+	return filename, hash, err
+}
+
+// imageExt is the extension of the file imageURL names, without any query,
+// which would make an invalid file name on Windows.
+func imageExt(imageURL string) string {
+	parsed, err := url.Parse(imageURL)
+	if err != nil {
+		return ""
+	}
+	return path.Ext(parsed.Path)
+}
+
+// hashFile returns the SHA-256 of the file, as imageDownload.hash has it.
+func hashFile(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Close removes the downloaded images, which must happen only after the epub
+// has been written.
+func (f *imageFetcher) Close() error {
+	f.mu.Lock()
+	downloads := f.downloads
+	f.mu.Unlock()
+	for _, download := range downloads {
+		<-download.done
+	}
+	return os.RemoveAll(f.dir)
+}
+
+// imageEmbedder adds the images referenced from chapter content to an epub,
+// remembering what it already added so an image shared between chapters is
+// only fetched once. Identical images from different URLs, such as scene
+// dividers re-uploaded with every chapter, are only embedded once.
+type imageEmbedder struct {
+	doc      *epub.Epub
+	allowed  hostAllowList
+	fetcher  *imageFetcher
+	embedded map[string]string
+	// byHash maps the hash of every embedded image to its path.
+	byHash map[string]string
+	// fallbacks maps the path of every embedded SVG image to that of the
+	// PNG rendered from it, for readers that can't show SVG.
+	fallbacks map[string]string
+}
+
+func newImageEmbedder(doc *epub.Epub, allowed hostAllowList, fetcher *imageFetcher) *imageEmbedder {
+	return &imageEmbedder{
+		doc:       doc,
+		allowed:   allowed,
+		fetcher:   fetcher,
+		embedded:  make(map[string]string),
+		byHash:    make(map[string]string),
+		fallbacks: make(map[string]string),
+	}
+}
+
+// imageURLs returns the images in content that embed would fetch.
+func (m *imageEmbedder) imageURLs(content string, pageURL string) []string {
+	if !strings.Contains(content, "<img") {
+		return nil
+	}
+	base, err := url.Parse(pageURL)
+	if err != nil {
+		return nil
+	}
+	fragment, err := goquery.NewDocumentFromReader(strings.NewReader(content))
+	if err != nil {
+		return nil
+	}
+	var urls []string
+	fragment.Find("img[src]").Each(func(_ int, img *goquery.Selection) {
+		src, _ := img.Attr("src")
+		if strings.HasPrefix(src, "data:") || strings.HasPrefix(src, "../"+epub.ImageFolderName+"/") {
+			return
+		}
+		if imageURL, err := base.Parse(src); err == nil && m.allowed.allows(imageURL.Hostname()) {
+			urls = append(urls, imageURL.String())
+		}
+	})
+	return urls
+}
+
+// add embeds the downloaded copy of imageURL under name, or a generated name
+// if that is taken. An image identical to one already embedded isn't added
+// again; the path of the earlier copy is returned instead.
+func (m *imageEmbedder) add(imageURL string, name string) (string, error) {
+	filename, hash, err := m.fetcher.wait(imageURL)
+	if err != nil {
+		return "", err
+	}
+	return m.addDownloaded(filename, hash, name)
+}
+
+// addDownloaded embeds the image at filename, whose hash is hash, like add.
+// WebP and AVIF images are embedded as JPEG or PNG, and SVG images along with
+// a PNG fallback.
+func (m *imageEmbedder) addDownloaded(filename string, hash string, name string) (string, error) {
+	if path, ok := m.byHash[hash]; ok {
+		logger.Debugw("Reuse identical image", "filename", filename, "path", path)
+		return path, nil
+	}
+	if converted, convertedName, err := convertImage(filename, name); errors.Is(err, errNoAVIFConverter) {
+		warnNoAVIFConverter.Do(func() { logger.Warnw("Embed AVIF images as they are", "error", err) })
+	} else if err != nil {
+		logger.Warnw("Failed to convert image", "filename", filename, "error", err)
+	} else {
+		filename, name = converted, convertedName
+	}
+	path, err := m.addFile(filename, name)
+	if err != nil {
+		return "", err
+	}
+	m.byHash[hash] = path
+	if svg, err := isSVG(filename); err == nil && svg {
+		m.addFallback(filename, name, path)
+	}
+	return path, nil
+}
+
+// addFallback embeds a PNG rendering of the SVG image at filename, embedded
+// at path, if there is anything to render it with.
+func (m *imageEmbedder) addFallback(filename string, name string, path string) {
+	fallback, fallbackName, err := rasterizeSVG(filename, name)
+	if err != nil {
+		logger.Warnw("Failed to render SVG image", "filename", filename, "error", err)
+		return
+	}
+	if fallback == "" {
+		warnNoSVGRasterizer.Do(func() {
+			logger.Warn("Embed SVG images without PNG fallbacks, as neither rsvg-convert nor resvg is installed")
+		})
+		return
+	}
+	fallbackPath, err := m.addFile(fallback, fallbackName)
+	if err != nil {
+		logger.Warnw("Failed to embed SVG fallback", "filename", fallback, "error", err)
+		return
+	}
+	m.fallbacks[path] = fallbackPath
+}
+
+// imageHTML is the markup showing the image embedded at path in place of an
+// inline SVG image: an <object> of it with its PNG fallback inside, or else
+// an <img>.
+func (m *imageEmbedder) imageHTML(path string) string {
+	if fallback, ok := m.fallbacks[path]; ok {
+		return fmt.Sprintf(`<object type="image/svg+xml" data="%s"><img src="%s" alt=""/></object>`, html.EscapeString(path), html.EscapeString(fallback))
+	}
+	return fmt.Sprintf(`<img src="%s" alt=""/>`, html.EscapeString(path))
+}
+
+func (m *imageEmbedder) addFile(filename string, name string) (string, error) {
+	if name != "" {
+		embedded, err := m.doc.AddImage(filename, name)
+		var used *epub.FilenameAlreadyUsedError
+		if !errors.As(err, &used) {
+			return embedded, err
+		}
+	}
+	return m.doc.AddImage(filename, "")
+}
+
+// embed rewrites every <img> in content whose source is on an allowed host to
+// point at an embedded copy. Images on other hosts, or that fail to download,
+// keep their remote source. Inline <svg> images are embedded as files of their
+// own, and SVG images get their PNG fallbacks.
+func (m *imageEmbedder) embed(content string, pageURL string) (string, error) {
+	if !strings.Contains(content, "<img") && !strings.Contains(content, "<svg") {
+		return content, nil
+	}
+	base, err := url.Parse(pageURL)
+	if err != nil {
+		return "", err
+	}
+	fragment, err := goquery.NewDocumentFromReader(strings.NewReader(content))
+	if err != nil {
+		return "", err
+	}
+	fragment.Find("svg").Each(func(_ int, svg *goquery.Selection) {
+		if svg.ParentsFiltered("svg").Length() > 0 {
+			return
+		}
+		filename, hash, err := saveInlineSVG(svg.Nodes[0], m.fetcher.dir)
+		if err != nil {
+			logger.Warnw("Failed to save inline SVG image", "page", pageURL, "error", err)
+			return
+		}
+		path, err := m.addDownloaded(filename, hash, "")
+		if err != nil {
+			logger.Warnw("Failed to embed inline SVG image", "page", pageURL, "error", err)
+			return
+		}
+		svg.ReplaceWithHtml(m.imageHTML(path))
+	})
+	fragment.Find("img[src]").Each(func(_ int, img *goquery.Selection) {
+		src, _ := img.Attr("src")
+		// Images carried over from a previous epub are already embedded.
+		if strings.HasPrefix(src, "data:") || strings.HasPrefix(src, "../"+epub.ImageFolderName+"/") {
+			return
+		}
+		imageURL, err := base.Parse(src)
+		if err != nil {
+			logger.Warnw("Invalid image source", "src", src, "page", pageURL)
+			return
+		}
+		if !m.allowed.allows(imageURL.Hostname()) {
+			logger.Warnw("Image host is not an allowed asset domain", "url", imageURL, "page", pageURL)
+			return
+		}
+		path, ok := m.embedded[imageURL.String()]
+		if !ok {
+			path, err = m.add(imageURL.String(), imageName(imageURL))
+			if err != nil {
+				logger.Warnw("Failed to embed image", "url", imageURL, "error", err)
+				return
+			}
+			m.embedded[imageURL.String()] = path
+		}
+		img.SetAttr("src", path)
+		if fallback, ok := m.fallbacks[path]; ok {
+			img.SetAttr("src", fallback)
+			img.WrapHtml(fmt.Sprintf(`<object type="image/svg+xml" data="%s"></object>`, html.EscapeString(path)))
+		}
+	})
+	return fragment.Find("body").Html()
+}
+
+// imageName is the name an image from imageURL is embedded under, the last
+// element of its path where that makes a usable file name.
+func imageName(imageURL *url.URL) string {
+	name := path.Base(imageURL.Path)
+	if name == "/" || name == "." || strings.ContainsAny(name, "%?#") {
+		return ""
+	}
+	return name
+}
+
+// lazySourceAttrs are where lazy-loading scripts, such as those of WordPress
+// and Madara themes, keep the source of an image until it scrolls into view,
+// its src being a placeholder meanwhile.
+var lazySourceAttrs = []string{"data-src", "data-lazy-src", "data-original"}
+
+// lazySrcsetAttrs are the same for srcset.
+var lazySrcsetAttrs = []string{"data-srcset", "data-lazy-srcset", "srcset"}
+
+// resolveLazyImages gives every image under node the source a browser would
+// end up showing, for the book not to embed placeholder pixels in place of
+// illustrations: that from a lazy-loading attribute, or else the largest
+// image of its srcset where it has no src of its own. Its srcset goes, as
+// the images in it aren't embedded.
+func resolveLazyImages(node *xhtml.Node) {
+	walkNodes(node, func(n *xhtml.Node) {
+		if n.DataAtom != atom.Img {
+			return
+		}
+		src := strings.TrimSpace(attr(n, "src"))
+		resolved := ""
+		for _, key := range lazySourceAttrs {
+			if value := strings.TrimSpace(attr(n, key)); value != "" && !strings.HasPrefix(value, "data:") {
+				resolved = value
+				break
+			}
+		}
+		if resolved == "" && (src == "" || strings.HasPrefix(src, "data:")) {
+			for _, key := range lazySrcsetAttrs {
+				if resolved = largestSrcsetImage(attr(n, key)); resolved != "" {
+					break
+				}
+			}
+		}
+		// The srcset goes either way, and the lazy-loading attributes once
+		// they have given the image its source.
+		dropped := func(key string) bool {
+			if key == "srcset" || key == "sizes" {
+				return true
+			}
+			return resolved != "" && (containsString(lazySourceAttrs, key) || containsString(lazySrcsetAttrs, key))
+		}
+		var attrs []xhtml.Attribute
+		for _, a := range n.Attr {
+			if !dropped(a.Key) {
+				attrs = append(attrs, a)
+			}
+		}
+		n.Attr = attrs
+		if resolved != "" && resolved != src {
+			setAttr(n, "src", resolved)
+		}
+	})
+}
+
+// largestSrcsetImage returns the URL of the widest, or highest density,
+// image of a srcset, or the first one if none say.
+func largestSrcsetImage(srcset string) string {
+	best, bestSize := "", -1.0
+	for _, candidate := range parseSrcset(srcset) {
+		if strings.HasPrefix(candidate.url, "data:") {
+			continue
+		}
+		size := 0.0
+		if fields := strings.Fields(candidate.descriptor); len(fields) > 0 {
+			descriptor := fields[0]
+			if n, err := strconv.ParseFloat(descriptor[:len(descriptor)-1], 64); err == nil && (strings.HasSuffix(descriptor, "w") || strings.HasSuffix(descriptor, "x")) {
+				size = n
+			}
+		}
+		if size > bestSize {
+			best, bestSize = candidate.url, size
+		}
+	}
+	return best
+}
+
+type srcsetCandidate struct {
+	url, descriptor string
+}
+
+// parseSrcset splits a srcset into its candidates as the HTML standard does:
+// a URL runs up to whitespace, commas and all, as in those of image CDNs
+// such as .../w_300,h_200/..., and its descriptor then up to a comma.
+func parseSrcset(srcset string) []srcsetCandidate {
+	var candidates []srcsetCandidate
+	isSpace := func(c byte) bool { return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' }
+	i := 0
+	for {
+		for i < len(srcset) && (isSpace(srcset[i]) || srcset[i] == ',') {
+			i++
+		}
+		if i == len(srcset) {
+			return candidates
+		}
+		start := i
+		for i < len(srcset) && !isSpace(srcset[i]) {
+			i++
+		}
+		candidate := srcsetCandidate{url: srcset[start:i]}
+		// A URL with commas at its end has no descriptor.
+		if trimmed := strings.TrimRight(candidate.url, ","); trimmed != candidate.url {
+			candidate.url = trimmed
+		} else {
+			start = i
+			depth := 0
+			for i < len(srcset) && (srcset[i] != ',' || depth > 0) {
+				switch srcset[i] {
+				case '(':
+					depth++
+				case ')':
+					if depth > 0 {
+						depth--
+					}
+				}
+				i++
+			}
+			candidate.descriptor = strings.TrimSpace(srcset[start:i])
+		}
+		if candidate.url != "" {
+			candidates = append(candidates, candidate)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mdepp/go-epub"
+	xhtml "golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+func TestResolveLazyImages(t *testing.T) {
+	for content, want := range map[string]string{
+		`<img src="data:image/gif;base64,R0lGOD" data-src=" https://example.com/a.jpg " class="lazyload">`: `<img src="https://example.com/a.jpg" class="lazyload"/>`,
+		`<img src="/lazy.png" data-lazy-src="/b.png" data-lazy-srcset="/b-300.png 300w">`:                  `<img src="/b.png"/>`,
+		`<img data-srcset="/c-300.jpg 300w, /c-1024.jpg 1024w, /c-768.jpg 768w" sizes="100vw">`:            `<img src="/c-1024.jpg"/>`,
+		`<img src="/d.jpg" srcset="/d.jpg 1x, /d@2x.jpg 2x">`:                                              `<img src="/d.jpg"/>`,
+		`<img alt="plain" src="/e.jpg">`:                                                                   `<img alt="plain" src="/e.jpg"/>`,
+	} {
+		context := &xhtml.Node{Type: xhtml.ElementNode, Data: "body", DataAtom: atom.Body}
+		nodes, err := xhtml.ParseFragment(strings.NewReader(content), context)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		for _, node := range nodes {
+			context.AppendChild(node)
+		}
+		resolveLazyImages(context)
+		for node := context.FirstChild; node != nil; node = node.NextSibling {
+			xhtml.Render(&buf, node)
+		}
+		if got := buf.String(); got != want {
+			t.Errorf("resolveLazyImages(%s) = %s, want %s", content, got, want)
+		}
+	}
+}
+
+func TestConvertImage(t *testing.T) {
+	dir := t.TempDir()
+	for _, test := range []struct {
+		source, name, wantName, wantFormat string
+	}{
+		{"blue-purple-pink.lossy.webp", "pink.webp", "pink.jpg", "jpeg"},
+		// Transparent, so kept so.
+		{"yellow_rose.lossy-with-alpha.webp", "rose.webp", "rose.png", "png"},
+	} {
+		data, err := os.ReadFile(filepath.Join("testdata", "images", test.source))
+		if err != nil {
+			t.Fatal(err)
+		}
+		filename := filepath.Join(dir, test.source)
+		if err := os.WriteFile(filename, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		converted, name, err := convertImage(filename, test.name)
+		if err != nil {
+			t.Fatalf("convertImage(%s): %v", test.source, err)
+		}
+		if name != test.wantName {
+			t.Errorf("convertImage(%s) named it %s, want %s", test.source, name, test.wantName)
+		}
+		f, err := os.Open(converted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, format, err := image.DecodeConfig(f)
+		f.Close()
+		if err != nil || format != test.wantFormat {
+			t.Errorf("convertImage(%s) made a %s image, want %s (%v)", test.source, format, test.wantFormat, err)
+		}
+	}
+	// Other images are embedded as they are.
+	filename := filepath.Join(dir, "plain.gif")
+	if err := os.WriteFile(filename, []byte("GIF89a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if converted, name, err := convertImage(filename, "plain.gif"); err != nil || converted != filename || name != "plain.gif" {
+		t.Errorf("convertImage(plain.gif) = %s, %s, %v", converted, name, err)
+	}
+}
+
+func TestEmbedSVG(t *testing.T) {
+	// Stands in for rsvg-convert, for the test to see the fallback used.
+	rasterizers := svgRasterizers
+	svgRasterizers = [][]string{{"cp", "{in}", "{out}"}}
+	defer func() { svgRasterizers = rasterizers }()
+
+	fetcher, err := newImageFetcher(http.DefaultClient, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fetcher.Close()
+	images := newImageEmbedder(epub.NewEpub(""), nil, fetcher)
+	content := repairHTML(`<p>A diagram:</p><svg viewBox="0 0 10 10"><defs><circle id="c" r="4"/></defs><use xlink:href="#c"/></svg>`)
+	if !strings.Contains(content, `xmlns:xlink="http://www.w3.org/1999/xlink"`) || !strings.Contains(content, `xlink:href="#c"`) {
+		t.Errorf("repairHTML dropped the xlink namespace: %s", content)
+	}
+	embedded, err := images.embed(content, "https://example.com/chapter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images.fallbacks) != 1 {
+		t.Fatalf("embedded %d SVG images with fallbacks, want 1", len(images.fallbacks))
+	}
+	for path, fallback := range images.fallbacks {
+		want := `<p>A diagram:</p><object type="image/svg+xml" data="` + path + `"><img src="` + fallback + `" alt=""/></object>`
+		if embedded != want {
+			t.Errorf("embed = %s, want %s", embedded, want)
+		}
+	}
+	files, _ := filepath.Glob(filepath.Join(fetcher.dir, "inline-*.svg"))
+	if len(files) != 1 {
+		t.Fatalf("saved %d inline SVG images, want 1", len(files))
+	}
+	data, _ := os.ReadFile(files[0])
+	if !strings.Contains(string(data), `<svg viewBox="0 0 10 10" xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink">`) {
+		t.Errorf("saved SVG image without its namespaces: %s", data)
+	}
+}
+
+func TestImageExt(t *testing.T) {
+	for imageURL, want := range map[string]string{
+		"https://i0.wp.com/example.com/x.png?w=300": ".png",
+		"https://example.com/cover.jpg#top":         ".jpg",
+		"https://example.com/image?id=3.gif":        "",
+	} {
+		if got := imageExt(imageURL); got != want {
+			t.Errorf("imageExt(%s) = %q, want %q", imageURL, got, want)
+		}
+	}
+}
+
+func TestLargestSrcsetImage(t *testing.T) {
+	for srcset, want := range map[string]string{
+		"/c-300.jpg 300w, /c-1024.jpg 1024w, /c-768.jpg 768w": "/c-1024.jpg",
+		"/d.jpg 1x,/d@2x.jpg 2x":                              "/d@2x.jpg",
+		"https://res.cloudinary.com/demo/image/upload/w_300,h_200/a.jpg 300w, https://res.cloudinary.com/demo/image/upload/w_900,h_600/a.jpg 900w": "https://res.cloudinary.com/demo/image/upload/w_900,h_600/a.jpg",
+		"https://i0.wp.com/x.png?resize=300,200, data:image/gif;base64,R0lGOD 2x":                                                                  "https://i0.wp.com/x.png?resize=300,200",
+	} {
+		if got := largestSrcsetImage(srcset); got != want {
+			t.Errorf("largestSrcsetImage(%q) = %q, want %q", srcset, got, want)
+		}
+	}
+}
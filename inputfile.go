@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// bookJob is one story to scrape, along with the options that apply to it.
+type bookJob struct {
+	URL     string
+	Output  string
+	Options ScrapeOptions
+	// Update, if set, is an epub written by an earlier run that only needs
+	// the chapters published since.
+	Update string
+	// NotifyURL, if set, is where this book's notifications are pushed
+	// instead of -notify-url, for stories scraped for different people.
+	NotifyURL string
+	// OnWritten, if set, is called with the name of the epub once it has
+	// been written.
+	OnWritten func(filename string)
+	// GlossaryURL, if set, is a page listing the story's terms or characters,
+	// such as a fan wiki's, to append to the book as a glossary.
+	GlossaryURL string
+}
+
+// readInputFile reads story URLs from filename, or from stdin if it is "-".
+// Each line holds a URL optionally followed by options overriding the
+// defaults for that story alone, e.g.
+//
+//	# Weekly serials
+//	https://www.royalroad.com/fiction/21220 -o "mother-of-learning.epub"
+//	https://www.scribblehub.com/series/1234/ --from-url https://...  # resumed
+//	https://www.royalroad.com/fiction/63759 --notify-url https://ntfy.sh/alice-books
+//
+// Blank lines and everything after a '#' that starts a word are ignored.
+func readInputFile(filename string, defaults bookJob) ([]bookJob, error) {
+	var r io.Reader = os.Stdin
+	if filename != "-" {
+		f, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	var jobs []bookJob
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		words, err := splitWords(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", filename, lineNumber, err)
+		}
+		if len(words) == 0 {
+			continue
+		}
+		job, err := parseJob(words, defaults)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", filename, lineNumber, err)
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, scanner.Err()
+}
+
+func parseJob(words []string, defaults bookJob) (bookJob, error) {
+	job := defaults
+	job.URL = words[0]
+	flags := flag.NewFlagSet(job.URL, flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	flags.StringVar(&job.Output, "output", job.Output, "")
+	flags.StringVar(&job.Output, "o", job.Output, "")
+	flags.StringVar(&job.Options.FromURL, "from-url", job.Options.FromURL, "")
+	flags.StringVar(&job.NotifyURL, "notify-url", job.NotifyURL, "")
+	flags.StringVar(&job.GlossaryURL, "glossary-url", job.GlossaryURL, "")
+	if err := flags.Parse(words[1:]); err != nil {
+		return bookJob{}, err
+	}
+	if flags.NArg() > 0 {
+		return bookJob{}, fmt.Errorf("unexpected argument %q", flags.Arg(0))
+	}
+	return job, nil
+}
+
+// splitWords splits a line on whitespace, honoring single and double quotes
+// and dropping a trailing comment.
+func splitWords(line string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	for _, r := range line {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			word.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote = r
+			inWord = true
+		case r == '#' && !inWord:
+			return words, nil
+		case r == ' ' || r == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	xhtml "golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// kepubFilename is where the kepub made from the epub at filename goes.
+// Kobo readers only treat a book as a kepub when its name ends .kepub.epub.
+func kepubFilename(filename string) string {
+	return strings.TrimSuffix(filename, filepath.Ext(filename)) + ".kepub.epub"
+}
+
+// writeKepub converts the epub at src into a kepub at dst, the flavour of
+// epub Kobo readers render with their own engine, which is faster and
+// brings reading statistics and better highlighting. Every sentence of the
+// sections is marked with a koboSpan, and their bodies wrapped in the
+// book-columns and book-inner divs the engine lays pages out with; everything
+// else is copied as it is.
+func writeKepub(src string, dst string) error {
+	reader, err := zip.OpenReader(src)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	out, err := os.CreateTemp(filepath.Dir(dst), ".ebook-scraper-*.kepub.epub")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	writer := zip.NewWriter(out)
+	for _, f := range reader.File {
+		header := f.FileHeader
+		w, err := writer.CreateHeader(&zip.FileHeader{Name: header.Name, Method: header.Method, Modified: header.Modified})
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(f.Name, epubXHTMLDir+"/") && path.Ext(f.Name) == ".xhtml" {
+			data, err := readZipFile(f)
+			if err != nil {
+				return err
+			}
+			data, err = kepubifySection(data)
+			if err != nil {
+				return fmt.Errorf("%s: %w", f.Name, err)
+			}
+			if _, err := w.Write(data); err != nil {
+				return err
+			}
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), dst)
+}
+
+// kobo spans are numbered by paragraph and by sentence within it, as
+// kobo.3.2 for the second sentence of the third paragraph.
+type koboSpanner struct {
+	paragraph, sentence int
+}
+
+// kepubifySection marks up one XHTML section of the book for Kobo.
+func kepubifySection(data []byte) ([]byte, error) {
+	// The XML declaration isn't HTML, and would come out as a comment.
+	var prolog []byte
+	if bytes.HasPrefix(data, []byte("<?xml")) {
+		if end := bytes.Index(data, []byte("?>")); end >= 0 {
+			prolog, data = data[:end+2], data[end+2:]
+		}
+	}
+	doc, err := xhtml.Parse(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	body := findElement(doc, atom.Body)
+	if body == nil {
+		return nil, fmt.Errorf("section has no body")
+	}
+	spanner := &koboSpanner{}
+	spanner.mark(body)
+
+	inner := &xhtml.Node{Type: xhtml.ElementNode, Data: "div", DataAtom: atom.Div, Attr: []xhtml.Attribute{{Key: "id", Val: "book-inner"}}}
+	for child := body.FirstChild; child != nil; child = body.FirstChild {
+		body.RemoveChild(child)
+		inner.AppendChild(child)
+	}
+	columns := &xhtml.Node{Type: xhtml.ElementNode, Data: "div", DataAtom: atom.Div, Attr: []xhtml.Attribute{{Key: "id", Val: "book-columns"}}}
+	columns.AppendChild(inner)
+	body.AppendChild(columns)
+
+	var buf bytes.Buffer
+	buf.Write(prolog)
+	if err := xhtml.Render(&buf, doc); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// blockElements are the elements that hold a paragraph of text, whose
+// sentences kobo spans number together.
+var blockElements = map[atom.Atom]bool{
+	atom.P: true, atom.H1: true, atom.H2: true, atom.H3: true, atom.H4: true, atom.H5: true, atom.H6: true,
+	atom.Li: true, atom.Dt: true, atom.Dd: true, atom.Td: true, atom.Th: true, atom.Blockquote: true,
+	atom.Figcaption: true, atom.Pre: true, atom.Div: true,
+}
+
+func (k *koboSpanner) mark(node *xhtml.Node) {
+	for child := node.FirstChild; child != nil; {
+		next := child.NextSibling
+		switch child.Type {
+		case xhtml.ElementNode:
+			if child.DataAtom == atom.Script || child.DataAtom == atom.Style {
+				break
+			}
+			if blockElements[child.DataAtom] {
+				k.paragraph++
+				k.sentence = 0
+			}
+			k.mark(child)
+		case xhtml.TextNode:
+			if strings.TrimSpace(child.Data) == "" {
+				break
+			}
+			if k.paragraph == 0 {
+				k.paragraph = 1
+			}
+			for _, sentence := range splitSentences(child.Data) {
+				k.sentence++
+				span := &xhtml.Node{Type: xhtml.ElementNode, Data: "span", DataAtom: atom.Span, Attr: []xhtml.Attribute{
+					{Key: "class", Val: "koboSpan"},
+					{Key: "id", Val: fmt.Sprintf("kobo.%d.%d", k.paragraph, k.sentence)},
+				}}
+				span.AppendChild(&xhtml.Node{Type: xhtml.TextNode, Data: sentence})
+				node.InsertBefore(span, child)
+			}
+			node.RemoveChild(child)
+		}
+		child = next
+	}
+}
+
+// splitSentences breaks text after each run of sentence-ending punctuation
+// that is followed by a space, keeping the spaces with the sentence before.
+func splitSentences(text string) []string {
+	var sentences []string
+	runes := []rune(text)
+	start := 0
+	for i := 0; i < len(runes); i++ {
+		if !strings.ContainsRune(".!?…", runes[i]) {
+			continue
+		}
+		j := i + 1
+		for j < len(runes) && strings.ContainsRune(".!?…\"'”’)", runes[j]) {
+			j++
+		}
+		if j == len(runes) || !unicode.IsSpace(runes[j]) {
+			i = j - 1
+			continue
+		}
+		for j < len(runes) && unicode.IsSpace(runes[j]) {
+			j++
+		}
+		sentences = append(sentences, string(runes[start:j]))
+		start = j
+		i = j - 1
+	}
+	if start < len(runes) {
+		sentences = append(sentences, string(runes[start:]))
+	}
+	return sentences
+}
+
+func findElement(node *xhtml.Node, a atom.Atom) *xhtml.Node {
+	if node.Type == xhtml.ElementNode && node.DataAtom == a {
+		return node
+	}
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		if found := findElement(child, a); found != nil {
+			return found
+		}
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"html/template"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// koboServer serves finished books on the local network for a while, so that
+// they can be downloaded with the Kobo's own browser instead of over a
+// cable. The reader's browser only downloads books from plain links, so the
+// root is a bare page linking every book.
+type koboServer struct {
+	server   *http.Server
+	listener net.Listener
+
+	mu    sync.Mutex
+	books []*koboBook
+	// downloaded is signalled whenever a book is first downloaded.
+	downloaded chan struct{}
+}
+
+type koboBook struct {
+	name       string
+	filename   string
+	downloaded bool
+}
+
+var koboIndexTemplate = template.Must(template.New("kobo").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>ebook-scraper</title></head>
+<body><h1>Books</h1><ul>
+{{range .}}<li><a href="/{{.Name}}">{{.Name}}</a>{{if .Downloaded}} (downloaded){{end}}</li>
+{{else}}<li>No books yet</li>
+{{end}}</ul></body></html>
+`))
+
+// startKoboServer listens on addr and serves books as they are added.
+func startKoboServer(addr string) (*koboServer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	k := &koboServer{listener: listener, downloaded: make(chan struct{}, 1)}
+	k.server = &http.Server{Handler: k, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := k.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Warnw("Kobo server stopped", "error", err)
+		}
+	}()
+	logger.Infow("Serve books to Kobo, open this in its browser", "url", k.url())
+	return k, nil
+}
+
+// url is the address the server is reached at from other machines on the
+// network. Dialing udp sends nothing, but picks the interface that routes
+// there.
+func (k *koboServer) url() string {
+	port := k.listener.Addr().(*net.TCPAddr).Port
+	host := "localhost"
+	if conn, err := net.Dial("udp", "192.0.2.1:80"); err == nil {
+		host = conn.LocalAddr().(*net.UDPAddr).IP.String()
+		conn.Close()
+	}
+	return "http://" + net.JoinHostPort(host, strconv.Itoa(port)) + "/"
+}
+
+// add makes the book at filename available for download.
+func (k *koboServer) add(filename string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	name := filepath.Base(filename)
+	for _, book := range k.books {
+		if book.name == name {
+			book.filename, book.downloaded = filename, false
+			return
+		}
+	}
+	k.books = append(k.books, &koboBook{name: name, filename: filename})
+}
+
+func (k *koboServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/" {
+		type listed struct {
+			Name       string
+			Downloaded bool
+		}
+		var books []listed
+		k.mu.Lock()
+		for _, book := range k.books {
+			books = append(books, listed{book.name, book.downloaded})
+		}
+		k.mu.Unlock()
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		koboIndexTemplate.Execute(w, books)
+		return
+	}
+	k.mu.Lock()
+	var found *koboBook
+	for _, book := range k.books {
+		if "/"+book.name == r.URL.Path {
+			found = book
+		}
+	}
+	k.mu.Unlock()
+	if found == nil {
+		http.NotFound(w, r)
+		return
+	}
+	logger.Infow("Kobo downloads book", "filename", found.filename, "remote", r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/epub+zip")
+	http.ServeFile(w, r, found.filename)
+	k.mu.Lock()
+	found.downloaded = true
+	k.mu.Unlock()
+	select {
+	case k.downloaded <- struct{}{}:
+	default:
+	}
+}
+
+func (k *koboServer) pending() int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	pending := 0
+	for _, book := range k.books {
+		if !book.downloaded {
+			pending++
+		}
+	}
+	return pending
+}
+
+// wait keeps serving until every book has been downloaded or timeout has
+// passed, and then shuts the server down.
+func (k *koboServer) wait(timeout time.Duration) {
+	deadline := time.After(timeout)
+	for k.pending() > 0 {
+		logger.Infow("Wait for Kobo to download books", "url", k.url(), "pending", k.pending(), "timeout", timeout)
+		select {
+		case <-k.downloaded:
+			continue
+		case <-deadline:
+			logger.Warnw("Stop serving books that weren't downloaded", "pending", k.pending())
+		}
+		break
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := k.server.Shutdown(ctx); err != nil {
+		logger.Warnw("Failed to stop Kobo server", "error", err)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// A library is a directory of books filed as Author/Title/Title.epub, with
+// an index of what it holds in libraryIndexFilename.
+const libraryIndexFilename = "index.json"
+
+type libraryEntry struct {
+	Title    string    `json:"title"`
+	Author   string    `json:"author"`
+	Source   string    `json:"source"`
+	Path     string    `json:"path"`
+	Chapters int       `json:"chapters"`
+	Updated  time.Time `json:"updated"`
+	// Hashes maps the URL of each chapter to its chapterHash.
+	Hashes map[string]string `json:"hashes,omitempty"`
+}
+
+func libraryFilename(dir string, book ScrapedBook) string {
+	title := sanitizePathComponent(book.meta.Title)
+	if title == "" {
+		title = "Untitled"
+	}
+	author := sanitizePathComponent(book.meta.Author)
+	if author == "" {
+		author = "Unknown"
+	}
+	return filepath.Join(dir, author, title, title+".epub")
+}
+
+// readLibraryIndex returns the entries of the index of the library in dir,
+// which are none before the first book is filed there.
+func readLibraryIndex(dir string) ([]libraryEntry, error) {
+	var entries []libraryEntry
+	data, err := os.ReadFile(filepath.Join(dir, libraryIndexFilename))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// updateLibraryIndex records entry in the index of the library in dir,
+// replacing any earlier entry for the same story.
+func updateLibraryIndex(dir string, entry libraryEntry) error {
+	filename := filepath.Join(dir, libraryIndexFilename)
+	entries, err := readLibraryIndex(dir)
+	if err != nil {
+		return err
+	}
+	if rel, err := filepath.Rel(dir, entry.Path); err == nil {
+		entry.Path = filepath.ToSlash(rel)
+	}
+	replaced := false
+	for i := range entries {
+		if entries[i].Source == entry.Source {
+			entries[i] = entry
+			replaced = true
+		}
+	}
+	if !replaced {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Author != entries[j].Author {
+			return entries[i].Author < entries[j].Author
+		}
+		return entries[i].Title < entries[j].Title
+	})
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filename+"~", append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(filename+"~", filename)
+}
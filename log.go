@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/term"
+)
+
+// logOptions say where logs go. By default people get concise status lines
+// on stderr, with warnings and errors highlighted. Structured logs, in
+// Format, are written to File when set, and replace the status lines on
+// stderr with Debug or the json format. Only warnings and errors are logged
+// with Quiet, debugging output such as every visited URL only with Verbose.
+type logOptions struct {
+	Verbose bool
+	Quiet   bool
+	Format  string
+	File    string
+	Debug   bool
+}
+
+// statusLines reports whether stderr gets status lines rather than structured
+// logs.
+func (o logOptions) statusLines() bool {
+	return !o.Debug && (o.Format != "json" || o.File != "")
+}
+
+func newLogger(options logOptions) (*zap.Logger, error) {
+	var config zapcore.EncoderConfig
+	switch options.Format {
+	case "console":
+		config = zap.NewDevelopmentEncoderConfig()
+	case "json":
+		config = zap.NewProductionEncoderConfig()
+	default:
+		return nil, fmt.Errorf("unknown log format %q", options.Format)
+	}
+	var level zapcore.Level
+	switch {
+	case options.Verbose && options.Quiet:
+		return nil, fmt.Errorf("-v and -q cannot be used together")
+	case options.Verbose:
+		level = zapcore.DebugLevel
+	case options.Quiet:
+		level = zapcore.WarnLevel
+	default:
+		level = zapcore.InfoLevel
+	}
+	encoder := zapcore.NewConsoleEncoder(config)
+	if options.Format == "json" {
+		encoder = zapcore.NewJSONEncoder(config)
+	}
+
+	var cores []zapcore.Core
+	if options.File != "" {
+		f, err := os.OpenFile(options.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		cores = append(cores, zapcore.NewCore(encoder, zapcore.AddSync(f), level))
+	}
+	if options.statusLines() {
+		cores = append(cores, newConsoleCore(os.Stderr, level))
+	} else {
+		cores = append(cores, zapcore.NewCore(encoder, zapcore.Lock(os.Stderr), level))
+	}
+	return zap.New(zapcore.NewTee(cores...), zap.AddCaller(), zap.AddStacktrace(zapcore.DPanicLevel)), nil
+}
+
+// consoleCore prints log entries as short status lines: the message followed
+// by its fields as key=value, colored by level when writing to a terminal.
+type consoleCore struct {
+	zapcore.LevelEnabler
+	out    *os.File
+	color  bool
+	fields []zapcore.Field
+	mu     *sync.Mutex
+}
+
+func newConsoleCore(out *os.File, level zapcore.LevelEnabler) *consoleCore {
+	color := term.IsTerminal(int(out.Fd())) && os.Getenv("NO_COLOR") == ""
+	return &consoleCore{LevelEnabler: level, out: out, color: color, mu: &sync.Mutex{}}
+}
+
+func (c *consoleCore) With(fields []zapcore.Field) zapcore.Core {
+	clone := *c
+	clone.fields = append(append([]zapcore.Field{}, c.fields...), fields...)
+	return &clone
+}
+
+func (c *consoleCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(entry.Level) {
+		return checked.AddCore(entry, c)
+	}
+	return checked
+}
+
+const (
+	ansiReset     = "\033[0m"
+	ansiDim       = "\033[2m"
+	ansiRed       = "\033[31m"
+	ansiYellow    = "\033[33m"
+	ansiCyan      = "\033[36m"
+	ansiClearLine = "\r\033[K"
+)
+
+func (c *consoleCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	var line strings.Builder
+	prefix, color := "", ""
+	switch {
+	case entry.Level >= zapcore.ErrorLevel:
+		prefix, color = "error: ", ansiRed
+	case entry.Level == zapcore.WarnLevel:
+		prefix, color = "warning: ", ansiYellow
+	case entry.Level == zapcore.InfoLevel:
+		prefix, color = "==> ", ansiCyan
+	default:
+		prefix, color = "    ", ansiDim
+	}
+	if c.color {
+		// A progress bar may be drawn on the current line.
+		line.WriteString(ansiClearLine + color + prefix + ansiReset)
+	} else {
+		line.WriteString(prefix)
+	}
+	line.WriteString(entry.Message)
+
+	var details []string
+	for _, field := range append(append([]zapcore.Field{}, c.fields...), fields...) {
+		encoder := zapcore.NewMapObjectEncoder()
+		field.AddTo(encoder)
+		for key, value := range encoder.Fields {
+			details = append(details, fmt.Sprintf("%s=%v", key, value))
+		}
+	}
+	if len(details) > 0 {
+		if c.color {
+			line.WriteString(" " + ansiDim + strings.Join(details, " ") + ansiReset)
+		} else {
+			line.WriteString(" " + strings.Join(details, " "))
+		}
+	}
+	line.WriteString("\n")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.out.WriteString(line.String())
+	return err
+}
+
+func (c *consoleCore) Sync() error {
+	return nil
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	mapset "github.com/deckarep/golang-set/v2"
+	"github.com/mdepp/go-epub"
+)
+
+// bookManifest records where a book and each of its chapters came from, so
+// the book can be updated later without scraping it again from scratch. It is
+// stored inside the epub as manifestFilename.
+type bookManifest struct {
+	Source   string            `json:"source"`
+	Chapters []manifestChapter `json:"chapters"`
+}
+
+type manifestChapter struct {
+	URL   string    `json:"url"`
+	Title string    `json:"title"`
+	Date  time.Time `json:"date,omitempty"`
+	// File is the section's name inside the epub's xhtml folder.
+	File string `json:"file"`
+	// Missing marks a chapter that couldn't be fetched and is only a
+	// placeholder, to be fetched again by the next update.
+	Missing bool `json:"missing,omitempty"`
+	// Hash is the chapterHash of the chapter's content, for telling when
+	// it has been edited upstream.
+	Hash string `json:"hash,omitempty"`
+}
+
+// hashes maps the URL of each chapter that has a hash to it.
+func (m *bookManifest) hashes() map[string]string {
+	hashes := make(map[string]string)
+	for _, chapter := range m.Chapters {
+		if chapter.Hash != "" {
+			hashes[chapter.URL] = chapter.Hash
+		}
+	}
+	return hashes
+}
+
+// chapterHash hashes the text of a chapter's content, with its whitespace
+// collapsed, so that the hash only changes with what the reader sees. Markup
+// is left out, as it differs between a chapter as scraped and as read back
+// from the epub with its images embedded.
+func chapterHash(content string) string {
+	sum := sha256.Sum256([]byte(strings.Join(strings.Fields(htmlText(content)), " ")))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+const (
+	manifestFilename = "ebook-scraper.json"
+	epubContentDir   = "EPUB"
+	epubPackageFile  = epubContentDir + "/package.opf"
+	epubXHTMLDir     = epubContentDir + "/xhtml"
+	epubImageDir     = epubContentDir + "/" + epub.ImageFolderName
+)
+
+// writeManifest adds manifest to the epub at filename, declaring it in the
+// package document so that validators don't flag it as a stray file. The
+// package metadata is completed with what is known of meta as a published
+// work.
+//
+// While rewriting the epub it also makes it reproducible: every entry is
+// dated modified, as is the package document's dcterms:modified, and the
+// package manifest, which go-epub writes in map order, is sorted.
+func writeManifest(filename string, manifest *bookManifest, meta Metadata, modified time.Time) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	reader, err := zip.OpenReader(filename)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	out, err := os.CreateTemp(filepath.Dir(filename), ".ebook-scraper-*.epub")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	writer := zip.NewWriter(out)
+
+	modified = modified.UTC().Truncate(time.Second)
+	for _, f := range reader.File {
+		if f.Name == epubContentDir+"/"+manifestFilename {
+			continue
+		}
+		if f.Name != epubPackageFile {
+			// Keeping each entry's method keeps the mimetype entry, which
+			// comes first, stored uncompressed as the OCF spec requires. It
+			// must not have extra fields either, and so isn't dated.
+			header := &zip.FileHeader{Name: f.Name, Method: f.Method, Modified: modified}
+			if f.Name == "mimetype" {
+				header.Modified = time.Time{}
+			}
+			w, err := writer.CreateHeader(header)
+			if err != nil {
+				return err
+			}
+			r, err := f.Open()
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(w, r)
+			r.Close()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		opf, err := readZipFile(f)
+		if err != nil {
+			return err
+		}
+		item := `<item id="ebook-scraper-manifest" href="` + manifestFilename + `" media-type="application/json"></item>`
+		if !strings.Contains(string(opf), item) {
+			opf = []byte(strings.Replace(string(opf), "</manifest>", "  "+item+"\n  </manifest>", 1))
+			opf = []byte(strings.Replace(string(opf), "  </metadata>", publishedMetadata(meta)+"  </metadata>", 1))
+		}
+		opf = normalizePackage(opf, modified)
+		w, err := writer.CreateHeader(&zip.FileHeader{Name: f.Name, Method: zip.Deflate, Modified: modified})
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(opf); err != nil {
+			return err
+		}
+	}
+	w, err := writer.CreateHeader(&zip.FileHeader{Name: epubContentDir + "/" + manifestFilename, Method: zip.Deflate, Modified: modified})
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), filename)
+}
+
+var (
+	modifiedRegexp        = regexp.MustCompile(`(<meta property="dcterms:modified">)[^<]*(</meta>)`)
+	packageManifestRegexp = regexp.MustCompile(`(?s)(<manifest>\n)(.*?\n)(\s*</manifest>)`)
+)
+
+// normalizePackage dates the package document modified and sorts the items
+// of its manifest, one per line as go-epub writes them.
+func normalizePackage(opf []byte, modified time.Time) []byte {
+	opf = modifiedRegexp.ReplaceAll(opf, []byte("${1}"+modified.Format("2006-01-02T15:04:05Z")+"${2}"))
+	return packageManifestRegexp.ReplaceAllFunc(opf, func(match []byte) []byte {
+		parts := packageManifestRegexp.FindSubmatch(match)
+		items := strings.SplitAfter(string(parts[2]), "\n")
+		sort.Strings(items)
+		return []byte(string(parts[1]) + strings.Join(items, "") + string(parts[3]))
+	})
+}
+
+// bookIdentifier derives the epub's identifier from its source, as a name
+// based UUID, so that it stays the same when the book is written again.
+func bookIdentifier(source string) string {
+	sum := sha1.Sum([]byte("ebook-scraper:" + source))
+	sum[6] = sum[6]&0x0f | 0x50
+	sum[8] = sum[8]&0x3f | 0x80
+	return fmt.Sprintf("urn:uuid:%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+// bookTimestamp is the time a book is dated, so that writing the same
+// chapters again gives the same epub: the override when it is set, otherwise
+// $SOURCE_DATE_EPOCH, otherwise the newest chapter's date, and only failing
+// all of those the current time.
+func bookTimestamp(book ScrapedBook, override time.Time) time.Time {
+	if !override.IsZero() {
+		return override
+	}
+	if epoch, err := strconv.ParseInt(os.Getenv("SOURCE_DATE_EPOCH"), 10, 64); err == nil {
+		return time.Unix(epoch, 0)
+	}
+	var newest time.Time
+	for _, entry := range book.toc {
+		if entry.Date.After(newest) {
+			newest = entry.Date
+		}
+	}
+	if !newest.IsZero() {
+		return newest
+	}
+	return time.Now()
+}
+
+func readZipFile(f *zip.File) ([]byte, error) {
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// previousEpub is a book written by an earlier run, opened for updating. Its
+// chapters still refer to their images inside the epub, which are extracted to
+// a temporary directory so they can be embedded again.
+type previousEpub struct {
+	manifest bookManifest
+	chapters *chapterStore
+	// images maps an image's name inside the epub to its extracted copy.
+	images   map[string]string
+	imageDir string
+}
+
+var embeddedImageRegexp = regexp.MustCompile(`\.\./` + epub.ImageFolderName + `/([^"'\s>]+)`)
+
+func readPreviousEpub(filename string) (*previousEpub, error) {
+	reader, err := zip.OpenReader(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	files := make(map[string]*zip.File)
+	for _, f := range reader.File {
+		files[f.Name] = f
+	}
+
+	manifest, err := readManifestFile(filename, files)
+	if err != nil {
+		return nil, err
+	}
+	previous := &previousEpub{manifest: *manifest, chapters: newChapterStore(), images: make(map[string]string)}
+
+	previous.imageDir, err = os.MkdirTemp("", "ebook-scraper-update")
+	if err != nil {
+		return nil, err
+	}
+	for _, chapter := range previous.manifest.Chapters {
+		f, ok := files[path.Join(epubXHTMLDir, chapter.File)]
+		if !ok {
+			previous.Close()
+			return nil, fmt.Errorf("%s: section %s is missing", filename, chapter.File)
+		}
+		content, err := readSectionBody(f)
+		if err != nil {
+			previous.Close()
+			return nil, fmt.Errorf("%s: %w", chapter.File, err)
+		}
+		previous.chapters.put(chapter.URL, Chapter{Title: chapter.Title, Content: content})
+
+		for _, match := range embeddedImageRegexp.FindAllStringSubmatch(content, -1) {
+			if err := previous.extractImage(files, match[1]); err != nil {
+				previous.Close()
+				return nil, err
+			}
+		}
+	}
+	return previous, nil
+}
+
+// readSectionBody returns the content of the body of the xhtml section f.
+func readSectionBody(f *zip.File) (string, error) {
+	data, err := readZipFile(f)
+	if err != nil {
+		return "", err
+	}
+	var section struct {
+		Body struct {
+			XML string `xml:",innerxml"`
+		} `xml:"body"`
+	}
+	if err := xml.Unmarshal(data, &section); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(section.Body.XML), nil
+}
+
+// readManifest returns the manifest stored in the epub at filename.
+func readManifest(filename string) (*bookManifest, error) {
+	reader, err := zip.OpenReader(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	files := make(map[string]*zip.File)
+	for _, f := range reader.File {
+		files[f.Name] = f
+	}
+	return readManifestFile(filename, files)
+}
+
+func readManifestFile(filename string, files map[string]*zip.File) (*bookManifest, error) {
+	f, ok := files[epubContentDir+"/"+manifestFilename]
+	if !ok {
+		return nil, fmt.Errorf("%s was not written by ebook-scraper, or by a version too old to update it", filename)
+	}
+	data, err := readZipFile(f)
+	if err != nil {
+		return nil, err
+	}
+	var manifest bookManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("%s: %s: %w", filename, manifestFilename, err)
+	}
+	return &manifest, nil
+}
+
+func (p *previousEpub) extractImage(files map[string]*zip.File, name string) error {
+	if _, ok := p.images[name]; ok {
+		return nil
+	}
+	f, ok := files[path.Join(epubImageDir, name)]
+	if !ok {
+		return errors.New("embedded image " + name + " is missing")
+	}
+	data, err := readZipFile(f)
+	if err != nil {
+		return err
+	}
+	extracted := filepath.Join(p.imageDir, name)
+	if err := os.WriteFile(extracted, data, 0644); err != nil {
+		return err
+	}
+	p.images[name] = extracted
+	return nil
+}
+
+func (p *previousEpub) Close() error {
+	p.chapters.Close()
+	return os.RemoveAll(p.imageDir)
+}
+
+func (p *previousEpub) chapterURLs() []string {
+	var urls []string
+	for _, chapter := range p.manifest.Chapters {
+		if !chapter.Missing {
+			urls = append(urls, chapter.URL)
+		}
+	}
+	return urls
+}
+
+// merge appends the chapters of book that the previous epub doesn't have yet
+// to the previous chapters, returning the combined book, the URLs of the
+// chapters that are new and of those replaced because they changed.
+// Chapters missing from the previous epub are filled in where book has them,
+// and count as new. Chapters the previous epub has are replaced by those in
+// book whose hash differs, if it has any.
+func (p *previousEpub) merge(book ScrapedBook) (ScrapedBook, []string, []string) {
+	merged := ScrapedBook{
+		meta:     book.meta,
+		chapters: newChapterStore(),
+		failed:   book.failed,
+	}
+	var added, changed []string
+	seen := mapset.NewSet[string]()
+	for _, chapter := range p.manifest.Chapters {
+		merged.toc = append(merged.toc, TOCEntry{URL: chapter.URL, Title: chapter.Title, Date: chapter.Date})
+		seen.Add(chapterKey(chapter.URL))
+		fetched, ok := book.chapters.get(chapter.URL)
+		if chapter.Missing {
+			if ok {
+				merged.chapters.put(chapter.URL, fetched)
+				added = append(added, chapter.URL)
+			}
+			continue
+		}
+		if ok && chapter.Hash != "" && chapterHash(fetched.Content) != chapter.Hash {
+			logger.Infow("Chapter changed upstream", "title", chapter.Title, "url", chapter.URL)
+			merged.chapters.put(chapter.URL, fetched)
+			changed = append(changed, chapter.URL)
+			continue
+		}
+		previousChapter, _ := p.chapters.get(chapter.URL)
+		merged.chapters.put(chapter.URL, previousChapter)
+	}
+	for _, entry := range book.toc {
+		if !seen.Add(chapterKey(entry.URL)) {
+			continue
+		}
+		merged.toc = append(merged.toc, entry)
+		// A new chapter that failed to fetch stays out of the store, to be
+		// written as a placeholder and fetched again by the next update.
+		if chapter, ok := book.chapters.get(entry.URL); ok {
+			merged.chapters.put(entry.URL, chapter)
+			added = append(added, entry.URL)
+		}
+	}
+	return merged, added, changed
+}
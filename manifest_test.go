@@ -0,0 +1,35 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMergeLeavesFailedChaptersOut(t *testing.T) {
+	previous := &previousEpub{
+		manifest: bookManifest{Chapters: []manifestChapter{{URL: "https://example.com/1", Title: "One", Hash: chapterHash("one")}}},
+		chapters: newChapterStore(),
+	}
+	previous.chapters.put("https://example.com/1", Chapter{Title: "One", Content: "one"})
+	book := ScrapedBook{
+		toc: []TOCEntry{
+			{URL: "https://example.com/1", Title: "One"},
+			{URL: "https://example.com/2", Title: "Two"},
+			{URL: "https://example.com/3", Title: "Three"},
+		},
+		chapters: newChapterStore(),
+		failed:   map[string]error{chapterKey("https://example.com/3"): errors.New("timeout")},
+	}
+	book.chapters.put("https://example.com/2", Chapter{Title: "Two", Content: "two"})
+
+	merged, added, changed := previous.merge(book)
+	if len(merged.toc) != 3 {
+		t.Fatalf("merged %d chapters, want 3", len(merged.toc))
+	}
+	if len(added) != 1 || added[0] != "https://example.com/2" || len(changed) != 0 {
+		t.Errorf("merge added %v and changed %v, want only chapter 2 added", added, changed)
+	}
+	if merged.chapters.has("https://example.com/3") {
+		t.Error("merge kept the chapter that failed to fetch, which would be written empty")
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"text/tabwriter"
+)
+
+// missingChapter is the placeholder section that stands in for a chapter
+// that couldn't be fetched, so the gap is plain to the reader and the
+// chapter can still be found on the site.
+func missingChapter(entry TOCEntry, err error) Chapter {
+	reason := "The page had no chapter content."
+	if err != nil {
+		reason = err.Error()
+	}
+	url := html.EscapeString(entry.URL)
+	content := fmt.Sprintf(`<h2>%s</h2>
+<div class="missing-chapter">
+<p><strong>This chapter is missing.</strong> It could not be fetched when this book was made.</p>
+<p>Source: <a href="%s">%s</a></p>
+<p>Error: %s</p>
+</div>`, html.EscapeString(entry.Title), url, url, html.EscapeString(reason))
+	return Chapter{Title: entry.Title, Content: content}
+}
+
+// missingReport is an entry in the report of chapters left missing by a run.
+type missingReport struct {
+	Book     string `json:"book"`
+	File     string `json:"file"`
+	Title    string `json:"title"`
+	URL      string `json:"url"`
+	Attempts int    `json:"attempts,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// missingReports lists the chapters the manifest marks as missing.
+func missingReports(filename string, book ScrapedBook, manifest *bookManifest) []missingReport {
+	var reports []missingReport
+	for _, chapter := range manifest.Chapters {
+		if !chapter.Missing {
+			continue
+		}
+		report := missingReport{Book: book.meta.Title, File: filename, Title: chapter.Title, URL: chapter.URL}
+		if err := book.failure(chapter.URL); err != nil {
+			report.Error = err.Error()
+			var failure *fetchError
+			if errors.As(err, &failure) {
+				report.Attempts = failure.Attempts
+				report.Error = failure.Err.Error()
+			}
+		}
+		reports = append(reports, report)
+	}
+	return reports
+}
+
+func printMissingReport(w io.Writer, reports []missingReport) {
+	fmt.Fprintf(w, "%d chapters are missing:\n", len(reports))
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, report := range reports {
+		reason := report.Error
+		if reason == "" {
+			reason = "no content"
+		}
+		attempts := "-"
+		if report.Attempts > 0 {
+			attempts = fmt.Sprintf("%d attempts", report.Attempts)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", report.Book, report.Title, report.URL, attempts, reason)
+	}
+	tw.Flush()
+}
+
+func writeMissingReport(filename string, reports []missingReport) error {
+	if reports == nil {
+		reports = []missingReport{}
+	}
+	data, err := json.MarshalIndent(reports, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, append(data, '\n'), 0644)
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The mock site serves miniature versions of the pages of every supported
+// site, with the structure the scrapers read and nothing else, so that
+// features from assembly onwards can be worked on and tested without the
+// network. `-target mock` answers every request from it.
+
+// mockStories are the stories the mock site has, one on each site, scraped
+// by `-target mock` when no URLs are given.
+var mockStories = []string{
+	"https://www.royalroad.com/fiction/1/mock-story",
+	"https://www.scribblehub.com/series/1/mock-story/",
+	"http://phrack.org/issues/1/1.html",
+}
+
+// mockChapters is how many chapters each mock story has.
+const mockChapters = 5
+
+var mockEpoch = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+var (
+	mockRoyalRoadFiction    = regexp.MustCompile(`^/fiction/(\d+)/([^/]+)$`)
+	mockRoyalRoadChapter    = regexp.MustCompile(`^/fiction/(\d+)/([^/]+)/chapter/(\d+)/[^/]+$`)
+	mockScribblehubSeries   = regexp.MustCompile(`^/series/(\d+)/([^/]+)/$`)
+	mockScribblehubGlossary = regexp.MustCompile(`^/series/(\d+)/([^/]+)/glossary/$`)
+	mockScribblehubChapter  = regexp.MustCompile(`^/read/(\d+)-([^/]+)/chapter/(\d+)/$`)
+	mockPhrackArticle       = regexp.MustCompile(`^/issues/(\d+)/(\d+)\.html$`)
+)
+
+// mockSite is the handler of the mock site, for all of its hosts at once.
+type mockSite struct{}
+
+func (mockSite) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, ".png") || strings.HasSuffix(r.URL.Path, ".jpg") {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(mockImage(r.URL.Path))
+		return
+	}
+	var page string
+	switch r.Host {
+	case "www.royalroad.com":
+		if m := mockRoyalRoadFiction.FindStringSubmatch(r.URL.Path); m != nil {
+			page = mockRoyalRoadFictionPage(m[1], m[2])
+		} else if m := mockRoyalRoadChapter.FindStringSubmatch(r.URL.Path); m != nil {
+			page = mockRoyalRoadChapterPage(m[3])
+		}
+	case "www.scribblehub.com":
+		if m := mockScribblehubSeries.FindStringSubmatch(r.URL.Path); m != nil {
+			page = mockScribblehubSeriesPage(m[1])
+		} else if mockScribblehubGlossary.MatchString(r.URL.Path) {
+			page = mockScribblehubGlossaryPage()
+		} else if r.URL.Path == "/wp-admin/admin-ajax.php" && r.Method == http.MethodPost {
+			page = mockScribblehubTOCPage(r.FormValue("mypostid"), r.FormValue("pagenum"))
+		} else if m := mockScribblehubChapter.FindStringSubmatch(r.URL.Path); m != nil {
+			page = mockScribblehubChapterPage(m[3])
+		}
+	case "phrack.org":
+		if m := mockPhrackArticle.FindStringSubmatch(r.URL.Path); m != nil {
+			page = mockPhrackArticlePage(m[1], m[2])
+		}
+	}
+	if page == "" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(page))
+}
+
+// mockTransport answers every request from the mock site, without a
+// listening server.
+type mockTransport struct{}
+
+func (mockTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	// The handler reads the body, which a transport mustn't leave open.
+	if request.Body != nil {
+		defer request.Body.Close()
+	}
+	recorder := httptest.NewRecorder()
+	served := request.Clone(request.Context())
+	served.Host = request.URL.Host
+	served.RequestURI = request.URL.RequestURI()
+	mockSite{}.ServeHTTP(recorder, served)
+	response := recorder.Result()
+	response.Request = request
+	return response, nil
+}
+
+func mockImage(path string) []byte {
+	// Covers must be large enough for the cover checks; an illustration is
+	// a short band.
+	width, height := 400, 600
+	if !strings.Contains(path, "cover") && !strings.Contains(path, "logo") {
+		height = 40
+	}
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	shade := uint8(len(path) * 37)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{shade, uint8(y * 255 / height), 160, 255})
+		}
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	return buf.Bytes()
+}
+
+// mockParagraphs is the text of a chapter, long enough not to look cut
+// short.
+func mockParagraphs(chapter int) string {
+	var b strings.Builder
+	for i := 1; i <= 4; i++ {
+		fmt.Fprintf(&b, "<p>Paragraph %d of chapter %d. The mock site tells the same story over and over, so that books can be assembled without the network. “Again?” someone asked. Yes, again.</p>\n", i, chapter)
+	}
+	return b.String()
+}
+
+func mockChapterTitle(chapter int) string {
+	return fmt.Sprintf("Chapter %d: The Mock Continues", chapter)
+}
+
+func mockChapterDate(chapter int) time.Time {
+	return mockEpoch.AddDate(0, 0, 7*(chapter-1))
+}
+
+func mockRoyalRoadFictionPage(id string, slug string) string {
+	type listed struct {
+		ID      int       `json:"id"`
+		Title   string    `json:"title"`
+		Date    time.Time `json:"date"`
+		Order   int       `json:"order"`
+		Visible int       `json:"visible"`
+		URL     string    `json:"url"`
+	}
+	var chapters []listed
+	var rows strings.Builder
+	for i := 1; i <= mockChapters; i++ {
+		chapterURL := fmt.Sprintf("/fiction/%s/%s/chapter/%d/chapter-%d", id, slug, 1000+i, i)
+		chapters = append(chapters, listed{ID: 1000 + i, Title: mockChapterTitle(i), Date: mockChapterDate(i), Order: i - 1, Visible: 1, URL: chapterURL})
+		fmt.Fprintf(&rows, `<tr><td><a href="%s">%s</a></td><td><a href="%s"><time unixtime="%d">%d days ago</time></a></td></tr>`+"\n",
+			chapterURL, html.EscapeString(mockChapterTitle(i)), chapterURL, mockChapterDate(i).Unix(), mockChapters-i)
+	}
+	list, _ := json.Marshal(chapters)
+	return `<!DOCTYPE html>
+<html><head><title>Mock Story | Royal Road</title></head>
+<body>
+<div class="fic-header">
+  <img data-type="cover" src="https://www.royalroadcdn.com/public/covers-full/` + id + `-cover.png" alt="Mock Story">
+  <div class="fic-title"><h1>Mock Story</h1><h4>by <a href="/profile/1">Mock Author</a></h4></div>
+</div>
+<div class="description"><div class="hidden-content"><p>A story the mock Royal Road tells, in ` + strconv.Itoa(mockChapters) + ` chapters.</p></div></div>
+<table id="chapters"><tbody>
+` + rows.String() + `</tbody></table>
+<script>window.chapters = ` + string(list) + `;</script>
+</body></html>
+`
+}
+
+func mockRoyalRoadChapterPage(id string) string {
+	chapter, _ := strconv.Atoi(id)
+	chapter -= 1000
+	illustration := ""
+	if chapter == 1 {
+		illustration = `<p><img src="https://www.royalroadcdn.com/public/mock/divider.png" alt=""></p>`
+	}
+	if chapter == 2 {
+		illustration = `<div style="background-color: #0a0a23; border: 2px solid gold; color: #fff"><p>Mock Hero, Level 2</p><p>Patience: 12</p></div>`
+	}
+	return `<!DOCTYPE html>
+<html><head><title>` + html.EscapeString(mockChapterTitle(chapter)) + ` | Royal Road</title></head>
+<body>
+<div class="fic-header"><h1>` + html.EscapeString(mockChapterTitle(chapter)) + `</h1></div>
+<div class="chapter-inner chapter-content">
+` + mockParagraphs(chapter) + illustration + `
+</div>
+` + mockRoyalRoadComments(chapter) + `
+</body></html>
+`
+}
+
+// mockRoyalRoadComments is a reader's comment on a chapter, and the author's
+// reply to it.
+func mockRoyalRoadComments(chapter int) string {
+	date := mockChapterDate(chapter).Add(time.Hour).Unix()
+	comment := func(profile int, name string, text string, replies string) string {
+		return fmt.Sprintf(`<div class="comment"><div class="media media-v2"><div class="media-body">
+<h4 class="media-heading"><span class="name"><a href="/profile/%d">%s</a></span> <small><time unixtime="%d">1 hour ago</time></small></h4>
+<div class="media-content"><p>%s</p></div>
+%s</div></div></div>`, profile, name, date, text, replies)
+	}
+	reply := comment(1, "Mock Author", "Glad you liked it!", "")
+	return `<div class="comments-container">
+` + comment(2, "Mock Reader", fmt.Sprintf("Thanks for chapter %d!", chapter), `<div class="subcomments">`+reply+`</div>`) + `
+</div>`
+}
+
+func mockScribblehubSeriesPage(id string) string {
+	return `<!DOCTYPE html>
+<html><head><title>Mock Story | Scribble Hub</title></head>
+<body>
+<div class="fic_image"><img src="https://cdn.scribblehub.com/images/mock/` + id + `-cover.png" alt="Mock Story"></div>
+<div class="fic_title" title="Mock Story">Mock Story</div>
+<span class="auth_name_fic">Mock Author</span>
+<div class="wi_fic_desc"><p>A story the mock Scribble Hub tells, in ` + strconv.Itoa(mockChapters) + ` chapters.</p></div>
+<input type="hidden" id="mypostid" value="` + id + `">
+</body></html>
+`
+}
+
+func mockScribblehubGlossaryPage() string {
+	return `<!DOCTYPE html>
+<html><head><title>Glossary - Mock Story | Scribble Hub</title></head>
+<body>
+<dl>
+<dt>mock site</dt><dd>Where the story is told, <em>over and over</em>.</dd>
+<dt>network</dt><dd>What the mock site does without.</dd>
+</dl>
+</body></html>
+`
+}
+
+// mockScribblehubTOCPage lists every chapter, newest first, on the first
+// page, and none on the pages after.
+func mockScribblehubTOCPage(id string, page string) string {
+	var b strings.Builder
+	b.WriteString(`<div class="wi_fic_table toc"><ol class="toc_ol">` + "\n")
+	if page == "1" {
+		for i := mockChapters; i >= 1; i-- {
+			fmt.Fprintf(&b, `<li class="toc_w" order="%d"><a href="https://www.scribblehub.com/read/%s-mock-story/chapter/%d/" class="toc_a">%s</a> <span class="fic_date_pub" title="%s">%d weeks ago</span></li>`+"\n",
+				i, id, 1000+i, html.EscapeString(mockChapterTitle(i)), mockChapterDate(i).Format("Jan 2, 2006 03:04 PM"), mockChapters-i)
+		}
+	}
+	b.WriteString("</ol></div>\n")
+	return b.String()
+}
+
+func mockScribblehubChapterPage(id string) string {
+	chapter, _ := strconv.Atoi(id)
+	chapter -= 1000
+	return `<!DOCTYPE html>
+<html><head><title>` + html.EscapeString(mockChapterTitle(chapter)) + ` | Scribble Hub</title></head>
+<body>
+<div class="chapter-title">` + html.EscapeString(mockChapterTitle(chapter)) + `</div>
+<div id="chp_raw" class="chp_raw">
+` + mockParagraphs(chapter) + `</div>
+</body></html>
+`
+}
+
+func mockPhrackArticlePage(issue string, article string) string {
+	number, _ := strconv.Atoi(article)
+	var b strings.Builder
+	b.WriteString("<!DOCTYPE html>\n<html><head><title>.:: Phrack Magazine ::.</title></head>\n<body>\n<table class=\"tissue\">\n")
+	for i := 1; i <= mockChapters; i++ {
+		fmt.Fprintf(&b, `<tr><td><a href="/issues/%s/%d.html">Article %d: Mock Phile</a></td><td class="details"></td></tr>`+"\n", issue, i, i)
+	}
+	b.WriteString("</table>\n<div class=\"p-title\">Mock Phile</div>\n<pre>\n")
+	fmt.Fprintf(&b, "                    ==Phrack Inc.==\n\n      Volume 1, Issue %s, Phile #%d of %d\n\n", issue, number, mockChapters)
+	for line := 1; line <= 12; line++ {
+		fmt.Fprintf(&b, "    %04d  mov eax, [ebp+%d]  ; load the &lt;%d&gt;th argument\n", line, 4*line, line)
+	}
+	b.WriteString("</pre>\n</body></html>\n")
+	return b.String()
+}
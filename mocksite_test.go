@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	mapset "github.com/deckarep/golang-set/v2"
+	"github.com/gocolly/colly"
+)
+
+// mockSession is a session whose every request is answered by the mock
+// site, writing books under dir.
+func mockSession(dir string) *session {
+	collector := colly.NewCollector(colly.UserAgent("ebook-scraper-test"))
+	collector.WithTransport(mockTransport{})
+	return &session{
+		client:       mockTransport{},
+		cache:        &CachingTransport{Transport: mockTransport{}, Dir: filepath.Join(dir, "cache")},
+		collector:    collector,
+		limitedHosts: mapset.NewSet[string](),
+		force:        true,
+		concurrency:  2,
+		imageWorkers: 2,
+		timestamp:    time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+}
+
+// TestMockSite scrapes every mock story, so that a scraper and the mock
+// site can't drift apart without notice.
+func TestMockSite(t *testing.T) {
+	for _, url := range mockStories {
+		url := url
+		t.Run(url, func(t *testing.T) {
+			dir := t.TempDir()
+			output := filepath.Join(dir, "book.epub")
+			if err := mockSession(dir).scrapeBook(bookJob{URL: url, Output: output}); err != nil {
+				t.Fatal(err)
+			}
+			manifest, err := readManifest(output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if manifest.Source != url {
+				t.Errorf("manifest source is %s, want %s", manifest.Source, url)
+			}
+			if len(manifest.Chapters) != mockChapters {
+				t.Errorf("epub has %d chapters, want %d", len(manifest.Chapters), mockChapters)
+			}
+			for _, chapter := range manifest.Chapters {
+				if chapter.Missing {
+					t.Errorf("chapter %s is missing", chapter.URL)
+				}
+			}
+		})
+	}
+}
+
+func TestRoyalRoadComments(t *testing.T) {
+	for mode, want := range map[string]string{commentsTop: "Mock Reader", commentsAuthor: "Mock Author"} {
+		comments := newChapterComments()
+		opts := ScrapeOptions{MaxChapters: 1, Comments: mode, OnComments: comments.add}
+		book, err := scrapeRoyalRoad(fixtureCollector(mockTransport{}), mockStories[0], opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		book.chapters.Close()
+		got := comments.get(book.toc[0].URL)
+		if len(got) != 1 || got[0].Author != want || got[0].ByAuthor != (mode == commentsAuthor) || got[0].Date.IsZero() {
+			t.Errorf("%s comments are %+v, want one by %s", mode, got, want)
+		}
+	}
+}
+
+// TestRecheckCleanTitles updates a book whose chapter titles are cleaned,
+// then rechecks it: the chapters carried over must keep the hashes of what
+// was fetched, not of their retitled content, or all would seem changed.
+func TestRecheckCleanTitles(t *testing.T) {
+	dir := t.TempDir()
+	output := filepath.Join(dir, "book.epub")
+	scrape := func(job bookJob, recheck bool) {
+		t.Helper()
+		s := mockSession(dir)
+		s.cleanTitles = []string{"numbering"}
+		s.recheck = recheck
+		if err := s.scrapeBook(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	scrape(bookJob{URL: mockStories[0], Output: output, Options: ScrapeOptions{MaxChapters: 2}}, false)
+	first, err := readManifest(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scrape(bookJob{URL: mockStories[0], Output: output, Update: output}, false)
+	updated, err := readManifest(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updated.Chapters) != mockChapters {
+		t.Fatalf("updated epub has %d chapters, want %d", len(updated.Chapters), mockChapters)
+	}
+	for i, chapter := range first.Chapters {
+		if updated.Chapters[i].Hash != chapter.Hash {
+			t.Errorf("chapter %s carried over with hash %s, want %s", chapter.URL, updated.Chapters[i].Hash, chapter.Hash)
+		}
+	}
+
+	before, err := os.Stat(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scrape(bookJob{URL: mockStories[0], Output: output, Update: output}, true)
+	after, err := os.Stat(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !after.ModTime().Equal(before.ModTime()) {
+		t.Error("recheck rewrote the epub though no chapter changed upstream")
+	}
+}
+
+// TestStoryStoreRules scrapes a book again with a rule added: the stored
+// chapters, filtered without it, must not be reused.
+func TestStoryStoreRules(t *testing.T) {
+	dir := t.TempDir()
+	output := filepath.Join(dir, "book.epub")
+	if err := mockSession(dir).scrapeBook(bookJob{URL: mockStories[0], Output: output}); err != nil {
+		t.Fatal(err)
+	}
+	s := mockSession(dir)
+	s.rules = []rewriteRule{{pattern: mustCompileRule(t, `Paragraph`), replacement: "Passage"}}
+	if err := s.scrapeBook(bookJob{URL: mockStories[0], Output: output}); err != nil {
+		t.Fatal(err)
+	}
+	book, err := readPreviousEpub(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer book.Close()
+	for _, entry := range book.manifest.Chapters {
+		chapter, _ := book.chapters.get(entry.URL)
+		if strings.Contains(chapter.Content, "Paragraph") || !strings.Contains(chapter.Content, "Passage") {
+			t.Errorf("chapter %s wasn't rewritten by the new rule", entry.URL)
+		}
+	}
+}
+
+// unreachableSite fails every request, as the network would offline.
+type unreachableSite struct{}
+
+func (unreachableSite) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, errors.New("network unreachable")
+}
+
+// TestScribblehubOffline scrapes a Scribblehub story offline from the cache
+// an earlier scrape filled, chapter list POSTs and all.
+func TestScribblehubOffline(t *testing.T) {
+	dir := t.TempDir()
+	url := mockStories[1]
+	for _, offline := range []bool{false, true} {
+		s := mockSession(dir)
+		var site http.RoundTripper = mockTransport{}
+		if offline {
+			site = unreachableSite{}
+		}
+		s.cache = &CachingTransport{Transport: site, Dir: filepath.Join(dir, "cache"), Offline: offline}
+		s.client = s.cache
+		s.collector.WithTransport(s.cache)
+		output := filepath.Join(dir, fmt.Sprintf("offline-%t.epub", offline))
+		if err := s.scrapeBook(bookJob{URL: url, Output: output}); err != nil {
+			t.Fatalf("offline %t: %v", offline, err)
+		}
+		manifest, err := readManifest(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(manifest.Chapters) != mockChapters {
+			t.Errorf("offline %t: epub has %d chapters, want %d", offline, len(manifest.Chapters), mockChapters)
+		}
+	}
+}
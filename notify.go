@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// notifier tells the user that a book has been written or has failed, which
+// matters for scrapes that run long enough to be left in the background.
+// Desktop notifications go through notify-send or osascript. URL is a push
+// service, told also when each book starts: a Gotify server given as
+// gotify[s]://TOKEN@host/ receives its message API's JSON, and any other URL
+// the message as a plain text POST with Title and Priority headers, which is
+// what ntfy expects and most webhooks accept. Webhook instead receives a
+// jobReport as JSON, for programs to act on.
+type notifier struct {
+	Desktop bool
+	URL     string
+	Webhook string
+	Client  *http.Client
+}
+
+// forJob returns the notifier for job, which tells the job's own push URL,
+// given in the input file, instead of the default one.
+func (n *notifier) forJob(job bookJob) *notifier {
+	if job.NotifyURL == "" {
+		return n
+	}
+	var own notifier
+	if n != nil {
+		own = *n
+	}
+	own.URL = job.NotifyURL
+	return &own
+}
+
+// jobReport describes how a book's job ended.
+type jobReport struct {
+	// Status is written or failed.
+	Status      string `json:"status"`
+	Source      string `json:"source"`
+	Output      string `json:"output,omitempty"`
+	Title       string `json:"title,omitempty"`
+	Chapters    int    `json:"chapters"`
+	NewChapters int    `json:"new_chapters"`
+	// Errors are why the job failed, or why chapters of a written book are
+	// missing.
+	Errors []string `json:"errors,omitempty"`
+}
+
+// Priorities of notifications, on ntfy's scale of 1 to 5.
+const (
+	priorityLow     = 2
+	priorityDefault = 3
+	priorityHigh    = 4
+)
+
+// bookStarted is only pushed to URL; on the desktop and to the webhook it
+// would just be noise.
+func (n *notifier) bookStarted(baseURL string) {
+	if n == nil || n.URL == "" {
+		return
+	}
+	if err := n.post("Book started", "Scraping "+baseURL, priorityLow); err != nil {
+		logger.Warnw("Failed to send notification", "url", redactURL(n.URL), "error", err)
+	}
+}
+
+func (n *notifier) bookWritten(report jobReport) {
+	report.Status = "written"
+	message := fmt.Sprintf("Wrote %s (%d chapters, %d new)", report.Output, report.Chapters, report.NewChapters)
+	if len(report.Errors) > 0 {
+		message += fmt.Sprintf(", %d missing", len(report.Errors))
+	}
+	n.send("Book finished", message, priorityDefault, report)
+}
+
+func (n *notifier) bookFailed(baseURL string, err error) {
+	report := jobReport{Status: "failed", Source: baseURL, Errors: []string{err.Error()}}
+	n.send("Book failed", fmt.Sprintf("Failed to scrape %s: %v", baseURL, err), priorityHigh, report)
+}
+
+// send delivers a notification wherever configured. Failures are only logged,
+// since the scrape itself is done by now.
+func (n *notifier) send(title string, message string, priority int, report jobReport) {
+	if n == nil {
+		return
+	}
+	if n.Desktop {
+		if err := desktopNotify(title, message); err != nil {
+			logger.Warnw("Failed to show desktop notification", "error", err)
+		}
+	}
+	if n.URL != "" {
+		if err := n.post(title, message, priority); err != nil {
+			logger.Warnw("Failed to send notification", "url", redactURL(n.URL), "error", err)
+		}
+	}
+	if n.Webhook != "" {
+		if err := n.postReport(report); err != nil {
+			logger.Warnw("Failed to call webhook", "url", n.Webhook, "error", err)
+		}
+	}
+}
+
+func (n *notifier) post(title string, message string, priority int) error {
+	if u, err := url.Parse(n.URL); err == nil && (u.Scheme == "gotify" || u.Scheme == "gotifys") {
+		return n.postGotify(u, title, message, priority)
+	}
+	request, err := http.NewRequest(http.MethodPost, n.URL, strings.NewReader(message))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	request.Header.Set("Title", title)
+	request.Header.Set("Priority", strconv.Itoa(priority))
+	return n.do(request)
+}
+
+// postGotify sends a message to a Gotify server, whose priorities run from
+// 0 to 10.
+func (n *notifier) postGotify(u *url.URL, title string, message string, priority int) error {
+	token := u.User.Username()
+	if token == "" {
+		return errors.New("gotify url has no application token, as in gotifys://TOKEN@host/")
+	}
+	endpoint := *u
+	endpoint.User = nil
+	endpoint.Scheme = "http"
+	if u.Scheme == "gotifys" {
+		endpoint.Scheme = "https"
+	}
+	endpoint.Path = strings.TrimSuffix(endpoint.Path, "/") + "/message"
+	data, err := json.Marshal(map[string]any{"title": title, "message": message, "priority": priority * 2})
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest(http.MethodPost, endpoint.String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Gotify-Key", token)
+	return n.do(request)
+}
+
+// redactURL hides the credentials of a URL, such as a Gotify token, for
+// logging it.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	if u.User != nil {
+		u.User = url.User("xxxxx")
+	}
+	return u.String()
+}
+
+func (n *notifier) postReport(report jobReport) error {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest(http.MethodPost, n.Webhook, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	return n.do(request)
+}
+
+func (n *notifier) do(request *http.Request) error {
+	client := n.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	request.Header.Set("User-Agent", versionUserAgent())
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("server returned %s", response.Status)
+	}
+	return nil
+}
+
+func desktopNotify(title string, message string) error {
+	switch runtime.GOOS {
+	case "linux", "freebsd", "openbsd":
+		return exec.Command("notify-send", "--app-name=ebook-scraper", title, message).Run()
+	case "darwin":
+		script := "display notification " + strconv.Quote(message) + " with title " + strconv.Quote(title)
+		return exec.Command("osascript", "-e", script).Run()
+	}
+	return fmt.Errorf("desktop notifications are not supported on %s", runtime.GOOS)
+}
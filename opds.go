@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"flag"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// The library can be served as an OPDS catalog, which e-reader apps such as
+// KOReader and Moon+ Reader browse to download books from over the network.
+const (
+	opdsAcquisitionType = "application/atom+xml;profile=opds-catalog;kind=acquisition"
+	opdsBooksPath       = "/books/"
+)
+
+type opdsFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []opdsLink  `xml:"link"`
+	Entries []opdsEntry `xml:"entry"`
+}
+
+type opdsEntry struct {
+	ID      string     `xml:"id"`
+	Title   string     `xml:"title"`
+	Author  opdsAuthor `xml:"author"`
+	Updated string     `xml:"updated"`
+	Summary string     `xml:"summary"`
+	Links   []opdsLink `xml:"link"`
+}
+
+type opdsAuthor struct {
+	Name string `xml:"name"`
+}
+
+type opdsLink struct {
+	Rel  string `xml:"rel,attr"`
+	Href string `xml:"href,attr"`
+	Type string `xml:"type,attr"`
+}
+
+// runServeCommand implements `serve [-addr ADDR]`, serving the library in dir
+// as an OPDS catalog until the program is stopped.
+func runServeCommand(dir string, args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	addr := flags.String("addr", ":8080", "listen on `address`")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if dir == "" {
+		return errors.New("serve needs the library to serve, given with -library")
+	}
+	server := &http.Server{
+		Addr:              *addr,
+		Handler:           opdsHandler(dir),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	logger.Infow("Serve OPDS catalog", "library", dir, "addr", *addr)
+	return server.ListenAndServe()
+}
+
+// opdsHandler serves the catalog of the library in dir at the root, and its
+// books under opdsBooksPath. The index is read again for every request, so
+// books written while the server runs show up without restarting it.
+func opdsHandler(dir string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		entries, err := readLibraryIndex(dir)
+		if err != nil {
+			logger.Warnw("Failed to read library index", "library", dir, "error", err)
+			http.Error(w, "failed to read library index", http.StatusInternalServerError)
+			return
+		}
+		data, err := xml.MarshalIndent(opdsCatalog(entries), "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", opdsAcquisitionType)
+		w.Write([]byte(xml.Header))
+		w.Write(data)
+	})
+	mux.HandleFunc(opdsBooksPath, func(w http.ResponseWriter, r *http.Request) {
+		entries, err := readLibraryIndex(dir)
+		if err != nil {
+			http.Error(w, "failed to read library index", http.StatusInternalServerError)
+			return
+		}
+		// Only books in the index are served, whatever else is in dir.
+		name := r.URL.Path[len(opdsBooksPath):]
+		for _, entry := range entries {
+			if entry.Path != name {
+				continue
+			}
+			w.Header().Set("Content-Type", "application/epub+zip")
+			w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(entry.Path)}))
+			http.ServeFile(w, r, filepath.Join(dir, filepath.FromSlash(entry.Path)))
+			return
+		}
+		http.NotFound(w, r)
+	})
+	return mux
+}
+
+// opdsCatalog lists the books of a library as an acquisition feed, most
+// recently updated first.
+func opdsCatalog(entries []libraryEntry) opdsFeed {
+	feed := opdsFeed{
+		ID:    "urn:ebook-scraper:library",
+		Title: "ebook-scraper library",
+		Links: []opdsLink{
+			{Rel: "self", Href: "/", Type: opdsAcquisitionType},
+			{Rel: "start", Href: "/", Type: opdsAcquisitionType},
+		},
+	}
+	var newest time.Time
+	for _, entry := range entries {
+		if entry.Updated.After(newest) {
+			newest = entry.Updated
+		}
+		href := (&url.URL{Path: opdsBooksPath + entry.Path}).EscapedPath()
+		feed.Entries = append(feed.Entries, opdsEntry{
+			ID:      bookIdentifier(entry.Source),
+			Title:   entry.Title,
+			Author:  opdsAuthor{Name: entry.Author},
+			Updated: entry.Updated.UTC().Format(time.RFC3339),
+			Summary: entry.Source,
+			Links: []opdsLink{
+				{Rel: "http://opds-spec.org/acquisition", Href: href, Type: "application/epub+zip"},
+				{Rel: "alternate", Href: entry.Source, Type: "text/html"},
+			},
+		})
+	}
+	// Dates formatted alike in UTC sort as strings.
+	sort.SliceStable(feed.Entries, func(i, j int) bool { return feed.Entries[i].Updated > feed.Entries[j].Updated })
+	feed.Updated = newest.UTC().Format(time.RFC3339)
+	return feed
+}
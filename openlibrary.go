@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const openLibrarySearchURL = "https://openlibrary.org/search.json"
+
+// openLibraryDoc is a work as found by Open Library's search.
+type openLibraryDoc struct {
+	Key              string   `json:"key"`
+	Title            string   `json:"title"`
+	AuthorName       []string `json:"author_name"`
+	FirstPublishYear int      `json:"first_publish_year"`
+	ISBN             []string `json:"isbn"`
+}
+
+// lookupOpenLibrary finds the book in Open Library and fills in its
+// canonical author name, year of first publication and identifiers. Only a
+// work of the very same title is taken, and of those the one whose author
+// matches if the book has one; a title shared by several works and no
+// author to tell them apart is left alone. It reports whether a work was
+// found.
+func lookupOpenLibrary(client *http.Client, meta *Metadata) (bool, error) {
+	if meta.Title == "" {
+		return false, nil
+	}
+	query := url.Values{
+		"title":  {meta.Title},
+		"fields": {"key,title,author_name,first_publish_year,isbn"},
+		"limit":  {"20"},
+	}
+	request, err := http.NewRequest(http.MethodGet, openLibrarySearchURL+"?"+query.Encode(), nil)
+	if err != nil {
+		return false, err
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return false, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("open library returned %s", response.Status)
+	}
+	var result struct {
+		Docs []openLibraryDoc `json:"docs"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return false, fmt.Errorf("reading open library results: %w", err)
+	}
+	doc := matchOpenLibraryDoc(result.Docs, meta.Title, meta.Author)
+	if doc == nil {
+		return false, nil
+	}
+	if len(doc.AuthorName) > 0 {
+		meta.Author = doc.AuthorName[0]
+	}
+	if doc.FirstPublishYear != 0 {
+		meta.Published = strconv.Itoa(doc.FirstPublishYear)
+	}
+	meta.OpenLibrary = strings.TrimPrefix(doc.Key, "/works/")
+	for _, isbn := range doc.ISBN {
+		// The 13 digit form is preferred, being the one printed today.
+		if len(isbn) == 13 || meta.ISBN == "" {
+			meta.ISBN = isbn
+		}
+		if len(meta.ISBN) == 13 {
+			break
+		}
+	}
+	return true, nil
+}
+
+func matchOpenLibraryDoc(docs []openLibraryDoc, title string, author string) *openLibraryDoc {
+	var sameTitle []*openLibraryDoc
+	for i := range docs {
+		if foldTitle(docs[i].Title) == foldTitle(title) {
+			sameTitle = append(sameTitle, &docs[i])
+		}
+	}
+	if author != "" {
+		for _, doc := range sameTitle {
+			for _, name := range doc.AuthorName {
+				if foldTitle(name) == foldTitle(author) {
+					return doc
+				}
+			}
+		}
+	}
+	if len(sameTitle) == 1 {
+		return sameTitle[0]
+	}
+	return nil
+}
+
+// foldTitle reduces a title or name to its lowercased letters and digits, so
+// that punctuation and spacing don't keep two spellings from matching.
+func foldTitle(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, s)
+}
+
+// publishedMetadata is the package metadata declaring what was learned of
+// a published work, which go-epub has no setters for.
+func publishedMetadata(meta Metadata) string {
+	var b strings.Builder
+	if meta.Published != "" {
+		fmt.Fprintf(&b, "    <dc:date>%s</dc:date>\n", html.EscapeString(meta.Published))
+	}
+	if meta.ISBN != "" {
+		fmt.Fprintf(&b, "    <dc:identifier>urn:isbn:%s</dc:identifier>\n", html.EscapeString(meta.ISBN))
+	}
+	if meta.OpenLibrary != "" {
+		fmt.Fprintf(&b, "    <dc:identifier>https://openlibrary.org/works/%s</dc:identifier>\n", html.EscapeString(meta.OpenLibrary))
+	}
+	return b.String()
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const defaultOutputTemplate = "{{slug .Title}}.epub"
+
+// outputFields are available to -output templates. Title and Author have
+// path separators replaced so they can't escape the intended directory.
+type outputFields struct {
+	Title        string
+	Author       string
+	ChapterCount int
+	Host         string
+}
+
+var outputFuncs = template.FuncMap{
+	"slug": func(s string) string {
+		return strings.ToLower(strings.ReplaceAll(s, " ", "-"))
+	},
+	"lower": strings.ToLower,
+}
+
+func sanitizePathComponent(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r < 0x20 {
+			return '-'
+		}
+		return r
+	}, s)
+	return strings.TrimLeft(strings.TrimSpace(s), ".")
+}
+
+// outputFilename expands the -output template for book. If the result names
+// an existing directory, the book is written inside it under the default name.
+func outputFilename(pattern string, book ScrapedBook, host string) (string, error) {
+	fields := outputFields{
+		Title:        sanitizePathComponent(book.meta.Title),
+		Author:       sanitizePathComponent(book.meta.Author),
+		ChapterCount: len(book.toc),
+		Host:         host,
+	}
+	expand := func(pattern string) (string, error) {
+		tmpl, err := template.New("output").Funcs(outputFuncs).Parse(pattern)
+		if err != nil {
+			return "", err
+		}
+		var out bytes.Buffer
+		if err := tmpl.Execute(&out, fields); err != nil {
+			return "", err
+		}
+		return out.String(), nil
+	}
+	filename, err := expand(pattern)
+	if err != nil {
+		return "", err
+	}
+	if info, err := os.Stat(filename); err == nil && info.IsDir() {
+		name, err := expand(defaultOutputTemplate)
+		if err != nil {
+			return "", err
+		}
+		filename = filepath.Join(filename, name)
+	}
+	return filename, nil
+}
+
+// resolveExisting decides what to do when filename already exists: refuse,
+// unless force allows overwriting it or unique asks for a new name carrying
+// the chapter count and, if that is taken too, the time.
+func resolveExisting(filename string, chapters int, force bool, unique bool) (string, error) {
+	if _, err := os.Stat(filename); err != nil || force {
+		return filename, nil
+	}
+	if !unique {
+		return "", fmt.Errorf("%s already exists, use -force to overwrite it or -unique to pick a new name", filename)
+	}
+	ext := filepath.Ext(filename)
+	base := strings.TrimSuffix(filename, ext)
+	candidate := fmt.Sprintf("%s-%dch%s", base, chapters, ext)
+	if _, err := os.Stat(candidate); err == nil {
+		candidate = fmt.Sprintf("%s-%dch-%s%s", base, chapters, time.Now().Format("20060102-150405"), ext)
+	}
+	return candidate, nil
+}
+
+// writeChapterHTML saves each chapter's HTML as numbered files in dir, as it
+// was extracted from its page and cleaned up by filters and rules: before the
+// repairs, translation and image embedding of the epub. Any image that
+// already points into the epub is pointed back at its source, given as a map
+// from embedded path to URL.
+func writeChapterHTML(dir string, book ScrapedBook, imageSources map[string]string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for index, entry := range book.toc {
+		chapter, _ := book.chapters.get(entry.URL)
+		for path, source := range imageSources {
+			chapter.Content = strings.ReplaceAll(chapter.Content, `src="`+path+`"`, `src="`+html.EscapeString(source)+`"`)
+		}
+		page := fmt.Sprintf("<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>%s</title>\n<link rel=\"canonical\" href=\"%s\">\n</head>\n<body>\n%s\n</body>\n</html>\n",
+			html.EscapeString(chapter.Title), html.EscapeString(entry.URL), chapter.Content)
+		name := fmt.Sprintf("%04d.html", index+1)
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(page), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// estimateBookSize guesses the uncompressed size of a book's chapters from
+// the ones already fetched, or failing that from the size of the first
+// chapter's page, which overestimates since it includes the site's chrome.
+func estimateBookSize(book ScrapedBook, client *http.Client) int64 {
+	if len(book.toc) == 0 {
+		return 0
+	}
+	var total, count int64
+	for _, entry := range book.toc {
+		if chapter, ok := book.chapters.get(entry.URL); ok {
+			total += int64(len(chapter.Content))
+			count++
+		}
+	}
+	if count == 0 {
+		response, err := client.Get(book.toc[0].URL)
+		if err != nil {
+			logger.Warnw("Failed to fetch sample chapter", "url", book.toc[0].URL, "error", err)
+			return 0
+		}
+		defer response.Body.Close()
+		total, _ = io.Copy(io.Discard, response.Body)
+		count = 1
+	}
+	return total / count * int64(len(book.toc))
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	runtimepprof "runtime/pprof"
+	"runtime/trace"
+)
+
+// profiling collects the optional profiles of a run: a CPU profile, a heap
+// profile taken at the end, an execution trace, and a live pprof endpoint.
+type profiling struct {
+	CPUProfile string
+	MemProfile string
+	Trace      string
+	PprofAddr  string
+
+	stops []func()
+}
+
+func (p *profiling) start() error {
+	if p.CPUProfile != "" {
+		logger.Infow("Begin CPU profile", "filename", p.CPUProfile)
+		f, err := os.Create(p.CPUProfile)
+		if err != nil {
+			return err
+		}
+		if err := runtimepprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			return err
+		}
+		p.stops = append(p.stops, func() {
+			runtimepprof.StopCPUProfile()
+			f.Close()
+		})
+	}
+	if p.Trace != "" {
+		logger.Infow("Begin execution trace", "filename", p.Trace)
+		f, err := os.Create(p.Trace)
+		if err != nil {
+			return err
+		}
+		if err := trace.Start(f); err != nil {
+			f.Close()
+			return err
+		}
+		p.stops = append(p.stops, func() {
+			trace.Stop()
+			f.Close()
+		})
+	}
+	if p.PprofAddr != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		logger.Infow("Serve pprof", "url", "http://"+p.PprofAddr+"/debug/pprof/")
+		go func() {
+			if err := http.ListenAndServe(p.PprofAddr, mux); err != nil {
+				logger.Warnw("Failed to serve pprof", "addr", p.PprofAddr, "error", err)
+			}
+		}()
+	}
+	return nil
+}
+
+// stop finishes the profiles and writes the heap profile.
+func (p *profiling) stop() {
+	for _, stop := range p.stops {
+		stop()
+	}
+	p.stops = nil
+	if p.MemProfile != "" {
+		logger.Infow("Write heap profile", "filename", p.MemProfile)
+		f, err := os.Create(p.MemProfile)
+		if err != nil {
+			logger.Warnw("Failed to write heap profile", "error", err)
+			return
+		}
+		defer f.Close()
+		runtime.GC()
+		if err := runtimepprof.WriteHeapProfile(f); err != nil {
+			logger.Warnw("Failed to write heap profile", "error", err)
+		}
+	}
+}
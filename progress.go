@@ -0,0 +1,84 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/schollz/progressbar/v3"
+)
+
+// progress shows how far along scraping a book is, with one bar per phase:
+// discovering chapters, downloading them, assembling the epub, which waits for
+// any images still downloading, and writing it. A zero progress shows nothing.
+type progress struct {
+	enabled bool
+
+	mu    sync.Mutex
+	phase string
+	bar   *progressbar.ProgressBar
+}
+
+// start finishes the current phase and begins the next, with total steps or
+// a spinner if total is -1.
+func (p *progress) start(phase string, total int) {
+	if !p.enabled {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.startLocked(phase, total)
+}
+
+func (p *progress) startLocked(phase string, total int) {
+	p.finishLocked()
+	p.phase = phase
+	p.bar = progressbar.Default(int64(total), phase)
+}
+
+// step advances phase by one, starting it without a known total if it isn't
+// the current phase yet.
+func (p *progress) step(phase string) {
+	if !p.enabled {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.phase != phase {
+		p.startLocked(phase, -1)
+	}
+	p.bar.Add(1)
+}
+
+// detail shows what the current phase is working on, such as the title of
+// the chapter just downloaded.
+func (p *progress) detail(text string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.bar == nil {
+		return
+	}
+	if runes := []rune(text); len(runes) > 40 {
+		text = string(runes[:39]) + "…"
+	}
+	p.bar.Describe(p.phase + ": " + text)
+}
+
+func (p *progress) finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.finishLocked()
+}
+
+func (p *progress) finishLocked() {
+	if p.bar != nil {
+		p.bar.Finish()
+		p.bar = nil
+		p.phase = ""
+	}
+}
+
+const (
+	phaseDiscover = "Discovering chapters"
+	phaseDownload = "Downloading chapters"
+	phaseAssemble = "Assembling epub"
+	phaseWrite    = "Writing epub"
+)
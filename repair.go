@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"unicode"
+
+	xhtml "golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// repairHTML makes chapter content well-formed enough for the XHTML of an
+// epub, which some readers refuse to open at the first error. The content is
+// parsed the way a browser would, which closes and re-nests elements, and
+// rendered again; on the way out attributes that can't be XML are dropped, as
+// are scripts and the control characters XML doesn't allow.
+func repairHTML(content string) string {
+	context := &xhtml.Node{Type: xhtml.ElementNode, Data: "body", DataAtom: atom.Body}
+	nodes, err := xhtml.ParseFragment(strings.NewReader(content), context)
+	if err != nil {
+		logger.Warnw("Failed to parse chapter content", "error", err)
+		return content
+	}
+	var buf bytes.Buffer
+	for _, node := range nodes {
+		if !repairNode(node) {
+			continue
+		}
+		if err := xhtml.Render(&buf, node); err != nil {
+			logger.Warnw("Failed to render chapter content", "error", err)
+			return content
+		}
+	}
+	return buf.String()
+}
+
+// repairNode cleans up node and its descendants, reporting whether node is
+// to be kept at all.
+func repairNode(node *xhtml.Node) bool {
+	switch node.Type {
+	case xhtml.ElementNode:
+		if node.DataAtom == atom.Script || node.DataAtom == atom.Noscript {
+			return false
+		}
+		node.Attr = repairAttrs(node.Attr)
+		if node.Namespace == "svg" && node.Data == "svg" {
+			declareSVGNamespaces(node)
+		}
+	case xhtml.TextNode:
+		node.Data = strings.Map(xmlChar, node.Data)
+	case xhtml.DoctypeNode:
+		return false
+	}
+	for child := node.FirstChild; child != nil; {
+		next := child.NextSibling
+		if !repairNode(child) {
+			node.RemoveChild(child)
+		}
+		child = next
+	}
+	return true
+}
+
+func repairAttrs(attrs []xhtml.Attribute) []xhtml.Attribute {
+	seen := make(map[string]bool, len(attrs))
+	kept := attrs[:0]
+	for _, attr := range attrs {
+		// Of namespaced attributes, only the xlink ones of SVG images have
+		// their namespace declared, by declareSVGNamespaces.
+		if attr.Namespace != "" && attr.Namespace != "xlink" || !xmlName(attr.Key) || seen[attr.Namespace+":"+attr.Key] {
+			continue
+		}
+		seen[attr.Namespace+":"+attr.Key] = true
+		attr.Val = strings.Map(xmlChar, attr.Val)
+		kept = append(kept, attr)
+	}
+	return kept
+}
+
+// xmlName reports whether name can be an XML attribute name without a
+// namespace prefix.
+func xmlName(name string) bool {
+	if name == "" || strings.Contains(name, ":") {
+		return false
+	}
+	for i, r := range name {
+		if unicode.IsLetter(r) || r == '_' {
+			continue
+		}
+		if i > 0 && (unicode.IsDigit(r) || r == '-' || r == '.') {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// xmlChar drops the characters XML doesn't allow in documents, such as the
+// form feeds of old plain text articles.
+func xmlChar(r rune) rune {
+	switch {
+	case r == '\t' || r == '\n' || r == '\r':
+	case r >= 0x20 && r <= 0xd7ff:
+	case r >= 0xe000 && r <= 0xfffd:
+	case r >= 0x10000 && r <= 0x10ffff:
+	default:
+		return -1
+	}
+	return r
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"unicode/utf8"
+)
+
+// extractionReport is what was extracted of each chapter of a book, for
+// -report to show scraper authors where extraction came out thin.
+type extractionReport struct {
+	Book     string
+	Source   string
+	Chapters []chapterExtraction
+}
+
+type chapterExtraction struct {
+	Title string
+	URL   string
+	// Bytes is the size of the chapter's content as extracted, markup and
+	// all, and Text how many characters of text it holds.
+	Bytes int
+	Text  int
+}
+
+// newExtractionReport measures the chapters of book that were fetched.
+func newExtractionReport(book ScrapedBook) extractionReport {
+	report := extractionReport{Book: book.meta.Title, Source: book.meta.SourceURL}
+	for _, entry := range book.toc {
+		chapter, ok := book.chapters.get(entry.URL)
+		if !ok {
+			continue
+		}
+		report.Chapters = append(report.Chapters, chapterExtraction{
+			Title: entry.Title,
+			URL:   entry.URL,
+			Bytes: len(chapter.Content),
+			Text:  utf8.RuneCountInString(strings.TrimSpace(htmlText(chapter.Content))),
+		})
+	}
+	return report
+}
+
+// printReport writes every selector looked for during the run with how many
+// elements it matched, and then what was extracted of each chapter of books.
+// Selectors that matched nothing and chapters with less text than a chapter
+// should have are flagged.
+func printReport(w io.Writer, books []extractionReport) {
+	selectorsMu.Lock()
+	used := make([]*siteSelector, 0, len(selectors))
+	for _, s := range selectors {
+		if s.lookups.Load() > 0 {
+			used = append(used, s)
+		}
+	}
+	selectorsMu.Unlock()
+	sort.SliceStable(used, func(i, j int) bool { return used[i].site < used[j].site })
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SITE\tSELECTOR\tCSS\tLOOKUPS\tMATCHES\t")
+	for _, s := range used {
+		lookups, matches := s.lookups.Load(), s.matches.Load()
+		note := ""
+		if matches == 0 {
+			note = "no matches"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%s\n", s.site, s.name, s.css, lookups, matches, note)
+	}
+	tw.Flush()
+
+	for _, book := range books {
+		fmt.Fprintf(w, "\n%s (%s): %d chapters extracted\n", book.Book, book.Source, len(book.Chapters))
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "#\tCHAPTER\tBYTES\tTEXT\t")
+		var bytes, text int
+		for i, chapter := range book.Chapters {
+			note := ""
+			if chapter.Text < minChapterText {
+				note = "thin"
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%d\t%d\t%s\n", i+1, chapter.Title, chapter.Bytes, chapter.Text, note)
+			bytes += chapter.Bytes
+			text += chapter.Text
+		}
+		fmt.Fprintf(tw, "\ttotal\t%d\t%d\t\n", bytes, text)
+		tw.Flush()
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/temoto/robotstxt"
+)
+
+// fetchCrawlDelay returns the Crawl-delay that the site's robots.txt asks of
+// agent, or zero if it sets none. Whether individual pages are allowed is
+// checked by colly itself once IgnoreRobotsTxt is turned off.
+func fetchCrawlDelay(client *http.Client, siteURL *url.URL, agent string) (time.Duration, error) {
+	response, err := client.Get(siteURL.Scheme + "://" + siteURL.Host + "/robots.txt")
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	robots, err := robotstxt.FromResponse(response)
+	if err != nil {
+		return 0, err
+	}
+	return robots.FindGroup(agent).CrawlDelay, nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	xhtml "golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// rewriteRule is a regular expression replacement the user asks for in
+// every chapter, or in those of some sites only.
+type rewriteRule struct {
+	// html rules rewrite the markup of a chapter, and title rules the
+	// titles of chapters; the others rewrite its text, one run of text
+	// between tags at a time, and leave tags alone.
+	html        bool
+	title       bool
+	pattern     *regexp.Regexp
+	replacement string
+	// hosts are the sites the rule is for, or empty for every site.
+	hosts []string
+}
+
+// readRules reads the rewrite rules in filename, one a line:
+//
+//	KIND PATTERN REPLACEMENT [HOST]...
+//
+// where KIND is text, html or title, PATTERN is a Go regular expression and
+// REPLACEMENT may refer to its groups as $1 or ${name}. Words are quoted as
+// in an input file, e.g.
+//
+//	# Typos the author keeps making
+//	text '\bteh\b' 'the'
+//	# Censor bypasses, on Royal Road only
+//	text 'f[*]ck' 'fuck' www.royalroad.com
+//	html '<p>\s*TL note:.*?</p>' '' www.scribblehub.com
+//	title '^Vol\. \d+ ' ''
+func readRules(filename string) ([]rewriteRule, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var rules []rewriteRule
+	scanner := bufio.NewScanner(f)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		words, err := splitWords(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", filename, lineNumber, err)
+		}
+		if len(words) == 0 {
+			continue
+		}
+		rule, err := parseRule(words)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", filename, lineNumber, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+func parseRule(words []string) (rewriteRule, error) {
+	if len(words) < 3 {
+		return rewriteRule{}, fmt.Errorf("want KIND PATTERN REPLACEMENT [HOST]..., got %d words", len(words))
+	}
+	var rule rewriteRule
+	switch words[0] {
+	case "text":
+	case "html":
+		rule.html = true
+	case "title":
+		rule.title = true
+	default:
+		return rewriteRule{}, fmt.Errorf("unknown kind %q, want text, html or title", words[0])
+	}
+	pattern, err := regexp.Compile(words[1])
+	if err != nil {
+		return rewriteRule{}, err
+	}
+	rule.pattern = pattern
+	rule.replacement = words[2]
+	rule.hosts = words[3:]
+	return rule, nil
+}
+
+func (r rewriteRule) appliesTo(host string) bool {
+	return len(r.hosts) == 0 || containsString(r.hosts, host)
+}
+
+// applyRules rewrites chapter content from host by the rules for that site,
+// in the order they were given.
+func applyRules(rules []rewriteRule, host string, url string, content string) string {
+	for i := 0; i < len(rules); i++ {
+		if rules[i].title {
+			continue
+		}
+		if rules[i].html {
+			if rules[i].appliesTo(host) {
+				content = rules[i].pattern.ReplaceAllString(content, rules[i].replacement)
+			}
+			continue
+		}
+		// Text rules next to each other share a parse of the content.
+		j := i + 1
+		for j < len(rules) && !rules[j].html && !rules[j].title {
+			j++
+		}
+		content = applyTextRules(rules[i:j], host, url, content)
+		i = j - 1
+	}
+	return content
+}
+
+// applyTextRules rewrites the text of content by rules, leaving its markup
+// as it was.
+func applyTextRules(rules []rewriteRule, host string, url string, content string) string {
+	var applicable []rewriteRule
+	for _, rule := range rules {
+		if rule.appliesTo(host) {
+			applicable = append(applicable, rule)
+		}
+	}
+	if len(applicable) == 0 {
+		return content
+	}
+	return rewriteText(content, url, func(text string) string {
+		for _, rule := range applicable {
+			text = rule.pattern.ReplaceAllString(text, rule.replacement)
+		}
+		return text
+	})
+}
+
+// rewriteText passes each run of text between the tags of content, but
+// those of scripts and stylesheets, through rewrite.
+func rewriteText(content string, url string, rewrite func(string) string) string {
+	context := &xhtml.Node{Type: xhtml.ElementNode, Data: "body", DataAtom: atom.Body}
+	nodes, err := xhtml.ParseFragment(strings.NewReader(content), context)
+	if err != nil {
+		logger.Warnw("Failed to parse chapter content", "url", url, "error", err)
+		return content
+	}
+	changed := false
+	var walk func(*xhtml.Node)
+	walk = func(node *xhtml.Node) {
+		if node.Type == xhtml.TextNode {
+			if text := rewrite(node.Data); text != node.Data {
+				node.Data = text
+				changed = true
+			}
+		}
+		if node.DataAtom == atom.Script || node.DataAtom == atom.Style {
+			return
+		}
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+	for _, node := range nodes {
+		walk(node)
+	}
+	if !changed {
+		return content
+	}
+	var buf bytes.Buffer
+	for _, node := range nodes {
+		if err := xhtml.Render(&buf, node); err != nil {
+			logger.Warnw("Failed to render chapter content", "url", url, "error", err)
+			return content
+		}
+	}
+	return buf.String()
+}
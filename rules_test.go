@@ -0,0 +1,46 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRules(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "rules.txt")
+	err := os.WriteFile(filename, []byte(`# Typos
+text '\bteh\b' 'the'
+text 'f[*]ck' 'fuck' www.royalroad.com  # censored
+html '<p>\s*TL note:.*?</p>' ''
+text '(\w+) \*(\w+)\*' '$1 $2'
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := readRules(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 4 {
+		t.Fatalf("read %d rules, want 4", len(rules))
+	}
+	content := `<p>teh f*ck</p><p>TL note: sorry</p><p><a href="teh.html" title="teh">teh</a> said *hello*</p>`
+	for host, want := range map[string]string{
+		"www.royalroad.com":   `<p>the fuck</p><p><a href="teh.html" title="teh">the</a> said hello</p>`,
+		"www.scribblehub.com": `<p>the f*ck</p><p><a href="teh.html" title="teh">the</a> said hello</p>`,
+	} {
+		if got := applyRules(rules, host, "https://"+host+"/chapter", content); got != want {
+			t.Errorf("applyRules for %s\n got %q\nwant %q", host, got, want)
+		}
+	}
+
+	for _, line := range []string{"text 'a'", "css 'a' 'b'", "html '(' 'b'"} {
+		words, err := splitWords(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := parseRule(words); err == nil {
+			t.Errorf("rule %q was taken", line)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/gocolly/colly"
+	"go.uber.org/zap"
+)
+
+func init() {
+	logger = zap.NewNop().Sugar()
+}
+
+// fixtureTransport answers requests with files from testdata, picking the
+// first route whose pattern matches the whole URL.
+type fixtureTransport []fixtureRoute
+
+type fixtureRoute struct {
+	pattern  *regexp.Regexp
+	filename string
+}
+
+func (t fixtureTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	for _, route := range t {
+		if !route.pattern.MatchString(request.URL.String()) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join("testdata", route.filename))
+		if err != nil {
+			return nil, err
+		}
+		header := http.Header{"Content-Type": {"text/html; charset=utf-8"}}
+		if strings.HasSuffix(route.filename, ".png") {
+			header.Set("Content-Type", "image/png")
+		}
+		return &http.Response{
+			Status:        "200 OK",
+			StatusCode:    http.StatusOK,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        header,
+			Body:          io.NopCloser(bytes.NewReader(data)),
+			ContentLength: int64(len(data)),
+			Request:       request,
+		}, nil
+	}
+	return &http.Response{
+		Status:     "404 Not Found",
+		StatusCode: http.StatusNotFound,
+		Header:     http.Header{},
+		Body:       http.NoBody,
+		Request:    request,
+	}, nil
+}
+
+func route(pattern string, filename string) fixtureRoute {
+	return fixtureRoute{regexp.MustCompile("^" + pattern + "$"), filename}
+}
+
+// scraperFixtures are the stored pages each scraper is run against.
+var scraperFixtures = []struct {
+	name      string
+	baseURL   string
+	transport fixtureTransport
+	chapters  int
+}{
+	{
+		name:    "royalroad",
+		baseURL: "https://www.royalroad.com/fiction/12345/the-example",
+		transport: fixtureTransport{
+			route(`https://www\.royalroad\.com/fiction/12345/the-example`, "royalroad/fiction.html"),
+			route(`https://www\.royalroad\.com/fiction/12345/the-example/chapter/\d+/.*`, "royalroad/chapter.html"),
+		},
+		chapters: 50,
+	},
+	{
+		name:    "phrack",
+		baseURL: "http://phrack.org/issues/70/1.html",
+		transport: fixtureTransport{
+			route(`http://phrack\.org/issues/70/\d+\.html`, "phrack/article.html"),
+		},
+		chapters: 10,
+	},
+	{
+		name:    "scribblehub",
+		baseURL: "https://www.scribblehub.com/series/123456/another-example/",
+		transport: fixtureTransport{
+			route(`https://www\.scribblehub\.com/series/123456/another-example/`, "scribblehub/series.html"),
+			route(`https://www\.scribblehub\.com/wp-admin/admin-ajax\.php`, "scribblehub/toc.html"),
+			route(`https://www\.scribblehub\.com/read/123456-another-example/chapter/1001/`, "scribblehub/chapter-1.html"),
+			route(`https://www\.scribblehub\.com/read/123456-another-example/chapter/1002/`, "scribblehub/chapter-2.html"),
+			route(`https://www\.scribblehub\.com/read/123456-another-example/chapter/1003/`, "scribblehub/chapter-3.html"),
+		},
+		chapters: 3,
+	},
+}
+
+func fixtureCollector(transport http.RoundTripper) *colly.Collector {
+	collector := colly.NewCollector()
+	collector.WithTransport(transport)
+	return collector
+}
+
+func BenchmarkScrape(b *testing.B) {
+	for _, fixture := range scraperFixtures {
+		fixture := fixture
+		b.Run(fixture.name, func(b *testing.B) {
+			baseURL, err := url.Parse(fixture.baseURL)
+			if err != nil {
+				b.Fatal(err)
+			}
+			scrape := handlers[baseURL.Host]
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				book, err := scrape(fixtureCollector(fixture.transport), fixture.baseURL, ScrapeOptions{})
+				if err != nil {
+					b.Fatal(err)
+				}
+				if book.chapters.count() != fixture.chapters {
+					b.Fatalf("scraped %d chapters, want %d", book.chapters.count(), fixture.chapters)
+				}
+				book.chapters.Close()
+			}
+		})
+	}
+}
+
+func BenchmarkImageURLs(b *testing.B) {
+	data, err := os.ReadFile(filepath.Join("testdata", "royalroad", "chapter.html"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	content := string(data)
+	embedder := newImageEmbedder(nil, hostAllowList{"royalroadcdn.com"}, nil)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(content)))
+	for i := 0; i < b.N; i++ {
+		if urls := embedder.imageURLs(content, "https://www.royalroad.com/fiction/12345/the-example/chapter/1001/chapter-1"); len(urls) != 1 {
+			b.Fatalf("found %d images, want 1", len(urls))
+		}
+	}
+}
+
+func BenchmarkEmbedImages(b *testing.B) {
+	data, err := os.ReadFile(filepath.Join("testdata", "royalroad", "chapter.html"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	content := string(data)
+	client := &http.Client{Transport: fixtureTransport{
+		route(`https://www\.royalroadcdn\.com/.*\.png`, "royalroad/divider.png"),
+	}}
+	builder, err := newEpubBuilder(client, hostAllowList{"royalroadcdn.com"}, 1, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer builder.Close()
+	b.ReportAllocs()
+	b.SetBytes(int64(len(content)))
+	for i := 0; i < b.N; i++ {
+		if _, err := builder.images.embed(content, "https://www.royalroad.com/fiction/12345/the-example/chapter/1001/chapter-1"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkChapterRows reads the table of contents rows the way colly's own
+// helpers would, parsing selectors on every call, and with the scraper's
+// compiled selectors.
+func BenchmarkChapterRows(b *testing.B) {
+	data, err := os.ReadFile(filepath.Join("testdata", "royalroad", "fiction.html"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(data))
+	if err != nil {
+		b.Fatal(err)
+	}
+	request := &colly.Request{URL: &url.URL{Scheme: "https", Host: "www.royalroad.com", Path: "/fiction/12345/the-example"}}
+	response := &colly.Response{Request: request}
+	table := colly.NewHTMLElementFromSelectionNode(response, doc.Selection, doc.Find("#chapters").Nodes[0], 0)
+
+	b.Run("parsed", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			table.ForEach("tbody tr", func(_ int, row *colly.HTMLElement) {
+				_ = row.ChildAttr("td:nth-child(1) a", "href")
+				_ = row.ChildText("td:nth-child(1) a")
+				_ = row.ChildAttr("time", "unixtime")
+			})
+		}
+	})
+	b.Run("compiled", func(b *testing.B) {
+		sel := &royalRoadSelectors
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			forEachChild(table, sel.chapterRow, func(_ int, row *colly.HTMLElement) {
+				_ = childAttr(row, sel.chapterLink, "href")
+				_ = childText(row, sel.chapterLink)
+				_ = childAttr(row, sel.chapterDate, "unixtime")
+			})
+		}
+	})
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files of the scraper tests from their current output")
+
+// goldenChapters is how many chapters of each book are fetched and kept in
+// its golden file; the rest of a fixture's chapters repeat the same page.
+const goldenChapters = 3
+
+// goldenBook is a ScrapedBook in the form it is stored in testdata, with the
+// chapters that were fetched in table of contents order.
+type goldenBook struct {
+	Meta     Metadata
+	TOC      []TOCEntry
+	Chapters []Chapter
+}
+
+func newGoldenBook(book ScrapedBook) goldenBook {
+	golden := goldenBook{Meta: book.meta, TOC: book.toc}
+	for _, entry := range book.toc {
+		if chapter, ok := book.chapters.get(entry.URL); ok {
+			golden.Chapters = append(golden.Chapters, chapter)
+		}
+	}
+	return golden
+}
+
+// TestScrapeGolden runs each scraper over its stored pages, through the same
+// colly pipeline as a real scrape, and compares the book it makes with
+// testdata/<scraper>/golden.json. After an intended change to what a
+// scraper extracts, run `go test -run TestScrapeGolden -update` and review
+// the diff of the golden files.
+func TestScrapeGolden(t *testing.T) {
+	for _, fixture := range scraperFixtures {
+		fixture := fixture
+		t.Run(fixture.name, func(t *testing.T) {
+			baseURL, err := url.Parse(fixture.baseURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			book, err := handlers[baseURL.Host](fixtureCollector(fixture.transport), fixture.baseURL, ScrapeOptions{MaxChapters: goldenChapters})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer book.chapters.Close()
+			var buf bytes.Buffer
+			encoder := json.NewEncoder(&buf)
+			encoder.SetEscapeHTML(false)
+			encoder.SetIndent("", "  ")
+			if err := encoder.Encode(newGoldenBook(book)); err != nil {
+				t.Fatal(err)
+			}
+			got := buf.Bytes()
+
+			filename := filepath.Join("testdata", fixture.name, "golden.json")
+			if *updateGolden {
+				if err := os.WriteFile(filename, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(filename)
+			if err != nil {
+				t.Fatalf("%v; run with -update to create it", err)
+			}
+			if !bytes.Equal(got, want) {
+				var wantBook goldenBook
+				if err := json.Unmarshal(want, &wantBook); err != nil {
+					t.Fatal(err)
+				}
+				reportGoldenDiff(t, newGoldenBook(book), wantBook)
+				t.Errorf("scraped book differs from %s; if the change is intended, run with -update", filename)
+			}
+		})
+	}
+}
+
+// reportGoldenDiff points out where two books first differ, which is easier
+// to act on than the whole of both.
+func reportGoldenDiff(t *testing.T, got goldenBook, want goldenBook) {
+	t.Helper()
+	if got.Meta != want.Meta {
+		t.Errorf("metadata is %+v, want %+v", got.Meta, want.Meta)
+	}
+	if len(got.TOC) != len(want.TOC) {
+		t.Errorf("table of contents has %d entries, want %d", len(got.TOC), len(want.TOC))
+	}
+	for i := 0; i < len(got.TOC) && i < len(want.TOC); i++ {
+		if !got.TOC[i].Date.Equal(want.TOC[i].Date) || got.TOC[i].URL != want.TOC[i].URL || got.TOC[i].Title != want.TOC[i].Title {
+			t.Errorf("table of contents entry %d is %+v, want %+v", i+1, got.TOC[i], want.TOC[i])
+			break
+		}
+	}
+	if len(got.Chapters) != len(want.Chapters) {
+		t.Errorf("%d chapters were fetched, want %d", len(got.Chapters), len(want.Chapters))
+	}
+	for i := 0; i < len(got.Chapters) && i < len(want.Chapters); i++ {
+		if got.Chapters[i] != want.Chapters[i] {
+			t.Errorf("chapter %d differs: title %q, want %q; content is %d bytes, want %d", i+1, got.Chapters[i].Title, want.Chapters[i].Title, len(got.Chapters[i].Content), len(want.Chapters[i].Content))
+			break
+		}
+	}
+}
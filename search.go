@@ -0,0 +1,192 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	xhtml "golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// searchIndex is a full-text index of the chapters of every book scraped,
+// kept in an SQLite FTS5 table in the cache directory, for finding which
+// book a half-remembered quote is from.
+type searchIndex struct {
+	db *sql.DB
+}
+
+// searchIndexFilename is where the index is kept, in a state directory of
+// the cache for pruning and eviction to leave it, and its journal, alone.
+// An index where older versions kept it, among the responses, is moved there.
+func searchIndexFilename(cacheDir string) string {
+	filename := filepath.Join(cacheDir, "search", "search.db")
+	old := filepath.Join(cacheDir, "search.db")
+	if _, err := os.Stat(old); err == nil {
+		if _, err := os.Stat(filename); errors.Is(err, fs.ErrNotExist) && os.MkdirAll(filepath.Dir(filename), 0755) == nil {
+			if err := os.Rename(old, filename); err != nil {
+				logger.Warnw("Failed to move search index", "from", old, "to", filename, "error", err)
+			}
+		}
+	}
+	return filename
+}
+
+func openSearchIndex(filename string) (*searchIndex, error) {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite", filename+"?_pragma=busy_timeout(10000)")
+	if err != nil {
+		return nil, err
+	}
+	// Books written at the same time take turns.
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS chapters USING fts5(
+		book, chapter, text,
+		source UNINDEXED, url UNINDEXED, output UNINDEXED, position UNINDEXED,
+		tokenize = 'unicode61 remove_diacritics 2'
+	)`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &searchIndex{db: db}, nil
+}
+
+func (i *searchIndex) Close() error {
+	return i.db.Close()
+}
+
+// add indexes the chapters of book, written to filename, in place of
+// whatever was indexed of it before.
+func (i *searchIndex) add(book ScrapedBook, filename string) error {
+	tx, err := i.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM chapters WHERE source = ?`, book.meta.SourceURL); err != nil {
+		return err
+	}
+	insert, err := tx.Prepare(`INSERT INTO chapters (book, chapter, text, source, url, output, position) VALUES (?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+	for position, entry := range book.toc {
+		chapter, ok := book.chapters.get(entry.URL)
+		if !ok {
+			continue
+		}
+		_, err := insert.Exec(book.meta.Title, chapter.Title, htmlText(chapter.Content), book.meta.SourceURL, entry.URL, filename, position+1)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// searchResult is a chapter matching a search, with a snippet of its text
+// around the match.
+type searchResult struct {
+	Book, Chapter, URL, Output, Snippet string
+	Position                            int
+}
+
+// search returns the chapters matching query, best matches first. The
+// query is FTS5's syntax, in which words are all required and a phrase is
+// quoted.
+func (i *searchIndex) search(query string, limit int) ([]searchResult, error) {
+	rows, err := i.db.Query(`SELECT book, chapter, url, output, position, snippet(chapters, 2, '[', ']', '…', 16)
+		FROM chapters WHERE chapters MATCH ? ORDER BY rank LIMIT ?`, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []searchResult
+	for rows.Next() {
+		var r searchResult
+		if err := rows.Scan(&r.Book, &r.Chapter, &r.URL, &r.Output, &r.Position, &r.Snippet); err != nil {
+			return nil, err
+		}
+		results = append(results, r)
+	}
+	return results, rows.Err()
+}
+
+// runSearchCommand implements `search [-limit N] [-query] TEXT...`. The text
+// is searched for as a phrase, unless -query passes it on as an FTS5 query.
+func runSearchCommand(cacheDir string, args []string) error {
+	flags := flag.NewFlagSet("search", flag.ContinueOnError)
+	limit := flags.Int("limit", 20, "show at most `n` chapters")
+	raw := flags.Bool("query", false, "take the text as an FTS5 query, with AND, OR, NOT and prefix* searches, instead of a phrase")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return errors.New("usage: search [-limit N] [-query] TEXT...")
+	}
+	filename := searchIndexFilename(cacheDir)
+	if _, err := os.Stat(filename); err != nil {
+		return fmt.Errorf("no books have been indexed yet: %w", err)
+	}
+	index, err := openSearchIndex(filename)
+	if err != nil {
+		return err
+	}
+	defer index.Close()
+	query := strings.Join(flags.Args(), " ")
+	if !*raw {
+		query = `"` + strings.ReplaceAll(query, `"`, `""`) + `"`
+	}
+	results, err := index.search(query, *limit)
+	if err != nil {
+		return err
+	}
+	if len(results) == 0 {
+		return errors.New("no chapters match")
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%d. %s\t%s\n", r.Book, r.Position, r.Chapter, strings.Join(strings.Fields(r.Snippet), " "))
+	}
+	return tw.Flush()
+}
+
+// htmlText is the text of an HTML fragment, with blocks on lines of their
+// own.
+func htmlText(fragment string) string {
+	nodes, err := xhtml.ParseFragment(strings.NewReader(fragment), &xhtml.Node{Type: xhtml.ElementNode, Data: "body", DataAtom: atom.Body})
+	if err != nil {
+		return fragment
+	}
+	var b strings.Builder
+	var walk func(node *xhtml.Node)
+	walk = func(node *xhtml.Node) {
+		switch node.Type {
+		case xhtml.TextNode:
+			b.WriteString(node.Data)
+		case xhtml.ElementNode:
+			if node.DataAtom == atom.Script || node.DataAtom == atom.Style {
+				return
+			}
+			if node.DataAtom == atom.Br || blockElements[node.DataAtom] {
+				b.WriteByte('\n')
+			}
+		}
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+	for _, node := range nodes {
+		walk(node)
+	}
+	return strings.TrimSpace(b.String())
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/andybalholm/cascadia"
+	"github.com/gocolly/colly"
+)
+
+// siteSelector is a compiled selector that a scraper looks for on a site's
+// pages. It counts how often it is looked for and how many elements it
+// matches, so that a selector broken by a change to the site's layout is
+// reported by name, rather than showing up as an empty book.
+type siteSelector struct {
+	cascadia.Selector
+	site, name, css string
+	// key marks the selectors a book can't be made without, as opposed to
+	// the likes of covers and dates that a book can do without.
+	key     bool
+	lookups atomic.Int64
+	matches atomic.Int64
+}
+
+var (
+	selectorsMu sync.Mutex
+	selectors   []*siteSelector
+)
+
+// newSelector compiles css as the selector called name of site, panicking if
+// it isn't valid like cascadia.MustCompile.
+func newSelector(site, name, css string) *siteSelector {
+	s := &siteSelector{Selector: cascadia.MustCompile(css), site: site, name: name, css: css}
+	selectorsMu.Lock()
+	selectors = append(selectors, s)
+	selectorsMu.Unlock()
+	return s
+}
+
+// keySelector is newSelector for a selector without which a book can't be
+// made.
+func keySelector(site, name, css string) *siteSelector {
+	s := newSelector(site, name, css)
+	s.key = true
+	return s
+}
+
+// find returns the elements inside e matched by s.
+func (s *siteSelector) find(e *colly.HTMLElement) *goquery.Selection {
+	selection := e.DOM.FindMatcher(s)
+	s.lookups.Add(1)
+	s.matches.Add(int64(selection.Length()))
+	return selection
+}
+
+// reportSelectorHealth logs how each selector that was looked for fared. Key
+// selectors that never matched are warned about, as the likely reason for
+// missing chapters or metadata.
+func reportSelectorHealth() {
+	selectorsMu.Lock()
+	used := make([]*siteSelector, 0, len(selectors))
+	for _, s := range selectors {
+		if s.lookups.Load() > 0 {
+			used = append(used, s)
+		}
+	}
+	selectorsMu.Unlock()
+	sort.SliceStable(used, func(i, j int) bool { return used[i].site < used[j].site })
+	for _, s := range used {
+		lookups, matches := s.lookups.Load(), s.matches.Load()
+		logger.Debugw("Selector health", "site", s.site, "selector", s.name, "css", s.css, "lookups", lookups, "matches", matches)
+		if matches == 0 && s.key {
+			logger.Warnw("Selector broke, matching nothing; the site's layout may have changed",
+				"site", s.site, "selector", s.name, "css", s.css, "lookups", lookups)
+		}
+	}
+}
+
+// brokenSelectors returns the names of the key selectors of site that were
+// looked for but never matched.
+func brokenSelectors(site string) []string {
+	selectorsMu.Lock()
+	defer selectorsMu.Unlock()
+	var names []string
+	for _, s := range selectors {
+		if s.site == site && s.key && s.lookups.Load() > 0 && s.matches.Load() == 0 {
+			names = append(names, s.name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,593 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mapset "github.com/deckarep/golang-set/v2"
+	"github.com/gocolly/colly"
+)
+
+// session holds what is shared between all the books scraped in one run. Its
+// books may be scraped concurrently.
+type session struct {
+	client        http.RoundTripper
+	cache         *CachingTransport
+	collector     *colly.Collector
+	limitedHosts  mapset.Set[string]
+	obeyRobots    bool
+	cookieBrowser string
+	assetDomains  []string
+	listChapters  bool
+	dryRun        bool
+	resume        bool
+	showProgress  bool
+	force         bool
+	unique        bool
+	library       string
+	// search, if set, indexes the text of every book written.
+	search *searchIndex
+	// calibreOPF writes Calibre's metadata.opf next to each epub, and
+	// calibreLibrary, if set, is the Calibre library books are added to.
+	calibreOPF     bool
+	calibreLibrary string
+	// openLibrary looks books up in Open Library for the metadata of their
+	// published editions.
+	openLibrary bool
+	// uploads are where each epub is pushed once written.
+	uploads []uploadTarget
+	// kepub also writes each book as a kepub, which is what is uploaded
+	// and served to kobo.
+	kepub bool
+	kobo  *koboServer
+	// about adds an "About this book" page to every epub.
+	about bool
+	// filters takes the junk contentFilters know of out of chapters.
+	filters bool
+	// rules are the user's rewrite rules, applied to every chapter fetched.
+	rules []rewriteRule
+	// cleanTitles are the -clean-titles transforms of chapter titles.
+	cleanTitles []string
+	// terms is the user's term dictionary, applied to every chapter and
+	// chapter title, or nil.
+	terms *termDictionary
+	// translator, if set, translates the chapters of every book.
+	translator *chapterTranslator
+	// comments are which comments of chapters to append, if any.
+	comments string
+	// glossary appends the glossary the site keeps for each story, if any.
+	glossary bool
+	// whatsNew adds a "What's new" page to the epubs updated, listing the
+	// chapters the update brought.
+	whatsNew bool
+	// archiver, if set, saves every chapter fetched to the Wayback Machine.
+	archiver *archiver
+	mailer   *mailer
+	keepHTML bool
+	// strict fails a book that checkBook finds problems with, rather
+	// than writing it regardless.
+	strict       bool
+	concurrency  int
+	imageWorkers int
+	// reuseTOC allows a book's table of contents to be taken from its
+	// snapshot when the listing pages haven't changed.
+	reuseTOC bool
+	prewarm  bool
+	// recheck fetches every chapter of the epubs updated again, replacing
+	// those whose text changed upstream.
+	recheck bool
+	// alternate allows suspect chapters to be fetched again with the
+	// alternate transport.
+	alternate bool
+	// timestamp, if set, dates every epub written.
+	timestamp time.Time
+	notifier  *notifier
+	// dump, if set, saves every book as scraped for -debug-dump.
+	dump *debugDump
+
+	hostsMu sync.Mutex
+	// mu serializes updates to the library index, reports on stdout and
+	// missing.
+	mu    sync.Mutex
+	books atomic.Int32
+	// missing lists the chapters of the books written that couldn't be
+	// fetched.
+	missing []missingReport
+	// report keeps what was extracted of each book's chapters in
+	// extractions, for -report.
+	report      bool
+	extractions []extractionReport
+}
+
+// setupHost prepares the shared collector for the first book from host:
+// browser cookies and a rate limit that honors the site's Crawl-delay.
+func (s *session) setupHost(siteURL *url.URL) error {
+	// Another book from the same host waits until the host is set up.
+	s.hostsMu.Lock()
+	defer s.hostsMu.Unlock()
+	if s.limitedHosts.Contains(siteURL.Host) {
+		return nil
+	}
+	s.limitedHosts.Add(siteURL.Host)
+	if s.prewarm {
+		origins := []string{siteURL.Scheme + "://" + siteURL.Host}
+		for _, host := range cdnHosts[siteURL.Host] {
+			origins = append(origins, "https://"+host)
+		}
+		prewarm(s.cache.Transport, origins)
+	}
+	if s.cookieBrowser != "" {
+		cookies, err := readBrowserCookies(s.cookieBrowser, siteURL.Hostname())
+		if err != nil {
+			return err
+		}
+		logger.Infow("Import browser cookies", "browser", s.cookieBrowser, "host", siteURL.Host, "count", len(cookies))
+		if err := s.collector.SetCookies(siteURL.String(), cookies); err != nil {
+			return err
+		}
+	}
+	limit := &colly.LimitRule{DomainGlob: siteURL.Host, Parallelism: s.concurrency}
+	if s.obeyRobots {
+		agent := userAgent
+		if agent == "" {
+			agent = s.collector.UserAgent
+		}
+		crawlDelay, err := fetchCrawlDelay(&http.Client{Transport: s.client}, siteURL, agent)
+		if err != nil {
+			logger.Warnw("Failed to read robots.txt", "error", err)
+		} else if crawlDelay > 0 {
+			logger.Infow("Honor crawl delay", "host", siteURL.Host, "delay", crawlDelay)
+			limit.Parallelism = 1
+			limit.Delay = crawlDelay
+		}
+	}
+	return s.collector.Limit(limit)
+}
+
+func (s *session) scrapeBook(job bookJob) (err error) {
+	baseURL := job.URL
+	parsedURL, err := url.Parse(baseURL)
+	if err != nil {
+		return err
+	}
+	handler := handlers[parsedURL.Host]
+	if err := s.setupHost(parsedURL); err != nil {
+		return err
+	}
+	if !job.Options.TOCOnly {
+		s.notifier.forJob(job).bookStarted(baseURL)
+	}
+	assetHosts := hostAllowList{parsedURL.Host, "wp.com"}
+	assetHosts = append(assetHosts, assetDomains[parsedURL.Host]...)
+	assetHosts = append(assetHosts, s.assetDomains...)
+
+	var previous *previousEpub
+	if job.Update != "" {
+		previous, err = readPreviousEpub(job.Update)
+		if err != nil {
+			return err
+		}
+		defer previous.Close()
+		if !s.recheck {
+			job.Options.Known = previous.chapterURLs()
+		}
+	}
+	// Rechecking an epub fetches its chapters again to find those edited
+	// since, which neither the stored chapters nor a snapshot can tell.
+	rechecking := previous != nil && s.recheck
+
+	// Requests are tagged with the book, for the cache to tell books
+	// scraped at the same time apart.
+	book := strconv.Itoa(int(s.books.Add(1)))
+	job.Options.OnRequest = func(r *colly.Request) { r.Headers.Set(cacheBookHeader, book) }
+	client := BookTransport{Transport: s.client, Book: book}
+
+	prog := &progress{enabled: s.showProgress}
+	defer prog.finish()
+	job.Options.OnQueue = func(n int) { prog.start(phaseDownload, n) }
+	job.Options.Alternate = s.alternate
+	job.Options.KeepUserAgent = s.cookieBrowser != ""
+	if s.filters || len(s.rules) > 0 || s.terms != nil {
+		host := parsedURL.Host
+		job.Options.Filter = func(url string, content string) string {
+			if s.filters {
+				content = filterContent(host, url, content)
+			}
+			content = applyRules(s.rules, host, url, content)
+			if s.terms != nil {
+				content = s.terms.apply(url, content)
+			}
+			return content
+		}
+	}
+	var failedMu sync.Mutex
+	failed := make(map[string]error)
+	job.Options.OnError = func(url string, err error) {
+		failedMu.Lock()
+		failed[chapterKey(url)] = err
+		failedMu.Unlock()
+	}
+	job.Options.OnChapter = func(_ string, chapter Chapter) {
+		prog.step(phaseDownload)
+		prog.detail(chapter.Title)
+	}
+
+	// Fetched chapters are recorded until the book has been written, for
+	// -resume to pick up after an interruption.
+	var state *crawlState
+	if !job.Options.TOCOnly {
+		state, err = openCrawlState(crawlStateFilename(filepath.Join(s.cache.Dir, "resume"), baseURL), s.resume)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err == nil {
+				state.Remove()
+			} else {
+				state.Close()
+			}
+		}()
+		if len(state.order) > 0 {
+			logger.Infow("Resume scrape", "baseURL", baseURL, "chapters", len(state.order))
+		}
+		job.Options.Known = append(job.Options.Known, state.order...)
+		job.Options.OnChapter = func(url string, chapter Chapter) {
+			state.record(url, chapter)
+			prog.step(phaseDownload)
+			prog.detail(chapter.Title)
+		}
+	}
+
+	// Chapters kept from earlier runs needn't be fetched again unless the
+	// table of contents dates them later than the stored version.
+	var stories *storyStore
+	// Neither do they have the comments of chapters.
+	var comments *chapterComments
+	if s.comments != "" && !job.Options.TOCOnly {
+		if commentSites[parsedURL.Host] {
+			comments = newChapterComments()
+			job.Options.Comments = s.comments
+			job.Options.OnComments = comments.add
+		} else {
+			logger.Warnw("Comments can't be taken from the site", "host", parsedURL.Host)
+		}
+	}
+	if !job.Options.TOCOnly && !s.cache.Refresh && !rechecking && comments == nil {
+		stories, err = openStoryStore(filepath.Join(s.cache.Dir, "stories"), baseURL, filterHash(s.filters, s.rules, s.terms))
+		if err != nil {
+			logger.Warnw("Ignore damaged story manifest", "baseURL", baseURL, "error", err)
+			stories = nil
+		} else {
+			defer stories.Close()
+			job.Options.Have = stories.has
+		}
+	}
+
+	assetClient := &http.Client{Transport: AllowedHostsTransport{Transport: client, Hosts: assetHosts}}
+	var builder *epubBuilder
+	if !job.Options.TOCOnly {
+		var carried map[string]string
+		if previous != nil {
+			carried = previous.images
+		}
+		builder, err = newEpubBuilder(assetClient, assetHosts, s.imageWorkers, carried)
+		if err != nil {
+			return err
+		}
+		defer builder.Close()
+		builder.alternate = s.alternate
+		builder.about = s.about
+		builder.comments = comments
+		builder.translator = s.translator
+		job.Options.Prepare = builder.prepare
+	}
+
+	if s.archiver != nil {
+		onChapter := job.Options.OnChapter
+		job.Options.OnChapter = func(url string, chapter Chapter) {
+			s.archiver.add(url)
+			onChapter(url, chapter)
+		}
+	}
+
+	// Snapshots are only kept of, and only stand in for, complete tables of
+	// contents.
+	snapshotFilename := tocSnapshotFilename(filepath.Join(s.cache.Dir, "toc"), baseURL)
+	opts := job.Options
+	snapshots := s.reuseTOC && opts.FromURL == "" && len(opts.ExcludeTitles) == 0 && opts.MaxChapters == 0 && !rechecking
+
+	prog.start(phaseDiscover, -1)
+	var scrapedBook ScrapedBook
+	if snapshots && (state == nil || len(state.order) == 0) {
+		scrapedBook, err = s.reusedTOC(snapshotFilename, job, previous)
+		if err != nil {
+			return err
+		}
+	}
+	if scrapedBook.chapters == nil {
+		logger.Infow("Scrape html", "baseURL", baseURL)
+		scrapedBook, err = handler(s.collector.Clone(), baseURL, job.Options)
+		if err != nil {
+			return err
+		}
+	}
+	defer scrapedBook.chapters.Close()
+	prog.finish()
+	scrapedBook.meta.SourceURL = baseURL
+	scrapedBook.failed = failed
+	if state != nil {
+		state.restore(&scrapedBook)
+	}
+	if stories != nil {
+		if err := stories.restore(&scrapedBook, job.Options.Prepare); err != nil {
+			return err
+		}
+	}
+	tocPages := s.cache.TOCPages(book)
+	if snapshots && previous == nil {
+		s.saveTOCSnapshot(snapshotFilename, scrapedBook, tocPages)
+	}
+	if job.Options.MaxChapters > 0 && !job.Options.TOCOnly {
+		scrapedBook.dropUnfetched()
+	}
+	if clean := titleCleaner(s.cleanTitles, s.rules, s.terms, parsedURL.Host, scrapedBook.meta.Title); clean != nil {
+		for i := range scrapedBook.toc {
+			scrapedBook.toc[i].Title = clean(scrapedBook.toc[i].Title)
+		}
+		if builder != nil {
+			builder.cleanTitle = clean
+		}
+	}
+	if misses := s.cache.Misses(book); len(misses) > 0 {
+		return fmt.Errorf("%d pages missing from cache in offline mode: %v", len(misses), misses)
+	}
+	if s.dump != nil {
+		var imageSources map[string]string
+		if builder != nil {
+			imageSources = builder.imageSources()
+		}
+		if err := s.dump.saveBook(book, scrapedBook, imageSources); err != nil {
+			logger.Warnw("Failed to dump book", "baseURL", baseURL, "error", err)
+		}
+	}
+	if s.listChapters {
+		s.mu.Lock()
+		printTOC(os.Stdout, scrapedBook.toc)
+		s.mu.Unlock()
+		return nil
+	}
+	if s.report && !job.Options.TOCOnly {
+		extraction := newExtractionReport(scrapedBook)
+		s.mu.Lock()
+		s.extractions = append(s.extractions, extraction)
+		s.mu.Unlock()
+	}
+	// The story store keeps chapters as scraped, before merging brings in
+	// those of the previous epub with their images already embedded.
+	fetchedBook := scrapedBook
+	newChapters := len(scrapedBook.toc)
+	if previous != nil {
+		var added, changed []string
+		scrapedBook, added, changed = previous.merge(scrapedBook)
+		newChapters = len(added)
+		defer scrapedBook.chapters.Close()
+		logger.Infow("Found new chapters", "filename", job.Update, "new", len(added), "changed", len(changed))
+		if snapshots {
+			s.saveTOCSnapshot(snapshotFilename, scrapedBook, tocPages)
+		}
+		if len(added) == 0 && len(changed) == 0 {
+			return nil
+		}
+		if s.whatsNew && builder != nil {
+			builder.added, builder.changed = added, changed
+		}
+		if builder != nil {
+			builder.carried = carriedHashes(previous, changed)
+		}
+	}
+	// Books only listed for a dry run have no chapters to check.
+	if !job.Options.TOCOnly {
+		problems := checkBook(scrapedBook)
+		for _, problem := range problems {
+			logger.Warnw("Book is inconsistent", "title", scrapedBook.meta.Title, "problem", problem)
+		}
+		if len(problems) > 0 && s.strict {
+			return fmt.Errorf("%d problems found before assembly, the first being that %s", len(problems), problems[0])
+		}
+	}
+	filename := job.Update
+	if filename == "" {
+		if s.library != "" {
+			filename = libraryFilename(s.library, scrapedBook)
+		} else {
+			filename, err = outputFilename(job.Output, scrapedBook, parsedURL.Host)
+			if err != nil {
+				return err
+			}
+		}
+		filename, err = resolveExisting(filename, len(scrapedBook.toc), s.force, s.unique)
+		if err != nil {
+			return err
+		}
+	}
+	if s.dryRun {
+		size := estimateBookSize(scrapedBook, &http.Client{Transport: client})
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		fmt.Printf("Title:          %s\n", scrapedBook.meta.Title)
+		fmt.Printf("Author:         %s\n", scrapedBook.meta.Author)
+		fmt.Printf("Chapters:       %d\n", len(scrapedBook.toc))
+		fmt.Printf("Output:         %s\n", filename)
+		fmt.Printf("Estimated size: %s\n", formatBytes(size))
+		return nil
+	}
+
+	// The lookup goes through the book's transports, for their headers,
+	// cache and recording; openLibrary is off when offline.
+	if s.openLibrary {
+		found, err := lookupOpenLibrary(&http.Client{Transport: client, Timeout: time.Minute}, &scrapedBook.meta)
+		if err != nil {
+			logger.Warnw("Failed to look book up in Open Library", "title", scrapedBook.meta.Title, "error", err)
+		} else if found {
+			logger.Infow("Found book in Open Library", "title", scrapedBook.meta.Title, "author", scrapedBook.meta.Author, "work", scrapedBook.meta.OpenLibrary)
+		} else {
+			logger.Debugw("Book is not in Open Library", "title", scrapedBook.meta.Title)
+		}
+	}
+	if s.glossary || job.GlossaryURL != "" {
+		s.addGlossary(builder, job, &http.Client{Transport: client})
+	}
+	logger.Infow("Assemble epub", "title", scrapedBook.meta.Title, "chapters", len(scrapedBook.toc))
+	timestamp := bookTimestamp(scrapedBook, s.timestamp)
+	doc, manifest, err := builder.assemble(scrapedBook, timestamp, prog)
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(filename); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	logger.Infow("Write to file", "filename", filename)
+	if err := doc.Write(filename); err != nil {
+		return err
+	}
+	prog.finish()
+	if err := writeManifest(filename, manifest, scrapedBook.meta, timestamp); err != nil {
+		return err
+	}
+	if missing := missingReports(filename, scrapedBook, manifest); len(missing) > 0 {
+		logger.Warnw("Some chapters are missing", "filename", filename, "missing", len(missing))
+		s.mu.Lock()
+		s.missing = append(s.missing, missing...)
+		s.mu.Unlock()
+	}
+	if stories != nil {
+		if err := stories.save(fetchedBook); err != nil {
+			logger.Warnw("Failed to save story manifest", "baseURL", baseURL, "error", err)
+		}
+	}
+	if s.keepHTML {
+		dir := strings.TrimSuffix(filename, filepath.Ext(filename)) + "_html"
+		logger.Infow("Write chapter html", "dir", dir)
+		if err := writeChapterHTML(dir, scrapedBook, builder.imageSources()); err != nil {
+			return err
+		}
+	}
+	if s.library != "" {
+		s.mu.Lock()
+		err := updateLibraryIndex(s.library, libraryEntry{
+			Title:    scrapedBook.meta.Title,
+			Author:   scrapedBook.meta.Author,
+			Source:   baseURL,
+			Path:     filename,
+			Chapters: len(scrapedBook.toc),
+			Updated:  time.Now(),
+			Hashes:   manifest.hashes(),
+		})
+		s.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	if s.search != nil {
+		if err := s.search.add(scrapedBook, filename); err != nil {
+			logger.Warnw("Failed to index book for search", "filename", filename, "error", err)
+		}
+	}
+	if s.calibreOPF {
+		if err := writeCalibreOPF(calibreOPFFilename(filename, s.library != ""), scrapedBook, timestamp); err != nil {
+			return err
+		}
+	}
+	if s.calibreLibrary != "" {
+		logger.Infow("Add to Calibre library", "filename", filename)
+		if err := calibreAdd(s.calibreLibrary, filename, scrapedBook); err != nil {
+			logger.Warnw("Failed to add book to Calibre library", "filename", filename, "error", err)
+		}
+	}
+	// Kobo readers get the kepub, where one was made, rather than the epub.
+	delivered := filename
+	if s.kepub {
+		delivered = kepubFilename(filename)
+		logger.Infow("Write kepub", "filename", delivered)
+		if err := writeKepub(filename, delivered); err != nil {
+			return err
+		}
+	}
+	uploadBook(s.uploads, delivered)
+	if s.kobo != nil {
+		s.kobo.add(delivered)
+	}
+	s.mailer.send(filename, scrapedBook.meta)
+	if job.OnWritten != nil {
+		job.OnWritten(filename)
+	}
+	var errs []string
+	for _, entry := range scrapedBook.toc {
+		if err := scrapedBook.failure(entry.URL); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", entry.URL, err))
+		}
+	}
+	s.notifier.forJob(job).bookWritten(jobReport{
+		Source:      baseURL,
+		Output:      filename,
+		Title:       scrapedBook.meta.Title,
+		Chapters:    len(scrapedBook.toc),
+		NewChapters: newChapters,
+		Errors:      errs,
+	})
+	return nil
+}
+
+// reusedTOC returns the book's table of contents from its snapshot, without
+// chapters, when that is all the job needs: the job only wants the table of
+// contents, or it updates an epub that already has every chapter listed. The
+// returned book has no chapter store if the snapshot can't be used.
+func (s *session) reusedTOC(filename string, job bookJob, previous *previousEpub) (ScrapedBook, error) {
+	snapshot, err := readTOCSnapshot(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ScrapedBook{}, nil
+	} else if err != nil {
+		logger.Warnw("Ignore damaged table of contents snapshot", "filename", filename, "error", err)
+		return ScrapedBook{}, nil
+	}
+	if !job.Options.TOCOnly {
+		if previous == nil {
+			return ScrapedBook{}, nil
+		}
+		known := ScrapeOptions{Known: previous.chapterURLs()}.knownKeys()
+		for _, entry := range snapshot.TOC {
+			if !known.Contains(chapterKey(entry.URL)) {
+				return ScrapedBook{}, nil
+			}
+		}
+	}
+	if !snapshot.current(s.cache) {
+		return ScrapedBook{}, nil
+	}
+	logger.Infow("Reuse table of contents, listing pages are unchanged", "baseURL", job.URL, "chapters", len(snapshot.TOC))
+	return ScrapedBook{meta: snapshot.Meta, toc: snapshot.TOC, chapters: newChapterStore()}, nil
+}
+
+// saveTOCSnapshot records the table of contents of book as read from pages.
+// Failing to record it only costs a crawl next time, so errors are logged.
+func (s *session) saveTOCSnapshot(filename string, book ScrapedBook, pages []string) {
+	snapshot := takeTOCSnapshot(s.cache, book, pages)
+	if snapshot == nil {
+		return
+	}
+	if err := writeTOCSnapshot(filename, snapshot); err != nil {
+		logger.Warnw("Failed to save table of contents snapshot", "filename", filename, "error", err)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+
+	xhtml "golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// statBlockClass and pollClass mark the blocks renderBlocks makes, which
+// assets/blocks.css styles.
+const (
+	statBlockClass = "stat-block"
+	pollClass      = "poll"
+)
+
+// renderBlocks makes the stat boxes and polls of Royal Road chapters
+// readable on e-ink. Authors of LitRPGs style stat boxes with colored
+// backgrounds and borders, often light text on a dark box, which comes out
+// as grey on grey or worse; they become plain bordered blocks. Polls, which
+// can't be voted in from a book, become their question and a list of their
+// options, or are left out with skipPolls.
+func renderBlocks(content string, skipPolls bool) string {
+	if !strings.Contains(content, "style=") && !strings.Contains(content, "<table") && !strings.Contains(content, "poll") && !strings.Contains(content, "<form") {
+		return content
+	}
+	context := &xhtml.Node{Type: xhtml.ElementNode, Data: "body", DataAtom: atom.Body}
+	nodes, err := xhtml.ParseFragment(strings.NewReader(content), context)
+	if err != nil {
+		logger.Warnw("Failed to parse chapter content", "error", err)
+		return content
+	}
+	for _, node := range nodes {
+		context.AppendChild(node)
+	}
+	if !renderBlockNodes(context, skipPolls) {
+		return content
+	}
+	var buf bytes.Buffer
+	for node := context.FirstChild; node != nil; node = node.NextSibling {
+		if err := xhtml.Render(&buf, node); err != nil {
+			logger.Warnw("Failed to render chapter content", "error", err)
+			return content
+		}
+	}
+	return buf.String()
+}
+
+// renderBlockNodes rewrites the stat boxes and polls under node, reporting
+// whether there were any.
+func renderBlockNodes(node *xhtml.Node, skipPolls bool) bool {
+	rendered := false
+	for child := node.FirstChild; child != nil; {
+		next := child.NextSibling
+		switch {
+		case child.Type != xhtml.ElementNode:
+		case isPoll(child):
+			if !skipPolls {
+				node.InsertBefore(renderPoll(child), child)
+			}
+			node.RemoveChild(child)
+			rendered = true
+		case child.DataAtom == atom.Table || isStyledBox(child):
+			plainBlock(child)
+			setAttr(child, "class", statBlockClass)
+			rendered = true
+		default:
+			if renderBlockNodes(child, skipPolls) {
+				rendered = true
+			}
+		}
+		child = next
+	}
+	return rendered
+}
+
+// isStyledBox reports whether the element is a block its author drew a box
+// around or filled in.
+func isStyledBox(node *xhtml.Node) bool {
+	if node.DataAtom != atom.Div && node.DataAtom != atom.P && node.DataAtom != atom.Blockquote {
+		return false
+	}
+	style := strings.ToLower(attr(node, "style"))
+	return strings.Contains(style, "border") || strings.Contains(style, "background")
+}
+
+// isPoll reports whether the element is a poll: one marked as such by its
+// class, or a form of options to pick from.
+func isPoll(node *xhtml.Node) bool {
+	for _, class := range strings.Fields(attr(node, "class")) {
+		if class == "poll" || strings.HasPrefix(class, "poll-") || strings.HasSuffix(class, "-poll") {
+			return true
+		}
+	}
+	return node.DataAtom == atom.Form && findNode(node, func(n *xhtml.Node) bool {
+		return n.DataAtom == atom.Input && (attr(n, "type") == "radio" || attr(n, "type") == "checkbox")
+	}) != nil
+}
+
+// renderPoll returns the question of a poll and its options, as text.
+func renderPoll(poll *xhtml.Node) *xhtml.Node {
+	question := findNode(poll, func(n *xhtml.Node) bool {
+		switch n.DataAtom {
+		case atom.Legend, atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6, atom.Strong, atom.B:
+			return true
+		}
+		return strings.Contains(attr(n, "class"), "question") || strings.Contains(attr(n, "class"), "title")
+	})
+	var options []string
+	walkNodes(poll, func(n *xhtml.Node) {
+		if n.DataAtom == atom.Label || n.DataAtom == atom.Li || strings.Contains(attr(n, "class"), "option") {
+			if text := nodeText(n); text != "" && !containsString(options, text) {
+				options = append(options, text)
+			}
+		}
+	})
+	block := &xhtml.Node{Type: xhtml.ElementNode, Data: "div", DataAtom: atom.Div, Attr: []xhtml.Attribute{{Key: "class", Val: pollClass}}}
+	heading := "Poll"
+	if question != nil && nodeText(question) != "" {
+		heading = "Poll: " + nodeText(question)
+	}
+	p := &xhtml.Node{Type: xhtml.ElementNode, Data: "p", DataAtom: atom.P}
+	p.AppendChild(&xhtml.Node{Type: xhtml.TextNode, Data: heading})
+	block.AppendChild(p)
+	if len(options) > 0 {
+		list := &xhtml.Node{Type: xhtml.ElementNode, Data: "ul", DataAtom: atom.Ul}
+		for _, option := range options {
+			item := &xhtml.Node{Type: xhtml.ElementNode, Data: "li", DataAtom: atom.Li}
+			item.AppendChild(&xhtml.Node{Type: xhtml.TextNode, Data: option})
+			list.AppendChild(item)
+		}
+		block.AppendChild(list)
+	}
+	return block
+}
+
+// plainBlock drops the presentation of the element and everything in it,
+// its colors, borders, backgrounds and sizes, for the stylesheet's to show.
+func plainBlock(node *xhtml.Node) {
+	walkNodes(node, func(n *xhtml.Node) {
+		var attrs []xhtml.Attribute
+		for _, a := range n.Attr {
+			switch a.Key {
+			case "style", "bgcolor", "color", "border", "width", "height", "cellpadding", "cellspacing", "class":
+			default:
+				attrs = append(attrs, a)
+			}
+		}
+		n.Attr = attrs
+		if n.DataAtom == atom.Font {
+			n.Data, n.DataAtom = "span", atom.Span
+		}
+	})
+}
+
+func attr(node *xhtml.Node, key string) string {
+	for _, a := range node.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func setAttr(node *xhtml.Node, key string, value string) {
+	for i, a := range node.Attr {
+		if a.Key == key {
+			node.Attr[i].Val = value
+			return
+		}
+	}
+	node.Attr = append(node.Attr, xhtml.Attribute{Key: key, Val: value})
+}
+
+// walkNodes calls f with node and every element under it.
+func walkNodes(node *xhtml.Node, f func(*xhtml.Node)) {
+	if node.Type == xhtml.ElementNode {
+		f(node)
+	}
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		walkNodes(child, f)
+	}
+}
+
+// findNode returns the first element under node that match reports, or nil.
+func findNode(node *xhtml.Node, match func(*xhtml.Node) bool) *xhtml.Node {
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		if child.Type == xhtml.ElementNode && match(child) {
+			return child
+		}
+		if found := findNode(child, match); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// nodeText is the text under node, its whitespace collapsed.
+func nodeText(node *xhtml.Node) string {
+	var b strings.Builder
+	var walk func(*xhtml.Node)
+	walk = func(n *xhtml.Node) {
+		if n.Type == xhtml.TextNode {
+			b.WriteString(n.Data)
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+	walk(node)
+	return strings.Join(strings.Fields(b.String()), " ")
+}
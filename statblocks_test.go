@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestRenderBlocks(t *testing.T) {
+	statBox := `<p style="text-align: center">* * *</p><div style="background-color: #0a0a23; border: 2px solid gold; color: #ffffff"><p><span style="color: #ffffff">Zorian</span> <font color="#00ff00">Level 4</font></p></div>` +
+		`<table style="width: 90%; background: black" border="1"><tbody><tr><td style="color: white" class="x">STR</td><td>12</td></tr></tbody></table>`
+	want := `<p style="text-align: center">* * *</p><div class="stat-block"><p><span>Zorian</span> <span>Level 4</span></p></div>` +
+		`<table class="stat-block"><tbody><tr><td>STR</td><td>12</td></tr></tbody></table>`
+	if got := renderBlocks(statBox, false); got != want {
+		t.Errorf("stat box\n got %q\nwant %q", got, want)
+	}
+
+	poll := `<p>Vote!</p><div class="chapter-poll"><strong>Who wins?</strong><ul><li>Zach</li><li>Zorian</li></ul><button>Vote</button></div>` +
+		`<form><legend>Next arc?</legend><label><input type="radio" name="a"> Cyoria</label><label><input type="radio" name="a"> Koth</label></form>`
+	want = `<p>Vote!</p><div class="poll"><p>Poll: Who wins?</p><ul><li>Zach</li><li>Zorian</li></ul></div>` +
+		`<div class="poll"><p>Poll: Next arc?</p><ul><li>Cyoria</li><li>Koth</li></ul></div>`
+	if got := renderBlocks(poll, false); got != want {
+		t.Errorf("polls\n got %q\nwant %q", got, want)
+	}
+	if got := renderBlocks(poll, true); got != `<p>Vote!</p>` {
+		t.Errorf("polls were kept: %q", got)
+	}
+
+	plain := `<p style="text-align: center">Just a chapter.</p>`
+	if got := renderBlocks(plain, false); got != plain {
+		t.Errorf("plain chapter became %q", got)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// crawlState records on disk the chapters fetched so far for one book, so that
+// an interrupted scrape can be resumed without fetching them again. Each
+// chapter is appended to a chapterLog as soon as it arrives. Chapters still
+// pending need no record of their own: the table of contents is fetched again
+// on resume and lists them.
+type crawlState struct {
+	filename string
+	chapters *chapterStore
+	// order lists the recorded chapters in the order they were fetched.
+	order []string
+	log   *chapterLog
+}
+
+// crawlStateFilename names the state file of the book at baseURL in dir.
+func crawlStateFilename(dir string, baseURL string) string {
+	sum := sha1.Sum([]byte(baseURL))
+	return filepath.Join(dir, hex.EncodeToString(sum[:])+".zst")
+}
+
+// openCrawlState starts recording to filename. With resume, the chapters
+// already in the file are loaded first; otherwise it is started afresh.
+func openCrawlState(filename string, resume bool) (*crawlState, error) {
+	state := &crawlState{filename: filename, chapters: newChapterStore()}
+	if resume {
+		if err := state.load(); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return nil, err
+	}
+	// The loaded records are written back rather than appended to, which
+	// drops any record left incomplete by the interruption.
+	log, err := createChapterLog(filename)
+	if err != nil {
+		return nil, err
+	}
+	state.log = log
+	for _, url := range state.order {
+		chapter, _ := state.chapters.get(url)
+		if err := log.add(chapterRecord{URL: url, Title: chapter.Title, Content: chapter.Content}); err != nil {
+			log.Close()
+			return nil, err
+		}
+	}
+	return state, nil
+}
+
+func (s *crawlState) load() error {
+	err := readChapterLog(s.filename, func(record chapterRecord) error {
+		if !s.chapters.has(record.URL) {
+			s.order = append(s.order, record.URL)
+		}
+		s.chapters.put(record.URL, Chapter{Title: record.Title, Content: record.Content})
+		return nil
+	})
+	if errors.Is(err, errDamagedLog) {
+		logger.Warnw("Ignore damaged resume record", "filename", s.filename)
+		return nil
+	}
+	return err
+}
+
+// record saves a freshly fetched chapter. Failing to save it only costs a
+// refetch on resume, so errors are logged rather than returned.
+func (s *crawlState) record(url string, chapter Chapter) {
+	if err := s.log.add(chapterRecord{URL: url, Title: chapter.Title, Content: chapter.Content}); err != nil {
+		logger.Warnw("Failed to record chapter for resume", "url", url, "error", err)
+	}
+}
+
+// restore adds the recorded chapters to book. Chapters the scraper didn't
+// find again, such as ones taken down since, are put in front of its table
+// of contents.
+func (s *crawlState) restore(book *ScrapedBook) {
+	inTOC := make(map[string]bool)
+	for _, entry := range book.toc {
+		inTOC[chapterKey(entry.URL)] = true
+	}
+	var toc []TOCEntry
+	for _, url := range s.order {
+		chapter, _ := s.chapters.get(url)
+		if !inTOC[chapterKey(url)] {
+			toc = append(toc, TOCEntry{URL: url, Title: chapter.Title})
+		}
+		if !book.chapters.has(url) {
+			book.chapters.put(url, chapter)
+		}
+	}
+	book.toc = append(toc, book.toc...)
+}
+
+func (s *crawlState) Close() error {
+	s.chapters.Close()
+	return s.log.Close()
+}
+
+// Remove deletes the state once the book has been written.
+func (s *crawlState) Remove() error {
+	s.Close()
+	return os.Remove(s.filename)
+}
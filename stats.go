@@ -0,0 +1,214 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// readingSpeed is how many words a minute the reading time is estimated at.
+const readingSpeed = 250
+
+// bookStats are the figures the stats command gives for a book.
+type bookStats struct {
+	File     string         `json:"file"`
+	Title    string         `json:"title"`
+	Source   string         `json:"source"`
+	Chapters []chapterStats `json:"chapters"`
+	Words    int            `json:"words"`
+	// AverageWords is the mean length of the chapters that aren't missing.
+	AverageWords int `json:"average_words"`
+	// ReadingMinutes is how long the book takes to read at readingSpeed.
+	ReadingMinutes int `json:"reading_minutes"`
+	// First and Last are the dates of the first and last chapter, and
+	// CadenceDays the median time between one chapter and the next, where
+	// the site dates its chapters.
+	First       time.Time `json:"first,omitempty"`
+	Last        time.Time `json:"last,omitempty"`
+	CadenceDays float64   `json:"cadence_days,omitempty"`
+	// PerWeek is how many chapters came out a week between First and Last.
+	PerWeek float64 `json:"per_week,omitempty"`
+}
+
+type chapterStats struct {
+	Title   string    `json:"title"`
+	Date    time.Time `json:"date,omitempty"`
+	Words   int       `json:"words"`
+	Missing bool      `json:"missing,omitempty"`
+}
+
+// runStatsCommand implements `stats [-json] EPUB...`, printing figures about
+// the length and publication of each book written by ebook-scraper.
+func runStatsCommand(args []string) error {
+	flags := flag.NewFlagSet("stats", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print the figures as json")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return errors.New("usage: stats [-json] EPUB...")
+	}
+	var books []bookStats
+	for _, filename := range flags.Args() {
+		stats, err := readBookStats(filename)
+		if err != nil {
+			return err
+		}
+		books = append(books, *stats)
+	}
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(books)
+	}
+	for i, book := range books {
+		if i > 0 {
+			fmt.Println()
+		}
+		if err := printBookStats(book); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readBookStats counts the words of each chapter of the epub at filename.
+func readBookStats(filename string) (*bookStats, error) {
+	reader, err := zip.OpenReader(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	files := make(map[string]*zip.File)
+	for _, f := range reader.File {
+		files[f.Name] = f
+	}
+	manifest, err := readManifestFile(filename, files)
+	if err != nil {
+		return nil, err
+	}
+	stats := &bookStats{File: filename, Source: manifest.Source, Title: epubPackageTitle(files)}
+	var dates []time.Time
+	written := 0
+	for _, chapter := range manifest.Chapters {
+		chapterStat := chapterStats{Title: chapter.Title, Date: chapter.Date, Missing: chapter.Missing}
+		if !chapter.Missing {
+			f, ok := files[path.Join(epubXHTMLDir, chapter.File)]
+			if !ok {
+				return nil, fmt.Errorf("%s: section %s is missing", filename, chapter.File)
+			}
+			content, err := readSectionBody(f)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: %w", filename, chapter.File, err)
+			}
+			chapterStat.Words = countWords(content)
+			stats.Words += chapterStat.Words
+			written++
+		}
+		if !chapter.Date.IsZero() {
+			dates = append(dates, chapter.Date)
+		}
+		stats.Chapters = append(stats.Chapters, chapterStat)
+	}
+	if written > 0 {
+		stats.AverageWords = stats.Words / written
+	}
+	stats.ReadingMinutes = (stats.Words + readingSpeed - 1) / readingSpeed
+	if len(dates) > 0 {
+		sort.Slice(dates, func(i, j int) bool { return dates[i].Before(dates[j]) })
+		stats.First, stats.Last = dates[0], dates[len(dates)-1]
+	}
+	if len(dates) > 1 {
+		gaps := make([]time.Duration, 0, len(dates)-1)
+		for i := 1; i < len(dates); i++ {
+			gaps = append(gaps, dates[i].Sub(dates[i-1]))
+		}
+		sort.Slice(gaps, func(i, j int) bool { return gaps[i] < gaps[j] })
+		stats.CadenceDays = gaps[len(gaps)/2].Hours() / 24
+		if span := stats.Last.Sub(stats.First); span > 0 {
+			stats.PerWeek = float64(len(dates)-1) / (span.Hours() / (24 * 7))
+		}
+	}
+	return stats, nil
+}
+
+// epubPackageTitle returns the dc:title of the epub's package document.
+func epubPackageTitle(files map[string]*zip.File) string {
+	f, ok := files[epubPackageFile]
+	if !ok {
+		return ""
+	}
+	opf, err := readZipFile(f)
+	if err != nil {
+		return ""
+	}
+	_, rest, found := strings.Cut(string(opf), "<dc:title>")
+	title, _, closed := strings.Cut(rest, "</dc:title>")
+	if !found || !closed {
+		return ""
+	}
+	return html.UnescapeString(title)
+}
+
+func printBookStats(book bookStats) error {
+	fmt.Printf("%s (%s)\n", book.Title, book.File)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "#\tWORDS\tDATE\t\tCHAPTER")
+	for i, chapter := range book.Chapters {
+		date := "-"
+		if !chapter.Date.IsZero() {
+			date = chapter.Date.Format("2006-01-02")
+		}
+		words := fmt.Sprint(chapter.Words)
+		if chapter.Missing {
+			words = "missing"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t\t%s\n", i+1, words, date, chapter.Title)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	tw = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Chapters:\t%d\n", len(book.Chapters))
+	fmt.Fprintf(tw, "Words:\t%d\n", book.Words)
+	fmt.Fprintf(tw, "Average chapter:\t%d words\n", book.AverageWords)
+	fmt.Fprintf(tw, "Reading time:\t%s at %d words a minute\n", formatDuration(time.Duration(book.ReadingMinutes)*time.Minute), readingSpeed)
+	if !book.First.IsZero() {
+		fmt.Fprintf(tw, "Published:\t%s to %s\n", book.First.Format("2006-01-02"), book.Last.Format("2006-01-02"))
+	}
+	if book.CadenceDays > 0 {
+		cadence := time.Duration(book.CadenceDays * float64(24*time.Hour))
+		fmt.Fprintf(tw, "Cadence:\ta chapter every %s, %.1f a week\n", formatDuration(cadence), book.PerWeek)
+	}
+	return tw.Flush()
+}
+
+// countWords counts the words of the text of a chapter's content.
+func countWords(content string) int {
+	return len(strings.Fields(htmlText(content)))
+}
+
+// formatDuration shows d in days, hours and minutes, to the minute.
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Minute)
+	days := d / (24 * time.Hour)
+	d -= days * 24 * time.Hour
+	hours := d / time.Hour
+	minutes := (d - hours*time.Hour) / time.Minute
+	switch {
+	case days > 0:
+		return fmt.Sprintf("%dd %dh", days, hours)
+	case hours > 0:
+		return fmt.Sprintf("%dh %dm", hours, minutes)
+	}
+	return fmt.Sprintf("%dm", minutes)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// chapterMemoryLimit is how many bytes of chapter content a chapterStore keeps
+// in memory before it spills further chapters to disk.
+var chapterMemoryLimit int64 = 256 << 20
+
+// chapterBacklog is how many fetched chapters may wait for a chapterQueue to
+// store them.
+var chapterBacklog = 16
+
+// chapterStore holds the chapters of a book by URL, looking them up by
+// chapterKey so that any form of a chapter's URL finds it. Serials with
+// thousands of chapters can outgrow memory, so once chapterMemoryLimit is
+// reached their content goes to files in a temporary directory instead,
+// leaving only titles in memory. It is safe for concurrent use.
+type chapterStore struct {
+	mu       sync.Mutex
+	titles   map[string]string
+	contents map[string]string
+	files    map[string]string
+	inMemory int64
+	dir      string
+}
+
+func newChapterStore() *chapterStore {
+	return &chapterStore{
+		titles:   make(map[string]string),
+		contents: make(map[string]string),
+		files:    make(map[string]string),
+	}
+}
+
+func (s *chapterStore) put(url string, chapter Chapter) {
+	url = chapterKey(url)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inMemory -= int64(len(s.contents[url]))
+	delete(s.contents, url)
+	s.titles[url] = chapter.Title
+	if s.inMemory+int64(len(chapter.Content)) > chapterMemoryLimit {
+		err := s.spill(url, chapter.Content)
+		if err == nil {
+			return
+		}
+		logger.Warnw("Failed to spill chapter to disk", "url", url, "error", err)
+	}
+	if filename, ok := s.files[url]; ok {
+		os.Remove(filename)
+		delete(s.files, url)
+	}
+	s.contents[url] = chapter.Content
+	s.inMemory += int64(len(chapter.Content))
+}
+
+func (s *chapterStore) spill(url string, content string) error {
+	if s.dir == "" {
+		dir, err := os.MkdirTemp("", "ebook-scraper-chapters")
+		if err != nil {
+			return err
+		}
+		s.dir = dir
+	}
+	sum := sha1.Sum([]byte(url))
+	filename := filepath.Join(s.dir, hex.EncodeToString(sum[:]))
+	if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+		return err
+	}
+	s.files[url] = filename
+	return nil
+}
+
+func (s *chapterStore) get(url string) (Chapter, bool) {
+	url = chapterKey(url)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	title, ok := s.titles[url]
+	if !ok {
+		return Chapter{}, false
+	}
+	if filename, ok := s.files[url]; ok {
+		content, err := os.ReadFile(filename)
+		if err != nil {
+			logger.Warnw("Failed to read spilled chapter", "url", url, "error", err)
+		}
+		return Chapter{Title: title, Content: string(content)}, true
+	}
+	return Chapter{Title: title, Content: s.contents[url]}, true
+}
+
+func (s *chapterStore) has(url string) bool {
+	url = chapterKey(url)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.titles[url]
+	return ok
+}
+
+// keys returns the chapterKey of every chapter held.
+func (s *chapterStore) keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.titles))
+	for key := range s.titles {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *chapterStore) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.titles)
+}
+
+// Close removes the chapters spilled to disk.
+func (s *chapterStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dir == "" {
+		return nil
+	}
+	return os.RemoveAll(s.dir)
+}
+
+// chapterQueue hands fetched chapters to a single goroutine that prepares and
+// stores them, which may mean recording them for -resume, parsing them for
+// images and spilling them to disk. At most chapterBacklog chapters wait for
+// it: when it falls behind, adding blocks the fetch callbacks, whose requests
+// keep their slots in the host's limit, and so fetching pauses until it
+// catches up.
+type chapterQueue struct {
+	chapters chan queuedChapter
+	done     chan struct{}
+}
+
+type queuedChapter struct {
+	url     string
+	chapter Chapter
+}
+
+func newChapterQueue(opts ScrapeOptions, store *chapterStore) *chapterQueue {
+	q := &chapterQueue{chapters: make(chan queuedChapter, chapterBacklog), done: make(chan struct{})}
+	go func() {
+		defer close(q.done)
+		for queued := range q.chapters {
+			store.put(queued.url, opts.fetched(queued.url, queued.chapter))
+		}
+	}()
+	return q
+}
+
+func (q *chapterQueue) add(url string, chapter Chapter) {
+	q.chapters <- queuedChapter{url, chapter}
+}
+
+// Close waits until every chapter added has been stored.
+func (q *chapterQueue) Close() {
+	close(q.chapters)
+	<-q.done
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// storyStore keeps the chapters of a story between runs, so that later runs
+// fetch only the chapters that are new or changed since, whatever the state
+// of the HTTP cache. Its manifest lists every chapter with the date the table
+// of contents gave it and the SHA-256 of its content; contents are kept by
+// their hash in a chapterLog alongside. Chapters are stored as filtered, so
+// a store filtered otherwise than the run at hand is started afresh.
+type storyStore struct {
+	dir      string
+	manifest storyManifest
+	byURL    map[string]storyChapter
+	// contents holds the logged contents by hash, records counts the
+	// records in the log including those no chapter refers to anymore.
+	contents *chapterStore
+	records  int
+	// damaged is set when the log ends in a damaged record, after which
+	// nothing appended could be read back.
+	damaged bool
+}
+
+type storyManifest struct {
+	Source string `json:"source"`
+	// Filters is the filterHash of the filters the chapters went through.
+	Filters  string         `json:"filters,omitempty"`
+	Chapters []storyChapter `json:"chapters"`
+}
+
+type storyChapter struct {
+	URL   string    `json:"url"`
+	Title string    `json:"title"`
+	Date  time.Time `json:"date,omitempty"`
+	Hash  string    `json:"hash"`
+}
+
+const (
+	storyManifestFilename = "manifest.json"
+	storyContentsFilename = "chapters.zst"
+)
+
+// openStoryStore opens the store of the story at baseURL in dir, for
+// chapters that go through the filters whose filterHash is filters. It is
+// empty if the story hasn't been scraped before, or not with those filters.
+func openStoryStore(dir string, baseURL string, filters string) (*storyStore, error) {
+	sum := sha1.Sum([]byte(baseURL))
+	store := &storyStore{
+		dir:      filepath.Join(dir, hex.EncodeToString(sum[:])),
+		manifest: storyManifest{Source: baseURL, Filters: filters},
+		byURL:    make(map[string]storyChapter),
+		contents: newChapterStore(),
+	}
+	data, err := os.ReadFile(filepath.Join(store.dir, storyManifestFilename))
+	if errors.Is(err, fs.ErrNotExist) {
+		return store, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var manifest storyManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, err
+	}
+	if manifest.Filters == filters {
+		store.manifest = manifest
+	} else {
+		// The stored contents are left for compaction to drop.
+		logger.Infow("Fetch stored chapters again for the changed filters", "baseURL", baseURL)
+	}
+	for _, chapter := range store.manifest.Chapters {
+		store.byURL[chapterKey(chapter.URL)] = chapter
+	}
+	err = readChapterLog(filepath.Join(store.dir, storyContentsFilename), func(record chapterRecord) error {
+		store.contents.put(record.Hash, Chapter{Content: record.Content})
+		store.records++
+		return nil
+	})
+	if errors.Is(err, errDamagedLog) {
+		// The chapters whose content was lost are fetched again.
+		logger.Warnw("Ignore damaged stored chapters", "dir", store.dir)
+		store.damaged = true
+	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		store.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// has reports whether the store holds the version of the chapter listed in
+// the table of contents. Chapters listed without a date can't be told apart
+// from earlier versions and are taken as unchanged.
+func (s *storyStore) has(entry TOCEntry) bool {
+	chapter, ok := s.byURL[chapterKey(entry.URL)]
+	if !ok {
+		return false
+	}
+	if !entry.Date.IsZero() && !entry.Date.Equal(chapter.Date) {
+		return false
+	}
+	return s.contents.has(chapter.Hash)
+}
+
+// restore adds the stored chapters listed in the book's table of contents
+// that the scraper didn't fetch, handing each to prepare.
+func (s *storyStore) restore(book *ScrapedBook, prepare func(url string, chapter Chapter) Chapter) error {
+	restored := 0
+	for _, entry := range book.toc {
+		if book.chapters.has(entry.URL) || !s.has(entry) {
+			continue
+		}
+		stored := s.byURL[chapterKey(entry.URL)]
+		content, _ := s.contents.get(stored.Hash)
+		chapter := Chapter{Title: stored.Title, Content: content.Content}
+		if prepare != nil {
+			chapter = prepare(entry.URL, chapter)
+		}
+		book.chapters.put(entry.URL, chapter)
+		restored++
+	}
+	if restored > 0 {
+		logger.Infow("Reuse stored chapters", "chapters", restored)
+	}
+	return nil
+}
+
+// save replaces the stored chapters with those of book. Contents are only
+// ever appended to the log, which is compacted once most of it is contents
+// no chapter refers to anymore.
+func (s *storyStore) save(book ScrapedBook) error {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+	log, err := appendChapterLog(filepath.Join(s.dir, storyContentsFilename))
+	if err != nil {
+		return err
+	}
+	manifest := storyManifest{Source: s.manifest.Source, Filters: s.manifest.Filters}
+	live := make(map[string]bool)
+	changed := 0
+	for _, entry := range book.toc {
+		chapter, ok := book.chapters.get(entry.URL)
+		if !ok {
+			continue
+		}
+		sum := sha256.Sum256([]byte(chapter.Content))
+		hash := hex.EncodeToString(sum[:])
+		if previous, ok := s.byURL[chapterKey(entry.URL)]; ok && previous.Hash != hash {
+			changed++
+		}
+		if !s.contents.has(hash) {
+			if err := log.add(chapterRecord{Hash: hash, Content: chapter.Content}); err != nil {
+				log.Close()
+				return err
+			}
+			s.contents.put(hash, Chapter{Content: chapter.Content})
+			s.records++
+		}
+		manifest.Chapters = append(manifest.Chapters, storyChapter{URL: entry.URL, Title: chapter.Title, Date: entry.Date, Hash: hash})
+		live[hash] = true
+	}
+	if err := log.Close(); err != nil {
+		return err
+	}
+	if changed > 0 {
+		logger.Infow("Found changed chapters", "chapters", changed)
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	filename := filepath.Join(s.dir, storyManifestFilename)
+	if err := os.WriteFile(filename+"~", data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(filename+"~", filename); err != nil {
+		return err
+	}
+	s.manifest = manifest
+	s.byURL = make(map[string]storyChapter)
+	for _, chapter := range manifest.Chapters {
+		s.byURL[chapterKey(chapter.URL)] = chapter
+	}
+	if s.damaged || s.records > 2*len(live) {
+		return s.compact(live)
+	}
+	return nil
+}
+
+// compact rewrites the log with only the live contents.
+func (s *storyStore) compact(live map[string]bool) error {
+	filename := filepath.Join(s.dir, storyContentsFilename)
+	log, err := createChapterLog(filename + "~")
+	if err != nil {
+		return err
+	}
+	for hash := range live {
+		content, _ := s.contents.get(hash)
+		if err := log.add(chapterRecord{Hash: hash, Content: content.Content}); err != nil {
+			log.Close()
+			return err
+		}
+	}
+	if err := log.Close(); err != nil {
+		return err
+	}
+	s.records = len(live)
+	s.damaged = false
+	return os.Rename(filename+"~", filename)
+}
+
+func (s *storyStore) Close() error {
+	return s.contents.Close()
+}
+
+// filterHash identifies the filters, rules and terms chapters go through,
+// or is "" for none.
+func filterHash(filters bool, rules []rewriteRule, terms *termDictionary) string {
+	if !filters && len(rules) == 0 && terms == nil {
+		return ""
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "filters %t\n", filters)
+	for _, rule := range rules {
+		fmt.Fprintf(h, "rule %t %t %q %q %q\n", rule.html, rule.title, rule.pattern, rule.replacement, rule.hosts)
+	}
+	if terms != nil {
+		replaced := make([]string, 0, len(terms.replacements))
+		for term := range terms.replacements {
+			replaced = append(replaced, term)
+		}
+		sort.Strings(replaced)
+		for _, term := range replaced {
+			fmt.Fprintf(h, "term %q %q\n", term, terms.replacements[term])
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	xhtml "golang.org/x/net/html"
+)
+
+const (
+	svgNamespace   = "http://www.w3.org/2000/svg"
+	xlinkNamespace = "http://www.w3.org/1999/xlink"
+)
+
+// svgRasterizers are the commands, tried in turn, that render an SVG image
+// as a PNG: librsvg's, then resvg's. Both only render; ImageMagick, like
+// Inkscape, would also act on what an SVG from the web asks of it, such as
+// reading other files, so it isn't used.
+var svgRasterizers = [][]string{
+	{"rsvg-convert", "--format", "png", "--output", "{out}", "{in}"},
+	{"resvg", "{in}", "{out}"},
+}
+
+// warnNoSVGRasterizer warns once that SVG images go without a fallback.
+var warnNoSVGRasterizer sync.Once
+
+// isSVG reports whether the file at filename is an SVG image.
+func isSVG(filename string) (bool, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	head := make([]byte, 1024)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return false, err
+	}
+	head = bytes.TrimSpace(head[:n])
+	return bytes.HasPrefix(head, []byte("<")) && bytes.Contains(head, []byte("<svg")), nil
+}
+
+// rasterizeSVG renders the SVG image at filename as a PNG for readers that
+// can't show SVG, returning the PNG and name with its extension, or "" if
+// there is nothing installed to render it with.
+func rasterizeSVG(filename string, name string) (string, string, error) {
+	out := strings.TrimSuffix(filename, filepath.Ext(filename)) + "-fallback.png"
+	found, err := convertWith(svgRasterizers, filename, out)
+	if err != nil || !found {
+		return "", "", err
+	}
+	if name != "" {
+		name = strings.TrimSuffix(name, path.Ext(name)) + ".png"
+	}
+	return out, name, nil
+}
+
+// declareSVGNamespaces declares the namespaces of an inline <svg> element,
+// which html leaves implied but an XHTML chapter or a file of its own needs.
+func declareSVGNamespaces(svg *xhtml.Node) {
+	setAttr(svg, "xmlns", svgNamespace)
+	usesXlink := false
+	var walk func(*xhtml.Node)
+	walk = func(n *xhtml.Node) {
+		for _, a := range n.Attr {
+			usesXlink = usesXlink || a.Namespace == "xlink"
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+	walk(svg)
+	if !usesXlink {
+		return
+	}
+	for _, a := range svg.Attr {
+		if a.Namespace == "xmlns" && a.Key == "xlink" {
+			return
+		}
+	}
+	svg.Attr = append(svg.Attr, xhtml.Attribute{Namespace: "xmlns", Key: "xlink", Val: xlinkNamespace})
+}
+
+// saveInlineSVG writes an inline <svg> element to a file of its own in dir,
+// for it to be embedded as an image, returning the file and its hash.
+func saveInlineSVG(svg *xhtml.Node, dir string) (string, string, error) {
+	declareSVGNamespaces(svg)
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	if err := xhtml.Render(&buf, svg); err != nil {
+		return "", "", err
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	hash := hex.EncodeToString(sum[:])
+	filename := filepath.Join(dir, "inline-"+hash[:16]+".svg")
+	return filename, hash, os.WriteFile(filename, buf.Bytes(), 0644)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// termDictionary replaces terms with the user's spellings of them wherever
+// they appear as whole words, in the case they appear in.
+type termDictionary struct {
+	pattern *regexp.Regexp
+	// replacements maps each term, lowercased, to its replacement.
+	replacements map[string]string
+}
+
+// readTerms reads the term dictionary in filename, a term and its
+// replacement a line, quoted as in an input file, e.g.
+//
+//	# Romanizations
+//	Ryuu Ryu
+//	'Tian Shen Sect' 'Heavenly God Sect'
+//	# Machine translation artifacts
+//	'young master' 'Young Master'
+func readTerms(filename string) (*termDictionary, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	replacements := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		words, err := splitWords(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", filename, lineNumber, err)
+		}
+		if len(words) == 0 {
+			continue
+		}
+		if len(words) != 2 || strings.TrimSpace(words[0]) == "" {
+			return nil, fmt.Errorf("%s:%d: want TERM REPLACEMENT, got %d words", filename, lineNumber, len(words))
+		}
+		replacements[strings.ToLower(words[0])] = words[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return newTermDictionary(replacements), nil
+}
+
+func newTermDictionary(replacements map[string]string) *termDictionary {
+	if len(replacements) == 0 {
+		return nil
+	}
+	terms := make([]string, 0, len(replacements))
+	for term := range replacements {
+		terms = append(terms, term)
+	}
+	// The longest terms first, for "Tian Shen Sect" to win over "Tian Shen".
+	sort.Slice(terms, func(i, j int) bool {
+		if len(terms[i]) != len(terms[j]) {
+			return len(terms[i]) > len(terms[j])
+		}
+		return terms[i] < terms[j]
+	})
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		quoted[i] = regexp.QuoteMeta(term)
+	}
+	return &termDictionary{
+		pattern:      regexp.MustCompile(`(?i)` + strings.Join(quoted, "|")),
+		replacements: replacements,
+	}
+}
+
+// replace replaces the terms in text.
+func (d *termDictionary) replace(text string) string {
+	matches := d.pattern.FindAllStringIndex(text, -1)
+	if matches == nil {
+		return text
+	}
+	var b strings.Builder
+	last := 0
+	for _, match := range matches {
+		start, end := match[0], match[1]
+		if !wordBoundary(text, start) || !wordBoundary(text, end) {
+			continue
+		}
+		found := text[start:end]
+		b.WriteString(text[last:start])
+		b.WriteString(matchCase(d.replacements[strings.ToLower(found)], found))
+		last = end
+	}
+	if last == 0 {
+		return text
+	}
+	b.WriteString(text[last:])
+	return b.String()
+}
+
+// apply replaces the terms in the text of chapter content.
+func (d *termDictionary) apply(url string, content string) string {
+	return rewriteText(content, url, d.replace)
+}
+
+// wordBoundary reports whether a word can start or end at offset i of text.
+// Scripts written without spaces, such as Chinese, have no words to keep
+// whole, so terms in them match anywhere.
+func wordBoundary(text string, i int) bool {
+	before, _ := utf8.DecodeLastRuneInString(text[:i])
+	after, _ := utf8.DecodeRuneInString(text[i:])
+	return !wordRune(before) || !wordRune(after)
+}
+
+func wordRune(r rune) bool {
+	if unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Thai) {
+		return false
+	}
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// matchCase gives replacement the case of found: all capitals, a capital
+// first, or all lowercase as the dictionary has it otherwise. A replacement
+// with capitals of its own, such as a name, keeps them unless found is all
+// capitals.
+func matchCase(replacement string, found string) string {
+	// Only letters of scripts with case, not Chinese, say anything.
+	cased, upper, lower := false, true, true
+	for _, r := range found {
+		if unicode.IsUpper(r) || unicode.IsLower(r) {
+			cased = true
+			upper = upper && unicode.IsUpper(r)
+			lower = lower && unicode.IsLower(r)
+		}
+	}
+	switch {
+	case !cased:
+		return replacement
+	case upper && utf8.RuneCountInString(found) > 1:
+		return strings.ToUpper(replacement)
+	case lower:
+		return replacement
+	}
+	first, _ := utf8.DecodeRuneInString(found)
+	if unicode.IsUpper(first) {
+		r, size := utf8.DecodeRuneInString(replacement)
+		return string(unicode.ToUpper(r)) + replacement[size:]
+	}
+	return replacement
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTerms(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "terms.txt")
+	err := os.WriteFile(filename, []byte(`# Romanizations
+Ryuu Ryu
+'Tian Shen' 'Heavenly God'
+'tian shen sect' 'Heavenly God Sect'
+'young master' 'young lord'
+天神 'Heavenly God'
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	terms, err := readTerms(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for text, want := range map[string]string{
+		"Ryuu's sword":                             "Ryu's sword",
+		"RYUU! Ryuuko ryuu":                        "RYU! Ryuuko Ryu",
+		"the Tian Shen Sect of Tian Shen":          "the Heavenly God Sect of Heavenly God",
+		"Young master, YOUNG MASTER, young master": "Young lord, YOUNG LORD, young lord",
+		"拜见天神":                                     "拜见Heavenly God",
+	} {
+		if got := terms.replace(text); got != want {
+			t.Errorf("replace(%q) = %q, want %q", text, got, want)
+		}
+	}
+	content := `<p class="ryuu"><a href="ryuu.html">Ryuu</a> said</p>`
+	if got, want := terms.apply("", content), `<p class="ryuu"><a href="ryuu.html">Ryu</a> said</p>`; got != want {
+		t.Errorf("apply(%q) = %q, want %q", content, got, want)
+	}
+}
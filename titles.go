@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+)
+
+// titleCleanerNames are the transforms -clean-titles knows, in the order
+// they are applied.
+var titleCleanerNames = []string{"tags", "story", "numbering"}
+
+var (
+	// titleTag is a translator's or editor's note on the state of a
+	// chapter, such as [TL] or (Unedited).
+	titleTag = regexp.MustCompile(`(?i)\s*[\[(【]\s*(tl|t/n|tn|tlc|mtl|ed|edited|unedited|proofread|raw|draft|revised|teaser)\b[^\])】]{0,20}[\])】]\s*`)
+	// titleNumbering is the number a chapter's title starts with, with or
+	// without a word for chapter before it.
+	titleNumbering = regexp.MustCompile(`(?i)^\s*(?:(?:chapter|chap\.?|ch\.?|episode|ep\.?|part)\s*#?\d+(?:\.\d+)?\s*[:.\-–—)|]?|#?\d+(?:\.\d+)?\s*[:.\-–—)|])\s*`)
+)
+
+// parseTitleCleaners checks the comma separated names given to
+// -clean-titles, all standing for every transform.
+func parseTitleCleaners(list string) ([]string, error) {
+	if list == "" {
+		return nil, nil
+	}
+	if list == "all" {
+		return titleCleanerNames, nil
+	}
+	var names []string
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if !containsString(titleCleanerNames, name) {
+			return nil, fmt.Errorf("unknown title cleanup %q, want %s or all", name, strings.Join(titleCleanerNames, ", "))
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// titleCleaner returns the function that cleans up the chapter titles of
+// the story called story on host, by the transforms named, the user's title
+// rules and their term dictionary, or nil if there is nothing to do.
+func titleCleaner(names []string, rules []rewriteRule, terms *termDictionary, host string, story string) func(string) string {
+	var titleRules []rewriteRule
+	for _, rule := range rules {
+		if rule.title && rule.appliesTo(host) {
+			titleRules = append(titleRules, rule)
+		}
+	}
+	if len(names) == 0 && len(titleRules) == 0 && terms == nil {
+		return nil
+	}
+	var storyAffix *regexp.Regexp
+	if story = strings.TrimSpace(story); story != "" {
+		quoted := regexp.QuoteMeta(story)
+		storyAffix = regexp.MustCompile(`(?i)^\s*` + quoted + `\s*[:\-–—|]\s*|\s*[:\-–—|]\s*` + quoted + `\s*$`)
+	}
+	return func(title string) string {
+		// The user's rules go first, for them to make titles such as the
+		// transforms expect.
+		cleaned := title
+		for _, rule := range titleRules {
+			cleaned = rule.pattern.ReplaceAllString(cleaned, rule.replacement)
+		}
+		if terms != nil {
+			cleaned = terms.replace(cleaned)
+		}
+		for _, name := range titleCleanerNames {
+			if !containsString(names, name) {
+				continue
+			}
+			switch name {
+			case "tags":
+				cleaned = titleTag.ReplaceAllString(cleaned, " ")
+			case "story":
+				if storyAffix != nil {
+					cleaned = storyAffix.ReplaceAllString(cleaned, "")
+				}
+			case "numbering":
+				cleaned = titleNumbering.ReplaceAllString(cleaned, "")
+			}
+		}
+		cleaned = strings.Join(strings.Fields(cleaned), " ")
+		// A title that was nothing but, say, its number stays as it was.
+		if cleaned == "" {
+			return title
+		}
+		return cleaned
+	}
+}
+
+// retitleContent replaces the heading some scrapers start a chapter's
+// content with, from its old title, with one from its new title.
+func retitleContent(content string, old string, new string) string {
+	heading := "<h2>" + html.EscapeString(old) + "</h2>"
+	if old == new || !strings.HasPrefix(content, heading) {
+		return content
+	}
+	return "<h2>" + html.EscapeString(new) + "</h2>" + content[len(heading):]
+}
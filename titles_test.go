@@ -0,0 +1,37 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestTitleCleaner(t *testing.T) {
+	rules := []rewriteRule{{title: true, hosts: []string{"www.royalroad.com"}, pattern: mustCompileRule(t, `^Vol\. \d+ `), replacement: ""}}
+	clean := titleCleaner(titleCleanerNames, rules, nil, "www.royalroad.com", "Mother of Learning")
+	for title, want := range map[string]string{
+		"Chapter 12: Into the Gate": "Into the Gate",
+		"Ch. 3 - Zorian":            "Zorian",
+		"12. The Bet":               "The Bet",
+		"[TL] Chapter 4 – The Rot – Mother of Learning": "The Rot",
+		"Mother of Learning | Interlude (Unedited)":     "Interlude",
+		"Vol. 2 Chapter 1: Home":                        "Home",
+		"Chapter 100":                                   "Chapter 100",
+		"1984 and Other Numbers":                        "1984 and Other Numbers",
+	} {
+		if got := clean(title); got != want {
+			t.Errorf("clean(%q) = %q, want %q", title, got, want)
+		}
+	}
+	if titleCleaner(nil, rules, nil, "www.scribblehub.com", "Mother of Learning") != nil {
+		t.Error("titles are cleaned with no transforms or rules for the site")
+	}
+}
+
+func mustCompileRule(t *testing.T, pattern string) *regexp.Regexp {
+	t.Helper()
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return re
+}
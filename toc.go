@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// tocSnapshot is the metadata and table of contents of a book as last
+// scraped, along with the validators of the listing pages they were read
+// from. As long as the site confirms that none of those pages changed, the
+// snapshot stands in for crawling them again.
+type tocSnapshot struct {
+	Source string     `json:"source"`
+	Meta   Metadata   `json:"meta"`
+	TOC    []TOCEntry `json:"toc"`
+	// Pages maps each listing page's URL to its validator.
+	Pages map[string]string `json:"pages"`
+}
+
+// tocSnapshotFilename names the snapshot of the book at baseURL in dir.
+func tocSnapshotFilename(dir string, baseURL string) string {
+	sum := sha1.Sum([]byte(baseURL))
+	return filepath.Join(dir, hex.EncodeToString(sum[:])+".json")
+}
+
+func readTOCSnapshot(filename string) (*tocSnapshot, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var snapshot tocSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+func writeTOCSnapshot(filename string, snapshot *tocSnapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filename+"~", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(filename+"~", filename)
+}
+
+// takeTOCSnapshot records book as read from pages, or returns nil if any of
+// them has no validator to check it against later.
+func takeTOCSnapshot(cache *CachingTransport, book ScrapedBook, pages []string) *tocSnapshot {
+	if len(pages) == 0 {
+		return nil
+	}
+	snapshot := &tocSnapshot{Source: book.meta.SourceURL, Meta: book.meta, TOC: book.toc, Pages: make(map[string]string)}
+	for _, page := range pages {
+		validator := cache.Validator(page)
+		if validator == "" {
+			return nil
+		}
+		snapshot.Pages[page] = validator
+	}
+	return snapshot
+}
+
+// current reports whether none of the snapshot's listing pages changed.
+func (s *tocSnapshot) current(cache *CachingTransport) bool {
+	if len(s.Pages) == 0 {
+		return false
+	}
+	for page, validator := range s.Pages {
+		if !cache.Unchanged(page, validator) {
+			logger.Debugw("Listing page changed", "url", page)
+			return false
+		}
+	}
+	return true
+}
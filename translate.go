@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// defaultLibreTranslateURL is the LibreTranslate server used unless
+// -translate-url names another, such as a self-hosted one.
+const defaultLibreTranslateURL = "https://libretranslate.com"
+
+// translator is a machine translation service.
+type translator interface {
+	// translate translates each of texts, which are html, into lang.
+	translate(texts []string, lang string) ([]string, error)
+}
+
+// chapterTranslator translates chapters with -translate, keeping each
+// translation under dir so that a chapter is only paid for once. The API key
+// of the service is taken from the environment:
+//
+//	TRANSLATE_API_KEY  the key for DeepL or Google Cloud Translation, and
+//	                   for LibreTranslate servers that want one
+type chapterTranslator struct {
+	backend translator
+	name    string
+	lang    string
+	dir     string
+}
+
+func newChapterTranslator(backend string, serverURL string, lang string, dir string) (*chapterTranslator, error) {
+	key := os.Getenv("TRANSLATE_API_KEY")
+	client := &http.Client{Timeout: 5 * time.Minute}
+	t := &chapterTranslator{name: backend, lang: lang, dir: dir}
+	switch backend {
+	case "deepl":
+		if key == "" {
+			return nil, errors.New("translating with DeepL needs its API key in $TRANSLATE_API_KEY")
+		}
+		t.backend = deepLTranslator{client: client, key: key}
+	case "google":
+		if key == "" {
+			return nil, errors.New("translating with Google needs its API key in $TRANSLATE_API_KEY")
+		}
+		t.backend = googleTranslator{client: client, key: key}
+	case "libretranslate":
+		if serverURL == "" {
+			serverURL = defaultLibreTranslateURL
+		}
+		t.backend = libreTranslator{client: client, url: strings.TrimSuffix(serverURL, "/"), key: key}
+	default:
+		return nil, fmt.Errorf("unknown translation backend %q, want deepl, google or libretranslate", backend)
+	}
+	return t, nil
+}
+
+// translatedChapter is a chapter's translation as kept on disk.
+type translatedChapter struct {
+	Title   string `json:"title"`
+	Content string `json:"content"`
+}
+
+// chapter returns the chapter translated. Its title is kept along with the
+// translation of it, for the table of contents to show both.
+func (t *chapterTranslator) chapter(chapter Chapter) (Chapter, error) {
+	sum := sha256.Sum256([]byte(t.name + "\x00" + t.lang + "\x00" + chapter.Title + "\x00" + chapter.Content))
+	filename := filepath.Join(t.dir, hex.EncodeToString(sum[:])+".json")
+	var translated translatedChapter
+	if data, err := os.ReadFile(filename); err == nil && json.Unmarshal(data, &translated) == nil {
+		logger.Debugw("Reuse translation", "title", chapter.Title)
+	} else {
+		texts, err := t.backend.translate([]string{chapter.Title, chapter.Content}, t.lang)
+		if err != nil {
+			return Chapter{}, fmt.Errorf("translating %q: %w", chapter.Title, err)
+		}
+		if len(texts) != 2 {
+			return Chapter{}, fmt.Errorf("translating %q: got %d texts back for 2", chapter.Title, len(texts))
+		}
+		translated = translatedChapter{Title: texts[0], Content: texts[1]}
+		if data, err := json.Marshal(translated); err == nil {
+			if err := os.MkdirAll(t.dir, 0755); err == nil {
+				if err := os.WriteFile(filename, data, 0644); err != nil {
+					logger.Warnw("Failed to keep translation", "filename", filename, "error", err)
+				}
+			}
+		}
+	}
+	// The service may have escaped the title, given to it as html.
+	title := strings.Join(strings.Fields(htmlText(translated.Title)), " ")
+	if title != "" && title != chapter.Title {
+		title = fmt.Sprintf("%s (%s)", title, chapter.Title)
+	} else {
+		title = chapter.Title
+	}
+	return Chapter{Title: title, Content: translated.Content}, nil
+}
+
+// carriedHashes maps the chapterKey of each chapter an update carries over
+// from the epub being updated to its hash, which is that of the chapter as
+// fetched, before it was retitled or translated.
+func carriedHashes(previous *previousEpub, changed []string) map[string]string {
+	replaced := make(map[string]bool)
+	for _, url := range changed {
+		replaced[chapterKey(url)] = true
+	}
+	carried := make(map[string]string)
+	for _, chapter := range previous.manifest.Chapters {
+		if !chapter.Missing && !replaced[chapterKey(chapter.URL)] {
+			carried[chapterKey(chapter.URL)] = chapter.Hash
+		}
+	}
+	return carried
+}
+
+// postTranslation sends a request to a translation service and decodes its
+// json answer into result.
+func postTranslation(client *http.Client, request *http.Request, result any) error {
+	if userAgent != "" {
+		request.Header.Set("User-Agent", userAgent)
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+		return fmt.Errorf("%s returned %s: %s", request.URL.Host, response.Status, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(response.Body).Decode(result)
+}
+
+type deepLTranslator struct {
+	client *http.Client
+	key    string
+}
+
+func (t deepLTranslator) translate(texts []string, lang string) ([]string, error) {
+	// Keys of the free plan, which end in :fx, only work with its own host.
+	endpoint := "https://api.deepl.com/v2/translate"
+	if strings.HasSuffix(t.key, ":fx") {
+		endpoint = "https://api-free.deepl.com/v2/translate"
+	}
+	form := url.Values{"target_lang": {strings.ToUpper(lang)}, "tag_handling": {"html"}, "text": texts}
+	request, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Authorization", "DeepL-Auth-Key "+t.key)
+	var result struct {
+		Translations []struct {
+			Text string `json:"text"`
+		} `json:"translations"`
+	}
+	if err := postTranslation(t.client, request, &result); err != nil {
+		return nil, err
+	}
+	translated := make([]string, len(result.Translations))
+	for i, translation := range result.Translations {
+		translated[i] = translation.Text
+	}
+	return translated, nil
+}
+
+type googleTranslator struct {
+	client *http.Client
+	key    string
+}
+
+func (t googleTranslator) translate(texts []string, lang string) ([]string, error) {
+	form := url.Values{"target": {lang}, "format": {"html"}, "q": texts}
+	endpoint := "https://translation.googleapis.com/language/translate/v2?key=" + url.QueryEscape(t.key)
+	request, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var result struct {
+		Data struct {
+			Translations []struct {
+				TranslatedText string `json:"translatedText"`
+			} `json:"translations"`
+		} `json:"data"`
+	}
+	if err := postTranslation(t.client, request, &result); err != nil {
+		return nil, err
+	}
+	translated := make([]string, len(result.Data.Translations))
+	for i, translation := range result.Data.Translations {
+		translated[i] = translation.TranslatedText
+	}
+	return translated, nil
+}
+
+type libreTranslator struct {
+	client *http.Client
+	url    string
+	key    string
+}
+
+func (t libreTranslator) translate(texts []string, lang string) ([]string, error) {
+	body, err := json.Marshal(map[string]any{
+		"q":       texts,
+		"source":  "auto",
+		"target":  lang,
+		"format":  "html",
+		"api_key": t.key,
+	})
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequest(http.MethodPost, t.url+"/translate", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	var result struct {
+		TranslatedText []string `json:"translatedText"`
+	}
+	if err := postTranslation(t.client, request, &result); err != nil {
+		return nil, err
+	}
+	return result.TranslatedText, nil
+}
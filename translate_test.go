@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// upperTranslator "translates" into upper case, counting its calls.
+type upperTranslator struct{ calls *int }
+
+func (t upperTranslator) translate(texts []string, lang string) ([]string, error) {
+	*t.calls++
+	translated := make([]string, len(texts))
+	for i, text := range texts {
+		translated[i] = strings.ToUpper(text)
+	}
+	return translated, nil
+}
+
+func TestChapterTranslator(t *testing.T) {
+	calls := 0
+	translator := &chapterTranslator{backend: upperTranslator{&calls}, name: "upper", lang: "en", dir: t.TempDir()}
+	chapter := Chapter{Title: "Chapter 1: Start", Content: "<p>Hello &amp; welcome.</p>"}
+	for i := 0; i < 2; i++ {
+		translated, err := translator.chapter(chapter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "CHAPTER 1: START (Chapter 1: Start)"; translated.Title != want {
+			t.Errorf("title is %q, want %q", translated.Title, want)
+		}
+		if want := "<P>HELLO &AMP; WELCOME.</P>"; translated.Content != want {
+			t.Errorf("content is %q, want %q", translated.Content, want)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("chapter was translated %d times, want once and then reused", calls)
+	}
+}
+
+func TestLibreTranslate(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Q      []string `json:"q"`
+			Target string   `json:"target"`
+			Format string   `json:"format"`
+			Key    string   `json:"api_key"`
+		}
+		if r.URL.Path != "/translate" || json.NewDecoder(r.Body).Decode(&request) != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if request.Target != "en" || request.Format != "html" || request.Key != "secret" {
+			http.Error(w, "bad options", http.StatusBadRequest)
+			return
+		}
+		translated := make([]string, len(request.Q))
+		for i, q := range request.Q {
+			translated[i] = "en:" + q
+		}
+		json.NewEncoder(w).Encode(map[string]any{"translatedText": translated})
+	}))
+	defer server.Close()
+	translator := libreTranslator{client: server.Client(), url: server.URL, key: "secret"}
+	got, err := translator.translate([]string{"第一話", "<p>本文</p>"}, "en")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0] != "en:第一話" || got[1] != "en:<p>本文</p>" {
+		t.Errorf("translations are %q", got)
+	}
+}
+
+// Translations are paid for, so pruning the cache must keep them.
+func TestCachePruneKeepsTranslations(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "translations", "chapter.json")
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filename, []byte(`{"title":"","content":""}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := cachePrune(dir, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filename); err != nil {
+		t.Errorf("cache prune removed a translation: %v", err)
+	}
+}
@@ -1,78 +1,351 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
-	"encoding/json"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/textproto"
+	"os"
 	"os/exec"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
 )
 
+// dialer opens every connection of the default transport. Keep-alives let
+// idle connections to the site be noticed as dead before they are reused.
+var dialer = &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+
+// Some anti-bot setups treat clients differently depending on the protocol
+// they speak, so the default transport can be pinned to one: "auto" lets Go
+// negotiate HTTP/2 when the server offers it, "1.1" never upgrades, "2"
+// requires HTTP/2 over TLS, and "3" uses quic-go's experimental HTTP/3 client.
+// Host names are looked up with resolver when it is not nil.
+func newDefaultTransport(httpVersion string, resolver *DoHResolver) (http.RoundTripper, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	if resolver != nil {
+		transport.DialContext = resolver.DialContext
+	}
+	// Large crawls keep -concurrency chapters and -image-concurrency images
+	// in flight per host; Go's default of two idle connections per host
+	// would close and reopen most of them between requests.
+	transport.MaxIdleConns = 256
+	transport.MaxIdleConnsPerHost = 64
+	transport.IdleConnTimeout = 2 * time.Minute
+	switch httpVersion {
+	case "auto":
+		return transport, nil
+	case "1.1":
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+		transport.TLSClientConfig = &tls.Config{NextProtos: []string{"http/1.1"}}
+		return transport, nil
+	case "2":
+		h2, err := http2.ConfigureTransports(transport)
+		if err != nil {
+			return nil, err
+		}
+		// Pinging idle connections finds the ones the server dropped before
+		// a request is sent on them.
+		h2.ReadIdleTimeout = 30 * time.Second
+		h2.PingTimeout = 10 * time.Second
+		transport.TLSClientConfig.NextProtos = []string{http2.NextProtoTLS}
+		return http2OnlyTransport{transport}, nil
+	case "3":
+		if resolver != nil {
+			return nil, errors.New("DNS-over-HTTPS is not supported with HTTP/3")
+		}
+		return &http3.RoundTripper{}, nil
+	}
+	return nil, fmt.Errorf("unknown http version %q", httpVersion)
+}
+
+// http2OnlyTransport is the default transport pinned to HTTP/2, which Go only
+// speaks over TLS; plain http URLs are refused rather than quietly fetched
+// with HTTP/1.1.
+type http2OnlyTransport struct {
+	*http.Transport
+}
+
+func (t http2OnlyTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if request.URL.Scheme != "https" {
+		return nil, fmt.Errorf("-http-version 2 needs https, but %s is plain %s; use -http-version auto or 1.1 for it", request.URL, request.URL.Scheme)
+	}
+	return t.Transport.RoundTrip(request)
+}
+
 // For whatever reason, Cloudflare sometimes doesn't like the default http
 // transport, but will accept requests from curl so long as the user agent
 // string is changed. CurlTransport calls curl in a subprocess and is useful
 // for those cases.
 type CurlTransport struct {
+	// Path is the curl binary to run, as found by findCurl.
+	Path string
+	// Runner runs curl, in a subprocess if it is nil.
+	Runner CommandRunner
+}
+
+// CommandRunner starts the commands a transport runs, for it to be tested
+// with scripted output or backed by something other than a subprocess.
+type CommandRunner interface {
+	// Start runs path with args, reading stdin if it isn't nil, until ctx is
+	// done.
+	Start(ctx context.Context, path string, args []string, stdin io.Reader) (RunningCommand, error)
+}
+
+// RunningCommand is a command started by a CommandRunner.
+type RunningCommand interface {
+	// Stdout is what the command writes to its standard output.
+	Stdout() io.Reader
+	// Wait waits for the command to exit, returning why it failed if it did
+	// along with what it wrote to its standard error.
+	Wait() (stderr string, err error)
+	// Kill stops the command without waiting for it.
+	Kill()
+}
+
+// execRunner runs commands as subprocesses.
+type execRunner struct{}
+
+func (execRunner) Start(ctx context.Context, path string, args []string, stdin io.Reader) (RunningCommand, error) {
+	// Cancelling the context kills the subprocess.
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Stdin = stdin
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &execCommand{cmd: cmd, stdout: stdout, stderr: stderr}, nil
+}
+
+type execCommand struct {
+	cmd    *exec.Cmd
+	stdout io.Reader
+	stderr *bytes.Buffer
+}
+
+func (c *execCommand) Stdout() io.Reader {
+	return c.stdout
+}
+
+func (c *execCommand) Wait() (string, error) {
+	err := c.cmd.Wait()
+	return c.stderr.String(), err
+}
+
+func (c *execCommand) Kill() {
+	c.cmd.Process.Kill()
+}
+
+// curlRequirement describes the curl that CurlTransport needs, for the
+// messages explaining why one can't be used.
+const curlRequirement = "curl 7.83.0 or later, with --write-out %{header_json} support"
+
+// findCurl looks for a curl binary that CurlTransport can use, returning its
+// path. Checking once at startup means a missing or outdated curl is reported
+// up front instead of failing every request of the scrape.
+func findCurl() (string, error) {
+	path, err := exec.LookPath("curl")
+	if err != nil {
+		return "", fmt.Errorf("%w; the curl transport needs %s", err, curlRequirement)
+	}
+	// curl only warns about write-out variables it doesn't know, so whether
+	// it knows header_json shows in the output rather than the exit status.
+	cmd := exec.Command(path, "--silent", "--output", os.DevNull, "--write-out", "%{header_json}", "file://"+os.DevNull)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil || !strings.HasPrefix(strings.TrimSpace(string(out)), "{") {
+		version, _ := exec.Command(path, "--version").Output()
+		first, _, _ := strings.Cut(string(version), "\n")
+		if first == "" {
+			first = "unknown version"
+		}
+		return "", fmt.Errorf("%s (%s) is incompatible: %s; the curl transport needs %s",
+			path, first, strings.TrimSpace(stderr.String()), curlRequirement)
+	}
+	return path, nil
+}
+
+// HeaderTransport sets a fixed set of headers on every request before passing
+// it on, overriding whatever the collector chose.
+type HeaderTransport struct {
+	Transport http.RoundTripper
+	Header    http.Header
+}
+
+func (t HeaderTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if len(t.Header) == 0 {
+		return t.Transport.RoundTrip(request)
+	}
+	request = request.Clone(request.Context())
+	for key, values := range t.Header {
+		request.Header[key] = values
+	}
+	return t.Transport.RoundTrip(request)
+}
+
+// alternateTransportHeader asks for a request to be made with the alternate
+// transport, for pages that came back as something other than what was asked
+// for. Like the cache's headers it is never sent to the site.
+const alternateTransportHeader = "X-Ebook-Scraper-Transport"
+
+// AlternateTransport passes requests marked with alternateTransportHeader to
+// Alternate and all others to Transport. The default transport and curl are
+// each other's alternates: a site that refuses one often accepts the other.
+type AlternateTransport struct {
+	Transport http.RoundTripper
+	Alternate http.RoundTripper
+}
+
+func (t AlternateTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if request.Header.Get(alternateTransportHeader) == "" {
+		return t.Transport.RoundTrip(request)
+	}
+	request = request.Clone(request.Context())
+	request.Header.Del(alternateTransportHeader)
+	logger.Debugw("Use alternate transport", "url", request.URL)
+	return t.Alternate.RoundTrip(request)
+}
+
+// AllowedHostsTransport refuses requests to hosts outside of Hosts.
+type AllowedHostsTransport struct {
+	Transport http.RoundTripper
+	Hosts     hostAllowList
+}
+
+func (t AllowedHostsTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if !t.Hosts.allows(request.URL.Hostname()) {
+		return nil, fmt.Errorf("host %s is not an allowed asset domain", request.URL.Hostname())
+	}
+	return t.Transport.RoundTrip(request)
+}
+
+// LimitTransport keeps at most as many requests in flight as it was made
+// with, across everything that shares it. A request holds its slot until its
+// response body is closed.
+type LimitTransport struct {
+	Transport http.RoundTripper
+	slots     chan struct{}
+}
+
+func NewLimitTransport(transport http.RoundTripper, limit int) *LimitTransport {
+	return &LimitTransport{Transport: transport, slots: make(chan struct{}, limit)}
+}
+
+func (t *LimitTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	select {
+	case t.slots <- struct{}{}:
+	case <-request.Context().Done():
+		return nil, request.Context().Err()
+	}
+	response, err := t.Transport.RoundTrip(request)
+	if err != nil {
+		<-t.slots
+		return nil, err
+	}
+	response.Body = &limitedBody{ReadCloser: response.Body, release: func() { <-t.slots }}
+	return response, nil
+}
+
+type limitedBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
 }
 
-const DELIMITER = "\n\n\n"
+func (b *limitedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
 
 func (t CurlTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	// With --include the status line and headers precede the body on stdout,
+	// so the response can be returned as soon as they have been read and the
+	// body streamed from the pipe.
 	args := []string{
-		request.URL.String(), "--compressed", "--silent", "--write-out", fmt.Sprintf("%s%%{json}%s%%{header_json}", DELIMITER, DELIMITER), "-X", request.Method,
+		request.URL.String(), "--compressed", "--silent", "--show-error", "--include", "--suppress-connect-headers",
+	}
+	if request.Method == http.MethodHead {
+		args = append(args, "--head")
+	} else {
+		args = append(args, "-X", request.Method)
 	}
 	for key, values := range request.Header {
 		for _, value := range values {
 			args = append(args, "-H", fmt.Sprintf("%s: %s", key, value))
 		}
 	}
-	out, err := exec.Command("/usr/bin/curl", args...).Output()
-	if err != nil {
-		return nil, err
+	path := t.Path
+	if path == "" {
+		path = "curl"
 	}
-	chunks := rsplit(out, []byte(DELIMITER), 3)
-
-	body := chunks[0]
-	var extra struct {
-		ResponseCode int    `json:"response_code"`
-		HTTPVersion  string `json:"http_version"`
+	var stdin io.Reader
+	if request.Body != nil && request.Body != http.NoBody {
+		args = append(args, "--data-binary", "@-")
+		stdin = request.Body
 	}
-	if err := json.Unmarshal(chunks[1], &extra); err != nil {
-		return nil, err
+	runner := t.Runner
+	if runner == nil {
+		runner = execRunner{}
 	}
-
-	var header http.Header
-	if err := json.Unmarshal(chunks[2], &header); err != nil {
+	cmd, err := runner.Start(request.Context(), path, args, stdin)
+	if err != nil {
 		return nil, err
 	}
-	// Canonicalize header keys
-	for key, values := range header {
-		header.Del(key)
-		for _, value := range values {
-			header.Add(key, value)
+	reader := bufio.NewReader(cmd.Stdout())
+	body := &curlBody{reader: reader, cmd: cmd}
+
+	proto, statusCode, status, header, err := readResponseHead(reader)
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			// curl exits without output when the request fails outright,
+			// and its own error message is more useful than ours.
+			if waitErr := body.wait(); waitErr != nil {
+				return nil, waitErr
+			}
 		}
+		body.Close()
+		return nil, err
 	}
-
-	major, minor, err := parseHTTPVersion(extra.HTTPVersion)
+	major, minor, err := parseHTTPVersion(strings.TrimPrefix(proto, "HTTP/"))
 	if err != nil {
+		body.Close()
 		return nil, err
 	}
+	// The body has already been decoded by curl (--compressed).
+	header.Del("Content-Encoding")
+	header.Del("Content-Length")
 
 	response := &http.Response{
-		Status:           fmt.Sprint(extra.ResponseCode),
-		StatusCode:       extra.ResponseCode,
-		Proto:            fmt.Sprintf("HTTP/%s", extra.HTTPVersion),
+		Status:           status,
+		StatusCode:       statusCode,
+		Proto:            proto,
 		ProtoMajor:       major,
 		ProtoMinor:       minor,
 		Header:           header,
-		Body:             io.NopCloser(bytes.NewReader(body)),
-		ContentLength:    int64(len(body)),
+		Body:             body,
+		ContentLength:    -1,
 		TransferEncoding: []string{},
 		Close:            true,
-		Uncompressed:     false,
+		Uncompressed:     true,
 		Trailer:          http.Header{},
 		Request:          request,
 		TLS:              request.TLS,
@@ -80,27 +353,116 @@ func (t CurlTransport) RoundTrip(request *http.Request) (*http.Response, error)
 	return response, nil
 }
 
-func rsplit(s, sep []byte, n int) [][]byte {
-	parts := bytes.Split(s, sep)
-	if len(parts) < n {
-		return parts
+// readResponseHead reads the status line and headers of the final response
+// in curl's --include output, skipping any informational 1xx responses.
+func readResponseHead(reader *bufio.Reader) (proto string, statusCode int, status string, header http.Header, err error) {
+	tp := textproto.NewReader(reader)
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return "", 0, "", nil, err
+		}
+		proto, status, found := strings.Cut(line, " ")
+		if !found || !strings.HasPrefix(proto, "HTTP/") {
+			return "", 0, "", nil, fmt.Errorf("malformed status line %q", line)
+		}
+		code, reason, _ := strings.Cut(status, " ")
+		if len(code) != 3 || code[0] < '1' || !isDigit(code[0]) || !isDigit(code[1]) || !isDigit(code[2]) {
+			return "", 0, "", nil, fmt.Errorf("malformed status line %q", line)
+		}
+		statusCode, _ := strconv.Atoi(code)
+		mimeHeader, err := tp.ReadMIMEHeader()
+		if err != nil {
+			return "", 0, "", nil, err
+		}
+		if statusCode >= 100 && statusCode < 200 && statusCode != http.StatusSwitchingProtocols {
+			continue
+		}
+		if reason == "" {
+			reason = http.StatusText(statusCode)
+		}
+		return proto, statusCode, code + " " + reason, http.Header(mimeHeader), nil
+	}
+}
+
+// curlBody streams a response body from curl's stdout, reaping the process
+// once the body has been read to the end or closed.
+type curlBody struct {
+	reader io.Reader
+	cmd    RunningCommand
+	done   bool
+	err    error
+}
+
+func (b *curlBody) Read(p []byte) (int, error) {
+	n, err := b.reader.Read(p)
+	if err == io.EOF {
+		if waitErr := b.wait(); waitErr != nil {
+			return n, waitErr
+		}
 	}
-	return append([][]byte{bytes.Join(parts[:len(parts)-n+1], sep)}, parts[len(parts)-n+1:]...)
+	return n, err
 }
 
+func (b *curlBody) Close() error {
+	if !b.done {
+		b.cmd.Kill()
+		b.wait()
+	}
+	return nil
+}
+
+func (b *curlBody) wait() error {
+	if !b.done {
+		b.done = true
+		if stderr, err := b.cmd.Wait(); err != nil {
+			b.err = fmt.Errorf("curl: %w: %s", err, strings.TrimSpace(stderr))
+		}
+	}
+	return b.err
+}
+
+// prewarm opens connections to the origins ahead of the first real request
+// to each, so that the DNS lookup and TLS handshake are out of the way.
+// Failures are only logged: the real requests will report them again.
+func prewarm(transport http.RoundTripper, origins []string) {
+	var wg sync.WaitGroup
+	for _, origin := range origins {
+		wg.Add(1)
+		go func(origin string) {
+			defer wg.Done()
+			request, err := http.NewRequest(http.MethodHead, origin+"/", nil)
+			if err != nil {
+				return
+			}
+			request.Header.Set("User-Agent", versionUserAgent())
+			response, err := transport.RoundTrip(request)
+			if err != nil {
+				logger.Debugw("Failed to prewarm connection", "origin", origin, "error", err)
+				return
+			}
+			response.Body.Close()
+			logger.Debugw("Prewarmed connection", "origin", origin)
+		}(origin)
+	}
+	wg.Wait()
+}
+
+// parseHTTPVersion parses the version of a status line's protocol, such as
+// 1.1, 2 or 3, as curl prints it.
 func parseHTTPVersion(versionString string) (int, int, error) {
 	major, minor, found := strings.Cut(versionString, ".")
 	if !found {
-		major = versionString
 		minor = "0"
 	}
-	majorInt, err := strconv.Atoi(major)
-	if err != nil {
-		return 0, 0, err
-	}
-	minorInt, err := strconv.Atoi(minor)
-	if err != nil {
-		return 0, 0, err
+	// Versions are a digit each; strconv.Atoi would also take signs and
+	// numbers of any size.
+	if len(major) != 1 || !isDigit(major[0]) || len(minor) != 1 || !isDigit(minor[0]) {
+		return 0, 0, fmt.Errorf("malformed HTTP version %q", versionString)
 	}
-	return majorInt, minorInt, nil
+	return int(major[0] - '0'), int(minor[0] - '0'), nil
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
 }
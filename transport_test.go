@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// curlHeads are response heads as curl --include prints them, seeding the
+// fuzz tests below.
+var curlHeads = []string{
+	"HTTP/1.1 200 OK\r\nContent-Type: text/html\r\n\r\n",
+	"HTTP/2 200\r\ncontent-type: text/html; charset=utf-8\r\n\r\n",
+	"HTTP/3 404\r\n\r\n",
+	"HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 201 Created\r\nLocation: /x\r\n\r\n",
+	"HTTP/1.0 301 Moved Permanently\r\nLocation: https://example.com/\r\n\r\n",
+	"HTTP/1.1 +12 Plus\r\n\r\n",
+	"HTTP/-1.1 200 OK\r\n\r\n",
+	"HTTP/1.1 200 OK\r\nBroken header line\r\n\r\n",
+	"<html>not a response</html>",
+}
+
+func FuzzReadResponseHead(f *testing.F) {
+	for _, head := range curlHeads {
+		f.Add([]byte(head))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		proto, statusCode, status, header, err := readResponseHead(bufio.NewReader(bytes.NewReader(data)))
+		if err != nil {
+			return
+		}
+		if !strings.HasPrefix(proto, "HTTP/") {
+			t.Errorf("protocol %q doesn't start with HTTP/", proto)
+		}
+		if statusCode < 100 || statusCode > 999 {
+			t.Errorf("status code %d is out of range", statusCode)
+		}
+		if !strings.HasPrefix(status, strconv.Itoa(statusCode)+" ") {
+			t.Errorf("status %q doesn't start with its code %d", status, statusCode)
+		}
+		if header == nil {
+			t.Error("header is nil")
+		}
+	})
+}
+
+// FuzzResponseBody checks that a body is left to be read as it was, whatever
+// it holds, including what looks like another response.
+func FuzzResponseBody(f *testing.F) {
+	f.Add([]byte("<html><body>Chapter</body></html>"))
+	f.Add([]byte("\r\n\r\nHTTP/1.1 200 OK\r\n\r\n"))
+	f.Add([]byte(`{"response_code":200}`))
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, body []byte) {
+		for _, head := range curlHeads[:5] {
+			reader := bufio.NewReader(io.MultiReader(strings.NewReader(head), bytes.NewReader(body)))
+			if _, _, _, _, err := readResponseHead(reader); err != nil {
+				t.Fatalf("head %q: %v", head, err)
+			}
+			rest, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(rest, body) {
+				t.Fatalf("head %q: body is %q, want %q", head, rest, body)
+			}
+		}
+	})
+}
+
+func FuzzParseHTTPVersion(f *testing.F) {
+	for _, version := range []string{"1.1", "1.0", "2", "2.0", "3", "", ".", "1.", "-1", "+1.1", "1.1.1", "99999999999999999999"} {
+		f.Add(version)
+	}
+	f.Fuzz(func(t *testing.T, version string) {
+		major, minor, err := parseHTTPVersion(version)
+		if err != nil {
+			return
+		}
+		if major < 0 || major > 9 || minor < 0 || minor > 9 {
+			t.Errorf("version %q parsed as %d.%d", version, major, minor)
+		}
+		want := strconv.Itoa(major) + "." + strconv.Itoa(minor)
+		if version != want && version+".0" != want {
+			t.Errorf("version %q parsed as %s", version, want)
+		}
+	})
+}
+
+// scriptedRunner stands in for curl, answering every command it is asked to
+// start with output, and exiting with err.
+type scriptedRunner struct {
+	output string
+	stderr string
+	err    error
+	args   []string
+	stdin  string
+}
+
+func (r *scriptedRunner) Start(_ context.Context, _ string, args []string, stdin io.Reader) (RunningCommand, error) {
+	r.args = args
+	if stdin != nil {
+		data, err := io.ReadAll(stdin)
+		if err != nil {
+			return nil, err
+		}
+		r.stdin = string(data)
+	}
+	return &scriptedCommand{stdout: strings.NewReader(r.output), stderr: r.stderr, err: r.err}, nil
+}
+
+type scriptedCommand struct {
+	stdout io.Reader
+	stderr string
+	err    error
+}
+
+func (c *scriptedCommand) Stdout() io.Reader     { return c.stdout }
+func (c *scriptedCommand) Wait() (string, error) { return c.stderr, c.err }
+func (c *scriptedCommand) Kill()                 {}
+
+func TestCurlTransport(t *testing.T) {
+	runner := &scriptedRunner{output: "HTTP/1.1 100 Continue\r\n\r\nHTTP/2 201\r\nContent-Type: text/plain\r\nContent-Encoding: gzip\r\n\r\nmade it"}
+	request, err := http.NewRequest(http.MethodPost, "https://example.com/form", strings.NewReader("a=1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("X-Test", "yes")
+	response, err := CurlTransport{Runner: runner}.RoundTrip(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusCreated || response.Status != "201 Created" || response.ProtoMajor != 2 {
+		t.Errorf("response is %d %q over %s", response.StatusCode, response.Status, response.Proto)
+	}
+	if response.Header.Get("Content-Encoding") != "" {
+		t.Error("Content-Encoding of a body curl decoded was kept")
+	}
+	if string(body) != "made it" {
+		t.Errorf("body is %q", body)
+	}
+	args := strings.Join(runner.args, " ")
+	for _, want := range []string{"https://example.com/form", "-X POST", "-H X-Test: yes", "--data-binary @-"} {
+		if !strings.Contains(args, want) {
+			t.Errorf("curl was run with %q, missing %q", args, want)
+		}
+	}
+	if runner.stdin != "a=1" {
+		t.Errorf("curl was given %q as the request body", runner.stdin)
+	}
+}
+
+func TestCurlTransportFailure(t *testing.T) {
+	runner := &scriptedRunner{stderr: "curl: (6) Could not resolve host: example.invalid\n", err: errors.New("exit status 6")}
+	request, err := http.NewRequest(http.MethodGet, "https://example.invalid/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = CurlTransport{Runner: runner}.RoundTrip(request)
+	if err == nil || !strings.Contains(err.Error(), "Could not resolve host") {
+		t.Errorf("error is %v, want curl's own", err)
+	}
+}
+
+func TestHTTP2Transport(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	roundTripper, err := newDefaultTransport("2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := roundTripper.(http2OnlyTransport)
+	transport.TLSClientConfig.RootCAs = server.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	client := &http.Client{Transport: transport}
+	response, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	if response.ProtoMajor != 2 || string(body) != "HTTP/2.0" {
+		t.Errorf("got %s, server saw %s, want HTTP/2", response.Proto, body)
+	}
+	if _, err := client.Get("http://phrack.org/images/phrack-logo.jpg"); err == nil || !strings.Contains(err.Error(), "needs https") {
+		t.Errorf("fetching a plain http URL over HTTP/2 returned %v, want it refused", err)
+	}
+}
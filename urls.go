@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+)
+
+// trackingParams are query parameters that only say where a link was
+// followed from, and never pick a different page.
+var trackingParams = map[string]bool{
+	"fbclid": true,
+	"gclid":  true,
+	"mc_cid": true,
+	"mc_eid": true,
+}
+
+// chapterKey is the form of a chapter's URL that chapters are stored and
+// told apart by. Sites link to the same chapter inconsistently, over http or
+// https, with or without a trailing slash, a fragment or tracking
+// parameters, and each of those would otherwise make a chapter look new or
+// missing. The URL itself is left as the site linked it for fetching, since
+// not every site serves every form of it.
+func chapterKey(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return rawURL
+	}
+	if u.Scheme == "http" {
+		u.Scheme = "https"
+	}
+	u.Host = strings.ToLower(u.Host)
+	u.Fragment = ""
+	u.RawFragment = ""
+	u.Path = strings.TrimRight(u.Path, "/")
+	u.RawPath = strings.TrimRight(u.RawPath, "/")
+	if u.RawQuery != "" {
+		query := u.Query()
+		for name := range query {
+			if trackingParams[name] || strings.HasPrefix(name, "utm_") {
+				query.Del(name)
+			}
+		}
+		u.RawQuery = query.Encode()
+	}
+	u.ForceQuery = false
+	return u.String()
+}
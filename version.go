@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// These can be set at build time with -ldflags "-X main.version=...";
+// otherwise they are filled in from the build info Go records in the binary.
+var (
+	version   string
+	commit    string
+	buildDate string
+)
+
+func init() {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return
+	}
+	if version == "" {
+		version = info.Main.Version
+	}
+	modified := false
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			if commit == "" {
+				commit = setting.Value
+			}
+		case "vcs.time":
+			// The commit's date stands in for the build date.
+			if buildDate == "" {
+				buildDate = setting.Value
+			}
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
+	}
+	if len(commit) > 12 {
+		commit = commit[:12]
+	}
+	if modified && commit != "" {
+		commit += "-dirty"
+	}
+}
+
+func versionString() string {
+	s := "ebook-scraper " + displayVersion()
+	if commit != "" {
+		s += " (commit " + commit
+		if buildDate != "" {
+			s += ", built " + buildDate
+		}
+		s += ")"
+	}
+	return s
+}
+
+func displayVersion() string {
+	if version == "" {
+		return "(devel)"
+	}
+	return version
+}
+
+// versionUserAgent identifies requests that don't use a randomized user
+// agent, such as fetching robots.txt.
+func versionUserAgent() string {
+	return fmt.Sprintf("ebook-scraper/%s (+https://github.com/mdepp/ebook-scraper)", displayVersion())
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// feedDocument is the part of an RSS or Atom feed that says which chapters
+// it announces: the links of its items or entries.
+type feedDocument struct {
+	Items []struct {
+		Link string `xml:"link"`
+	} `xml:"channel>item"`
+	Entries []struct {
+		Links []struct {
+			Href string `xml:"href,attr"`
+			Rel  string `xml:"rel,attr"`
+		} `xml:"link"`
+	} `xml:"entry"`
+}
+
+func (d feedDocument) links() []string {
+	var links []string
+	for _, item := range d.Items {
+		if link := strings.TrimSpace(item.Link); link != "" {
+			links = append(links, link)
+		}
+	}
+	for _, entry := range d.Entries {
+		for _, link := range entry.Links {
+			if link.Rel == "" || link.Rel == "alternate" {
+				links = append(links, strings.TrimSpace(link.Href))
+				break
+			}
+		}
+	}
+	return links
+}
+
+var (
+	royalRoadFictionID   = regexp.MustCompile(`/fiction/(\d+)`)
+	scribblehubFictionID = regexp.MustCompile(`/series/(\d+)`)
+)
+
+// storyFeedURL returns the feed a site publishes a story's new chapters in.
+// Sites not known here are taken to be WordPress serials, which have a feed
+// at feed/ under any page.
+func storyFeedURL(source string) (string, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return "", err
+	}
+	switch u.Host {
+	case "www.royalroad.com", "royalroad.com":
+		match := royalRoadFictionID.FindStringSubmatch(u.Path)
+		if match == nil {
+			return "", fmt.Errorf("no fiction id in %s", source)
+		}
+		return "https://www.royalroad.com/syndication/" + match[1], nil
+	case "www.scribblehub.com", "scribblehub.com":
+		match := scribblehubFictionID.FindStringSubmatch(u.Path)
+		if match == nil {
+			return "", fmt.Errorf("no series id in %s", source)
+		}
+		return "https://www.scribblehub.com/rssfeed.php?type=series&sid=" + match[1], nil
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/feed/"
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u.String(), nil
+}
+
+// feedWatcher polls the feed of a story, remembering the validators of the
+// last response so that an unchanged feed costs the site next to nothing.
+type feedWatcher struct {
+	URL          string
+	etag         string
+	lastModified string
+	// checked is when the story was last found up to date, from the start
+	// of that round of polling.
+	checked time.Time
+}
+
+// poll returns the chapter links of the feed, or nil if it hasn't changed
+// since the last poll.
+func (w *feedWatcher) poll(client *http.Client) ([]string, error) {
+	request, err := http.NewRequest(http.MethodGet, w.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if userAgent != "" {
+		request.Header.Set("User-Agent", userAgent)
+	}
+	if w.etag != "" {
+		request.Header.Set("If-None-Match", w.etag)
+	}
+	if w.lastModified != "" {
+		request.Header.Set("If-Modified-Since", w.lastModified)
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotModified {
+		return nil, nil
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("feed returned %s", response.Status)
+	}
+	var doc feedDocument
+	if err := xml.NewDecoder(io.LimitReader(response.Body, 10<<20)).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("reading feed: %w", err)
+	}
+	w.etag = response.Header.Get("ETag")
+	w.lastModified = response.Header.Get("Last-Modified")
+	return doc.links(), nil
+}
+
+// watchBooks polls the feeds of the books of jobs, which update epubs, every
+// interval, and updates a book only when its feed links to a chapter its
+// epub doesn't have. RoyalRoad fictions are first looked for on the site's
+// latest updates, and their feeds polled only if they are there or the page
+// doesn't reach back to when they were last checked. With once it polls a
+// single time, for running from cron.
+func (s *session) watchBooks(jobs []bookJob, interval time.Duration, once bool) {
+	client := &http.Client{Timeout: time.Minute}
+	watchers := make([]*feedWatcher, len(jobs))
+	royalRoad := make([]bool, len(jobs))
+	for i, job := range jobs {
+		if job.Update == "" {
+			logger.Warnw("Only epubs can be watched", "url", job.URL)
+			continue
+		}
+		feedURL, err := storyFeedURL(job.URL)
+		if err != nil {
+			logger.Warnw("Cannot watch book", "filename", job.Update, "error", err)
+			continue
+		}
+		watchers[i] = &feedWatcher{URL: feedURL}
+		royalRoad[i] = strings.HasPrefix(feedURL, "https://www.royalroad.com/")
+	}
+	for {
+		round := time.Now()
+		latest := latestRoyalRoadUpdates(client, watchers, royalRoad)
+		for i, job := range jobs {
+			if watchers[i] == nil {
+				continue
+			}
+			if royalRoad[i] && latest != nil && !latest.mayHaveUpdated(job.URL, watchers[i].checked) {
+				logger.Debugw("Fiction is not among the latest updates", "url", job.URL)
+				watchers[i].checked = round
+				continue
+			}
+			hasNew, err := s.feedHasNewChapters(client, watchers[i], job)
+			if err != nil {
+				continue
+			}
+			if !hasNew {
+				watchers[i].checked = round
+				continue
+			}
+			logger.Infow("Feed has new chapters, update book", "filename", job.Update)
+			if err := s.scrapeBook(job); err != nil {
+				logger.Errorw("Failed to update book", "filename", job.Update, "error", err)
+				s.notifier.forJob(job).bookFailed(job.URL, err)
+				// The feed is checked in full again next time, rather than
+				// passed over as unchanged.
+				watchers[i].etag, watchers[i].lastModified = "", ""
+				continue
+			}
+			watchers[i].checked = round
+		}
+		if once {
+			return
+		}
+		logger.Debugw("Wait for next poll", "interval", interval)
+		time.Sleep(interval)
+	}
+}
+
+// feedHasNewChapters polls the feed of job's book, reporting whether it links
+// to a chapter the epub doesn't have. Errors are logged before they are
+// returned.
+func (s *session) feedHasNewChapters(client *http.Client, watcher *feedWatcher, job bookJob) (bool, error) {
+	links, err := watcher.poll(client)
+	if err != nil {
+		logger.Warnw("Failed to poll feed", "feed", watcher.URL, "error", err)
+		return false, err
+	}
+	if links == nil {
+		logger.Debugw("Feed is unchanged", "feed", watcher.URL)
+		return false, nil
+	}
+	manifest, err := readManifest(job.Update)
+	if err != nil {
+		logger.Warnw("Failed to read book", "filename", job.Update, "error", err)
+		return false, err
+	}
+	have := make(map[string]bool)
+	for _, chapter := range manifest.Chapters {
+		if !chapter.Missing {
+			have[chapterKey(chapter.URL)] = true
+		}
+	}
+	for _, link := range links {
+		if !have[chapterKey(link)] {
+			logger.Debugw("Feed links to a new chapter", "feed", watcher.URL, "url", link)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// royalRoadLatestUpdates lists the fictions on RoyalRoad that most recently
+// had a chapter published, newest first.
+const royalRoadLatestUpdates = "https://www.royalroad.com/fictions/latest-updates"
+
+// latestUpdatesSlack allows for the clocks of RoyalRoad and ours disagreeing
+// when telling whether a chapter came out since a fiction was checked.
+const latestUpdatesSlack = 10 * time.Minute
+
+// latestUpdates is what RoyalRoad's latest updates page says: when each
+// fiction on it last had a chapter, by fiction id, and since when the page
+// lists every update.
+type latestUpdates struct {
+	updated map[string]time.Time
+	since   time.Time
+}
+
+// latestRoyalRoadUpdates fetches RoyalRoad's latest updates, so that a single
+// request can stand in for polling the feed of each RoyalRoad fiction being
+// watched. It returns nil if none of them has been checked yet, since those
+// are polled regardless, or if the page can't be read.
+func latestRoyalRoadUpdates(client *http.Client, watchers []*feedWatcher, royalRoad []bool) *latestUpdates {
+	needed := false
+	for i, watcher := range watchers {
+		if royalRoad[i] && !watcher.checked.IsZero() {
+			needed = true
+		}
+	}
+	if !needed {
+		return nil
+	}
+	request, err := http.NewRequest(http.MethodGet, royalRoadLatestUpdates, nil)
+	if err != nil {
+		return nil
+	}
+	if userAgent != "" {
+		request.Header.Set("User-Agent", userAgent)
+	}
+	response, err := client.Do(request)
+	if err == nil && response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		err = fmt.Errorf("latest updates returned %s", response.Status)
+	}
+	if err != nil {
+		logger.Warnw("Failed to fetch RoyalRoad's latest updates, poll each feed instead", "error", err)
+		return nil
+	}
+	defer response.Body.Close()
+	latest, err := parseLatestUpdates(io.LimitReader(response.Body, 10<<20))
+	if err != nil {
+		logger.Warnw("Failed to read RoyalRoad's latest updates, poll each feed instead", "error", err)
+		return nil
+	}
+	return latest
+}
+
+// parseLatestUpdates reads RoyalRoad's latest updates page, which lists
+// fictions with their newest chapters and when each came out.
+func parseLatestUpdates(r io.Reader) (*latestUpdates, error) {
+	doc, err := goquery.NewDocumentFromReader(r)
+	if err != nil {
+		return nil, err
+	}
+	latest := &latestUpdates{updated: make(map[string]time.Time)}
+	doc.Find(".fiction-list-item").Each(func(_ int, item *goquery.Selection) {
+		match := royalRoadFictionID.FindStringSubmatch(item.Find(".fiction-title a").AttrOr("href", ""))
+		if match == nil {
+			return
+		}
+		item.Find("time[unixtime]").Each(func(_ int, element *goquery.Selection) {
+			unixtime, err := strconv.ParseInt(element.AttrOr("unixtime", ""), 10, 64)
+			if err != nil {
+				return
+			}
+			published := time.Unix(unixtime, 0)
+			if published.After(latest.updated[match[1]]) {
+				latest.updated[match[1]] = published
+			}
+			if latest.since.IsZero() || published.Before(latest.since) {
+				latest.since = published
+			}
+		})
+	})
+	if len(latest.updated) == 0 {
+		return nil, errors.New("no fictions listed")
+	}
+	return latest, nil
+}
+
+// mayHaveUpdated reports whether the fiction at source may have had a
+// chapter since it was checked: if the page doesn't go back that far, or
+// lists a chapter of it from after then.
+func (l *latestUpdates) mayHaveUpdated(source string, checked time.Time) bool {
+	since := checked.Add(-latestUpdatesSlack)
+	if checked.IsZero() || l.since.After(since) {
+		return true
+	}
+	match := royalRoadFictionID.FindStringSubmatch(source)
+	if match == nil {
+		return true
+	}
+	return l.updated[match[1]].After(since)
+}
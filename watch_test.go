@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const latestUpdatesPage = `<html><body>
+<div class="fiction-list-item row">
+  <h2 class="fiction-title"><a href="/fiction/21220/mother-of-learning">Mother of Learning</a></h2>
+  <ul class="list-unstyled">
+    <li class="list-item"><a href="/fiction/21220/mother-of-learning/chapter/2/x"><time unixtime="1700003600">1 hour ago</time></a></li>
+    <li class="list-item"><a href="/fiction/21220/mother-of-learning/chapter/1/x"><time unixtime="1700000000">2 hours ago</time></a></li>
+  </ul>
+</div>
+<div class="fiction-list-item row">
+  <h2 class="fiction-title"><a href="/fiction/63759/other">Other</a></h2>
+  <ul class="list-unstyled">
+    <li class="list-item"><a href="/fiction/63759/other/chapter/3/x"><time unixtime="1699990000">5 hours ago</time></a></li>
+  </ul>
+</div>
+</body></html>`
+
+func TestLatestUpdates(t *testing.T) {
+	latest, err := parseLatestUpdates(strings.NewReader(latestUpdatesPage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Unix(1699990000, 0); !latest.since.Equal(want) {
+		t.Errorf("page lists updates since %v, want %v", latest.since, want)
+	}
+	at := func(unixtime int64) time.Time { return time.Unix(unixtime, 0) }
+	for _, test := range []struct {
+		source  string
+		checked time.Time
+		want    bool
+	}{
+		{"https://www.royalroad.com/fiction/21220/mother-of-learning", time.Time{}, true},
+		{"https://www.royalroad.com/fiction/21220/mother-of-learning", at(1700002000), true},
+		{"https://www.royalroad.com/fiction/21220/mother-of-learning", at(1700010000), false},
+		{"https://www.royalroad.com/fiction/63759/other", at(1700002000), false},
+		{"https://www.royalroad.com/fiction/555/unlisted", at(1700002000), false},
+		// The page doesn't go back far enough to tell.
+		{"https://www.royalroad.com/fiction/555/unlisted", at(1699900000), true},
+	} {
+		if got := latest.mayHaveUpdated(test.source, test.checked); got != test.want {
+			t.Errorf("mayHaveUpdated(%s, %v) = %v, want %v", test.source, test.checked.Unix(), got, test.want)
+		}
+	}
+}